@@ -5,6 +5,7 @@ import (
 	"bytes"
 	_ "embed"
 	"encoding/binary"
+	"io"
 	"net"
 	"testing"
 
@@ -35,6 +36,50 @@ func BenchmarkConn_WriteMessage(b *testing.B) {
 	})
 }
 
+func BenchmarkConn_WriteBatch(b *testing.B) {
+	upgrader := NewUpgrader(&BuiltinEventHandler{}, nil)
+	conn := &Conn{
+		conn:   &benchConn{},
+		config: upgrader.option.getConfig(),
+	}
+	messages := make([]BatchMessage, 32)
+	for i := range messages {
+		messages[i] = BatchMessage{Opcode: OpcodeText, Payload: internal.AlphabetNumeric.Generate(64)}
+	}
+	for i := 0; i < b.N; i++ {
+		_ = conn.WriteBatch(messages...)
+	}
+}
+
+// 比较大负载写入 TCP 连接时, 拷贝到缓冲区与 writev 直接写入的开销
+// Compares copying a large payload into a buffer with writing it directly through writev on a TCP connection
+func BenchmarkConn_WriteLargeMessage(b *testing.B) {
+	payload := internal.AlphabetNumeric.Generate(1024 * 1024)
+	server, client, err := newTCPPeer(new(BuiltinEventHandler), nil, new(BuiltinEventHandler), nil)
+	if err != nil {
+		b.Skip(err)
+	}
+	go func() { _, _ = io.Copy(io.Discard, client.conn) }()
+	defer client.conn.Close()
+
+	b.Run("copy", func(b *testing.B) {
+		conn := &Conn{isServer: true, conn: struct{ net.Conn }{server.conn}, config: server.config}
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = conn.WriteMessage(OpcodeBinary, payload)
+		}
+	})
+
+	b.Run("writev", func(b *testing.B) {
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = server.WriteMessage(OpcodeBinary, payload)
+		}
+	})
+}
+
 func BenchmarkConn_ReadMessage(b *testing.B) {
 	handler := &webSocketMocker{}
 	handler.onMessage = func(socket *Conn, message *Message) { _ = message.Close() }
@@ -66,6 +111,35 @@ func BenchmarkConn_ReadMessage(b *testing.B) {
 			_ = conn2.readMessage()
 		}
 	})
+
+	b.Run("zero copy", func(b *testing.B) {
+		upgrader := NewUpgrader(handler, &ServerOption{ZeroCopyEnabled: true})
+		conn1 := &Conn{
+			isServer: false,
+			conn:     &benchConn{},
+			config:   upgrader.option.getConfig(),
+		}
+		buf, _ := conn1.genFrame(OpcodeText, internal.Bytes(githubData), frameConfig{
+			fin:           true,
+			broadcast:     false,
+			checkEncoding: false,
+		})
+
+		reader := bytes.NewBuffer(buf.Bytes())
+		conn2 := &Conn{
+			isServer: true,
+			conn:     &benchConn{},
+			br:       bufio.NewReaderSize(reader, buf.Len()),
+			config:   upgrader.option.getConfig(),
+			handler:  upgrader.eventHandler,
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			internal.BufferReset(reader, buf.Bytes())
+			conn2.br.Reset(reader)
+			_ = conn2.readMessage()
+		}
+	})
 }
 
 func BenchmarkMask(b *testing.B) {
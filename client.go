@@ -23,8 +23,22 @@ type Dialer interface {
 	Dial(network, addr string) (c net.Conn, err error)
 }
 
+// ContextDialer 支持 context 的拨号器, 例如 *net.Dialer. Dialer 同时实现了该接口时, 取消 context 会中止进行中的拨号.
+// Dialer supporting a context, e.g. *net.Dialer. When a Dialer also implements it, canceling the context aborts a dial in progress.
+type ContextDialer interface {
+	// DialContext 使用 context 连接到指定网络上的地址
+	// Connects to the address on the named network using the context
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// 设为连接的超时时间, 让阻塞的读写立即返回
+// Set as the deadline of a connection to make blocked reads and writes return immediately
+var aLongTimeAgo = time.Unix(1, 0)
+
 type connector struct {
+	ctx             context.Context
 	option          *ClientOption
+	addr            string
 	conn            net.Conn
 	eventHandler    EventHandler
 	secWebsocketKey string
@@ -33,9 +47,29 @@ type connector struct {
 // NewClient 创建一个新的 WebSocket 客户端连接
 // Creates a new WebSocket client connection
 func NewClient(handler EventHandler, option *ClientOption) (*Conn, *http.Response, error) {
+	return NewClientContext(context.Background(), handler, option)
+}
+
+// NewClientContext 使用 context 创建 WebSocket 客户端连接.
+// 取消 ctx 会中止拨号, TLS 握手和升级, 并返回 ctx.Err(); 连接建立之后 ctx 不再影响连接.
+// Creates a WebSocket client connection using the context.
+// Canceling ctx aborts the dial, the TLS handshake and the upgrade, and returns ctx.Err();
+// once the connection is established, ctx no longer affects it.
+func NewClientContext(ctx context.Context, handler EventHandler, option *ClientOption) (*Conn, *http.Response, error) {
 	option = initClientOption(option)
-	c := &connector{option: option, eventHandler: handler}
-	URL, err := url.Parse(option.Addr)
+	c := &connector{ctx: ctx, option: option, addr: option.Addr, eventHandler: handler}
+	client, resp, err := c.dialAndHandshake()
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return client, resp, err
+}
+
+func (c *connector) dialAndHandshake() (*Conn, *http.Response, error) {
+	if strings.HasPrefix(c.option.Addr, "ws+unix://") {
+		return c.dialUnix()
+	}
+	URL, err := url.Parse(c.option.Addr)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -43,55 +77,155 @@ func NewClient(handler EventHandler, option *ClientOption) (*Conn, *http.Respons
 		return nil, nil, ErrUnsupportedProtocol
 	}
 
-	tlsEnabled := URL.Scheme == "wss"
-	dialer, err := option.NewDialer()
-	if err != nil {
-		return nil, nil, err
+	if c.option.HTTP2Transport != nil {
+		return c.dialHTTP2(URL)
 	}
 
-	c.conn, err = dialer.Dial("tcp", internal.GetAddrFromURL(URL, tlsEnabled))
-	if err != nil {
-		return nil, nil, err
+	tlsEnabled := URL.Scheme == "wss"
+	if resp, err := c.dial(URL, tlsEnabled); err != nil {
+		return nil, resp, err
 	}
 	if tlsEnabled {
-		if option.TlsConfig == nil {
-			option.TlsConfig = &tls.Config{}
+		if c.option.TlsConfig == nil {
+			c.option.TlsConfig = &tls.Config{}
 		}
-		if option.TlsConfig.ServerName == "" {
-			option.TlsConfig.ServerName = URL.Hostname()
+		if c.option.TlsConfig.ServerName == "" {
+			c.option.TlsConfig.ServerName = URL.Hostname()
 		}
-		c.conn = tls.Client(c.conn, option.TlsConfig)
+		c.conn = tls.Client(c.conn, c.option.TlsConfig)
 	}
+	return c.handshakeContext()
+}
 
-	client, resp, err := c.handshake()
+// 建立到服务器的 TCP 连接, 配置了代理时经过代理的隧道
+// Opens the TCP connection to the server, through a tunnel of the proxy when one is configured
+func (c *connector) dial(URL *url.URL, tlsEnabled bool) (*http.Response, error) {
+	addr := internal.GetAddrFromURL(URL, tlsEnabled)
+	proxyURL, err := c.getProxy(URL)
 	if err != nil {
-		_ = c.conn.Close()
+		return nil, err
 	}
-	return client, resp, err
+	if proxyURL != nil {
+		var resp *http.Response
+		c.conn, resp, err = c.dialProxy(proxyURL, addr)
+		return resp, err
+	}
+	c.conn, err = c.dialContext("tcp", addr)
+	return nil, err
 }
 
-// NewClientFromConn 通过外部连接创建客户端, 支持 TCP/KCP/Unix Domain Socket
-// Create new client via external connection, supports TCP/KCP/Unix Domain Socket.
-func NewClientFromConn(handler EventHandler, option *ClientOption, conn net.Conn) (*Conn, *http.Response, error) {
-	option = initClientOption(option)
-	c := &connector{option: option, conn: conn, eventHandler: handler}
-	client, resp, err := c.handshake()
+// 通过 NewDialer 创建的拨号器拨号. 拨号器没有实现 ContextDialer 时在协程中拨号, ctx 取消后直接返回, 迟到的连接会被关闭.
+// Dials with the dialer created by NewDialer. A dialer not implementing ContextDialer dials in a goroutine;
+// the call returns as soon as ctx is canceled and a late connection is closed.
+func (c *connector) dialContext(network, addr string) (net.Conn, error) {
+	dialer, err := c.option.NewDialer()
 	if err != nil {
-		_ = c.conn.Close()
+		return nil, err
+	}
+	ctx := c.getContext()
+	if d, ok := dialer.(ContextDialer); ok {
+		return d.DialContext(ctx, network, addr)
+	}
+	if ctx.Done() == nil {
+		return dialer.Dial(network, addr)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := dialer.Dial(network, addr)
+		ch <- result{conn: conn, err: err}
+	}()
+	select {
+	case res := <-ch:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-ch; res.conn != nil {
+				_ = res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
 	}
-	return client, resp, err
+}
+
+// 在 ctx 的控制下完成 TLS 握手和 WebSocket 握手, 失败时关闭连接.
+// ctx 取消时连接的超时时间被设为过去, 阻塞的读写立即返回.
+// Completes the TLS handshake and the WebSocket handshake under the control of ctx, and closes the connection on failure.
+// Canceling ctx sets the deadline of the connection in the past so that blocked reads and writes return immediately.
+func (c *connector) handshakeContext() (*Conn, *http.Response, error) {
+	conn := c.conn
+	stop := internal.AfterFunc(c.getContext(), func() { _ = conn.SetDeadline(aLongTimeAgo) })
+	var client *Conn
+	var resp *http.Response
+	err := c.handshakeTLS(conn)
+	if err == nil {
+		client, resp, err = c.handshake()
+	}
+	if !stop() {
+		client, err = nil, c.getContext().Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, resp, err
+	}
+	return client, resp, nil
+}
+
+// 显式地完成 TLS 握手, 耗时不超过 HandshakeTimeout
+// Explicitly completes the TLS handshake, taking no longer than HandshakeTimeout
+func (c *connector) handshakeTLS(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(c.getContext(), c.option.HandshakeTimeout)
+	defer cancel()
+	return tlsConn.HandshakeContext(ctx)
+}
+
+// 拨号和握手使用的 context
+// The context used by dialing and the handshake
+func (c *connector) getContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// 通过 Unix 域套接字连接, 握手请求以 localhost 作为主机名
+// Connects through a Unix domain socket, the handshake request uses localhost as the host name
+func (c *connector) dialUnix() (*Conn, *http.Response, error) {
+	socket, path := internal.GetUnixAddrFromURL(c.option.Addr)
+	c.addr = "ws://localhost" + path
+	var err error
+	if c.conn, err = c.dialContext("unix", socket); err != nil {
+		return nil, nil, err
+	}
+	return c.handshakeContext()
+}
+
+// NewClientFromConn 通过外部连接创建客户端, 支持 TCP/KCP/Unix Domain Socket/rudp
+// Create new client via external connection, supports TCP/KCP/Unix Domain Socket/rudp.
+func NewClientFromConn(handler EventHandler, option *ClientOption, conn net.Conn) (*Conn, *http.Response, error) {
+	option = initClientOption(option)
+	c := &connector{option: option, addr: option.Addr, conn: conn, eventHandler: handler}
+	return c.handshakeContext()
 }
 
 // 发送HTTP请求, 即WebSocket握手
 // Sends an http request, i.e., websocket handshake
 func (c *connector) request() (*http.Response, *bufio.Reader, error) {
 	_ = c.conn.SetDeadline(time.Now().Add(c.option.HandshakeTimeout))
-	ctx, cancel := context.WithTimeout(context.Background(), c.option.HandshakeTimeout)
+	ctx, cancel := context.WithTimeout(c.getContext(), c.option.HandshakeTimeout)
 	defer cancel()
 
 	// 构建HTTP请求
 	// building a http request
-	r, err := http.NewRequestWithContext(ctx, http.MethodGet, c.option.Addr, nil)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, c.addr, nil)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -101,6 +235,9 @@ func (c *connector) request() (*http.Response, *bufio.Reader, error) {
 	r.Header.Set(internal.Connection.Key, internal.Connection.Val)
 	r.Header.Set(internal.Upgrade.Key, internal.Upgrade.Val)
 	r.Header.Set(internal.SecWebSocketVersion.Key, internal.SecWebSocketVersion.Val)
+	if extensions := c.extensionOffer(); extensions != "" {
+		r.Header.Set(internal.SecWebSocketExtensions.Key, extensions)
+	}
 	if c.secWebsocketKey == "" {
 		var key [16]byte
 		binary.BigEndian.PutUint64(key[0:8], internal.AlphabetNumeric.Uint64())
@@ -133,9 +270,23 @@ func (c *connector) request() (*http.Response, *bufio.Reader, error) {
 	return resp, br, err
 }
 
+// 生成 Sec-WebSocket-Extensions 请求头, 压缩拓展排在最前
+// Generates the Sec-WebSocket-Extensions request header, with the compression extension first
+func (c *connector) extensionOffer() string {
+	extensions := offerExtensions(c.option.Extensions)
+	if c.option.PermessageDeflate.Enabled {
+		extensions = append([]string{c.option.PermessageDeflate.genRequestHeader()}, extensions...)
+	}
+	return strings.Join(extensions, ", ")
+}
+
 // 执行 WebSocket 握手操作
 // Performs the WebSocket handshake operation
 func (c *connector) handshake() (*Conn, *http.Response, error) {
+	if c.option.NativeEnabled {
+		socket, err := c.nativeHandshake()
+		return socket, nil, err
+	}
 	resp, br, err := c.request()
 	if err != nil {
 		return nil, resp, err
@@ -147,6 +298,19 @@ func (c *connector) handshake() (*Conn, *http.Response, error) {
 	if err != nil {
 		return nil, resp, err
 	}
+	pd, err := c.getPermessageDeflate(resp)
+	if err != nil {
+		return nil, resp, err
+	}
+	list, err := confirmExtensions(
+		c.option.Extensions,
+		resp.Header.Get(internal.SecWebSocketExtensions.Key),
+		internal.SelectValue(pd.Enabled, RSV1, 0),
+		internal.PermessageDeflate,
+	)
+	if err != nil {
+		return nil, resp, err
+	}
 
 	socket := &Conn{
 		ss:                c.option.NewSession(),
@@ -162,10 +326,40 @@ func (c *connector) handshake() (*Conn, *http.Response, error) {
 		writeQueue:        workerQueue{maxConcurrency: 1},
 		readQueue:         make(channel, c.option.ParallelGolimit),
 	}
+	if pd.Enabled {
+		socket.initPermessageDeflate(pd, new(deflater).initialize(pd, c.option.ReadMaxPayloadSize))
+	}
+	socket.initExtensions(list)
 
 	return socket, resp, c.conn.SetDeadline(time.Time{})
 }
 
+// 从响应中获取压缩拓展的协商结果
+// Retrieves the negotiated compression parameters from the response
+func (c *connector) getPermessageDeflate(resp *http.Response) (PermessageDeflate, error) {
+	offer, ok := permessageOffer(resp.Header.Get(internal.SecWebSocketExtensions.Key))
+	if !ok {
+		return PermessageDeflate{}, nil
+	}
+	// 服务端不能接受客户端没有提议的拓展
+	// The server must not accept an extension the client did not offer
+	clientPD := c.option.PermessageDeflate
+	if !clientPD.Enabled {
+		return PermessageDeflate{}, ErrHandshake
+	}
+	serverPD := permessageNegotiation(offer)
+	return PermessageDeflate{
+		Enabled:               true,
+		Level:                 clientPD.Level,
+		Threshold:             clientPD.Threshold,
+		PoolSize:              clientPD.PoolSize,
+		ServerContextTakeover: serverPD.ServerContextTakeover,
+		ClientContextTakeover: serverPD.ClientContextTakeover,
+		ServerMaxWindowBits:   serverPD.ServerMaxWindowBits,
+		ClientMaxWindowBits:   serverPD.ClientMaxWindowBits,
+	}, nil
+}
+
 // 从响应中获取子协议
 // Retrieves the subprotocol from the response
 func (c *connector) getSubProtocol(resp *http.Response) (string, error) {
@@ -1,10 +1,12 @@
 package gbs
 
 import (
+	"context"
 	"crypto/tls"
 	"io"
 	"net"
 	"net/http"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -236,7 +238,8 @@ func TestClientHandshakeFail(t *testing.T) {
 
 	t.Run("deflate", func(t *testing.T) {
 		option := &ClientOption{
-			RequestHeader: http.Header{},
+			RequestHeader:     http.Header{},
+			PermessageDeflate: PermessageDeflate{Enabled: true},
 		}
 		option.RequestHeader.Set(internal.SecWebSocketKey.Key, "1fTfP/qALD+eAWcU80P0bg==")
 		option = initClientOption(option)
@@ -411,3 +414,132 @@ func TestNewClient_WriteRequest(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+// 拨号一直阻塞到 release 关闭的拨号器
+// Dialer blocking until release is closed
+type blockingDialer struct {
+	release chan struct{}
+}
+
+func (c *blockingDialer) Dial(network, addr string) (net.Conn, error) {
+	<-c.release
+	return net.Dial(network, addr)
+}
+
+// 记录 DialContext 调用的拨号器
+// Dialer recording calls to DialContext
+type recordingDialer struct {
+	net.Dialer
+	calls int32
+}
+
+func (c *recordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return c.Dialer.DialContext(ctx, network, addr)
+}
+
+func TestNewClientContext(t *testing.T) {
+	as := assert.New(t)
+
+	// 接受连接之后不做任何响应的服务器
+	// A server accepting connections without ever responding
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	silentAddr := silent.Addr().String()
+
+	// 在 d 之后取消 context, 返回 NewClientContext 的错误和耗时
+	// Cancels the context after d, returns the error of NewClientContext and the time taken
+	cancelAfter := func(d time.Duration, option *ClientOption) (time.Duration, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		time.AfterFunc(d, cancel)
+		start := time.Now()
+		_, _, err := NewClientContext(ctx, new(BuiltinEventHandler), option)
+		return time.Since(start), err
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err := NewClientContext(ctx, new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + silentAddr})
+		as.ErrorIs(err, context.Canceled)
+	})
+
+	t.Run("dial", func(t *testing.T) {
+		dialer := &blockingDialer{release: make(chan struct{})}
+		defer close(dialer.release)
+		elapsed, err := cancelAfter(20*time.Millisecond, &ClientOption{
+			Addr:      "ws://" + silentAddr,
+			NewDialer: func() (Dialer, error) { return dialer, nil },
+		})
+		as.Equal(context.Canceled, err)
+		as.Less(elapsed, time.Second)
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		dialer := new(recordingDialer)
+		elapsed, err := cancelAfter(20*time.Millisecond, &ClientOption{
+			Addr:             "ws://" + silentAddr,
+			HandshakeTimeout: 10 * time.Second,
+			NewDialer:        func() (Dialer, error) { return dialer, nil },
+		})
+		as.Equal(context.Canceled, err)
+		as.Less(elapsed, time.Second)
+		as.Equal(int32(1), atomic.LoadInt32(&dialer.calls))
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		elapsed, err := cancelAfter(20*time.Millisecond, &ClientOption{
+			Addr:             "wss://" + silentAddr,
+			HandshakeTimeout: 10 * time.Second,
+			TlsConfig:        &tls.Config{InsecureSkipVerify: true},
+		})
+		as.Equal(context.Canceled, err)
+		as.Less(elapsed, time.Second)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, _, err := NewClientContext(ctx, new(BuiltinEventHandler), &ClientOption{
+			Addr:             "ws://" + silentAddr,
+			HandshakeTimeout: 10 * time.Second,
+		})
+		as.Equal(context.DeadlineExceeded, err)
+	})
+
+	t.Run("established", func(t *testing.T) {
+		// 连接建立之后取消 context 不影响连接
+		// Canceling the context after the connection is established does not affect it
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		addr := newEchoServer(t, nil)
+		var messages = make(chan string, 1)
+		clientHandler := new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			messages <- message.Data.String()
+		}
+		client, _, err := NewClientContext(ctx, clientHandler, &ClientOption{Addr: "ws://" + addr})
+		if !as.NoError(err) {
+			return
+		}
+		cancel()
+		go client.ReadLoop()
+		time.Sleep(10 * time.Millisecond)
+		as.NoError(client.WriteString("hello"))
+		as.Equal("hello", <-messages)
+		_ = client.WriteClose(1000, nil)
+	})
+}
@@ -0,0 +1,382 @@
+package gbs
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/catermujo/gbs/internal"
+)
+
+// flateTail 按照 RFC 的规定添加四个字节, 并追加一个空的最终块以避免 flate reader 报告 unexpected EOF
+// Add four bytes as specified in RFC, plus an empty final block to squelch unexpected EOF error from flate reader.
+var flateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// 压缩器池, 无上下文接管模式下在连接之间共享
+// Pool of deflaters, shared between connections in non-context-takeover mode
+type deflaterPool struct {
+	serial uint64
+	num    uint64
+	pool   []*deflater
+}
+
+// 初始化压缩器池
+// Initialize the deflaterPool
+func (c *deflaterPool) initialize(options PermessageDeflate, limit int) *deflaterPool {
+	c.num = uint64(options.PoolSize)
+	for i := uint64(0); i < c.num; i++ {
+		c.pool = append(c.pool, new(deflater).initialize(options, limit))
+	}
+	return c
+}
+
+// Select 从压缩器池中选择一个压缩器
+// Selects a deflater from the pool
+func (c *deflaterPool) Select() *deflater {
+	j := atomic.AddUint64(&c.serial, 1) & (c.num - 1)
+	return c.pool[j]
+}
+
+type deflater struct {
+	dpsLocker sync.Mutex
+	buf       []byte
+	limit     int
+	dpsBuffer *bytes.Buffer
+	dpsReader io.ReadCloser
+	cpsLocker sync.Mutex
+	cpsWriter *flate.Writer
+	level     int
+}
+
+// 初始化压缩器
+// Initialize the deflater
+func (c *deflater) initialize(options PermessageDeflate, limit int) *deflater {
+	c.dpsReader = flate.NewReader(nil)
+	c.dpsBuffer = bytes.NewBuffer(nil)
+	c.buf = make([]byte, 32*1024)
+	c.limit = limit
+	c.level = options.Level
+	return c
+}
+
+// 重置解压器
+// Resets the inflater
+func (c *deflater) resetFR(r io.Reader, dict []byte) {
+	resetter := c.dpsReader.(flate.Resetter)
+	_ = resetter.Reset(r, dict) // must return a null pointer
+	if c.dpsBuffer.Cap() > int(bufferThreshold) {
+		c.dpsBuffer = bytes.NewBuffer(nil)
+	}
+	c.dpsBuffer.Reset()
+}
+
+// Decompress 解压
+// Decompresses data
+func (c *deflater) Decompress(src *bytes.Buffer, dict []byte) (*bytes.Buffer, error) {
+	c.dpsLocker.Lock()
+	defer c.dpsLocker.Unlock()
+
+	_, _ = src.Write(flateTail)
+	c.resetFR(src, dict)
+	reader := limitReader(c.dpsReader, c.limit)
+	if _, err := io.CopyBuffer(c.dpsBuffer, reader, c.buf); err != nil {
+		return nil, err
+	}
+	dst := binaryPool.Get(c.dpsBuffer.Len())
+	_, _ = c.dpsBuffer.WriteTo(dst)
+	return dst, nil
+}
+
+// Compress 压缩, 不引用之前的任何消息
+// Compresses data without referencing any previous message
+func (c *deflater) Compress(src internal.Payload, dst *bytes.Buffer) error {
+	c.cpsLocker.Lock()
+	defer c.cpsLocker.Unlock()
+
+	// 压缩器占用内存较多, 在首次使用时才创建
+	// Compressors are memory hungry, so they are created on first use
+	if c.cpsWriter == nil {
+		c.cpsWriter, _ = flate.NewWriter(dst, c.level)
+	} else {
+		c.cpsWriter.Reset(dst)
+	}
+	return flush(c.cpsWriter, src, dst)
+}
+
+// 写入并刷新压缩流, 然后去掉同步刷新产生的尾部标记
+// Writes and flushes the compressed stream, then strips the marker left by the sync flush
+func flush(w *flate.Writer, src internal.Payload, dst *bytes.Buffer) error {
+	if _, err := src.WriteTo(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if n := dst.Len(); n >= 4 {
+		compressedContent := dst.Bytes()
+		if tail := compressedContent[n-4:]; binary.BigEndian.Uint32(tail) == math.MaxUint16 {
+			dst.Truncate(n - 4)
+		}
+	}
+	return nil
+}
+
+// 上下文接管模式下的压缩器, 每个连接独占一个, 压缩流在消息之间延续
+// Compressor for context takeover mode. Each connection owns one and the stream carries on between messages.
+type streamDeflater struct {
+	dst    writerProxy
+	writer *flate.Writer
+}
+
+// 初始化流式压缩器
+// Initialize the stream deflater
+func (c *streamDeflater) initialize(level int) *streamDeflater {
+	c.writer, _ = flate.NewWriter(&c.dst, level)
+	return c
+}
+
+// Compress 压缩, 可以引用同一连接上之前压缩过的消息
+// Compresses data, possibly referencing messages previously compressed on the same connection
+func (c *streamDeflater) Compress(src internal.Payload, dst *bytes.Buffer) error {
+	c.dst.w = dst
+	err := flush(c.writer, src, dst)
+	c.dst.w = nil
+	return err
+}
+
+// Reset 丢弃压缩上下文, 下一条消息不会引用之前的内容
+// Discards the compression context so that the next message does not reference earlier content
+func (c *streamDeflater) Reset() {
+	c.writer.Reset(&c.dst)
+}
+
+// 转发写入到当前的目标缓冲区
+// Forwards writes to the current destination buffer
+type writerProxy struct {
+	w io.Writer
+}
+
+func (c *writerProxy) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// 滑动窗口
+// Sliding window
+type slideWindow struct {
+	enabled bool
+	dict    []byte
+	size    int
+}
+
+// 初始化滑动窗口
+// Initialize the sliding window
+func (c *slideWindow) initialize(windowBits int) *slideWindow {
+	c.enabled = true
+	c.size = internal.BinaryPow(windowBits)
+	c.dict = make([]byte, 0, c.size)
+	return c
+}
+
+// Write 将数据写入滑动窗口
+// Writes data to the sliding window
+func (c *slideWindow) Write(p []byte) (int, error) {
+	if !c.enabled {
+		return 0, nil
+	}
+
+	total := len(p)
+	n := total
+	length := len(c.dict)
+	if n+length <= c.size {
+		c.dict = append(c.dict, p...)
+		return total, nil
+	}
+
+	if m := c.size - length; m > 0 {
+		c.dict = append(c.dict, p[:m]...)
+		p = p[m:]
+		n = len(p)
+	}
+
+	if n >= c.size {
+		copy(c.dict, p[n-c.size:])
+		return total, nil
+	}
+
+	copy(c.dict, c.dict[n:])
+	copy(c.dict[c.size-n:], p)
+	return total, nil
+}
+
+// 生成请求头
+// Generates the request header
+func (c *PermessageDeflate) genRequestHeader() string {
+	options := make([]string, 0, 5)
+	options = append(options, internal.PermessageDeflate)
+	if !c.ServerContextTakeover {
+		options = append(options, internal.ServerNoContextTakeover)
+	}
+	if !c.ClientContextTakeover {
+		options = append(options, internal.ClientNoContextTakeover)
+	}
+	if c.ServerMaxWindowBits != 15 {
+		options = append(options, internal.ServerMaxWindowBits+internal.EQ+strconv.Itoa(c.ServerMaxWindowBits))
+	}
+	if c.ClientMaxWindowBits != 15 {
+		options = append(options, internal.ClientMaxWindowBits+internal.EQ+strconv.Itoa(c.ClientMaxWindowBits))
+	} else if c.ClientContextTakeover {
+		options = append(options, internal.ClientMaxWindowBits)
+	}
+	return strings.Join(options, "; ")
+}
+
+// 生成响应头
+// Generates the response header
+func (c *PermessageDeflate) genResponseHeader() string {
+	options := make([]string, 0, 5)
+	options = append(options, internal.PermessageDeflate)
+	if !c.ServerContextTakeover {
+		options = append(options, internal.ServerNoContextTakeover)
+	}
+	if !c.ClientContextTakeover {
+		options = append(options, internal.ClientNoContextTakeover)
+	}
+	if c.ServerMaxWindowBits != 15 {
+		options = append(options, internal.ServerMaxWindowBits+internal.EQ+strconv.Itoa(c.ServerMaxWindowBits))
+	}
+	if c.ClientMaxWindowBits != 15 {
+		options = append(options, internal.ClientMaxWindowBits+internal.EQ+strconv.Itoa(c.ClientMaxWindowBits))
+	}
+	return strings.Join(options, "; ")
+}
+
+// 从 Sec-WebSocket-Extensions 中找出 permessage-deflate 的首个提议
+// Finds the first permessage-deflate offer in Sec-WebSocket-Extensions
+func permessageOffer(extensions string) (string, bool) {
+	for _, item := range internal.Split(extensions, ",") {
+		if name, _, _ := strings.Cut(item, ";"); strings.TrimSpace(name) == internal.PermessageDeflate {
+			return item, true
+		}
+	}
+	return "", false
+}
+
+// 压缩拓展协商
+// Negotiation of compression parameters
+func permessageNegotiation(str string) PermessageDeflate {
+	options := PermessageDeflate{
+		ServerContextTakeover: true,
+		ClientContextTakeover: true,
+		ServerMaxWindowBits:   15,
+		ClientMaxWindowBits:   15,
+	}
+
+	for _, s := range internal.Split(str, ";") {
+		pair := strings.SplitN(s, internal.EQ, 2)
+		switch strings.TrimSpace(pair[0]) {
+		case internal.ServerNoContextTakeover:
+			options.ServerContextTakeover = false
+		case internal.ClientNoContextTakeover:
+			options.ClientContextTakeover = false
+		case internal.ServerMaxWindowBits:
+			if len(pair) == 2 {
+				x, _ := strconv.Atoi(strings.Trim(strings.TrimSpace(pair[1]), `"`))
+				x = internal.WithDefault(x, 15)
+				options.ServerMaxWindowBits = internal.Min(options.ServerMaxWindowBits, x)
+			}
+		case internal.ClientMaxWindowBits:
+			if len(pair) == 2 {
+				x, _ := strconv.Atoi(strings.Trim(strings.TrimSpace(pair[1]), `"`))
+				x = internal.WithDefault(x, 15)
+				options.ClientMaxWindowBits = internal.Min(options.ClientMaxWindowBits, x)
+			}
+		}
+	}
+
+	options.ClientMaxWindowBits = internal.SelectValue(options.ClientMaxWindowBits < 8, 8, options.ClientMaxWindowBits)
+	options.ServerMaxWindowBits = internal.SelectValue(options.ServerMaxWindowBits < 8, 8, options.ServerMaxWindowBits)
+	return options
+}
+
+// 限制从io.Reader中最多读取m个字节
+// Limit reading up to m bytes from io.Reader
+func limitReader(r io.Reader, m int) io.Reader { return &limitedReader{R: r, M: m} }
+
+type limitedReader struct {
+	R io.Reader
+	N int
+	M int
+}
+
+func (c *limitedReader) Read(p []byte) (n int, err error) {
+	n, err = c.R.Read(p)
+	c.N += n
+	if c.N > c.M {
+		return n, internal.CloseMessageTooLarge
+	}
+	return
+}
+
+// 根据协商结果初始化连接的压缩拓展
+// Initializes the compression extension of the connection from the negotiated parameters
+func (c *Conn) initPermessageDeflate(pd PermessageDeflate, d *deflater) {
+	c.pd = pd
+	if !pd.Enabled {
+		return
+	}
+	c.rsv |= RSV1
+	c.deflater = d
+	if takeover, windowBits := c.cpsParams(); takeover && windowBits == 15 {
+		c.cps = new(streamDeflater).initialize(pd.Level)
+	}
+	if c.isServer && pd.ClientContextTakeover {
+		c.dpsWindow.initialize(pd.ClientMaxWindowBits)
+	}
+	if !c.isServer && pd.ServerContextTakeover {
+		c.dpsWindow.initialize(pd.ServerMaxWindowBits)
+	}
+}
+
+// 返回本端压缩器的上下文接管模式和滑动窗口指数
+// Returns the context takeover mode and the window exponent of the local compressor
+func (c *Conn) cpsParams() (takeover bool, windowBits int) {
+	if c.isServer {
+		return c.pd.ServerContextTakeover, c.pd.ServerMaxWindowBits
+	}
+	return c.pd.ClientContextTakeover, c.pd.ClientMaxWindowBits
+}
+
+// 判断是否压缩消息
+// 标准库的压缩器总是使用 32KB 的窗口, 如果协商的窗口更小, 只压缩不超过窗口大小的消息, 以保证回溯距离不越界.
+// Reports whether the message should be compressed.
+// The standard library compressor always uses a 32KB window; with a smaller negotiated window,
+// only messages that fit in the window are compressed so that back-references stay in range.
+func (c *Conn) shouldCompress(opcode Opcode, n int) bool {
+	if !c.pd.Enabled || !opcode.isDataFrame() || n < c.pd.Threshold {
+		return false
+	}
+	_, windowBits := c.cpsParams()
+	return windowBits == 15 || n <= internal.BinaryPow(windowBits)
+}
+
+// 解压消息, 并更新解压字典
+// Decompresses the message and updates the decompression dictionary
+func (c *Conn) decompress(msg *Message) (*Message, error) {
+	data, err := c.deflater.Decompress(msg.Data, c.dpsWindow.dict)
+	_ = msg.Close()
+	if err != nil {
+		if v, ok := err.(internal.StatusCode); ok {
+			return nil, v
+		}
+		return nil, internal.NewError(internal.CloseInternalErr, err)
+	}
+	_, _ = c.dpsWindow.Write(data.Bytes())
+	msg.Data = data
+	return msg, nil
+}
@@ -0,0 +1,394 @@
+package gbs
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/catermujo/gbs/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+// 通过完整的握手过程创建一对连接
+// Creates a pair of connections through a full handshake
+func newHandshakePeer(serverHandler EventHandler, serverOption *ServerOption, clientHandler EventHandler, clientOption *ClientOption) (server, client *Conn, err error) {
+	s, c := net.Pipe()
+	upgrader := NewUpgrader(serverHandler, serverOption)
+	ch := make(chan error, 1)
+	sch := make(chan *Conn, 1)
+	go func() {
+		br := bufio.NewReader(s)
+		r, err := http.ReadRequest(br)
+		if err != nil {
+			ch <- err
+			return
+		}
+		socket, err := upgrader.UpgradeFromConn(s, br, r)
+		sch <- socket
+		ch <- err
+	}()
+	if clientOption == nil {
+		clientOption = new(ClientOption)
+	}
+	clientOption.Addr = "ws://localhost/connect"
+	client, _, err = NewClientFromConn(clientHandler, clientOption, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	return <-sch, client, <-ch
+}
+
+func TestPermessageNegotiation(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("default", func(t *testing.T) {
+		pd := permessageNegotiation("permessage-deflate")
+		as.True(pd.ServerContextTakeover)
+		as.True(pd.ClientContextTakeover)
+		as.Equal(15, pd.ServerMaxWindowBits)
+		as.Equal(15, pd.ClientMaxWindowBits)
+	})
+
+	t.Run("params", func(t *testing.T) {
+		pd := permessageNegotiation("permessage-deflate; server_no_context_takeover; client_no_context_takeover; server_max_window_bits=10; client_max_window_bits=\"9\"")
+		as.False(pd.ServerContextTakeover)
+		as.False(pd.ClientContextTakeover)
+		as.Equal(10, pd.ServerMaxWindowBits)
+		as.Equal(9, pd.ClientMaxWindowBits)
+	})
+
+	t.Run("out of range", func(t *testing.T) {
+		pd := permessageNegotiation("permessage-deflate; server_max_window_bits=1; client_max_window_bits=20")
+		as.Equal(8, pd.ServerMaxWindowBits)
+		as.Equal(15, pd.ClientMaxWindowBits)
+	})
+
+	t.Run("offer", func(t *testing.T) {
+		offer, ok := permessageOffer("x-custom; foo=1, permessage-deflate; client_max_window_bits, permessage-deflate")
+		as.True(ok)
+		as.Equal("permessage-deflate; client_max_window_bits", offer)
+
+		_, ok = permessageOffer("x-custom")
+		as.False(ok)
+
+		_, ok = permessageOffer("permessage-deflate-v2")
+		as.False(ok)
+	})
+
+	t.Run("header", func(t *testing.T) {
+		pd := PermessageDeflate{ServerMaxWindowBits: 15, ClientMaxWindowBits: 15}
+		as.Equal("permessage-deflate; server_no_context_takeover; client_no_context_takeover", pd.genRequestHeader())
+		as.Equal("permessage-deflate; server_no_context_takeover; client_no_context_takeover", pd.genResponseHeader())
+
+		pd = PermessageDeflate{ServerContextTakeover: true, ClientContextTakeover: true, ServerMaxWindowBits: 12, ClientMaxWindowBits: 15}
+		as.Equal("permessage-deflate; server_max_window_bits=12; client_max_window_bits", pd.genRequestHeader())
+		as.Equal("permessage-deflate; server_max_window_bits=12", pd.genResponseHeader())
+	})
+}
+
+func TestUpgrader_GetPermessageDeflate(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("disabled", func(t *testing.T) {
+		upgrader := NewUpgrader(new(BuiltinEventHandler), nil)
+		pd := upgrader.getPermessageDeflate("permessage-deflate")
+		as.False(pd.Enabled)
+	})
+
+	t.Run("not offered", func(t *testing.T) {
+		upgrader := NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+			PermessageDeflate: PermessageDeflate{Enabled: true},
+		})
+		pd := upgrader.getPermessageDeflate("x-custom")
+		as.False(pd.Enabled)
+	})
+
+	t.Run("window bits", func(t *testing.T) {
+		upgrader := NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+			PermessageDeflate: PermessageDeflate{
+				Enabled:               true,
+				ServerContextTakeover: true,
+				ClientContextTakeover: true,
+				ClientMaxWindowBits:   10,
+			},
+		})
+		pd := upgrader.getPermessageDeflate("permessage-deflate; server_max_window_bits=12")
+		as.True(pd.Enabled)
+		as.Equal(12, pd.ServerMaxWindowBits)
+		as.Equal(15, pd.ClientMaxWindowBits)
+
+		pd = upgrader.getPermessageDeflate("permessage-deflate; client_max_window_bits")
+		as.Equal(15, pd.ServerMaxWindowBits)
+		as.Equal(10, pd.ClientMaxWindowBits)
+	})
+}
+
+func TestPermessageDeflate(t *testing.T) {
+	var cases = []struct {
+		Title  string
+		Server PermessageDeflate
+		Client PermessageDeflate
+	}{
+		{
+			Title:  "no context takeover",
+			Server: PermessageDeflate{Enabled: true},
+			Client: PermessageDeflate{Enabled: true},
+		},
+		{
+			Title:  "context takeover",
+			Server: PermessageDeflate{Enabled: true, ServerContextTakeover: true, ClientContextTakeover: true},
+			Client: PermessageDeflate{Enabled: true, ServerContextTakeover: true, ClientContextTakeover: true},
+		},
+		{
+			Title:  "small window",
+			Server: PermessageDeflate{Enabled: true, ServerContextTakeover: true, ClientContextTakeover: true, ServerMaxWindowBits: 9},
+			Client: PermessageDeflate{Enabled: true, ServerContextTakeover: true, ClientContextTakeover: true, ClientMaxWindowBits: 10},
+		},
+		{
+			Title:  "server only",
+			Server: PermessageDeflate{Enabled: true},
+			Client: PermessageDeflate{},
+		},
+	}
+
+	for _, item := range cases {
+		t.Run(item.Title, func(t *testing.T) {
+			as := assert.New(t)
+			const count = 100
+			var serverMessages, clientMessages []string
+			var listA, listB []string
+			mu := &sync.Mutex{}
+			wg := &sync.WaitGroup{}
+			wg.Add(2 * count)
+
+			serverHandler := new(webSocketMocker)
+			clientHandler := new(webSocketMocker)
+			serverHandler.onMessage = func(socket *Conn, message *Message) {
+				mu.Lock()
+				serverMessages = append(serverMessages, message.Data.String())
+				mu.Unlock()
+				wg.Done()
+			}
+			clientHandler.onMessage = func(socket *Conn, message *Message) {
+				mu.Lock()
+				clientMessages = append(clientMessages, message.Data.String())
+				mu.Unlock()
+				wg.Done()
+			}
+
+			server, client, err := newHandshakePeer(
+				serverHandler, &ServerOption{PermessageDeflate: item.Server, CheckUtf8Enabled: true},
+				clientHandler, &ClientOption{PermessageDeflate: item.Client, CheckUtf8Enabled: true},
+			)
+			if !as.NoError(err) {
+				return
+			}
+			as.Equal(item.Client.Enabled, server.Compressed())
+			as.Equal(item.Client.Enabled, client.Compressed())
+			go server.ReadLoop()
+			go client.ReadLoop()
+
+			for i := 0; i < count; i++ {
+				n := internal.AlphabetNumeric.Intn(4 * 1024)
+				if i%10 == 0 {
+					n = 64 * 1024
+				}
+				a := string(internal.AlphabetNumeric.Generate(n))
+				b := string(internal.AlphabetNumeric.Generate(n))
+				listA = append(listA, a)
+				listB = append(listB, b)
+				as.NoError(client.WriteString(a))
+				as.NoError(server.WriteString(b))
+			}
+			wg.Wait()
+			as.Equal(listA, serverMessages)
+			as.Equal(listB, clientMessages)
+		})
+	}
+}
+
+func TestPermessageDeflate_Segments(t *testing.T) {
+	as := assert.New(t)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	serverHandler := new(webSocketMocker)
+	clientHandler := new(webSocketMocker)
+	payload := bytes.Repeat([]byte("hello world "), 1024)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal(string(payload), message.Data.String())
+		wg.Done()
+	}
+	pd := PermessageDeflate{Enabled: true, ServerContextTakeover: true, ClientContextTakeover: true}
+	server, client, err := newHandshakePeer(serverHandler, &ServerOption{PermessageDeflate: pd}, clientHandler, &ClientOption{PermessageDeflate: pd})
+	if !as.NoError(err) {
+		return
+	}
+	go server.ReadLoop()
+
+	// 把一条压缩后的消息拆成三帧发送, 只有第一帧设置 RSV1
+	// Split a compressed message into three frames, only the first one has RSV1 set
+	compressed := bytes.NewBuffer(nil)
+	as.NoError(client.cps.Compress(internal.Bytes(payload), compressed))
+	p := compressed.Bytes()
+	n := len(p) / 3
+	frames := []struct {
+		fin, rsv1 bool
+		opcode    Opcode
+		data      []byte
+	}{
+		{false, true, OpcodeText, p[:n]},
+		{false, false, OpcodeContinuation, p[n : 2*n]},
+		{true, false, OpcodeContinuation, p[2*n:]},
+	}
+	for _, f := range frames {
+		header := frameHeader{}
+		headerLength, maskBytes := header.GenerateHeader(false, f.fin, f.rsv1, f.opcode, len(f.data))
+		data := testCloneBytes(f.data)
+		internal.MaskXOR(data, maskBytes)
+		_, err = client.conn.Write(append(header[:headerLength], data...))
+		as.NoError(err)
+	}
+	wg.Wait()
+}
+
+func TestPermessageDeflate_Threshold(t *testing.T) {
+	as := assert.New(t)
+	pd := PermessageDeflate{Enabled: true, Threshold: 100}
+	server, _, err := newHandshakePeer(new(BuiltinEventHandler), &ServerOption{PermessageDeflate: pd}, new(BuiltinEventHandler), &ClientOption{PermessageDeflate: pd})
+	if !as.NoError(err) {
+		return
+	}
+
+	frame, err := server.genFrame(OpcodeText, internal.Bytes(bytes.Repeat([]byte("a"), 99)), frameConfig{fin: true, compress: true})
+	as.NoError(err)
+	fh := frameHeader{frame.Bytes()[0]}
+	as.False(fh.GetRSV1())
+
+	frame, err = server.genFrame(OpcodeText, internal.Bytes(bytes.Repeat([]byte("a"), 100)), frameConfig{fin: true, compress: true})
+	as.NoError(err)
+	fh = frameHeader{frame.Bytes()[0]}
+	as.True(fh.GetRSV1())
+
+	frame, err = server.genFrame(OpcodePing, internal.Bytes(bytes.Repeat([]byte("a"), 100)), frameConfig{fin: true, compress: true})
+	as.NoError(err)
+	fh = frameHeader{frame.Bytes()[0]}
+	as.False(fh.GetRSV1())
+}
+
+func TestPermessageDeflate_Broadcast(t *testing.T) {
+	as := assert.New(t)
+	const count = 8
+	payload := bytes.Repeat([]byte("market data "), 1024)
+	wg := &sync.WaitGroup{}
+	wg.Add(2 * count)
+	clientHandler := new(webSocketMocker)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal(string(payload), message.Data.String())
+		wg.Done()
+	}
+
+	pd := PermessageDeflate{Enabled: true, ServerContextTakeover: true, ClientContextTakeover: true}
+	var servers []*Conn
+	for i := 0; i < count; i++ {
+		server, client, err := newHandshakePeer(new(BuiltinEventHandler), &ServerOption{PermessageDeflate: pd}, clientHandler, &ClientOption{PermessageDeflate: pd})
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+		servers = append(servers, server)
+	}
+
+	// 广播之后, 连接自身的压缩上下文必须仍然可用
+	// After a broadcast, the connection's own compression context must still be usable
+	b := NewBroadcaster(OpcodeText, payload)
+	for _, server := range servers {
+		as.NoError(b.Broadcast(server))
+		server.WriteAsync(OpcodeText, payload, nil)
+	}
+	wg.Wait()
+	as.NotNil(b.msgs[1].frame)
+	as.Nil(b.msgs[0].frame)
+	_ = b.Close()
+}
+
+func TestPermessageDeflate_Unsolicited(t *testing.T) {
+	as := assert.New(t)
+	_, _, err := newHandshakePeer(
+		new(BuiltinEventHandler), &ServerOption{ResponseHeader: http.Header{"X-Server": []string{"gbs"}}},
+		new(BuiltinEventHandler), nil,
+	)
+	as.NoError(err)
+
+	srv, cli := net.Pipe()
+	go func() {
+		br := bufio.NewReader(srv)
+		r, _ := http.ReadRequest(br)
+		key := r.Header.Get(internal.SecWebSocketKey.Key)
+		text := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + internal.ComputeAcceptKey(key) + "\r\n" +
+			"Sec-WebSocket-Extensions: permessage-deflate\r\n\r\n"
+		_, _ = srv.Write([]byte(text))
+	}()
+	_, _, err = NewClientFromConn(new(BuiltinEventHandler), &ClientOption{Addr: "ws://localhost"}, cli)
+	as.ErrorIs(err, ErrHandshake)
+}
+
+func TestPermessageDeflate_Unnegotiated(t *testing.T) {
+	as := assert.New(t)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	serverHandler := new(webSocketMocker)
+	serverHandler.onClose = func(socket *Conn, err error) {
+		as.Equal(internal.CloseProtocolError, err)
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, nil, new(BuiltinEventHandler), nil)
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	header := frameHeader{}
+	headerLength, _ := header.GenerateHeader(false, true, true, OpcodeText, 0)
+	_, _ = client.conn.Write(header[:headerLength])
+	wg.Wait()
+}
+
+func TestSlideWindow(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("", func(t *testing.T) {
+		sw := new(slideWindow).initialize(3)
+		_, _ = sw.Write([]byte("abcd"))
+		as.Equal("abcd", string(sw.dict))
+		_, _ = sw.Write([]byte("efgh"))
+		as.Equal("abcdefgh", string(sw.dict))
+		_, _ = sw.Write([]byte("ij"))
+		as.Equal("cdefghij", string(sw.dict))
+		_, _ = sw.Write([]byte("0123456789"))
+		as.Equal("23456789", string(sw.dict))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		sw := slideWindow{}
+		n, _ := sw.Write([]byte("abcd"))
+		as.Equal(0, n)
+		as.Equal(0, len(sw.dict))
+	})
+}
+
+func TestLimitReader(t *testing.T) {
+	as := assert.New(t)
+	deflater := new(deflater).initialize(PermessageDeflate{Level: defaultCompressLevel}, 64)
+	buf := bytes.NewBuffer(nil)
+	as.NoError(deflater.Compress(internal.Bytes(bytes.Repeat([]byte("a"), 65)), buf))
+	_, err := deflater.Decompress(buf, nil)
+	as.Equal(internal.CloseMessageTooLarge, err)
+
+	buf.Reset()
+	as.NoError(deflater.Compress(internal.Bytes(bytes.Repeat([]byte("a"), 64)), buf))
+	dst, err := deflater.Decompress(buf, nil)
+	as.NoError(err)
+	as.Equal(64, dst.Len())
+}
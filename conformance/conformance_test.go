@@ -0,0 +1,292 @@
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+
+	normalClosure  = 1000
+	protocolError  = 1002
+	noStatus       = 1005
+	invalidPayload = 1007
+)
+
+// 测试中的一帧
+// A frame of a test case
+type frame struct {
+	Payload  []byte
+	Opcode   uint8
+	RSV      uint8
+	Fin      bool
+	Unmasked bool
+}
+
+func text(fin bool, s string) frame { return frame{Fin: fin, Opcode: opText, Payload: []byte(s)} }
+func bin(fin bool, p []byte) frame  { return frame{Fin: fin, Opcode: opBinary, Payload: p} }
+func cont(fin bool, s string) frame {
+	return frame{Fin: fin, Opcode: opContinuation, Payload: []byte(s)}
+}
+func ping(s string) frame { return frame{Fin: true, Opcode: opPing, Payload: []byte(s)} }
+func pong(s string) frame { return frame{Fin: true, Opcode: opPong, Payload: []byte(s)} }
+
+func closeFrame(code uint16, reason string) frame {
+	p := binary.BigEndian.AppendUint16(nil, code)
+	return frame{Fin: true, Opcode: opClose, Payload: append(p, reason...)}
+}
+
+// 回显消息的事件处理器, 按照 RFC 6455 5.5.3 回复携带相同负载的 Pong
+// Event handler that echoes messages and replies with a Pong carrying the same payload, as RFC 6455 5.5.3 requires
+type echoHandler struct {
+	gbs.BuiltinEventHandler
+}
+
+func (c *echoHandler) OnPing(socket *gbs.Conn, payload []byte) {
+	_ = socket.WritePong(payload)
+}
+
+func (c *echoHandler) OnMessage(socket *gbs.Conn, message *gbs.Message) {
+	_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	_ = message.Close()
+}
+
+// 逐帧控制的对端
+// Peer controlled frame by frame
+type peer struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// server Whether the peer plays the server role, i.e. does not mask its frames
+	server bool
+}
+
+// 创建 gbs 服务端, 返回扮演客户端的对端
+// Creates a gbs server and returns the peer playing the client
+func newServerPeer(t *testing.T, option *gbs.ServerOption) *peer {
+	s, c := net.Pipe()
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	r := &http.Request{Method: http.MethodGet, Header: http.Header{}}
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+
+	upgrader := gbs.NewUpgrader(new(echoHandler), option)
+	go func() {
+		socket, err := upgrader.UpgradeFromConn(s, bufio.NewReader(s), r)
+		if err == nil {
+			socket.ReadLoop()
+		}
+	}()
+
+	p := &peer{conn: c, br: bufio.NewReader(c)}
+	resp, err := http.ReadResponse(p.br, r)
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode) {
+		t.FailNow()
+	}
+	return p
+}
+
+// 创建 gbs 客户端, 返回扮演服务端的对端
+// Creates a gbs client and returns the peer playing the server
+func newClientPeer(t *testing.T, option *gbs.ClientOption) *peer {
+	s, c := net.Pipe()
+	p := &peer{conn: s, br: bufio.NewReader(s), server: true}
+	go func() {
+		r, err := http.ReadRequest(p.br)
+		if err != nil {
+			return
+		}
+		accept := computeAcceptKey(r.Header.Get("Sec-WebSocket-Key"))
+		_, _ = io.WriteString(s, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: "+accept+"\r\n\r\n")
+	}()
+
+	option.Addr = "ws://127.0.0.1/"
+	socket, _, err := gbs.NewClientFromConn(new(echoHandler), option, c)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go socket.ReadLoop()
+	return p
+}
+
+func computeAcceptKey(key string) string {
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// 写入一帧, 客户端角色的帧默认带掩码
+// Writes a frame, frames of the client role are masked unless told otherwise
+func (c *peer) write(f frame) error {
+	b0 := f.Opcode | f.RSV<<4
+	if f.Fin {
+		b0 |= 0x80
+	}
+	buf := []byte{b0, 0}
+	n := len(f.Payload)
+	switch {
+	case n <= 125:
+		buf[1] = byte(n)
+	case n <= 65535:
+		buf[1] = 126
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf[1] = 127
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	payload := append([]byte(nil), f.Payload...)
+	if !c.server && !f.Unmasked {
+		buf[1] |= 0x80
+		key := make([]byte, 4)
+		_, _ = rand.Read(key)
+		buf = append(buf, key...)
+		for i := range payload {
+			payload[i] ^= key[i&3]
+		}
+	}
+	_, err := c.conn.Write(append(buf, payload...))
+	return err
+}
+
+// 在后台依次写入多帧. net.Pipe 是同步的, 对方出错后不再读取, 所以不能阻塞读取响应的协程.
+// Writes frames one by one in the background. net.Pipe is synchronous and the other side stops reading
+// after an error, so the goroutine reading the responses must not be blocked.
+func (c *peer) send(frames ...frame) {
+	go func() {
+		for _, f := range frames {
+			if err := c.write(f); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// 读取一帧, 并检查掩码是否符合角色
+// Reads a frame and checks that the mask matches the role
+func (c *peer) read() (frame, bool, error) {
+	var f frame
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return f, false, err
+	}
+	f.Fin = header[0]&0x80 != 0
+	f.RSV = header[0] >> 4 & 0x07
+	f.Opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+
+	n := uint64(header[1] & 0x7F)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return f, masked, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return f, masked, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, key[:]); err != nil {
+			return f, masked, err
+		}
+	}
+	f.Payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, f.Payload); err != nil {
+		return f, masked, err
+	}
+	if masked {
+		for i := range f.Payload {
+			f.Payload[i] ^= key[i&3]
+		}
+	}
+	return f, masked, nil
+}
+
+// 测试用例: 发送 Frames, 期望依次收到 Expect, 然后收到状态码为 Close 的关闭帧.
+// Close 为 0 表示连接保持打开, 为 1005 (No Status Received) 表示关闭帧没有负载.
+// Test case: sends Frames, expects Expect in order, then a close frame with status Close.
+// A zero Close means the connection stays open, 1005 (No Status Received) means a close frame without payload.
+type testCase struct {
+	Title  string
+	Frames []frame
+	Expect []frame
+	Close  uint16
+}
+
+func (c *testCase) run(t *testing.T, p *peer) {
+	as := assert.New(t)
+	defer p.conn.Close()
+
+	p.send(c.Frames...)
+	for _, expected := range c.Expect {
+		f, masked, err := p.read()
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(p.server, masked, "mask bit")
+		as.Equal(expected.Opcode, f.Opcode)
+		as.Equal(expected.Fin, f.Fin)
+		as.Equal(string(expected.Payload), string(f.Payload))
+	}
+	if c.Close == 0 {
+		return
+	}
+
+	f, _, err := p.read()
+	if !as.NoError(err) {
+		return
+	}
+	if as.Equal(uint8(opClose), f.Opcode, "expected a close frame") {
+		if c.Close == noStatus {
+			as.Empty(f.Payload)
+		} else if as.GreaterOrEqual(len(f.Payload), 2) {
+			as.Equal(c.Close, binary.BigEndian.Uint16(f.Payload))
+		}
+	}
+
+	// 发送关闭帧之后必须断开连接
+	// The connection must be dropped after the close frame
+	_, _, err = p.read()
+	as.ErrorIs(err, io.EOF)
+}
+
+func runServerCases(t *testing.T, option func() *gbs.ServerOption, cases []testCase) {
+	for _, item := range cases {
+		item := item
+		t.Run(item.Title, func(t *testing.T) {
+			item.run(t, newServerPeer(t, option()))
+		})
+	}
+}
+
+func defaultOption() *gbs.ServerOption { return &gbs.ServerOption{CheckUtf8Enabled: true} }
+
+func repeat(b byte, n int) []byte { return bytes.Repeat([]byte{b}, n) }
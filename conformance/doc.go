@@ -0,0 +1,7 @@
+// Package conformance 在内存连接上验证 gbs 对 RFC 6455 的实现, 不依赖网络和外部的 Autobahn 服务.
+// 测试用例模拟一个逐帧控制的对端, 覆盖分片规则, 分片消息中的控制帧, 非法操作码, 关闭码, UTF-8 边界情况和掩码规则.
+// Package conformance checks the RFC 6455 implementation of gbs over in-memory connections,
+// without a network or the external Autobahn server.
+// The test cases drive a frame-by-frame peer through fragmentation rules, control frames inside fragmented messages,
+// invalid opcodes, close codes, UTF-8 edge cases and masking rules.
+package conformance
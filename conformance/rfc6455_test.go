@@ -0,0 +1,343 @@
+package conformance
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/catermujo/gbs"
+)
+
+// RFC 6455 5.2, 5.6: 基本帧格式, 保留位和操作码
+// RFC 6455 5.2, 5.6: base framing, reserved bits and opcodes
+func TestFraming(t *testing.T) {
+	var cases []testCase
+	for _, n := range []int{0, 1, 125, 126, 127, 65535, 65536} {
+		payload := string(repeat('*', n))
+		cases = append(cases,
+			testCase{
+				Title:  fmt.Sprintf("text %d bytes", n),
+				Frames: []frame{text(true, payload)},
+				Expect: []frame{text(true, payload)},
+			},
+			testCase{
+				Title:  fmt.Sprintf("binary %d bytes", n),
+				Frames: []frame{bin(true, repeat(0xfe, n))},
+				Expect: []frame{bin(true, repeat(0xfe, n))},
+			},
+		)
+	}
+
+	for _, rsv := range []uint8{1, 2, 3, 4, 5, 6, 7} {
+		cases = append(cases, testCase{
+			Title:  fmt.Sprintf("rsv %d without extension", rsv),
+			Frames: []frame{{Fin: true, Opcode: opText, RSV: rsv, Payload: []byte("hello")}},
+			Close:  protocolError,
+		})
+	}
+	cases = append(cases, testCase{
+		Title:  "rsv on ping without extension",
+		Frames: []frame{{Fin: true, Opcode: opPing, RSV: 4}},
+		Close:  protocolError,
+	})
+
+	for _, opcode := range []uint8{3, 4, 5, 6, 7, 0xB, 0xC, 0xD, 0xE, 0xF} {
+		cases = append(cases,
+			testCase{
+				Title:  fmt.Sprintf("reserved opcode %d", opcode),
+				Frames: []frame{{Fin: true, Opcode: opcode}},
+				Close:  protocolError,
+			},
+			testCase{
+				Title:  fmt.Sprintf("reserved opcode %d after a message", opcode),
+				Frames: []frame{text(true, "hello"), {Fin: true, Opcode: opcode, Payload: []byte("hello")}},
+				Expect: []frame{text(true, "hello")},
+				Close:  protocolError,
+			},
+		)
+	}
+
+	runServerCases(t, defaultOption, cases)
+}
+
+// RFC 6455 5.5: 控制帧
+// RFC 6455 5.5: control frames
+func TestControlFrames(t *testing.T) {
+	runServerCases(t, defaultOption, []testCase{
+		{
+			Title:  "ping without payload",
+			Frames: []frame{ping("")},
+			Expect: []frame{pong("")},
+		},
+		{
+			Title:  "ping with payload",
+			Frames: []frame{ping("hello")},
+			Expect: []frame{pong("hello")},
+		},
+		{
+			Title:  "ping with 125 bytes payload",
+			Frames: []frame{ping(string(repeat('a', 125)))},
+			Expect: []frame{pong(string(repeat('a', 125)))},
+		},
+		{
+			Title:  "ping with 126 bytes payload",
+			Frames: []frame{ping(string(repeat('a', 126)))},
+			Close:  protocolError,
+		},
+		{
+			Title:  "fragmented ping",
+			Frames: []frame{{Fin: false, Opcode: opPing, Payload: []byte("hello")}, cont(true, "world")},
+			Close:  protocolError,
+		},
+		{
+			Title:  "unsolicited pong",
+			Frames: []frame{pong("hello"), ping("world")},
+			Expect: []frame{pong("world")},
+		},
+		{
+			Title:  "pings in a row",
+			Frames: []frame{ping("1"), ping("2"), ping("3"), ping("4"), ping("5")},
+			Expect: []frame{pong("1"), pong("2"), pong("3"), pong("4"), pong("5")},
+		},
+		{
+			Title:  "close with 126 bytes payload",
+			Frames: []frame{closeFrame(normalClosure, string(repeat('a', 124)))},
+			Close:  protocolError,
+		},
+	})
+}
+
+// RFC 6455 5.4: 分片
+// RFC 6455 5.4: fragmentation
+func TestFragmentation(t *testing.T) {
+	runServerCases(t, defaultOption, []testCase{
+		{
+			Title:  "text in three fragments",
+			Frames: []frame{text(false, "frag"), cont(false, "ment"), cont(true, "ed")},
+			Expect: []frame{text(true, "fragmented")},
+		},
+		{
+			Title:  "binary in two fragments",
+			Frames: []frame{bin(false, []byte{1, 2}), {Fin: true, Opcode: opContinuation, Payload: []byte{3}}},
+			Expect: []frame{bin(true, []byte{1, 2, 3})},
+		},
+		{
+			Title:  "empty fragments",
+			Frames: []frame{text(false, ""), cont(false, ""), cont(false, "hello"), cont(true, "")},
+			Expect: []frame{text(true, "hello")},
+		},
+		{
+			Title:  "ping between fragments",
+			Frames: []frame{text(false, "hello, "), ping("ping"), cont(true, "world")},
+			Expect: []frame{pong("ping"), text(true, "hello, world")},
+		},
+		{
+			Title:  "pong between fragments",
+			Frames: []frame{text(false, "hello, "), pong("pong"), cont(true, "world")},
+			Expect: []frame{text(true, "hello, world")},
+		},
+		{
+			Title:  "close between fragments",
+			Frames: []frame{text(false, "hello, "), closeFrame(normalClosure, ""), cont(true, "world")},
+			Close:  normalClosure,
+		},
+		{
+			Title:  "continuation without a message",
+			Frames: []frame{cont(true, "hello")},
+			Close:  protocolError,
+		},
+		{
+			Title:  "unfinished continuation without a message",
+			Frames: []frame{cont(false, "hello"), cont(true, "world")},
+			Close:  protocolError,
+		},
+		{
+			Title:  "continuation after a complete message",
+			Frames: []frame{text(true, "hello"), cont(true, "world")},
+			Expect: []frame{text(true, "hello")},
+			Close:  protocolError,
+		},
+		{
+			Title:  "new text message inside a fragmented message",
+			Frames: []frame{text(false, "hello"), text(true, "world")},
+			Close:  protocolError,
+		},
+		{
+			Title:  "new binary message inside a fragmented message",
+			Frames: []frame{text(false, "hello"), bin(false, []byte("world")), cont(true, "")},
+			Close:  protocolError,
+		},
+	})
+}
+
+// RFC 6455 8.1: 文本消息必须是有效的 UTF-8
+// RFC 6455 8.1: text messages must be valid UTF-8
+func TestUTF8(t *testing.T) {
+	var cases = []testCase{
+		{
+			Title:  "valid multi-byte text",
+			Frames: []frame{text(true, "κόσμε")},
+			Expect: []frame{text(true, "κόσμε")},
+		},
+		{
+			Title:  "character split between fragments",
+			Frames: []frame{text(false, "κ\xcf"), cont(false, "\x8cσ"), cont(true, "με")},
+			Expect: []frame{text(true, "κόσμε")},
+		},
+		{
+			Title:  "character split byte by byte",
+			Frames: []frame{text(false, "\xf0"), cont(false, "\x9f"), cont(false, "\x98"), cont(true, "\x80")},
+			Expect: []frame{text(true, "\U0001F600")},
+		},
+		{
+			Title:  "maximum code point",
+			Frames: []frame{text(true, "\xf4\x8f\xbf\xbf")},
+			Expect: []frame{text(true, "\xf4\x8f\xbf\xbf")},
+		},
+		{
+			Title:  "invalid text in a fragmented message",
+			Frames: []frame{text(false, "hello"), cont(false, "\xff"), cont(true, "world")},
+			Close:  invalidPayload,
+		},
+		{
+			Title:  "invalid text in the close reason",
+			Frames: []frame{closeFrame(normalClosure, "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80")},
+			Close:  invalidPayload,
+		},
+		{
+			Title:  "binary messages are not validated",
+			Frames: []frame{bin(true, []byte{0xff, 0xfe})},
+			Expect: []frame{bin(true, []byte{0xff, 0xfe})},
+		},
+	}
+
+	for title, s := range map[string]string{
+		"single invalid byte":       "\xff",
+		"unexpected continuation":   "\x80",
+		"overlong slash":            "\xc0\xaf",
+		"overlong nul":              "\xe0\x80\x80",
+		"utf-16 surrogate":          "\xed\xa0\x80",
+		"beyond maximum code point": "\xf4\x90\x80\x80",
+		"truncated at the end":      "hello\xce",
+		"invalid in the middle":     "κόσμε\xffκόσμε",
+	} {
+		cases = append(cases, testCase{
+			Title:  title,
+			Frames: []frame{text(true, s)},
+			Close:  invalidPayload,
+		})
+	}
+
+	runServerCases(t, defaultOption, cases)
+}
+
+// RFC 6455 5.5.1, 7.4: 关闭帧和状态码
+// RFC 6455 5.5.1, 7.4: close frames and status codes
+func TestClose(t *testing.T) {
+	var cases = []testCase{
+		{
+			Title:  "close without payload",
+			Frames: []frame{{Fin: true, Opcode: opClose}},
+			Close:  noStatus,
+		},
+		{
+			Title:  "close with one byte payload",
+			Frames: []frame{{Fin: true, Opcode: opClose, Payload: []byte{0x03}}},
+			Close:  protocolError,
+		},
+		{
+			Title:  "close with reason",
+			Frames: []frame{closeFrame(normalClosure, "bye")},
+			Close:  normalClosure,
+		},
+		{
+			Title:  "close with 123 bytes reason",
+			Frames: []frame{closeFrame(normalClosure, string(repeat('a', 123)))},
+			Close:  normalClosure,
+		},
+		{
+			Title:  "messages after close are ignored",
+			Frames: []frame{closeFrame(normalClosure, ""), text(true, "hello"), ping("hello")},
+			Close:  normalClosure,
+		},
+		{
+			Title:  "fragmented close",
+			Frames: []frame{{Fin: false, Opcode: opClose, Payload: []byte{0x03, 0xe8}}},
+			Close:  protocolError,
+		},
+	}
+
+	for _, code := range []uint16{1000, 1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011} {
+		cases = append(cases, testCase{
+			Title:  fmt.Sprintf("valid code %d", code),
+			Frames: []frame{closeFrame(code, "")},
+			Close:  normalClosure,
+		})
+	}
+	for _, code := range []uint16{3000, 3999, 4000, 4999} {
+		cases = append(cases, testCase{
+			Title:  fmt.Sprintf("application code %d", code),
+			Frames: []frame{closeFrame(code, "")},
+			Close:  code,
+		})
+	}
+	for _, code := range []uint16{0, 999, 1004, 1005, 1006, 1014, 1015, 1016, 1100, 2000, 2999, 5000, 65535} {
+		cases = append(cases, testCase{
+			Title:  fmt.Sprintf("invalid code %d", code),
+			Frames: []frame{closeFrame(code, "")},
+			Close:  protocolError,
+		})
+	}
+
+	runServerCases(t, defaultOption, cases)
+}
+
+// RFC 6455 5.1, 5.3: 客户端必须对帧加掩码, 服务端不能加掩码
+// RFC 6455 5.1, 5.3: clients must mask their frames, servers must not
+func TestMasking(t *testing.T) {
+	runServerCases(t, defaultOption, []testCase{
+		{
+			Title:  "unmasked text from the client",
+			Frames: []frame{{Fin: true, Opcode: opText, Payload: []byte("hello"), Unmasked: true}},
+			Close:  protocolError,
+		},
+		{
+			Title:  "unmasked ping from the client",
+			Frames: []frame{{Fin: true, Opcode: opPing, Unmasked: true}},
+			Close:  protocolError,
+		},
+		{
+			Title:  "unmasked continuation from the client",
+			Frames: []frame{text(false, "hello"), {Fin: true, Opcode: opContinuation, Payload: []byte("world"), Unmasked: true}},
+			Close:  protocolError,
+		},
+	})
+
+	var cases = []struct {
+		testCase
+		masked bool
+	}{
+		{
+			testCase: testCase{
+				Title:  "client echoes with masked frames",
+				Frames: []frame{text(true, "hello"), ping("ping")},
+				Expect: []frame{text(true, "hello"), pong("ping")},
+			},
+		},
+		{
+			testCase: testCase{
+				Title:  "masked frame from the server",
+				Frames: []frame{text(true, "hello")},
+				Close:  protocolError,
+			},
+			masked: true,
+		},
+	}
+	for _, item := range cases {
+		item := item
+		t.Run(item.Title, func(t *testing.T) {
+			p := newClientPeer(t, &gbs.ClientOption{CheckUtf8Enabled: true})
+			p.server = !item.masked
+			item.run(t, p)
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/binary"
+	"io"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -24,14 +25,39 @@ type Conn struct {
 	readQueue channel
 	config    *Config
 	// br Buffered reader
-	br                *bufio.Reader
+	br *bufio.Reader
+	// deflater Compressor, possibly shared with other connections
+	deflater *deflater
+	// cps Compressor owned by the connection in context takeover mode
+	cps               *streamDeflater
 	subprotocol       string
 	continuationFrame continuationFrame
-	writeQueue        workerQueue
-	mu                sync.Mutex
-	closed            uint32
-	fh                frameHeader
-	isServer          bool
+	// reader Streaming reader of the message being read
+	reader     io.Reader
+	writeQueue workerQueue
+	// conflated Conflating broadcasts waiting in writeQueue, by key
+	conflated conflation
+	// extensions Negotiated extensions, in the order of the response header
+	extensions     []extensionCodec
+	extensionNames []string
+	// dpsWindow Decompression dictionary
+	dpsWindow slideWindow
+	pd        PermessageDeflate
+	mu        sync.Mutex
+	// closing Closing handshake started by this side
+	closing atomic.Pointer[closeHandshake]
+	// dmu Data message lock, held by a streaming writer until the message is finished; acquire before mu
+	dmu    sync.Mutex
+	closed uint32
+	fh     frameHeader
+	// rsv Reserved bits defined by the negotiated extensions
+	rsv      RSV
+	isServer bool
+	// native Native framing mode, see ServerOption.NativeEnabled
+	native bool
+	// throttler Outgoing rate limiter, created from Config.Throttle on first use or set by SetThrottle
+	throttler     atomic.Pointer[throttler]
+	throttleStats throttleCounter
 }
 
 func (c *Conn) UpdateHandler(handler EventHandler) {
@@ -54,6 +80,10 @@ func (c *Conn) ReadLoop() {
 		}
 	}
 
+	// 读取结束, 不会再收到对端的关闭帧
+	// Reading has stopped, the peer's close frame can no longer arrive
+	c.finishClose()
+
 	err, ok := c.ev.Load().(error)
 	c.handler.OnClose(c, internal.SelectValue(ok, err, errEmpty))
 
@@ -134,6 +164,10 @@ func (c *Conn) emitClose(buf *bytes.Buffer) error {
 	}
 	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
 		_ = c.writeClose(&CloseError{Code: realCode, Reason: buf.Bytes()}, responseCode.Bytes())
+	} else {
+		// 对端回复了本端发起的关闭握手
+		// The peer answered the closing handshake started by this side
+		c.finishClose()
 	}
 	return internal.CloseNormalClosure
 }
@@ -199,6 +233,10 @@ func (c *Conn) SetNoDelay(noDelay bool) error {
 	return nil
 }
 
+// Compressed 是否协商了压缩拓展
+// Whether the compression extension has been negotiated
+func (c *Conn) Compressed() bool { return c.pd.Enabled }
+
 // SubProtocol 获取协商的子协议
 // Gets the negotiated sub-protocol
 func (c *Conn) SubProtocol() string { return c.subprotocol }
@@ -0,0 +1,683 @@
+package gbs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/catermujo/gbs/internal"
+)
+
+// 数据报模式在 UDP 之上模拟一条连接: 每次 Write 写入的若干个完整帧会被切分为多个数据报, 接收端重组后再交给 Conn 解析.
+// 任意一个分片丢失都会导致整次写入被丢弃, 所以帧边界始终保持完整; 消息可能丢失或乱序, 但不会损坏.
+// 每条消息都作为单独的一帧写入, 无论它占用多少个数据报. 分片的消息 (NextWriter) 不受支持, 写入时返回 ErrFragmented:
+// 丢失其中一帧会让剩下的帧无法解析, 对端收到分片的消息时仍然按协议错误关闭连接.
+// Datagram mode emulates a connection on top of UDP: the complete frames passed to a single Write are split into
+// datagrams, which the receiver reassembles before handing them to the Conn parser.
+// Losing any fragment drops the whole write, so frame boundaries always stay intact;
+// messages may be lost or reordered, but never corrupted.
+// Every message is written as a single frame however many datagrams it spans. Fragmented messages (NextWriter) are
+// not supported and fail with ErrFragmented: losing one of their frames would leave the rest unparsable, and a
+// fragmented message from the peer still closes the connection with a protocol error.
+const (
+	// 数据报协议版本
+	// Version of the datagram protocol
+	datagramVersion uint8 = 1
+
+	// 握手请求: type(1) version(1) nonce(8) subprotocols
+	// Handshake request: type(1) version(1) nonce(8) subprotocols
+	datagramHello uint8 = 1
+
+	// 握手响应: type(1) version(1) nonce(8) subprotocol
+	// Handshake response: type(1) version(1) nonce(8) subprotocol
+	datagramWelcome uint8 = 2
+
+	// 数据分片: type(1) id(4) index(2) count(2) payload
+	// Data fragment: type(1) id(4) index(2) count(2) payload
+	datagramData uint8 = 3
+
+	// 断开通知: type(1) version(1) nonce(8)
+	// Disconnect notice: type(1) version(1) nonce(8)
+	datagramBye uint8 = 4
+
+	datagramHandshakeSize = 10
+	datagramHeaderSize    = 9
+
+	// UDP 包的最大长度
+	// Maximum size of a UDP packet
+	datagramMaxPacketSize = 64 * 1024
+
+	// 同时重组的写入数量上限, 超出后丢弃新的写入
+	// Maximum number of writes being reassembled at once, new writes are dropped beyond it
+	datagramMaxPartials = 16
+
+	// 未完成重组的写入的过期时间
+	// Expiry time of writes whose reassembly has not completed
+	datagramReassemblyTimeout = 5 * time.Second
+
+	// 握手请求的重传间隔
+	// Retransmission interval of the handshake request
+	datagramHelloInterval = 200 * time.Millisecond
+)
+
+// 正在重组的写入
+// Write being reassembled
+type datagramPartial struct {
+	fragments [][]byte
+	received  int
+	size      int
+	created   time.Time
+}
+
+// datagramConn 在 net.PacketConn 上模拟与单个对端的 net.Conn
+// datagramConn emulates a net.Conn with a single peer on top of a net.PacketConn
+type datagramConn struct {
+	pc    net.PacketConn
+	addr  net.Addr
+	mtu   int
+	limit int
+	nonce uint64
+
+	// active 服务端最后一次收到对端数据报的时间, 单位纳秒
+	// active Time the server last received a datagram from the peer, in nanoseconds
+	active atomic.Int64
+
+	// welcome 服务端缓存的握手响应, 用于应答重传的握手请求
+	// welcome Handshake response cached by the server, used to answer retransmitted requests
+	welcome []byte
+
+	// onClose 连接关闭时的回调
+	// onClose Callback invoked when the connection is closed
+	onClose func()
+
+	// mu 保护以下读取状态
+	// mu Protects the read state below
+	mu         sync.Mutex
+	queue      [][]byte
+	queued     int
+	buf        []byte
+	partials   map[uint32]*datagramPartial
+	eof        bool
+	deadline   time.Time
+	deadlineCh chan struct{}
+	notify     chan struct{}
+
+	// wmu 保证同一次写入的分片连续发送
+	// wmu Keeps the fragments of a write together
+	wmu sync.Mutex
+	id  uint32
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newDatagramConn(pc net.PacketConn, addr net.Addr, nonce uint64, mtu int, limit int) *datagramConn {
+	c := &datagramConn{
+		pc:         pc,
+		addr:       addr,
+		mtu:        internal.Max(mtu, datagramHeaderSize+1),
+		limit:      limit,
+		nonce:      nonce,
+		onClose:    func() {},
+		partials:   make(map[uint32]*datagramPartial),
+		deadlineCh: make(chan struct{}),
+		notify:     make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+	}
+	c.active.Store(time.Now().UnixNano())
+	return c
+}
+
+// 生成握手阶段的数据报
+// Generates a datagram of the handshake stage
+func newDatagramPacket(kind uint8, nonce uint64, extra string) []byte {
+	b := make([]byte, datagramHandshakeSize, datagramHandshakeSize+len(extra))
+	b[0], b[1] = kind, datagramVersion
+	binary.BigEndian.PutUint64(b[2:], nonce)
+	return append(b, extra...)
+}
+
+// 解析握手阶段的数据报
+// Parses a datagram of the handshake stage
+func parseDatagramPacket(b []byte) (nonce uint64, extra string, ok bool) {
+	if len(b) < datagramHandshakeSize || b[1] != datagramVersion {
+		return 0, "", false
+	}
+	return binary.BigEndian.Uint64(b[2:]), string(b[datagramHandshakeSize:]), true
+}
+
+// Read 读取重组后的数据. 对端断开后, 读完剩余数据返回 io.EOF.
+// Reads reassembled data. Once the peer is gone, returns io.EOF after the remaining data.
+func (c *datagramConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.buf) == 0 && len(c.queue) > 0 {
+			c.buf = c.queue[0]
+			c.queue[0] = nil
+			c.queue = c.queue[1:]
+		}
+		if len(c.buf) > 0 {
+			n := copy(p, c.buf)
+			c.buf = c.buf[n:]
+			c.queued -= n
+			c.mu.Unlock()
+			return n, nil
+		}
+		eof, deadline, changed := c.eof, c.deadline, c.deadlineCh
+		c.mu.Unlock()
+
+		select {
+		case <-c.closed:
+			return 0, net.ErrClosed
+		default:
+		}
+		if eof {
+			return 0, io.EOF
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		var err error
+		select {
+		case <-c.notify:
+		case <-changed:
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-c.closed:
+			err = net.ErrClosed
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write 将 p 切分为不超过 MTU 的数据报发送给对端
+// Splits p into datagrams no larger than the MTU and sends them to the peer
+func (c *datagramConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	size := c.mtu - datagramHeaderSize
+	count := (len(p) + size - 1) / size
+	if count > math.MaxUint16 {
+		return 0, ErrMessageTooLarge
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.id++
+	buf := binaryPool.Get(c.mtu)
+	defer binaryPool.Put(buf)
+	packet := buf.Bytes()[:c.mtu]
+	packet[0] = datagramData
+	binary.BigEndian.PutUint32(packet[1:5], c.id)
+	binary.BigEndian.PutUint16(packet[7:9], uint16(count))
+	for i := 0; i < count; i++ {
+		chunk := p[i*size : internal.Min((i+1)*size, len(p))]
+		binary.BigEndian.PutUint16(packet[5:7], uint16(i))
+		n := copy(packet[datagramHeaderSize:], chunk)
+		if _, err := c.pc.WriteTo(packet[:datagramHeaderSize+n], c.addr); err != nil {
+			return i * size, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close 通知对端并关闭连接
+// Notifies the peer and closes the connection
+func (c *datagramConn) Close() error {
+	c.once.Do(func() {
+		_, _ = c.pc.WriteTo(newDatagramPacket(datagramBye, c.nonce, ""), c.addr)
+		close(c.closed)
+
+		c.mu.Lock()
+		c.queue, c.queued, c.buf, c.partials = nil, 0, nil, nil
+		c.mu.Unlock()
+
+		c.onClose()
+	})
+	return nil
+}
+
+func (c *datagramConn) LocalAddr() net.Addr { return c.pc.LocalAddr() }
+
+func (c *datagramConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *datagramConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *datagramConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	close(c.deadlineCh)
+	c.deadlineCh = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline UDP 写入不会阻塞, 写超时没有意义
+// UDP writes do not block, so write deadlines are meaningless
+func (c *datagramConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// 处理对端发来的数据分片和断开通知
+// Handles the data fragments and disconnect notices sent by the peer
+func (c *datagramConn) handle(b []byte) {
+	switch b[0] {
+	case datagramData:
+		if len(b) >= datagramHeaderSize {
+			c.reassemble(b)
+		}
+	case datagramBye:
+		if nonce, _, ok := parseDatagramPacket(b); ok && nonce == c.nonce {
+			c.mu.Lock()
+			c.eof = true
+			c.mu.Unlock()
+			c.wake()
+		}
+	}
+}
+
+// 重组数据分片, 完整的写入进入读队列
+// Reassembles data fragments, complete writes enter the read queue
+func (c *datagramConn) reassemble(b []byte) {
+	id := binary.BigEndian.Uint32(b[1:5])
+	index := int(binary.BigEndian.Uint16(b[5:7]))
+	count := int(binary.BigEndian.Uint16(b[7:9]))
+	payload := b[datagramHeaderSize:]
+	// 分片不会超过 MTU, 更长的分片来自异常的对端, 不能让它绕过下面按 MTU 估算的上限
+	// Fragments never exceed the MTU; longer ones come from a misbehaving peer and must not bypass the limits below,
+	// which are estimated from the MTU
+	if index >= count || len(payload) > c.mtu-datagramHeaderSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.partials == nil {
+		return
+	}
+	if count == 1 {
+		c.push(append([]byte(nil), payload...))
+		return
+	}
+
+	now := time.Now()
+	for k, v := range c.partials {
+		if now.Sub(v.created) > datagramReassemblyTimeout {
+			delete(c.partials, k)
+		}
+	}
+
+	p := c.partials[id]
+	if p == nil {
+		if count*(c.mtu-datagramHeaderSize) > c.limit+c.mtu || len(c.partials) >= datagramMaxPartials {
+			return
+		}
+		p = &datagramPartial{fragments: make([][]byte, count), created: now}
+		c.partials[id] = p
+	}
+	if len(p.fragments) != count || p.fragments[index] != nil {
+		return
+	}
+	// 超过上限的写入无论如何都会被 push 丢弃, 尽早释放已经缓存的分片
+	// A write over the limit would be dropped by push anyway, so the buffered fragments are released early
+	if p.size+len(payload) > c.limit {
+		delete(c.partials, id)
+		return
+	}
+	p.fragments[index] = append([]byte(nil), payload...)
+	p.received++
+	p.size += len(payload)
+	if p.received < count {
+		return
+	}
+
+	delete(c.partials, id)
+	data := make([]byte, 0, p.size)
+	for _, fragment := range p.fragments {
+		data = append(data, fragment...)
+	}
+	c.push(data)
+}
+
+// 加入读队列, 待读取的数据超过上限时丢弃
+// Appends to the read queue, dropped when too much data is waiting to be read
+func (c *datagramConn) push(data []byte) {
+	if c.queued+len(data) > c.limit {
+		return
+	}
+	c.queue = append(c.queue, data)
+	c.queued += len(data)
+	c.wake()
+}
+
+func (c *datagramConn) wake() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// DatagramServer 基于 UDP 的数据报服务器
+// 每个对端地址对应一个 Conn, 通过轻量的握手建立, 事件回调与 Server 相同.
+// 数据报模式不支持 Authorize, ResponseHeader, PermessageDeflate, Extensions 和分片的消息 (NextWriter).
+// Datagram server on top of UDP.
+// Each peer address gets its own Conn, established by a lightweight handshake, with the same callbacks as Server.
+// Authorize, ResponseHeader, PermessageDeflate, Extensions and fragmented messages (NextWriter)
+// are not supported in datagram mode.
+type DatagramServer struct {
+	option       *ServerOption
+	eventHandler EventHandler
+
+	mu    sync.Mutex
+	peers map[string]*datagramConn
+
+	// 错误处理回调函数
+	// Error handling callback function
+	OnError func(addr net.Addr, err error)
+}
+
+// NewDatagramServer 创建一个新的数据报服务器实例
+// Creates a new datagram server instance
+func NewDatagramServer(eventHandler EventHandler, option *ServerOption) *DatagramServer {
+	c := &DatagramServer{
+		option:       initServerOption(option),
+		eventHandler: eventHandler,
+		peers:        make(map[string]*datagramConn),
+	}
+	c.OnError = func(addr net.Addr, err error) { c.option.Logger.Error("gbs: " + err.Error()) }
+	return c
+}
+
+// Run 启动数据报服务器, 监听指定的 UDP 地址
+// Starts the datagram server and listens on the specified UDP address
+func (c *DatagramServer) Run(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return c.RunPacketConn(pc)
+}
+
+// RunPacketConn 使用指定的 PacketConn 运行数据报服务器, PacketConn 关闭后返回并断开所有连接
+// Runs the datagram server on the specified PacketConn, returns and drops every connection once it is closed
+func (c *DatagramServer) RunPacketConn(pc net.PacketConn) error {
+	done := make(chan struct{})
+	go c.sweep(done)
+	defer func() {
+		close(done)
+		_ = pc.Close()
+		c.mu.Lock()
+		peers := make([]*datagramConn, 0, len(c.peers))
+		for _, peer := range c.peers {
+			peers = append(peers, peer)
+		}
+		c.mu.Unlock()
+		for _, peer := range peers {
+			_ = peer.Close()
+		}
+	}()
+
+	buf := make([]byte, datagramMaxPacketSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			c.OnError(addr, err)
+			continue
+		}
+		if n > 0 {
+			c.serve(pc, addr, buf[:n])
+		}
+	}
+}
+
+// 定期断开超过 DatagramIdleTimeout 没有发来数据报的对端, 它们的读协程随之退出并归还读缓冲
+// Periodically drops the peers that sent no datagram for DatagramIdleTimeout;
+// their read goroutines exit and return their read buffers
+func (c *DatagramServer) sweep(done <-chan struct{}) {
+	ticker := time.NewTicker(c.option.DatagramIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			deadline := now.Add(-c.option.DatagramIdleTimeout).UnixNano()
+			var idle []*datagramConn
+			c.mu.Lock()
+			for _, peer := range c.peers {
+				if peer.active.Load() < deadline {
+					idle = append(idle, peer)
+				}
+			}
+			c.mu.Unlock()
+			for _, peer := range idle {
+				_ = peer.Close()
+			}
+		}
+	}
+}
+
+// 将数据报分发给对应的连接, 或者处理握手请求
+// Dispatches a datagram to its connection, or handles a handshake request
+func (c *DatagramServer) serve(pc net.PacketConn, addr net.Addr, b []byte) {
+	key := addr.String()
+	c.mu.Lock()
+	peer := c.peers[key]
+	c.mu.Unlock()
+	if peer != nil {
+		peer.active.Store(time.Now().UnixNano())
+	}
+
+	if b[0] != datagramHello {
+		if peer != nil {
+			peer.handle(b)
+		}
+		return
+	}
+
+	nonce, subprotocols, ok := parseDatagramPacket(b)
+	if !ok {
+		return
+	}
+	if peer != nil {
+		// 重传的握手请求, 说明握手响应丢失了
+		// A retransmitted request means the response was lost
+		if peer.nonce == nonce {
+			_, _ = pc.WriteTo(peer.welcome, addr)
+			return
+		}
+		// 对端使用新的握手重新连接
+		// The peer reconnects with a new handshake
+		_ = peer.Close()
+	}
+
+	// 握手请求没有认证, 来源地址也可能是伪造的, 对端数量必须有上限
+	// Handshake requests are unauthenticated and their source addresses may be spoofed, so the peers are capped
+	c.mu.Lock()
+	full := len(c.peers) >= c.option.DatagramMaxPeers
+	c.mu.Unlock()
+	if full {
+		return
+	}
+
+	subprotocol := internal.GetIntersectionElem(c.option.SubProtocols, internal.Split(subprotocols, ","))
+	peer = newDatagramConn(pc, addr, nonce, c.option.DatagramMTU, c.option.ReadMaxPayloadSize)
+	peer.welcome = newDatagramPacket(datagramWelcome, nonce, subprotocol)
+	peer.onClose = func() {
+		c.mu.Lock()
+		if c.peers[key] == peer {
+			delete(c.peers, key)
+		}
+		c.mu.Unlock()
+	}
+	c.mu.Lock()
+	c.peers[key] = peer
+	c.mu.Unlock()
+
+	if _, err := pc.WriteTo(peer.welcome, addr); err != nil {
+		c.OnError(addr, err)
+	}
+
+	config := c.option.getConfig()
+	br := config.brPool.Get()
+	br.Reset(peer)
+	socket := &Conn{
+		ss:                c.option.NewSession(),
+		isServer:          true,
+		subprotocol:       subprotocol,
+		conn:              peer,
+		config:            config,
+		br:                br,
+		continuationFrame: continuationFrame{},
+		fh:                frameHeader{},
+		handler:           c.eventHandler,
+		closed:            0,
+		writeQueue:        workerQueue{maxConcurrency: 1},
+		readQueue:         make(channel, c.option.ParallelGolimit),
+	}
+	go socket.ReadLoop()
+}
+
+// NewDatagramClient 创建一个新的数据报客户端连接, 地址格式为 ws+udp://host:port
+// Creates a new datagram client connection, the address looks like ws+udp://host:port
+func NewDatagramClient(handler EventHandler, option *ClientOption) (*Conn, error) {
+	option = initClientOption(option)
+	URL, err := url.Parse(option.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if URL.Scheme != "ws+udp" {
+		return nil, ErrUnsupportedProtocol
+	}
+	addr, err := net.ResolveUDPAddr("udp", URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewDatagramClientFromConn(handler, option, pc, addr)
+}
+
+// NewDatagramClientFromConn 通过 PacketConn 创建数据报客户端, 连接关闭时 PacketConn 也会被关闭
+// Creates a datagram client via a PacketConn, which is closed together with the connection
+func NewDatagramClientFromConn(handler EventHandler, option *ClientOption, pc net.PacketConn, addr net.Addr) (*Conn, error) {
+	option = initClientOption(option)
+	conn := newDatagramConn(pc, addr, internal.AlphabetNumeric.Uint64(), option.DatagramMTU, option.ReadMaxPayloadSize)
+	conn.onClose = func() { _ = pc.Close() }
+
+	welcome := make(chan string, 1)
+	go conn.receive(welcome)
+
+	subprotocol, err := conn.handshake(welcome, option)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	a := internal.Split(option.RequestHeader.Get(internal.SecWebSocketProtocol.Key), ",")
+	if len(a) > 0 && subprotocol == "" {
+		_ = conn.Close()
+		return nil, ErrSubprotocolNegotiation
+	}
+
+	socket := &Conn{
+		ss:                option.NewSession(),
+		isServer:          false,
+		subprotocol:       subprotocol,
+		conn:              conn,
+		config:            option.getConfig(),
+		br:                bufio.NewReaderSize(conn, option.ReadBufferSize),
+		continuationFrame: continuationFrame{},
+		fh:                frameHeader{},
+		handler:           handler,
+		closed:            0,
+		writeQueue:        workerQueue{maxConcurrency: 1},
+		readQueue:         make(channel, option.ParallelGolimit),
+	}
+	return socket, nil
+}
+
+// 发送握手请求, 直到收到响应或者超时
+// Sends the handshake request until the response arrives or the timeout expires
+func (c *datagramConn) handshake(welcome <-chan string, option *ClientOption) (string, error) {
+	hello := newDatagramPacket(datagramHello, c.nonce, option.RequestHeader.Get(internal.SecWebSocketProtocol.Key))
+	ticker := time.NewTicker(datagramHelloInterval)
+	defer ticker.Stop()
+	timer := time.NewTimer(option.HandshakeTimeout)
+	defer timer.Stop()
+
+	for {
+		if _, err := c.pc.WriteTo(hello, c.addr); err != nil {
+			return "", err
+		}
+		select {
+		case subprotocol := <-welcome:
+			return subprotocol, nil
+		case <-ticker.C:
+		case <-timer.C:
+			return "", ErrHandshake
+		}
+	}
+}
+
+// 客户端接收循环, 只处理来自服务端地址的数据报
+// Receive loop of the client, only handles datagrams from the server address
+func (c *datagramConn) receive(welcome chan<- string) {
+	buf := make([]byte, datagramMaxPacketSize)
+	for {
+		n, addr, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			c.mu.Lock()
+			c.eof = true
+			c.mu.Unlock()
+			c.wake()
+			return
+		}
+		if n == 0 || addr.String() != c.addr.String() {
+			continue
+		}
+		if buf[0] != datagramWelcome {
+			c.handle(buf[:n])
+			continue
+		}
+		if nonce, subprotocol, ok := parseDatagramPacket(buf[:n]); ok && nonce == c.nonce {
+			select {
+			case welcome <- subprotocol:
+			default:
+			}
+		}
+	}
+}
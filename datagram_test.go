@@ -0,0 +1,293 @@
+package gbs
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+// 启动本地数据报服务器, 返回其地址
+// Starts a local datagram server and returns its address
+func newDatagramServer(t *testing.T, handler EventHandler, option *ServerOption) (*DatagramServer, net.PacketConn) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewDatagramServer(handler, option)
+	go func() { _ = server.RunPacketConn(pc) }()
+	t.Cleanup(func() { _ = pc.Close() })
+	return server, pc
+}
+
+func newDatagramFragment(id uint32, index, count int, payload string) []byte {
+	b := make([]byte, datagramHeaderSize, datagramHeaderSize+len(payload))
+	b[0] = datagramData
+	binary.BigEndian.PutUint32(b[1:5], id)
+	binary.BigEndian.PutUint16(b[5:7], uint16(index))
+	binary.BigEndian.PutUint16(b[7:9], uint16(count))
+	return append(b, payload...)
+}
+
+func TestDatagram(t *testing.T) {
+	as := assert.New(t)
+	serverHandler := new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+		_ = message.Close()
+	}
+	_, pc := newDatagramServer(t, serverHandler, &ServerOption{SubProtocols: []string{"chat"}, DatagramMTU: 512})
+
+	var messages = make(chan string, 8)
+	clientHandler := new(webSocketMocker)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		messages <- message.Data.String()
+	}
+	client, err := NewDatagramClient(clientHandler, &ClientOption{
+		Addr:          "ws+udp://" + pc.LocalAddr().String(),
+		RequestHeader: http.Header{"Sec-Websocket-Protocol": {"chat"}},
+		DatagramMTU:   512,
+	})
+	if !as.NoError(err) {
+		return
+	}
+	as.Equal("chat", client.SubProtocol())
+	as.Equal(pc.LocalAddr().String(), client.RemoteAddr().String())
+	go client.ReadLoop()
+
+	for _, n := range []int{0, 10, 503, 504, 4096, 64 * 1024} {
+		payload := string(internal.AlphabetNumeric.Generate(n))
+		as.NoError(client.WriteString(payload))
+		select {
+		case s := <-messages:
+			as.Equal(payload, s)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout waiting for %d bytes", n)
+		}
+	}
+
+	// 分片的消息不受支持, 连接不受影响
+	// Fragmented messages are not supported, the connection is not affected
+	w := client.NextWriter(OpcodeText)
+	_, err = w.Write([]byte("hello"))
+	as.ErrorIs(err, ErrFragmented)
+	as.ErrorIs(w.Close(), ErrFragmented)
+	as.False(client.IsClosed())
+	as.NoError(client.WriteString("world"))
+	select {
+	case s := <-messages:
+		as.Equal("world", s)
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout")
+	}
+	_ = client.WriteClose(1000, nil)
+}
+
+func TestDatagram_Close(t *testing.T) {
+	as := assert.New(t)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	serverHandler := new(webSocketMocker)
+	serverHandler.onClose = func(socket *Conn, err error) {
+		as.Equal(uint16(1000), err.(*CloseError).Code)
+		wg.Done()
+	}
+	server, pc := newDatagramServer(t, serverHandler, nil)
+
+	client, err := NewDatagramClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws+udp://" + pc.LocalAddr().String()})
+	if !as.NoError(err) {
+		return
+	}
+	go client.ReadLoop()
+	client.WriteClose(1000, nil)
+	wg.Wait()
+
+	time.Sleep(50 * time.Millisecond)
+	server.mu.Lock()
+	as.Empty(server.peers)
+	server.mu.Unlock()
+}
+
+func TestDatagramServer_Peers(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("max peers", func(t *testing.T) {
+		_, pc := newDatagramServer(t, new(BuiltinEventHandler), &ServerOption{DatagramMaxPeers: 1})
+		option := &ClientOption{Addr: "ws+udp://" + pc.LocalAddr().String(), HandshakeTimeout: 300 * time.Millisecond}
+		client, err := NewDatagramClient(new(BuiltinEventHandler), option)
+		if !as.NoError(err) {
+			return
+		}
+		defer client.NetConn().Close()
+		_, err = NewDatagramClient(new(BuiltinEventHandler), option)
+		as.ErrorIs(err, ErrHandshake)
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		wg := &sync.WaitGroup{}
+		wg.Add(2)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) { wg.Done() }
+		server, pc := newDatagramServer(t, serverHandler, &ServerOption{DatagramIdleTimeout: 100 * time.Millisecond})
+
+		clientHandler := new(webSocketMocker)
+		clientHandler.onClose = func(socket *Conn, err error) { wg.Done() }
+		client, err := NewDatagramClient(clientHandler, &ClientOption{Addr: "ws+udp://" + pc.LocalAddr().String()})
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+		wg.Wait()
+
+		server.mu.Lock()
+		as.Empty(server.peers)
+		server.mu.Unlock()
+	})
+}
+
+func TestDatagram_Handshake(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("timeout", func(t *testing.T) {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		_, err = NewDatagramClient(new(BuiltinEventHandler), &ClientOption{
+			Addr:             "ws+udp://" + pc.LocalAddr().String(),
+			HandshakeTimeout: 300 * time.Millisecond,
+		})
+		as.ErrorIs(err, ErrHandshake)
+	})
+
+	t.Run("subprotocol", func(t *testing.T) {
+		_, pc := newDatagramServer(t, new(BuiltinEventHandler), &ServerOption{SubProtocols: []string{"chat"}})
+		_, err := NewDatagramClient(new(BuiltinEventHandler), &ClientOption{
+			Addr:          "ws+udp://" + pc.LocalAddr().String(),
+			RequestHeader: http.Header{"Sec-Websocket-Protocol": {"json"}},
+		})
+		as.ErrorIs(err, ErrSubprotocolNegotiation)
+	})
+
+	t.Run("retransmitted hello", func(t *testing.T) {
+		server, pc := newDatagramServer(t, new(BuiltinEventHandler), nil)
+		client, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		buf := make([]byte, 64)
+		for i := 0; i < 2; i++ {
+			_, _ = client.WriteTo(newDatagramPacket(datagramHello, 1, ""), pc.LocalAddr())
+			_ = client.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := client.ReadFrom(buf)
+			if !as.NoError(err) {
+				return
+			}
+			nonce, _, ok := parseDatagramPacket(buf[:n])
+			as.True(ok)
+			as.Equal(datagramWelcome, buf[0])
+			as.Equal(uint64(1), nonce)
+		}
+		server.mu.Lock()
+		as.Equal(1, len(server.peers))
+		server.mu.Unlock()
+	})
+
+	t.Run("unsupported protocol", func(t *testing.T) {
+		_, err := NewDatagramClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://127.0.0.1:0"})
+		as.ErrorIs(err, ErrUnsupportedProtocol)
+	})
+}
+
+func TestDatagramConn_Reassemble(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("out of order", func(t *testing.T) {
+		conn := newDatagramConn(nil, nil, 1, 16, 1024)
+		conn.handle(newDatagramFragment(1, 2, 3, "!"))
+		conn.handle(newDatagramFragment(2, 0, 1, "single"))
+		conn.handle(newDatagramFragment(1, 0, 3, "hello, "))
+		conn.handle(newDatagramFragment(1, 0, 3, "hello, "))
+		conn.handle(newDatagramFragment(1, 1, 3, "world"))
+
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		as.NoError(err)
+		as.Equal("single", string(buf[:n]))
+		n, err = conn.Read(buf)
+		as.NoError(err)
+		as.Equal("hello, world!", string(buf[:n]))
+		as.Empty(conn.partials)
+	})
+
+	t.Run("incomplete", func(t *testing.T) {
+		conn := newDatagramConn(nil, nil, 1, 16, 1024)
+		conn.handle(newDatagramFragment(1, 0, 2, "hello"))
+		conn.handle(newDatagramFragment(1, 3, 2, "world"))
+		_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 64))
+		as.ErrorIs(err, os.ErrDeadlineExceeded)
+		as.Equal(1, len(conn.partials))
+
+		conn.partials[1].created = time.Now().Add(-2 * datagramReassemblyTimeout)
+		conn.handle(newDatagramFragment(1, 1, 2, "world"))
+		as.Equal(1, len(conn.partials))
+		as.Equal(1, conn.partials[1].received)
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		conn := newDatagramConn(nil, nil, 1, 16, 32)
+		conn.handle(newDatagramFragment(1, 0, 100, "hello"))
+		as.Empty(conn.partials)
+
+		for i := 0; i < datagramMaxPartials+1; i++ {
+			conn.handle(newDatagramFragment(uint32(i), 0, 2, "hello"))
+		}
+		as.Equal(datagramMaxPartials, len(conn.partials))
+
+		conn.handle(newDatagramFragment(100, 0, 1, string(internal.AlphabetNumeric.Generate(30))))
+		conn.handle(newDatagramFragment(101, 0, 1, "hello"))
+		as.Equal(1, len(conn.queue))
+
+		// 超过 MTU 的分片被丢弃
+		// Fragments longer than the MTU are dropped
+		conn = newDatagramConn(nil, nil, 1, 16, 32)
+		conn.handle(newDatagramFragment(1, 0, 2, string(internal.AlphabetNumeric.Generate(8))))
+		as.Empty(conn.partials)
+
+		// 累计超过上限的写入整体被丢弃
+		// A write whose fragments add up to more than the limit is dropped as a whole
+		conn.handle(newDatagramFragment(2, 0, 5, "1234567"))
+		conn.handle(newDatagramFragment(2, 1, 5, "1234567"))
+		conn.handle(newDatagramFragment(2, 2, 5, "1234567"))
+		conn.handle(newDatagramFragment(2, 3, 5, "1234567"))
+		as.Equal(1, len(conn.partials))
+		conn.handle(newDatagramFragment(2, 4, 5, "1234567"))
+		as.Empty(conn.partials)
+		as.Empty(conn.queue)
+	})
+
+	t.Run("bye", func(t *testing.T) {
+		conn := newDatagramConn(nil, nil, 1, 16, 1024)
+		conn.handle(newDatagramFragment(1, 0, 1, "hello"))
+		conn.handle(newDatagramPacket(datagramBye, 2, ""))
+		conn.handle(newDatagramPacket(datagramBye, 1, ""))
+
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		as.NoError(err)
+		as.Equal("hello", string(buf[:n]))
+		_, err = conn.Read(buf)
+		as.ErrorIs(err, io.EOF)
+	})
+}
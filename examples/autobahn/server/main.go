@@ -21,12 +21,20 @@ func main() {
 	s3 := gbs.NewServer(&Handler{Sync: true}, &gbs.ServerOption{
 		CheckUtf8Enabled: true,
 		Recovery:         gbs.Recovery,
+		PermessageDeflate: gbs.PermessageDeflate{
+			Enabled:               true,
+			ServerContextTakeover: true,
+			ClientContextTakeover: true,
+		},
 	})
 
 	s4 := gbs.NewServer(&Handler{Sync: false}, &gbs.ServerOption{
 		ParallelEnabled:  true,
 		CheckUtf8Enabled: true,
 		Recovery:         gbs.Recovery,
+		PermessageDeflate: gbs.PermessageDeflate{
+			Enabled: true,
+		},
 	})
 
 	go func() {
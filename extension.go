@@ -0,0 +1,313 @@
+package gbs
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/catermujo/gbs/internal"
+)
+
+// RSV 帧头中的保留位
+// Reserved bits of the frame header
+type RSV uint8
+
+const (
+	RSV1 RSV = 0x40 // permessage-deflate
+	RSV2 RSV = 0x20
+	RSV3 RSV = 0x10
+
+	rsvMask = RSV1 | RSV2 | RSV3
+)
+
+var (
+	// ErrExtensionNegotiation 拓展协商失败
+	// Extension negotiation failed
+	ErrExtensionNegotiation = errors.New("extension negotiation failed")
+
+	// ErrDiscardMessage 由 ExtensionCodec.Decode 返回, 表示丢弃这条消息, 不触发 OnMessage, 连接不受影响
+	// Returned by ExtensionCodec.Decode to discard the message without calling OnMessage; the connection is not affected
+	ErrDiscardMessage = errors.New("discard message")
+)
+
+type (
+	// Extension 通过 Sec-WebSocket-Extensions 协商的拓展
+	// 拓展作用于整条消息: 发送时变换负载并设置保留位, 接收时根据第一帧的保留位还原负载.
+	// 如果同时开启了 permessage-deflate, 拓展处理的是未压缩的数据.
+	// An extension negotiated through Sec-WebSocket-Extensions.
+	// Extensions work on whole messages: they transform the outgoing payload and set reserved bits,
+	// and restore the incoming payload according to the reserved bits of the first frame.
+	// If permessage-deflate is negotiated too, extensions see uncompressed data.
+	Extension interface {
+		// Name 拓展名称, 例如 x-checksum
+		// Extension token, e.g. x-checksum
+		Name() string
+
+		// RSV 拓展占用的保留位, 不能与其它已协商的拓展冲突
+		// Reserved bits claimed by the extension, must not overlap with other negotiated extensions
+		RSV() RSV
+
+		// Offer 客户端在请求头中提议的参数, 例如 "alg=crc32"
+		// Parameters offered by the client in the request header, e.g. "alg=crc32"
+		Offer() string
+
+		// Accept 服务端根据客户端的参数创建连接独享的编解码器, 并返回响应参数.
+		// 返回错误表示拒绝该提议, 连接仍然会建立.
+		// Server side. Creates a per-connection codec from the client's parameters and returns the response parameters.
+		// Returning an error declines the offer; the connection is still established.
+		Accept(params string) (codec ExtensionCodec, response string, err error)
+
+		// Confirm 客户端根据服务端的响应参数创建连接独享的编解码器.
+		// 返回错误会导致握手失败.
+		// Client side. Creates a per-connection codec from the server's response parameters.
+		// Returning an error fails the handshake.
+		Confirm(params string) (ExtensionCodec, error)
+	}
+
+	// ExtensionCodec 连接独享的拓展编解码器, 读写分别在各自的协程中串行调用
+	// Per-connection extension codec. Encode and Decode are each called serially, from the writer and the reader respectively.
+	ExtensionCodec interface {
+		// Encode 变换待发送的数据消息, 返回新的负载以及是否设置拓展的保留位. 不要原地修改 payload, 它属于调用者.
+		// Transforms an outgoing data message, returns the new payload and whether to set the extension's reserved bits.
+		// Do not modify payload in place, it belongs to the caller.
+		Encode(opcode Opcode, payload []byte) (result []byte, rsv bool, err error)
+
+		// Decode 还原收到的数据消息, rsv 表示第一帧是否设置了拓展的保留位. 返回 ErrDiscardMessage 时丢弃这条消息.
+		// Restores an incoming data message, rsv reports whether the first frame had the extension's reserved bits set.
+		// Returning ErrDiscardMessage discards the message.
+		Decode(opcode Opcode, rsv bool, payload []byte) ([]byte, error)
+	}
+
+	// ExtensionBinder 编解码器可以实现的接口. 连接创建之后, 开始读写之前调用 Bind, 例如用于在解码时触发连接相关的回调.
+	// 服务端在握手响应发出之后才调用 Bind, 失败的握手不会调用.
+	// Bind 返回错误时连接以 1001 关闭, 之后的 Bind 不再调用; 连接仍然交给应用, OnOpen 之后 OnClose 收到这个错误.
+	// An interface codecs may implement. Bind is called once the connection is created and before any read or write,
+	// e.g. to raise connection-specific callbacks while decoding.
+	// On the server side Bind is only called once the handshake response is written, never for a failed handshake.
+	// When Bind returns an error the connection is closed with 1001 and no further Bind is called;
+	// the connection is still handed to the application, and OnClose receives the error right after OnOpen.
+	ExtensionBinder interface {
+		Bind(socket *Conn) error
+	}
+
+	// SessionRestorer 编解码器可以实现的接口, 用于恢复断线之前的会话. 在 Bind 之前调用,
+	// 返回非 nil 时连接改用它作为 SessionStorage, 握手期间 (例如 Authorize 中) 写入的键值会合并进去.
+	// An interface codecs may implement to restore the session from before a disconnect. It is called before Bind;
+	// when it returns a non-nil storage the connection uses it as its SessionStorage,
+	// and the entries stored during the handshake (e.g. in Authorize) are merged into it.
+	SessionRestorer interface {
+		RestoreSession() SessionStorage
+	}
+
+	// 已协商的拓展
+	// Negotiated extension
+	extensionCodec struct {
+		codec ExtensionCodec
+		rsv   RSV
+	}
+)
+
+// 协商结果, 按照响应头中的顺序排列
+// Negotiation result, in the order of the response header
+type extensionList struct {
+	codecs   []extensionCodec
+	names    []string
+	response []string
+	rsv      RSV
+}
+
+// 追加一个拓展
+// Appends an extension
+func (c *extensionList) add(name string, rsv RSV, codec ExtensionCodec, params string) {
+	c.codecs = append(c.codecs, extensionCodec{codec: codec, rsv: rsv})
+	c.names = append(c.names, name)
+	c.response = append(c.response, joinExtension(name, params))
+	c.rsv |= rsv
+}
+
+// 拼接拓展名称和参数
+// Joins an extension token and its parameters
+func joinExtension(name, params string) string {
+	if params = strings.TrimSpace(params); params == "" {
+		return name
+	}
+	return name + "; " + params
+}
+
+// 解析 Sec-WebSocket-Extensions, 返回每个拓展的名称和参数
+// Parses Sec-WebSocket-Extensions into extension tokens and their parameters
+func parseExtensions(header string) (names, params []string) {
+	for _, item := range internal.Split(header, ",") {
+		name, param, _ := strings.Cut(item, ";")
+		names = append(names, strings.TrimSpace(name))
+		params = append(params, strings.TrimSpace(param))
+	}
+	return names, params
+}
+
+// 查找指定名称的拓展
+// Finds the extension with the given name
+func findExtension(extensions []Extension, name string) Extension {
+	for _, item := range extensions {
+		if item.Name() == name {
+			return item
+		}
+	}
+	return nil
+}
+
+// 服务端协商拓展, used 是已经被占用的保留位
+// Server side negotiation, used holds the reserved bits already taken
+func acceptExtensions(extensions []Extension, header string, used RSV) *extensionList {
+	list := &extensionList{}
+	if len(extensions) == 0 {
+		return list
+	}
+	names, params := parseExtensions(header)
+	for i, name := range names {
+		ext := findExtension(extensions, name)
+		if ext == nil || internal.InCollection(name, list.names) {
+			continue
+		}
+		rsv := ext.RSV() & rsvMask
+		if rsv&(used|list.rsv) != 0 {
+			continue
+		}
+		codec, response, err := ext.Accept(params[i])
+		if err != nil || codec == nil {
+			continue
+		}
+		list.add(name, rsv, codec, response)
+	}
+	return list
+}
+
+// 客户端生成拓展提议
+// Client side offers
+func offerExtensions(extensions []Extension) []string {
+	offers := make([]string, 0, len(extensions))
+	for _, item := range extensions {
+		offers = append(offers, joinExtension(item.Name(), item.Offer()))
+	}
+	return offers
+}
+
+// 客户端确认服务端的响应, skip 是内置拓展的名称
+// Client side confirmation of the server's response, skip is the name of a built-in extension
+func confirmExtensions(extensions []Extension, header string, used RSV, skip string) (*extensionList, error) {
+	list := &extensionList{}
+	names, params := parseExtensions(header)
+	for i, name := range names {
+		if name == skip {
+			continue
+		}
+		ext := findExtension(extensions, name)
+		if ext == nil || internal.InCollection(name, list.names) {
+			return nil, ErrExtensionNegotiation
+		}
+		rsv := ext.RSV() & rsvMask
+		if rsv&(used|list.rsv) != 0 {
+			return nil, ErrExtensionNegotiation
+		}
+		codec, err := ext.Confirm(params[i])
+		if err != nil {
+			return nil, err
+		}
+		if codec == nil {
+			return nil, ErrExtensionNegotiation
+		}
+		list.add(name, rsv, codec, params[i])
+	}
+	return list, nil
+}
+
+// 根据协商结果设置连接的拓展
+// Sets up the extensions of the connection from the negotiation result
+func (c *Conn) initExtensions(list *extensionList) {
+	c.extensions = list.codecs
+	c.extensionNames = list.names
+	c.rsv |= list.rsv
+	for _, item := range list.codecs {
+		restorer, ok := item.codec.(SessionRestorer)
+		if !ok {
+			continue
+		}
+		if ss := restorer.RestoreSession(); ss != nil {
+			c.ss.Range(func(key string, value any) bool {
+				ss.Store(key, value)
+				return true
+			})
+			c.ss = ss
+		}
+	}
+	for _, item := range list.codecs {
+		if binder, ok := item.codec.(ExtensionBinder); ok {
+			if err := binder.Bind(c); err != nil {
+				c.emitError(false, err)
+				return
+			}
+		}
+	}
+}
+
+// Extensions 返回协商成功的拓展名称, 不包括 permessage-deflate
+// Returns the names of the negotiated extensions, not including permessage-deflate
+func (c *Conn) Extensions() []string { return c.extensionNames }
+
+// 依次执行拓展的编码, 返回变换后的负载和需要设置的保留位
+// Runs the extension encoders in order, returns the transformed payload and the reserved bits to set
+func (c *Conn) encodeExtensions(opcode Opcode, payload internal.Payload) (internal.Payload, RSV, error) {
+	var p []byte
+	switch v := payload.(type) {
+	case internal.Bytes:
+		p = v
+	default:
+		buf := bytes.NewBuffer(make([]byte, 0, payload.Len()))
+		_, _ = payload.WriteTo(buf)
+		p = buf.Bytes()
+	}
+
+	var rsv RSV
+	for _, item := range c.extensions {
+		result, set, err := item.codec.Encode(opcode, p)
+		if err != nil {
+			return nil, 0, err
+		}
+		p = result
+		if set {
+			rsv |= item.rsv
+		}
+	}
+	return internal.Bytes(p), rsv, nil
+}
+
+// 逆序执行拓展的解码
+// Runs the extension decoders in reverse order
+func (c *Conn) decodeExtensions(msg *Message, rsv RSV) (*Message, error) {
+	p := msg.Bytes()
+	for i := len(c.extensions) - 1; i >= 0; i-- {
+		item := c.extensions[i]
+		result, err := item.codec.Decode(msg.Opcode, rsv&item.rsv != 0, p)
+		if errors.Is(err, ErrDiscardMessage) {
+			_ = msg.Close()
+			return nil, nil
+		}
+		if err != nil {
+			_ = msg.Close()
+			return nil, internal.NewError(internal.CloseProtocolError, err)
+		}
+		p = result
+	}
+
+	// 结果是原负载的前缀时直接截断, 否则拷贝到新的缓冲区
+	// Truncate in place when the result is a prefix of the original payload, otherwise copy into a new buffer
+	if b := msg.Bytes(); len(p) == 0 || (len(p) <= len(b) && &p[0] == &b[0]) {
+		msg.Data.Truncate(len(p))
+		return msg, nil
+	}
+	buf := binaryPool.Get(len(p))
+	buf.Write(p)
+	_ = msg.Close()
+	msg.Data = buf
+	return msg, nil
+}
@@ -0,0 +1,452 @@
+package gbs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/catermujo/gbs/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+// 在消息尾部追加 CRC32 校验和的拓展
+// Extension that appends a CRC32 checksum to every message
+type checksumExtension struct {
+	rsv      RSV
+	declined bool
+}
+
+func (c *checksumExtension) Name() string { return "x-checksum" }
+
+func (c *checksumExtension) RSV() RSV { return internal.SelectValue(c.rsv == 0, RSV2, c.rsv) }
+
+func (c *checksumExtension) Offer() string { return "alg=crc32" }
+
+func (c *checksumExtension) Accept(params string) (ExtensionCodec, string, error) {
+	if c.declined || params != "alg=crc32" {
+		return nil, "", errors.New("declined")
+	}
+	return new(checksumCodec), "alg=crc32", nil
+}
+
+func (c *checksumExtension) Confirm(params string) (ExtensionCodec, error) {
+	if params != "alg=crc32" {
+		return nil, errors.New("unexpected params")
+	}
+	return new(checksumCodec), nil
+}
+
+type checksumCodec struct{}
+
+func (c *checksumCodec) Encode(opcode Opcode, payload []byte) ([]byte, bool, error) {
+	p := make([]byte, len(payload), len(payload)+4)
+	copy(p, payload)
+	return binary.BigEndian.AppendUint32(p, crc32.ChecksumIEEE(payload)), true, nil
+}
+
+func (c *checksumCodec) Decode(opcode Opcode, rsv bool, payload []byte) ([]byte, error) {
+	if !rsv {
+		return payload, nil
+	}
+	n := len(payload) - 4
+	if n < 0 || crc32.ChecksumIEEE(payload[:n]) != binary.BigEndian.Uint32(payload[n:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload[:n], nil
+}
+
+// 在消息头部添加标签的拓展
+// Extension that prepends a tag to every message
+type tagExtension struct{}
+
+func (c tagExtension) Name() string { return "x-tag" }
+
+func (c tagExtension) RSV() RSV { return RSV3 }
+
+func (c tagExtension) Offer() string { return "" }
+
+func (c tagExtension) Accept(params string) (ExtensionCodec, string, error) {
+	return tagCodec{}, "", nil
+}
+
+func (c tagExtension) Confirm(params string) (ExtensionCodec, error) { return tagCodec{}, nil }
+
+type tagCodec struct{}
+
+func (c tagCodec) Encode(opcode Opcode, payload []byte) ([]byte, bool, error) {
+	return append([]byte("tag:"), payload...), true, nil
+}
+
+func (c tagCodec) Decode(opcode Opcode, rsv bool, payload []byte) ([]byte, error) {
+	if !rsv || !bytes.HasPrefix(payload, []byte("tag:")) {
+		return nil, errors.New("missing tag")
+	}
+	return payload[4:], nil
+}
+
+func TestParseExtensions(t *testing.T) {
+	as := assert.New(t)
+	names, params := parseExtensions("permessage-deflate; client_max_window_bits, x-checksum;alg=crc32 ,x-tag")
+	as.Equal([]string{"permessage-deflate", "x-checksum", "x-tag"}, names)
+	as.Equal([]string{"client_max_window_bits", "alg=crc32", ""}, params)
+
+	as.Equal("x-tag", joinExtension("x-tag", " "))
+	as.Equal("x-checksum; alg=crc32", joinExtension("x-checksum", "alg=crc32"))
+}
+
+func TestAcceptExtensions(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("ok", func(t *testing.T) {
+		list := acceptExtensions([]Extension{tagExtension{}, new(checksumExtension)}, "x-checksum; alg=crc32, x-tag, x-unknown", 0)
+		as.Equal([]string{"x-checksum", "x-tag"}, list.names)
+		as.Equal([]string{"x-checksum; alg=crc32", "x-tag"}, list.response)
+		as.Equal(RSV2|RSV3, list.rsv)
+	})
+
+	t.Run("declined", func(t *testing.T) {
+		list := acceptExtensions([]Extension{&checksumExtension{declined: true}}, "x-checksum; alg=crc32", 0)
+		as.Empty(list.names)
+	})
+
+	t.Run("duplicated", func(t *testing.T) {
+		list := acceptExtensions([]Extension{new(checksumExtension)}, "x-checksum; alg=crc32, x-checksum; alg=crc32", 0)
+		as.Equal([]string{"x-checksum"}, list.names)
+	})
+
+	t.Run("rsv conflict", func(t *testing.T) {
+		list := acceptExtensions([]Extension{&checksumExtension{rsv: RSV1}, tagExtension{}}, "x-checksum; alg=crc32, x-tag", RSV1)
+		as.Equal([]string{"x-tag"}, list.names)
+	})
+}
+
+func TestConfirmExtensions(t *testing.T) {
+	as := assert.New(t)
+	extensions := []Extension{new(checksumExtension), tagExtension{}}
+
+	list, err := confirmExtensions(extensions, "permessage-deflate, x-tag", RSV1, internal.PermessageDeflate)
+	as.NoError(err)
+	as.Equal([]string{"x-tag"}, list.names)
+
+	_, err = confirmExtensions(extensions, "x-unknown", 0, internal.PermessageDeflate)
+	as.ErrorIs(err, ErrExtensionNegotiation)
+
+	_, err = confirmExtensions(extensions, "x-tag, x-tag", 0, internal.PermessageDeflate)
+	as.ErrorIs(err, ErrExtensionNegotiation)
+
+	_, err = confirmExtensions(extensions, "x-checksum; alg=md5", 0, internal.PermessageDeflate)
+	as.Error(err)
+
+	_, err = confirmExtensions([]Extension{&checksumExtension{rsv: RSV1}}, "x-checksum; alg=crc32", RSV1, internal.PermessageDeflate)
+	as.ErrorIs(err, ErrExtensionNegotiation)
+}
+
+func TestExtensions(t *testing.T) {
+	var cases = []struct {
+		Title string
+		PD    PermessageDeflate
+	}{
+		{Title: "plain"},
+		{Title: "deflate", PD: PermessageDeflate{Enabled: true, Threshold: 1, ServerContextTakeover: true, ClientContextTakeover: true}},
+	}
+
+	for _, item := range cases {
+		t.Run(item.Title, func(t *testing.T) {
+			as := assert.New(t)
+			const count = 64
+			var listA, listB []string
+			mu := &sync.Mutex{}
+			wg := &sync.WaitGroup{}
+			wg.Add(2 * count)
+
+			serverHandler := new(webSocketMocker)
+			clientHandler := new(webSocketMocker)
+			serverHandler.onMessage = func(socket *Conn, message *Message) {
+				mu.Lock()
+				listA = append(listA, message.Data.String())
+				mu.Unlock()
+				wg.Done()
+			}
+			clientHandler.onMessage = func(socket *Conn, message *Message) {
+				mu.Lock()
+				listB = append(listB, message.Data.String())
+				mu.Unlock()
+				wg.Done()
+			}
+
+			extensions := []Extension{new(checksumExtension), tagExtension{}}
+			server, client, err := newHandshakePeer(
+				serverHandler, &ServerOption{Extensions: extensions, PermessageDeflate: item.PD},
+				clientHandler, &ClientOption{Extensions: extensions, PermessageDeflate: item.PD},
+			)
+			if !as.NoError(err) {
+				return
+			}
+			as.Equal([]string{"x-checksum", "x-tag"}, server.Extensions())
+			as.Equal([]string{"x-checksum", "x-tag"}, client.Extensions())
+			go server.ReadLoop()
+			go client.ReadLoop()
+
+			var expected []string
+			for i := 0; i < count; i++ {
+				s := string(internal.AlphabetNumeric.Generate(internal.AlphabetNumeric.Intn(2048)))
+				expected = append(expected, s)
+				as.NoError(client.WriteString(s))
+				as.NoError(server.Writev(OpcodeText, []byte(s[:len(s)/2]), []byte(s[len(s)/2:])))
+			}
+			wg.Wait()
+			as.Equal(expected, listA)
+			as.Equal(expected, listB)
+		})
+	}
+}
+
+func TestExtensions_Broadcast(t *testing.T) {
+	as := assert.New(t)
+	const count = 4
+	payload := []byte("hello")
+	wg := &sync.WaitGroup{}
+	wg.Add(count)
+	clientHandler := new(webSocketMocker)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal(string(payload), message.Data.String())
+		wg.Done()
+	}
+
+	b := NewBroadcaster(OpcodeText, payload)
+	for i := 0; i < count; i++ {
+		var serverExtensions []Extension
+		if i%2 == 0 {
+			serverExtensions = []Extension{new(checksumExtension)}
+		}
+		server, client, err := newHandshakePeer(
+			new(BuiltinEventHandler), &ServerOption{Extensions: serverExtensions},
+			clientHandler, &ClientOption{Extensions: []Extension{new(checksumExtension)}},
+		)
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+		as.NoError(b.Broadcast(server))
+	}
+	wg.Wait()
+	_ = b.Close()
+}
+
+func TestExtensions_ProtocolError(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("unnegotiated rsv", func(t *testing.T) {
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			as.Equal(internal.CloseProtocolError, err)
+			wg.Done()
+		}
+		server, client, err := newHandshakePeer(
+			serverHandler, &ServerOption{Extensions: []Extension{new(checksumExtension)}},
+			new(BuiltinEventHandler), &ClientOption{Extensions: []Extension{new(checksumExtension)}},
+		)
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		header := frameHeader{}
+		headerLength, _ := header.GenerateHeader(false, true, false, OpcodeText, 0)
+		header.SetRSV(RSV3)
+		_, _ = client.conn.Write(header[:headerLength])
+		wg.Wait()
+	})
+
+	t.Run("rsv on control frame", func(t *testing.T) {
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			as.Equal(internal.CloseProtocolError, err)
+			wg.Done()
+		}
+		server, client, err := newHandshakePeer(
+			serverHandler, &ServerOption{Extensions: []Extension{new(checksumExtension)}},
+			new(BuiltinEventHandler), &ClientOption{Extensions: []Extension{new(checksumExtension)}},
+		)
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		header := frameHeader{}
+		headerLength, _ := header.GenerateHeader(false, true, false, OpcodePing, 0)
+		header.SetRSV(RSV2)
+		_, _ = client.conn.Write(header[:headerLength])
+		wg.Wait()
+	})
+
+	t.Run("decode error", func(t *testing.T) {
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			as.Equal("checksum mismatch", err.Error())
+			wg.Done()
+		}
+		server, client, err := newHandshakePeer(
+			serverHandler, &ServerOption{Extensions: []Extension{new(checksumExtension)}},
+			new(BuiltinEventHandler), &ClientOption{Extensions: []Extension{new(checksumExtension)}},
+		)
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		payload := []byte("hello world")
+		header := frameHeader{}
+		headerLength, maskBytes := header.GenerateHeader(false, true, false, OpcodeText, len(payload))
+		header.SetRSV(RSV2)
+		internal.MaskXOR(payload, maskBytes)
+		_, _ = client.conn.Write(append(header[:headerLength], payload...))
+		wg.Wait()
+	})
+
+	t.Run("unsolicited", func(t *testing.T) {
+		_, _, err := newHandshakePeer(
+			new(BuiltinEventHandler), &ServerOption{ResponseHeader: http.Header{}, Extensions: []Extension{tagExtension{}}},
+			new(BuiltinEventHandler), &ClientOption{RequestHeader: http.Header{internal.SecWebSocketExtensions.Key: []string{"x-tag"}}},
+		)
+		as.ErrorIs(err, ErrExtensionNegotiation)
+	})
+}
+
+// 丢弃内容为 drop 的消息, 并记录绑定的连接; bindErr 非 nil 时服务端的 Bind 返回它
+// Discards messages reading drop and records the bound connection; the server-side Bind returns bindErr when set
+type discardExtension struct {
+	codecs  chan *discardCodec
+	bindErr error
+}
+
+func (c *discardExtension) Name() string { return "x-discard" }
+
+func (c *discardExtension) RSV() RSV { return RSV2 }
+
+func (c *discardExtension) Offer() string { return "" }
+
+func (c *discardExtension) Accept(params string) (ExtensionCodec, string, error) {
+	codec := &discardCodec{bindErr: c.bindErr}
+	c.codecs <- codec
+	return codec, "", nil
+}
+
+func (c *discardExtension) Confirm(params string) (ExtensionCodec, error) {
+	return new(discardCodec), nil
+}
+
+type discardCodec struct {
+	socket  *Conn
+	bindErr error
+}
+
+func (c *discardCodec) RestoreSession() SessionStorage {
+	ss := newSmap()
+	ss.Store("restored", true)
+	return ss
+}
+
+func (c *discardCodec) Bind(socket *Conn) error {
+	c.socket = socket
+	return c.bindErr
+}
+
+func (c *discardCodec) Encode(opcode Opcode, payload []byte) ([]byte, bool, error) {
+	return payload, false, nil
+}
+
+func (c *discardCodec) Decode(opcode Opcode, rsv bool, payload []byte) ([]byte, error) {
+	if string(payload) == "drop" {
+		return nil, ErrDiscardMessage
+	}
+	return payload, nil
+}
+
+func TestExtensions_Discard(t *testing.T) {
+	as := assert.New(t)
+	var messages = make(chan string, 4)
+	serverHandler := new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		messages <- message.Data.String()
+	}
+	extension := &discardExtension{codecs: make(chan *discardCodec, 1)}
+	server, client, err := newHandshakePeer(
+		serverHandler, &ServerOption{
+			Extensions: []Extension{extension},
+			Authorize: func(r *http.Request, session SessionStorage) bool {
+				session.Store("authorized", true)
+				return true
+			},
+		},
+		new(BuiltinEventHandler), &ClientOption{Extensions: []Extension{extension}},
+	)
+	if !as.NoError(err) {
+		return
+	}
+	as.Same(server, (<-extension.codecs).socket)
+
+	// 恢复的会话合并了握手期间写入的键值
+	// The restored session has the entries stored during the handshake merged in
+	_, restored := server.Session().Load("restored")
+	_, authorized := server.Session().Load("authorized")
+	as.True(restored)
+	as.True(authorized)
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	as.NoError(client.WriteString("drop"))
+	as.NoError(client.WriteString("keep"))
+	as.Equal("keep", <-messages)
+	as.False(server.IsClosed())
+}
+
+func TestExtensions_BindError(t *testing.T) {
+	as := assert.New(t)
+	bindErr := errors.New("bind failed")
+	var events = make(chan string, 2)
+	var closed = make(chan error, 1)
+	serverHandler := new(webSocketMocker)
+	serverHandler.onOpen = func(socket *Conn) { events <- "open" }
+	serverHandler.onClose = func(socket *Conn, err error) {
+		events <- "close"
+		closed <- err
+	}
+	extension := &discardExtension{codecs: make(chan *discardCodec, 1), bindErr: bindErr}
+	server := NewServer(serverHandler, &ServerOption{Extensions: []Extension{extension}})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !as.NoError(err) {
+		return
+	}
+	go server.RunListener(listener)
+
+	client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+		Addr:       "ws://" + listener.Addr().String(),
+		Extensions: []Extension{extension},
+	})
+	if !as.NoError(err) {
+		return
+	}
+	defer client.NetConn().Close()
+	go client.ReadLoop()
+
+	// 连接已经关闭, 应用先收到 OnOpen, 然后 OnClose 收到 Bind 的错误
+	// The connection is closed already; the application gets OnOpen, then OnClose with the error of Bind
+	as.Equal("open", <-events)
+	as.Equal("close", <-events)
+	as.ErrorIs(<-closed, bindErr)
+}
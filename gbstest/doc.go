@@ -0,0 +1,13 @@
+// Package gbstest 提供测试 gbs 事件处理器的工具: 基于 net.Pipe 的内存连接对, 以及记录全部事件的 Recorder.
+// 不需要监听端口, 也不需要真实的网络.
+// Package gbstest provides utilities for testing gbs event handlers: in-memory connection pairs over net.Pipe,
+// and a Recorder capturing every event. No listening port or real network is needed.
+//
+//	recorder := new(gbstest.Recorder)
+//	server, client, err := gbstest.Pipe(handler, recorder, nil, nil)
+//	go server.ReadLoop()
+//	go client.ReadLoop()
+//
+//	_ = client.WriteString("hello")
+//	messages, err := recorder.WaitMessages(1, time.Second)
+package gbstest
@@ -0,0 +1,72 @@
+package gbstest
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/catermujo/gbs"
+)
+
+// 客户端未指定地址时握手请求使用的地址
+// Address of the handshake request when the client specifies none
+const defaultAddr = "ws://localhost/"
+
+// Pipe 在 net.Pipe 上完成握手, 返回服务端和客户端的连接. 两端的选项可以为 nil, 客户端未指定 Addr 时使用 ws://localhost/.
+// net.Pipe 没有缓冲, 一端写入时另一端必须在读取, 所以发送消息前需要启动两端的 ReadLoop.
+// Completes the handshake over net.Pipe and returns the server and client connections.
+// Either option may be nil, and the client uses ws://localhost/ when no Addr is specified.
+// net.Pipe is unbuffered and a write blocks until the other end reads,
+// so the ReadLoop of both ends has to be started before sending messages.
+func Pipe(serverHandler, clientHandler gbs.EventHandler, serverOpt *gbs.ServerOption, clientOpt *gbs.ClientOption) (server, client *gbs.Conn, err error) {
+	if serverOpt == nil {
+		serverOpt = new(gbs.ServerOption)
+	}
+	if clientOpt == nil {
+		clientOpt = new(gbs.ClientOption)
+	}
+	if clientOpt.Addr == "" {
+		clientOpt.Addr = defaultAddr
+	}
+	upgrader := gbs.NewUpgrader(serverHandler, serverOpt)
+
+	type result struct {
+		socket *gbs.Conn
+		err    error
+	}
+	srv, cli := net.Pipe()
+	ch := make(chan result, 1)
+	go func() {
+		br := bufio.NewReaderSize(srv, serverOpt.ReadBufferSize)
+		r, err := http.ReadRequest(br)
+		if err != nil {
+			_ = srv.Close()
+			ch <- result{err: err}
+			return
+		}
+		socket, err := upgrader.UpgradeFromConn(srv, br, r)
+		ch <- result{socket: socket, err: err}
+	}()
+
+	client, _, err = gbs.NewClientFromConn(clientHandler, clientOpt, cli)
+	res := <-ch
+
+	// 服务端拒绝握手时客户端只能得到 ErrHandshake, 此时返回服务端的错误, 它说明了拒绝的原因
+	// When the server rejects the handshake the client only gets ErrHandshake,
+	// so the server error is returned instead as it tells why
+	if err != nil {
+		if res.err != nil && errors.Is(err, gbs.ErrHandshake) {
+			err = res.err
+		}
+		if res.socket != nil {
+			_ = srv.Close()
+		}
+		return nil, nil, err
+	}
+	if res.err != nil {
+		_ = cli.Close()
+		return nil, nil, res.err
+	}
+	return res.socket, client, nil
+}
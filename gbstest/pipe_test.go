@@ -0,0 +1,84 @@
+package gbstest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs"
+	"github.com/catermujo/gbs/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+// 原样返回消息的处理器
+// Handler echoing messages back
+type echoHandler struct {
+	gbs.BuiltinEventHandler
+}
+
+func (c *echoHandler) OnMessage(socket *gbs.Conn, message *gbs.Message) {
+	_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	_ = message.Close()
+}
+
+func TestPipe(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("echo", func(t *testing.T) {
+		recorder := new(Recorder)
+		server, client, err := Pipe(new(echoHandler), recorder,
+			&gbs.ServerOption{
+				SubProtocols:      []string{"chat"},
+				PermessageDeflate: gbs.PermessageDeflate{Enabled: true, Threshold: 1},
+			},
+			&gbs.ClientOption{
+				RequestHeader:     http.Header{"Sec-Websocket-Protocol": {"chat"}},
+				PermessageDeflate: gbs.PermessageDeflate{Enabled: true, Threshold: 1},
+			},
+		)
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal("chat", server.SubProtocol())
+		as.Equal("chat", client.SubProtocol())
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var payloads []string
+		for _, n := range []int{0, 125, 126, 65536} {
+			payload := string(internal.AlphabetNumeric.Generate(n))
+			payloads = append(payloads, payload)
+			as.NoError(client.WriteString(payload))
+		}
+		messages, err := recorder.WaitMessages(len(payloads), time.Second)
+		if !as.NoError(err) {
+			return
+		}
+		for i, message := range messages {
+			as.Equal(gbs.OpcodeText, message.Opcode)
+			as.Equal(payloads[i], string(message.Payload))
+		}
+
+		as.NoError(client.WriteClose(1000, nil))
+		_, err = recorder.WaitClose(1000, time.Second)
+		as.NoError(err)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		_, _, err := Pipe(new(gbs.BuiltinEventHandler), new(Recorder),
+			&gbs.ServerOption{Authorize: func(r *http.Request, session gbs.SessionStorage) bool {
+				return r.URL.Path != "/forbidden"
+			}},
+			&gbs.ClientOption{Addr: "ws://localhost/forbidden"},
+		)
+		as.ErrorIs(err, gbs.ErrUnauthorized)
+	})
+
+	t.Run("subprotocol", func(t *testing.T) {
+		_, _, err := Pipe(new(gbs.BuiltinEventHandler), new(Recorder),
+			nil,
+			&gbs.ClientOption{RequestHeader: http.Header{"Sec-Websocket-Protocol": {"chat"}}},
+		)
+		as.ErrorIs(err, gbs.ErrSubprotocolNegotiation)
+	})
+}
@@ -0,0 +1,225 @@
+package gbstest
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/catermujo/gbs"
+	"github.com/catermujo/gbs/internal"
+)
+
+var (
+	// ErrTimeout 等待事件超时
+	// Timed out waiting for events
+	ErrTimeout = errors.New("gbstest: timeout waiting for events")
+
+	// ErrCloseCode 连接以非预期的状态码关闭
+	// The connection closed with an unexpected status code
+	ErrCloseCode = errors.New("gbstest: unexpected close code")
+)
+
+// EventType 事件类型
+// Type of an event
+type EventType uint8
+
+const (
+	EventOpen EventType = iota
+	EventClose
+	EventPing
+	EventPong
+	EventMessage
+)
+
+func (c EventType) String() string {
+	switch c {
+	case EventOpen:
+		return "open"
+	case EventClose:
+		return "close"
+	case EventPing:
+		return "ping"
+	case EventPong:
+		return "pong"
+	case EventMessage:
+		return "message"
+	default:
+		return "unknown"
+	}
+}
+
+// Event 记录的一个事件
+// An event captured by the Recorder
+type Event struct {
+	// 事件类型
+	// Type of the event
+	Type EventType
+
+	// 收到事件的时间
+	// Time the event was received
+	Time time.Time
+
+	// 消息的操作码, 仅用于消息事件
+	// Opcode of the message, only for message events
+	Opcode gbs.Opcode
+
+	// 消息, Ping 或 Pong 的负载, 或者关闭原因
+	// Payload of the message, ping or pong, or the close reason
+	Payload []byte
+
+	// 关闭状态码, 仅用于关闭事件. 对端未携带状态码时为 1005, 没有关闭帧时为 1006.
+	// Close status code, only for close events.
+	// It is 1005 when the peer sent no status code and 1006 when there was no close frame.
+	Code uint16
+
+	// 传给 OnClose 的错误, 仅用于关闭事件
+	// Error passed to OnClose, only for close events
+	Err error
+}
+
+// Recorder 记录全部事件的 EventHandler, 零值即可使用. 收到 Ping 时回复携带相同负载的 Pong.
+// An EventHandler capturing every event; the zero value is ready to use.
+// It replies to pings with pongs carrying the same payload.
+type Recorder struct {
+	mu      sync.Mutex
+	events  []Event
+	changed chan struct{}
+}
+
+func (c *Recorder) OnOpen(socket *gbs.Conn) {
+	c.add(Event{Type: EventOpen})
+}
+
+func (c *Recorder) OnClose(socket *gbs.Conn, err error) {
+	event := Event{Type: EventClose, Code: internal.CloseAbnormalClosure.Uint16(), Err: err}
+	switch v := err.(type) {
+	case *gbs.CloseError:
+		event.Code = internal.SelectValue(v.Code == 0, internal.CloseNoStatusReceived.Uint16(), v.Code)
+		event.Payload = append([]byte(nil), v.Reason...)
+	case internal.StatusCode:
+		event.Code = v.Uint16()
+	}
+	c.add(event)
+}
+
+func (c *Recorder) OnPing(socket *gbs.Conn, payload []byte) {
+	c.add(Event{Type: EventPing, Payload: append([]byte(nil), payload...)})
+	_ = socket.WritePong(payload)
+}
+
+func (c *Recorder) OnPong(socket *gbs.Conn, payload []byte) {
+	c.add(Event{Type: EventPong, Payload: append([]byte(nil), payload...)})
+}
+
+func (c *Recorder) OnMessage(socket *gbs.Conn, message *gbs.Message) {
+	c.add(Event{Type: EventMessage, Opcode: message.Opcode, Payload: append([]byte(nil), message.Bytes()...)})
+	_ = message.Close()
+}
+
+// 记录事件并唤醒等待者
+// Records the event and wakes up the waiters
+func (c *Recorder) add(event Event) {
+	event.Time = time.Now()
+	c.mu.Lock()
+	c.events = append(c.events, event)
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+	c.mu.Unlock()
+}
+
+// Events 返回目前记录的全部事件
+// Returns all events recorded so far
+func (c *Recorder) Events() []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Event(nil), c.events...)
+}
+
+// Messages 返回目前记录的消息事件
+// Returns the message events recorded so far
+func (c *Recorder) Messages() []Event {
+	return c.filter(EventMessage)
+}
+
+// Reset 清空记录的事件
+// Clears the recorded events
+func (c *Recorder) Reset() {
+	c.mu.Lock()
+	c.events = nil
+	c.mu.Unlock()
+}
+
+func (c *Recorder) filter(eventType EventType) []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var events []Event
+	for _, event := range c.events {
+		if event.Type == eventType {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// 等待 ready 返回 true, 每记录一个事件检查一次
+// Waits until ready returns true, checking once per recorded event
+func (c *Recorder) wait(timeout time.Duration, ready func() bool) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		if c.changed == nil {
+			c.changed = make(chan struct{})
+		}
+		changed := c.changed
+		c.mu.Unlock()
+
+		if ready() {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			if ready() {
+				return nil
+			}
+			return ErrTimeout
+		}
+	}
+}
+
+// WaitEvents 等待至少 n 个指定类型的事件, 返回最早的 n 个
+// Waits for at least n events of the given type and returns the first n of them
+func (c *Recorder) WaitEvents(eventType EventType, n int, timeout time.Duration) ([]Event, error) {
+	var events []Event
+	err := c.wait(timeout, func() bool {
+		events = c.filter(eventType)
+		return len(events) >= n
+	})
+	if err != nil {
+		return events, err
+	}
+	return events[:n], nil
+}
+
+// WaitMessages 等待至少 n 条消息, 返回最早的 n 条
+// Waits for at least n messages and returns the first n of them
+func (c *Recorder) WaitMessages(n int, timeout time.Duration) ([]Event, error) {
+	return c.WaitEvents(EventMessage, n, timeout)
+}
+
+// WaitClose 等待关闭事件. 状态码不等于 code 时返回 ErrCloseCode, 可以从返回的事件中查看实际的状态码.
+// Waits for the close event. Returns ErrCloseCode when the status code differs from code,
+// the actual status code can be found in the returned event.
+func (c *Recorder) WaitClose(code uint16, timeout time.Duration) (Event, error) {
+	events, err := c.WaitEvents(EventClose, 1, timeout)
+	if err != nil {
+		return Event{}, err
+	}
+	if events[0].Code != code {
+		return events[0], ErrCloseCode
+	}
+	return events[0], nil
+}
@@ -0,0 +1,100 @@
+package gbstest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("events", func(t *testing.T) {
+		serverRecorder, clientRecorder := new(Recorder), new(Recorder)
+		server, client, err := Pipe(serverRecorder, clientRecorder, nil, nil)
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(client.WritePing([]byte("ping")))
+		as.NoError(server.WriteMessage(gbs.OpcodeBinary, []byte{1, 2, 3}))
+		messages, err := clientRecorder.WaitMessages(1, time.Second)
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(gbs.OpcodeBinary, messages[0].Opcode)
+		as.Equal([]byte{1, 2, 3}, messages[0].Payload)
+		pongs, err := clientRecorder.WaitEvents(EventPong, 1, time.Second)
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal([]byte("ping"), pongs[0].Payload)
+
+		as.NoError(server.WriteClose(4000, []byte("bye")))
+		event, err := clientRecorder.WaitClose(4000, time.Second)
+		as.NoError(err)
+		as.Equal([]byte("bye"), event.Payload)
+		_, err = serverRecorder.WaitClose(4000, time.Second)
+		as.NoError(err)
+
+		// 服务端记录了 Ping, 客户端记录了自动回复的 Pong
+		// The server recorded the ping and the client recorded the automatic pong
+		var types []EventType
+		for _, event := range serverRecorder.Events() {
+			types = append(types, event.Type)
+		}
+		as.Equal([]EventType{EventOpen, EventPing, EventClose}, types)
+
+		events := clientRecorder.Events()
+		types = types[:0]
+		for i, event := range events {
+			types = append(types, event.Type)
+			if i > 0 {
+				as.False(event.Time.Before(events[i-1].Time))
+			}
+		}
+		// Pong 和消息的先后顺序不确定
+		// The order of the pong and the message is not deterministic
+		as.ElementsMatch([]EventType{EventOpen, EventPong, EventMessage, EventClose}, types)
+		as.Equal(EventOpen, types[0])
+		as.Equal(EventClose, types[3])
+
+		clientRecorder.Reset()
+		as.Empty(clientRecorder.Events())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		recorder := new(Recorder)
+		recorder.OnMessage(nil, &gbs.Message{Opcode: gbs.OpcodeText, Data: bytes.NewBufferString("hello")})
+		messages, err := recorder.WaitMessages(2, 20*time.Millisecond)
+		as.ErrorIs(err, ErrTimeout)
+		as.Len(messages, 1)
+		_, err = recorder.WaitClose(1000, 20*time.Millisecond)
+		as.ErrorIs(err, ErrTimeout)
+	})
+
+	t.Run("close code", func(t *testing.T) {
+		recorder := new(Recorder)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			recorder.OnClose(nil, &gbs.CloseError{})
+		}()
+		event, err := recorder.WaitClose(1000, time.Second)
+		as.ErrorIs(err, ErrCloseCode)
+		as.Equal(uint16(1005), event.Code)
+
+		recorder.Reset()
+		recorder.OnClose(nil, ErrTimeout)
+		event, err = recorder.WaitClose(1006, time.Second)
+		as.NoError(err)
+		as.Equal(ErrTimeout, event.Err)
+	})
+
+	as.Equal("message", EventMessage.String())
+	as.Equal("unknown", EventType(100).String())
+}
@@ -0,0 +1,320 @@
+package gbs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catermujo/gbs/internal"
+)
+
+// RFC 8441 扩展 CONNECT 请求中的伪头部
+// The pseudo header of RFC 8441 extended CONNECT requests
+const protocolPseudoHeader = ":protocol"
+
+// 是否为 RFC 8441 的扩展 CONNECT 请求
+// Reports whether the request is an RFC 8441 extended CONNECT request
+func isExtendedConnect(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodConnect && r.Header.Get(protocolPseudoHeader) == "websocket"
+}
+
+// 通过 HTTP/2 扩展 CONNECT 升级, 连接运行在请求所在的流上.
+// 处理函数返回时流就会结束, 所以处理函数必须等到连接关闭, 例如直接调用 ReadLoop.
+// Upgrades through HTTP/2 extended CONNECT, the connection runs over the stream of the request.
+// The stream ends when the handler returns, so the handler must wait for the connection to close,
+// e.g. by calling ReadLoop directly.
+func (c *Upgrader) upgradeHTTP2(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	socket, err := c.doUpgradeHTTP2(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+	return socket, err
+}
+
+func (c *Upgrader) doUpgradeHTTP2(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	session := c.option.NewSession()
+	if !c.option.Authorize(r, session) {
+		return nil, ErrUnauthorized
+	}
+	if !strings.EqualFold(r.Header.Get(internal.SecWebSocketVersion.Key), internal.SecWebSocketVersion.Val) {
+		return nil, errors.New("gbs: websocket version not supported")
+	}
+
+	// RFC 8441 没有 Sec-WebSocket-Key 和 Sec-WebSocket-Accept, 以 200 状态码表示成功
+	// RFC 8441 drops Sec-WebSocket-Key and Sec-WebSocket-Accept, a 200 status code means success
+	header := w.Header()
+	var subprotocol string
+	if len(c.option.SubProtocols) > 0 {
+		subprotocol = internal.GetIntersectionElem(c.option.SubProtocols, internal.Split(r.Header.Get(internal.SecWebSocketProtocol.Key), ","))
+		if subprotocol == "" {
+			return nil, ErrSubprotocolNegotiation
+		}
+		header.Set(internal.SecWebSocketProtocol.Key, subprotocol)
+	}
+	extensions := r.Header.Get(internal.SecWebSocketExtensions.Key)
+	pd := c.getPermessageDeflate(extensions)
+	list := acceptExtensions(c.option.Extensions, extensions, internal.SelectValue(pd.Enabled, RSV1, 0))
+	if response := extensionResponse(pd, list); response != "" {
+		header.Set(internal.SecWebSocketExtensions.Key, response)
+	}
+	for k := range c.option.ResponseHeader {
+		header.Set(k, c.option.ResponseHeader.Get(k))
+	}
+
+	conn := newHTTP2ServerConn(w, r)
+	w.WriteHeader(http.StatusOK)
+	if err := conn.controller.Flush(); err != nil {
+		return nil, err
+	}
+
+	config := c.option.getConfig()
+	br := config.brPool.Get()
+	br.Reset(conn)
+	socket := &Conn{
+		ss:                session,
+		isServer:          true,
+		subprotocol:       subprotocol,
+		conn:              conn,
+		config:            config,
+		br:                br,
+		continuationFrame: continuationFrame{},
+		fh:                frameHeader{},
+		handler:           c.eventHandler,
+		closed:            0,
+		writeQueue:        workerQueue{maxConcurrency: 1},
+		readQueue:         make(channel, c.option.ParallelGolimit),
+	}
+	if pd.Enabled {
+		socket.initPermessageDeflate(pd, config.deflaterPool.Select())
+	}
+	socket.initExtensions(list)
+
+	return socket, nil
+}
+
+// 通过 HTTP/2 扩展 CONNECT 连接服务器, 服务器必须在 SETTINGS 中开启 SETTINGS_ENABLE_CONNECT_PROTOCOL
+// Connects to the server through HTTP/2 extended CONNECT; the server must enable SETTINGS_ENABLE_CONNECT_PROTOCOL
+func (c *connector) dialHTTP2(URL *url.URL) (*Conn, *http.Response, error) {
+	target := *URL
+	target.Scheme = internal.SelectValue(URL.Scheme == "wss", "https", "http")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+	r, err := http.NewRequestWithContext(ctx, http.MethodConnect, target.String(), reader)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	for k, v := range c.option.RequestHeader {
+		r.Header[k] = v
+	}
+	r.Header.Set(protocolPseudoHeader, "websocket")
+	r.Header.Set(internal.SecWebSocketVersion.Key, internal.SecWebSocketVersion.Val)
+	if extensions := c.extensionOffer(); extensions != "" {
+		r.Header.Set(internal.SecWebSocketExtensions.Key, extensions)
+	}
+
+	// 流的生命周期不受 c.ctx 约束, 只在握手期间监听它的取消
+	// The stream does not live under c.ctx, its cancellation is only watched during the handshake
+	timer := time.AfterFunc(c.option.HandshakeTimeout, cancel)
+	stop := internal.AfterFunc(c.getContext(), cancel)
+	resp, err := c.option.HTTP2Transport.RoundTrip(r)
+	timer.Stop()
+	if !stop() {
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		err = c.getContext().Err()
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	socket, err := c.confirmHTTP2(resp, &http2Conn{
+		reader: resp.Body,
+		writer: writer,
+		cancel: cancel,
+		local:  http2Addr(""),
+		remote: http2Addr(URL.Host),
+	})
+	if err != nil {
+		_ = resp.Body.Close()
+		cancel()
+	}
+	return socket, resp, err
+}
+
+// 检查扩展 CONNECT 的响应并创建连接
+// Checks the response to the extended CONNECT and creates the connection
+func (c *connector) confirmHTTP2(resp *http.Response, conn *http2Conn) (*Conn, error) {
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrHandshake
+	}
+	subprotocol, err := c.getSubProtocol(resp)
+	if err != nil {
+		return nil, err
+	}
+	pd, err := c.getPermessageDeflate(resp)
+	if err != nil {
+		return nil, err
+	}
+	list, err := confirmExtensions(
+		c.option.Extensions,
+		resp.Header.Get(internal.SecWebSocketExtensions.Key),
+		internal.SelectValue(pd.Enabled, RSV1, 0),
+		internal.PermessageDeflate,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	socket := &Conn{
+		ss:                c.option.NewSession(),
+		isServer:          false,
+		subprotocol:       subprotocol,
+		conn:              conn,
+		config:            c.option.getConfig(),
+		br:                bufio.NewReaderSize(conn, c.option.ReadBufferSize),
+		continuationFrame: continuationFrame{},
+		fh:                frameHeader{},
+		handler:           c.eventHandler,
+		closed:            0,
+		writeQueue:        workerQueue{maxConcurrency: 1},
+		readQueue:         make(channel, c.option.ParallelGolimit),
+	}
+	if pd.Enabled {
+		socket.initPermessageDeflate(pd, new(deflater).initialize(pd, c.option.ReadMaxPayloadSize))
+	}
+	socket.initExtensions(list)
+	return socket, nil
+}
+
+// 以 HTTP/2 流作为底层连接.
+// 服务端通过 ResponseController 设置超时; 客户端的超时到期时取消请求, 流随之关闭.
+// Uses an HTTP/2 stream as the underlying connection.
+// The server side sets deadlines through the ResponseController;
+// on the client side an expired deadline cancels the request, which closes the stream.
+type http2Conn struct {
+	reader     io.ReadCloser
+	writer     io.Writer
+	controller *http.ResponseController
+	cancel     context.CancelFunc
+	local      net.Addr
+	remote     net.Addr
+
+	mu         sync.Mutex
+	readTimer  *time.Timer
+	writeTimer *time.Timer
+	once       sync.Once
+}
+
+func newHTTP2ServerConn(w http.ResponseWriter, r *http.Request) *http2Conn {
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if local == nil {
+		local = http2Addr("")
+	}
+	return &http2Conn{
+		reader:     r.Body,
+		writer:     w,
+		controller: http.NewResponseController(w),
+		local:      local,
+		remote:     http2Addr(r.RemoteAddr),
+	}
+}
+
+func (c *http2Conn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Write 写入后立即刷新, 数据帧不会滞留在缓冲区
+// Flushes right after writing so that data frames do not linger in the buffer
+func (c *http2Conn) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if c.controller != nil {
+		return n, c.controller.Flush()
+	}
+	return n, nil
+}
+
+// Close 关闭流. 服务端的流在处理函数返回时才会结束.
+// Closes the stream. On the server side the stream only ends once the handler returns.
+func (c *http2Conn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.readTimer = resetDeadline(c.readTimer, time.Time{}, nil)
+		c.writeTimer = resetDeadline(c.writeTimer, time.Time{}, nil)
+		c.mu.Unlock()
+
+		if closer, ok := c.writer.(io.Closer); ok {
+			_ = closer.Close()
+		}
+		err = c.reader.Close()
+		if c.cancel != nil {
+			c.cancel()
+		}
+	})
+	return err
+}
+
+func (c *http2Conn) LocalAddr() net.Addr { return c.local }
+
+func (c *http2Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *http2Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *http2Conn) SetReadDeadline(t time.Time) error {
+	if c.controller != nil {
+		return c.controller.SetReadDeadline(t)
+	}
+	c.mu.Lock()
+	c.readTimer = resetDeadline(c.readTimer, t, c.cancel)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *http2Conn) SetWriteDeadline(t time.Time) error {
+	if c.controller != nil {
+		return c.controller.SetWriteDeadline(t)
+	}
+	c.mu.Lock()
+	c.writeTimer = resetDeadline(c.writeTimer, t, c.cancel)
+	c.mu.Unlock()
+	return nil
+}
+
+// 停止旧的定时器, t 不为零值时在 t 到期后调用 f
+// Stops the old timer and, unless t is zero, calls f once t expires
+func resetDeadline(timer *time.Timer, t time.Time, f func()) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), f)
+}
+
+// HTTP/2 流两端的地址
+// Address of either end of an HTTP/2 stream
+type http2Addr string
+
+func (c http2Addr) Network() string { return "tcp" }
+
+func (c http2Addr) String() string { return string(c) }
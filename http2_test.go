@@ -0,0 +1,439 @@
+package gbs
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+// 构造一个扩展 CONNECT 请求
+// Builds an extended CONNECT request
+func newExtendedConnect(body io.Reader) *http.Request {
+	r := httptest.NewRequest(http.MethodConnect, "https://localhost/connect", body)
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+	r.Header.Set(protocolPseudoHeader, "websocket")
+	r.Header.Set(internal.SecWebSocketVersion.Key, internal.SecWebSocketVersion.Val)
+	return r
+}
+
+func TestUpgrader_HTTP2(t *testing.T) {
+	as := assert.New(t)
+	upgrader := NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+		SubProtocols:      []string{"chat"},
+		PermessageDeflate: PermessageDeflate{Enabled: true},
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		r := newExtendedConnect(strings.NewReader(""))
+		r.Header.Set(internal.SecWebSocketProtocol.Key, "chat")
+		r.Header.Set(internal.SecWebSocketExtensions.Key, "permessage-deflate")
+		w := httptest.NewRecorder()
+		socket, err := upgrader.Upgrade(w, r)
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(http.StatusOK, w.Code)
+		as.True(w.Flushed)
+		as.Equal("chat", w.Header().Get(internal.SecWebSocketProtocol.Key))
+		as.Contains(w.Header().Get(internal.SecWebSocketExtensions.Key), "permessage-deflate")
+		as.Empty(w.Header().Get(internal.SecWebSocketAccept.Key))
+		as.Equal("chat", socket.SubProtocol())
+		as.True(socket.pd.Enabled)
+
+		w.Body.Reset()
+		as.NoError(socket.WriteMessage(OpcodeBinary, []byte{1}))
+		as.Equal([]byte{0x82, 0x01, 0x01}, w.Body.Bytes())
+	})
+
+	t.Run("version", func(t *testing.T) {
+		r := newExtendedConnect(strings.NewReader(""))
+		r.Header.Del(internal.SecWebSocketVersion.Key)
+		w := httptest.NewRecorder()
+		_, err := upgrader.Upgrade(w, r)
+		as.Error(err)
+		as.Equal(http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("subprotocol", func(t *testing.T) {
+		r := newExtendedConnect(strings.NewReader(""))
+		r.Header.Set(internal.SecWebSocketProtocol.Key, "json")
+		w := httptest.NewRecorder()
+		_, err := upgrader.Upgrade(w, r)
+		as.ErrorIs(err, ErrSubprotocolNegotiation)
+		as.Equal(http.StatusBadRequest, w.Code)
+	})
+}
+
+// 在进程内模拟 HTTP/2 传输: 请求直接交给处理函数, 请求体和响应体都是流
+// Emulates an HTTP/2 transport in process: requests go straight to the handler, with streaming request and response bodies
+type http2Transport struct {
+	handler http.Handler
+}
+
+func (c *http2Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	reader, writer := io.Pipe()
+	w := &http2ResponseWriter{header: http.Header{}, writer: writer, ready: make(chan int, 1)}
+	req := r.Clone(r.Context())
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	req.Body = r.Body
+	req.RemoteAddr = "127.0.0.1:1234"
+	// 和真正的传输一样, 取消请求会中断响应体的读取
+	// Like a real transport, canceling the request aborts reading the response body
+	go func() {
+		<-r.Context().Done()
+		_ = reader.CloseWithError(r.Context().Err())
+	}()
+	go func() {
+		c.handler.ServeHTTP(w, req)
+		w.WriteHeader(http.StatusOK)
+		_ = writer.Close()
+	}()
+
+	select {
+	case code := <-w.ready:
+		return &http.Response{
+			Status:     http.StatusText(code),
+			StatusCode: code,
+			Proto:      "HTTP/2.0",
+			ProtoMajor: 2,
+			Header:     w.header,
+			Body:       reader,
+			Request:    r,
+		}, nil
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+}
+
+type http2ResponseWriter struct {
+	header http.Header
+	writer *io.PipeWriter
+	ready  chan int
+	once   sync.Once
+}
+
+func (c *http2ResponseWriter) Header() http.Header { return c.header }
+
+func (c *http2ResponseWriter) Write(p []byte) (int, error) {
+	c.WriteHeader(http.StatusOK)
+	return c.writer.Write(p)
+}
+
+func (c *http2ResponseWriter) WriteHeader(code int) {
+	c.once.Do(func() { c.ready <- code })
+}
+
+func (c *http2ResponseWriter) Flush() {}
+
+func TestHTTP2(t *testing.T) {
+	as := assert.New(t)
+	serverHandler := new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+		_ = message.Close()
+	}
+	upgrader := NewUpgrader(serverHandler, &ServerOption{
+		SubProtocols:      []string{"chat"},
+		PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1},
+		Authorize: func(r *http.Request, session SessionStorage) bool {
+			return r.URL.Path != "/forbidden"
+		},
+	})
+	transport := &http2Transport{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if socket, err := upgrader.Upgrade(w, r); err == nil {
+			socket.ReadLoop()
+		}
+	})}
+
+	t.Run("ok", func(t *testing.T) {
+		var messages = make(chan string, 8)
+		clientHandler := new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			messages <- message.Data.String()
+		}
+		client, resp, err := NewClient(clientHandler, &ClientOption{
+			Addr:              "wss://localhost/connect",
+			RequestHeader:     http.Header{"Sec-Websocket-Protocol": {"chat"}},
+			PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1},
+			HTTP2Transport:    transport,
+		})
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(http.StatusOK, resp.StatusCode)
+		as.Equal(http.MethodConnect, resp.Request.Method)
+		as.Equal("https", resp.Request.URL.Scheme)
+		as.Equal("chat", client.SubProtocol())
+		as.True(client.pd.Enabled)
+		as.Equal("localhost", client.RemoteAddr().String())
+		go client.ReadLoop()
+
+		for _, n := range []int{0, 125, 126, 65536, 1024 * 1024} {
+			payload := string(internal.AlphabetNumeric.Generate(n))
+			as.NoError(client.WriteString(payload))
+			select {
+			case s := <-messages:
+				as.Equal(payload, s)
+			case <-time.After(3 * time.Second):
+				t.Fatalf("timeout waiting for %d bytes", n)
+			}
+		}
+		_ = client.WriteClose(1000, nil)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		_, resp, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+			Addr:           "ws://localhost/forbidden",
+			HTTP2Transport: transport,
+		})
+		as.ErrorIs(err, ErrHandshake)
+		as.Equal(http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+			Addr:           "ws://localhost/connect",
+			RequestHeader:  http.Header{"Sec-Websocket-Protocol": {"chat"}},
+			HTTP2Transport: transport,
+		})
+		if !as.NoError(err) {
+			return
+		}
+		// 客户端的读超时到期后流被取消
+		// The stream is canceled once the read deadline of the client expires
+		as.NoError(client.SetReadDeadline(time.Now().Add(50 * time.Millisecond)))
+		_, err = client.NetConn().Read(make([]byte, 1))
+		as.Error(err)
+	})
+}
+
+// 标准库只在启动时读取 GODEBUG, 所以在设置了 http2xconnect=1 的子进程中重新运行测试
+// The standard library reads GODEBUG only at startup, so the test is run again in a child process with http2xconnect=1
+func runWithExtendedConnect(t *testing.T) bool {
+	if strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		return false
+	}
+	godebug := "http2xconnect=1"
+	if v := os.Getenv("GODEBUG"); v != "" {
+		godebug = v + "," + godebug
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.count=1")
+	cmd.Env = append(os.Environ(), "GODEBUG="+godebug)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	return true
+}
+
+// 最小的 HTTP/2 客户端, 直接读写帧, 用来检查标准库服务器实际发出的 SETTINGS 和扩展 CONNECT 的处理.
+// 标准库的 *http.Transport 会拒绝 :protocol 伪头部, 所以不能用它.
+// A minimal HTTP/2 client reading and writing raw frames, to check the SETTINGS the standard library server actually
+// sends and how it handles extended CONNECT. The standard *http.Transport rejects the :protocol pseudo header.
+type rawHTTP2Client struct {
+	conn   net.Conn
+	header [9]byte
+}
+
+const (
+	http2FrameData     = 0x0
+	http2FrameHeaders  = 0x1
+	http2FrameSettings = 0x4
+
+	http2FlagEndHeaders = 0x4
+	http2FlagAck        = 0x1
+
+	http2SettingEnableConnectProtocol = 0x8
+)
+
+// 建立连接并交换 SETTINGS, 返回服务器的 SETTINGS
+// Connects and exchanges SETTINGS, returns those of the server
+func dialRawHTTP2(t *testing.T, srv *httptest.Server) (*rawHTTP2Client, map[uint16]uint32) {
+	config := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.NextProtos = []string{"h2"}
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { _ = conn.Close() })
+	if conn.ConnectionState().NegotiatedProtocol != "h2" {
+		t.Fatal("h2 not negotiated")
+	}
+
+	c := &rawHTTP2Client{conn: conn}
+	_, _ = conn.Write([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"))
+	c.writeFrame(t, http2FrameSettings, 0, 0, nil)
+	for {
+		kind, flags, _, payload := c.readFrame(t)
+		if kind != http2FrameSettings || flags&http2FlagAck != 0 {
+			continue
+		}
+		var settings = make(map[uint16]uint32)
+		for i := 0; i+6 <= len(payload); i += 6 {
+			settings[binary.BigEndian.Uint16(payload[i:])] = binary.BigEndian.Uint32(payload[i+2:])
+		}
+		c.writeFrame(t, http2FrameSettings, http2FlagAck, 0, nil)
+		return c, settings
+	}
+}
+
+func (c *rawHTTP2Client) writeFrame(t *testing.T, kind, flags byte, stream uint32, payload []byte) {
+	var frame = make([]byte, 9, 9+len(payload))
+	frame[0], frame[1], frame[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	frame[3], frame[4] = kind, flags
+	binary.BigEndian.PutUint32(frame[5:], stream)
+	if _, err := c.conn.Write(append(frame, payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *rawHTTP2Client) readFrame(t *testing.T) (kind, flags byte, stream uint32, payload []byte) {
+	if _, err := io.ReadFull(c.conn, c.header[:]); err != nil {
+		t.Fatal(err)
+	}
+	n := int(c.header[0])<<16 | int(c.header[1])<<8 | int(c.header[2])
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.conn, payload); err != nil {
+		t.Fatal(err)
+	}
+	return c.header[3], c.header[4], binary.BigEndian.Uint32(c.header[5:]) & 0x7fffffff, payload
+}
+
+// 读取指定流上的下一个帧, 跳过其他流和连接级的帧
+// Reads the next frame of the stream, skipping other streams and connection-level frames
+func (c *rawHTTP2Client) readStream(t *testing.T, stream uint32) (kind byte, payload []byte) {
+	for {
+		kind, _, id, payload := c.readFrame(t)
+		if id == stream {
+			return kind, payload
+		}
+	}
+}
+
+// 以不加索引, 不使用哈夫曼编码的字面量编码头部
+// Encodes header fields as literals without indexing or Huffman coding
+func encodeRawHPACK(fields ...string) []byte {
+	var b []byte
+	for i := 0; i+1 < len(fields); i += 2 {
+		b = append(b, 0x00, byte(len(fields[i])))
+		b = append(b, fields[i]...)
+		b = append(b, byte(len(fields[i+1])))
+		b = append(b, fields[i+1]...)
+	}
+	return b
+}
+
+func TestHTTP2_Stdlib(t *testing.T) {
+	as := assert.New(t)
+	serverHandler := new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+		_ = message.Close()
+	}
+	var requests = make(chan *http.Request, 8)
+	server := NewServer(serverHandler, &ServerOption{
+		SubProtocols: []string{"chat"},
+		Authorize: func(r *http.Request, session SessionStorage) bool {
+			requests <- r
+			return true
+		},
+	})
+	srv := httptest.NewUnstartedServer(server)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// 未开启 http2xconnect 时, 服务器不会在 SETTINGS 中开启扩展 CONNECT
+	// Without http2xconnect the server does not enable extended CONNECT in its SETTINGS
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		_, settings := dialRawHTTP2(t, srv)
+		as.Zero(settings[http2SettingEnableConnectProtocol])
+	}
+	if runWithExtendedConnect(t) {
+		return
+	}
+
+	t.Run("extended connect", func(t *testing.T) {
+		client, settings := dialRawHTTP2(t, srv)
+		as.Equal(uint32(1), settings[http2SettingEnableConnectProtocol])
+
+		client.writeFrame(t, http2FrameHeaders, http2FlagEndHeaders, 1, encodeRawHPACK(
+			":method", "CONNECT",
+			":protocol", "websocket",
+			":scheme", "https",
+			":authority", srv.Listener.Addr().String(),
+			":path", "/connect",
+			"sec-websocket-version", "13",
+			"sec-websocket-protocol", "chat",
+		))
+		kind, payload := client.readStream(t, 1)
+		as.Equal(byte(http2FrameHeaders), kind)
+		// 静态表第 8 项即 :status 200
+		// Entry 8 of the static table is :status 200
+		as.Equal(byte(0x88), payload[0])
+
+		r := <-requests
+		as.Equal(2, r.ProtoMajor)
+		as.Equal(http.MethodConnect, r.Method)
+		as.Equal("websocket", r.Header.Get(protocolPseudoHeader))
+
+		// 流上承载的是普通的 WebSocket 帧: 客户端加掩码, 服务端不加
+		// The stream carries plain WebSocket frames: masked from the client, unmasked from the server
+		var frame = []byte{0x81, 0x85, 1, 2, 3, 4}
+		for i, b := range []byte("hello") {
+			frame = append(frame, b^frame[2+i%4])
+		}
+		client.writeFrame(t, http2FrameData, 0, 1, frame)
+		var echo []byte
+		for len(echo) < 7 {
+			kind, payload = client.readStream(t, 1)
+			if kind == http2FrameData {
+				echo = append(echo, payload...)
+			}
+		}
+		as.Equal(append([]byte{0x81, 0x05}, "hello"...), echo)
+	})
+
+	t.Run("http/1.1", func(t *testing.T) {
+		config := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		config.NextProtos = nil
+		var messages = make(chan string, 1)
+		clientHandler := new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) { messages <- message.Data.String() }
+		client, _, err := NewClient(clientHandler, &ClientOption{
+			Addr:          "wss://" + srv.Listener.Addr().String() + "/connect",
+			TlsConfig:     config,
+			RequestHeader: http.Header{"Sec-Websocket-Protocol": {"chat"}},
+		})
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(1, (<-requests).ProtoMajor)
+		go client.ReadLoop()
+		as.NoError(client.WriteString("hello"))
+		as.Equal("hello", <-messages)
+		_ = client.WriteClose(1000, nil)
+	})
+}
+
+func TestServer_HTTP2(t *testing.T) {
+	as := assert.New(t)
+	server := NewServer(new(BuiltinEventHandler), &ServerOption{TlsConfig: &tls.Config{ServerName: "localhost"}})
+	srv := server.newHTTPServer(":0")
+	as.Equal([]string{"h2", "http/1.1"}, srv.TLSConfig.NextProtos)
+	as.Equal("localhost", srv.TLSConfig.ServerName)
+	as.Nil(server.option.TlsConfig.NextProtos)
+	as.Same(server, srv.Handler)
+}
@@ -3,10 +3,11 @@ package gbs
 import "github.com/catermujo/gbs/internal"
 
 var (
-	framePadding    = frameHeader{}            // 帧头填充物
-	defaultLogger   = new(stdLogger)           // 默认日志工具
-	bufferThreshold = uint32(256 * 1024)       // buffer阈值
-	binaryPool      = new(internal.BufferPool) // 内存池
+	framePadding    = frameHeader{}                                             // 帧头填充物
+	defaultLogger   = new(stdLogger)                                            // 默认日志工具
+	bufferThreshold = uint32(256 * 1024)                                        // buffer阈值
+	binaryPool      = new(internal.BufferPool)                                  // 内存池
+	messagePool     = internal.NewPool(func() *Message { return new(Message) }) // 零拷贝模式下的消息池
 )
 
 func init() {
@@ -28,10 +28,67 @@ func CheckEncoding(enabled bool, opcode uint8, payload []byte) bool {
 	return true
 }
 
+// SplitUTF8 返回 p 中不含末尾不完整字符的前缀长度, 以及该前缀是否为有效的 UTF-8 编码
+// 用于分片校验文本: 被截断的字符留到下一片再校验.
+// returns the length of the prefix of p without a trailing incomplete character, and whether that prefix is valid UTF-8.
+// It is used to validate fragmented text: a truncated character is carried over to the next fragment.
+func SplitUTF8(p []byte) (n int, ok bool) {
+	n = len(p)
+	for i := n - 1; i >= 0 && i >= n-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				n = i
+			}
+			break
+		}
+	}
+	return n, utf8.Valid(p[:n])
+}
+
+// UTF8Checker 增量校验分段到达的 UTF-8 文本
+// Incrementally validates UTF-8 text that arrives in pieces
+type UTF8Checker struct {
+	buf [utf8.UTFMax]byte
+	n   int
+}
+
+// Write 校验下一段数据, 被截断的字符留到下一段
+// Validates the next piece, a truncated character is carried over to the next one
+func (c *UTF8Checker) Write(p []byte) bool {
+	if c.n > 0 {
+		for len(p) > 0 && !utf8.FullRune(c.buf[:c.n]) {
+			c.buf[c.n] = p[0]
+			c.n++
+			p = p[1:]
+		}
+		if !utf8.FullRune(c.buf[:c.n]) {
+			return true
+		}
+		if r, size := utf8.DecodeRune(c.buf[:c.n]); r == utf8.RuneError && size == 1 {
+			return false
+		}
+		c.n = 0
+	}
+	n, ok := SplitUTF8(p)
+	if !ok {
+		return false
+	}
+	c.n = copy(c.buf[:], p[n:])
+	return true
+}
+
+// Done 文本是否以完整的字符结束
+// Whether the text ends with a complete character
+func (c *UTF8Checker) Done() bool { return c.n == 0 }
+
 type Payload interface {
 	io.WriterTo
 	Len() int
 	CheckEncoding(enabled bool, opcode uint8) bool
+
+	// AppendTo 将负载的切片追加到 dst, 不拷贝数据
+	// appends the slices of the payload to dst, without copying the data
+	AppendTo(dst [][]byte) [][]byte
 }
 
 type Buffers [][]byte
@@ -66,6 +123,15 @@ func (b Buffers) WriteTo(w io.Writer) (int64, error) {
 	return int64(n), nil
 }
 
+func (b Buffers) AppendTo(dst [][]byte) [][]byte {
+	for i := range b {
+		if len(b[i]) > 0 {
+			dst = append(dst, b[i])
+		}
+	}
+	return dst
+}
+
 type Bytes []byte
 
 func (b Bytes) CheckEncoding(enabled bool, opcode uint8) bool {
@@ -81,3 +147,10 @@ func (b Bytes) WriteTo(w io.Writer) (int64, error) {
 	n, err := w.Write(b)
 	return int64(n), err
 }
+
+func (b Bytes) AppendTo(dst [][]byte) [][]byte {
+	if len(b) == 0 {
+		return dst
+	}
+	return append(dst, b)
+}
@@ -88,3 +88,60 @@ func TestBytes_WriteTo(t *testing.T) {
 		assert.True(t, b.CheckEncoding(true, 2))
 	})
 }
+
+func TestSplitUTF8(t *testing.T) {
+	as := assert.New(t)
+	s := []byte("你好")
+
+	n, ok := SplitUTF8(s)
+	as.Equal(6, n)
+	as.True(ok)
+
+	n, ok = SplitUTF8(s[:4])
+	as.Equal(3, n)
+	as.True(ok)
+
+	n, ok = SplitUTF8(s[:5])
+	as.Equal(3, n)
+	as.True(ok)
+
+	n, ok = SplitUTF8(nil)
+	as.Equal(0, n)
+	as.True(ok)
+
+	_, ok = SplitUTF8([]byte{'a', 0xff, 'b'})
+	as.False(ok)
+
+	_, ok = SplitUTF8([]byte{'a', 0xe0, 0x80})
+	as.False(ok)
+}
+
+func TestUTF8Checker(t *testing.T) {
+	as := assert.New(t)
+	text := []byte("hello, 你好, 世界")
+
+	for i := 1; i <= len(text); i++ {
+		var c UTF8Checker
+		for j := 0; j < len(text); j += i {
+			as.True(c.Write(text[j:Min(j+i, len(text))]))
+		}
+		as.True(c.Done())
+	}
+
+	var c UTF8Checker
+	as.True(c.Write(text[:8]))
+	as.False(c.Done())
+	as.False(c.Write([]byte("a")))
+
+	c = UTF8Checker{}
+	as.False(c.Write([]byte{'a', 0xff}))
+}
+
+func TestPayload_AppendTo(t *testing.T) {
+	as := assert.New(t)
+	dst := [][]byte{[]byte("head")}
+	dst = Buffers{[]byte("a"), nil, []byte("bc")}.AppendTo(dst)
+	dst = Bytes("d").AppendTo(dst)
+	dst = Bytes(nil).AppendTo(dst)
+	as.Equal([][]byte{[]byte("head"), []byte("a"), []byte("bc"), []byte("d")}, dst)
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/binary"
@@ -9,6 +10,7 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"sync"
 	"unsafe"
 )
 
@@ -254,3 +256,44 @@ func GetAddrFromURL(URL *url.URL, tlsEnabled bool) string {
 	}
 	return hostname + ":" + port
 }
+
+// GetUnixAddrFromURL 解析 ws+unix://<socket>:<path> 形式的地址, 返回套接字路径和请求路径.
+// 套接字路径本身不能包含冒号, 以 @ 开头表示抽象命名空间; 请求路径缺省为 /, 缺少开头的 / 时会补上.
+// Parses an address of the form ws+unix://<socket>:<path>, returns the socket path and the request path.
+// The socket path itself must not contain a colon, a leading @ denotes the abstract namespace; the request path defaults to /
+// and gets a leading / when it lacks one.
+func GetUnixAddrFromURL(addr string) (socket string, path string) {
+	addr = strings.TrimPrefix(addr, "ws+unix://")
+	socket, path, _ = strings.Cut(addr, ":")
+	if path == "" || path[0] != '/' {
+		path = "/" + path
+	}
+	return socket, path
+}
+
+// AfterFunc 在 ctx 取消后调用 f, 类似 Go 1.21 的 context.AfterFunc.
+// stop 阻止 f 被调用时返回 true; 返回 false 说明 f 已经被调用, 并且此时 f 已经执行完毕.
+// Calls f once ctx is canceled, similar to context.AfterFunc of Go 1.21.
+// stop returns true if it prevented f from being called; false means f has been called and has already returned.
+func AfterFunc(ctx context.Context, f func()) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return true }
+	}
+	var once sync.Once
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			once.Do(f)
+		case <-done:
+		}
+	}()
+	return func() bool {
+		stopped := false
+		once.Do(func() {
+			stopped = true
+			close(done)
+		})
+		return stopped
+	}
+}
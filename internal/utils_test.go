@@ -2,6 +2,7 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"hash/fnv"
@@ -9,7 +10,9 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -260,3 +263,46 @@ func TestGetAddrFromURL(t *testing.T) {
 		assert.Equal(t, addr, "google.com:80")
 	})
 }
+
+func TestGetUnixAddrFromURL(t *testing.T) {
+	as := assert.New(t)
+	for _, item := range []struct{ addr, socket, path string }{
+		{"ws+unix:///run/app.sock:/connect?id=1", "/run/app.sock", "/connect?id=1"},
+		{"ws+unix:///run/app.sock", "/run/app.sock", "/"},
+		{"ws+unix:///run/app.sock:?id=1", "/run/app.sock", "/?id=1"},
+		{"ws+unix:///run/app.sock:connect", "/run/app.sock", "/connect"},
+		{"ws+unix://@app:/connect", "@app", "/connect"},
+	} {
+		socket, path := GetUnixAddrFromURL(item.addr)
+		as.Equal(item.socket, socket)
+		as.Equal(item.path, path)
+	}
+}
+
+func TestAfterFunc(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var called = make(chan struct{})
+		stop := AfterFunc(ctx, func() { close(called) })
+		cancel()
+		<-called
+		as.False(stop())
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var called int32
+		stop := AfterFunc(ctx, func() { atomic.AddInt32(&called, 1) })
+		as.True(stop())
+		as.False(stop())
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+		as.Zero(atomic.LoadInt32(&called))
+	})
+
+	t.Run("background", func(t *testing.T) {
+		as.True(AfterFunc(context.Background(), func() {})())
+	})
+}
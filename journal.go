@@ -0,0 +1,32 @@
+package gbs
+
+import (
+	"bytes"
+
+	"github.com/catermujo/gbs/internal"
+)
+
+// Journal 记录连接收发的数据消息, 例如 journal 包的实现.
+// 发出的消息在成功写入之后记录, 调用时持有连接的写锁, 所以记录顺序就是写入顺序; 收到的消息在解码之后, 交付之前记录.
+// 流式写入器 (NextWriter) 和流式读取器逐帧收发的消息不会被记录. payload 只在调用期间有效.
+// Records the data messages a connection sends and receives, e.g. the implementation of the journal package.
+// Outgoing messages are recorded once written successfully, under the write lock of the connection,
+// so they are recorded in the order they hit the wire; incoming messages are recorded after decoding and before delivery.
+// Messages streamed frame by frame through NextWriter or streaming readers are not recorded.
+// The payload is only valid during the call.
+type Journal interface {
+	Record(socket *Conn, inbound bool, opcode Opcode, payload []byte)
+}
+
+// 记录消息, 未设置 Journal 时什么也不做
+// Records the message, does nothing without a Journal
+func (c *Conn) record(inbound bool, opcode Opcode, payload internal.Payload) {
+	if c.config.Journal == nil {
+		return
+	}
+	if p, ok := payload.(internal.Bytes); ok {
+		c.config.Journal.Record(c, inbound, opcode, p)
+		return
+	}
+	c.config.Journal.Record(c, inbound, opcode, bytes.Join(payload.AppendTo(nil), nil))
+}
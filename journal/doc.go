@@ -0,0 +1,24 @@
+// Package journal 把连接收发的消息追加写入磁盘, 用于审计和为后加入的订阅者补发历史, 不依赖外部数据库.
+// 每条记录带有序列号, 时间戳和连接 ID, 依次写入可轮转的段文件, 每个段文件有一个记录偏移量的索引文件,
+// Replay 借助索引定位到任意序列号并按序遍历. 打开日志时会校验最后一个段文件, 截掉崩溃留下的不完整记录.
+// 把 *Journal 设置为 ServerOption.Journal 或 ClientOption.Journal 即可记录连接发出的消息, 包括 Broadcaster 广播的消息;
+// 连接 ID 是该连接第一条记录的序列号.
+// Package journal appends the messages of connections to disk, for auditing and for catching up late joiners,
+// without any external database.
+// Every record carries a sequence number, a timestamp and a connection ID, and goes into rotating segment files,
+// each with an index file of record offsets, through which Replay seeks to any sequence number and iterates in order.
+// Opening the journal validates the last segment and cuts off an incomplete record left by a crash.
+// Set the *Journal as ServerOption.Journal or ClientOption.Journal to record the messages the connections send,
+// including those sent by a Broadcaster; the connection ID is the sequence number of the first record of the connection.
+//
+//	j, err := journal.Open("/var/lib/app/journal", &journal.Option{Sync: journal.SyncInterval, Inbound: true})
+//	server := gbs.NewServer(handler, &gbs.ServerOption{Journal: j})
+//
+//	it := j.Replay(from, math.MaxUint64)
+//	for it.Next() {
+//		record := it.Record()
+//	}
+//	if err := it.Close(); err != nil {
+//		return err
+//	}
+package journal
@@ -0,0 +1,171 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+)
+
+// Iterator 按序列号遍历记录, 用法类似 bufio.Scanner. 不能并发使用.
+// Iterates over records by sequence number, used like bufio.Scanner. Not safe for concurrent use.
+type Iterator struct {
+	dir       string
+	segments  []uint64
+	seq       uint64 // 下一条要读取的序列号 / Sequence number to read next
+	end       uint64 // 遍历的终点, 不包含 / End of the iteration, exclusive
+	last      uint64 // 当前段文件的终点, 不包含 / End of the current segment, exclusive
+	file      *os.File
+	reader    *bufio.Reader
+	remaining int64
+	header    [headerSize]byte
+	record    *Record
+	err       error
+}
+
+// Replay 按序列号遍历区间 [from, to] 内的记录, 例如 Replay(1, math.MaxUint64) 遍历全部记录.
+// 只包含调用时已经追加的记录; 已经被轮转删除的记录会被跳过, 可以通过 Record().Seq 发现.
+// 遍历结束后需要调用 Close.
+// Iterates over the records of [from, to] by sequence number, e.g. Replay(1, math.MaxUint64) iterates over them all.
+// Only the records appended by the time of the call are included;
+// records already deleted by rotation are skipped, which Record().Seq reveals.
+// Close has to be called once done.
+func (c *Journal) Replay(from, to uint64) *Iterator {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.next
+	if to < end {
+		end = to + 1
+	}
+	return &Iterator{
+		dir:      c.dir,
+		segments: append([]uint64(nil), c.segments...),
+		seq:      from,
+		end:      end,
+		reader:   bufio.NewReader(nil),
+	}
+}
+
+// Next 读取下一条记录, 遍历结束或者出错时返回 false
+// Reads the next record, returns false at the end of the iteration or on error
+func (c *Iterator) Next() bool {
+	for c.err == nil && c.seq < c.end {
+		if c.file == nil {
+			c.err = c.open()
+			continue
+		}
+		if c.seq >= c.last {
+			c.closeFile()
+			continue
+		}
+
+		record, n, err := c.read()
+		if err != nil {
+			c.err = err
+			break
+		}
+		c.remaining -= n
+		c.seq++
+		c.record = record
+		return true
+	}
+	c.closeFile()
+	return false
+}
+
+// 读取一条记录并检查序列号
+// Reads a record and checks its sequence number
+func (c *Iterator) read() (*Record, int64, error) {
+	record, n, err := readRecord(c.reader, c.header[:], c.remaining)
+	if err == io.EOF || (err == nil && record.Seq != c.seq) {
+		err = ErrCorrupted
+	}
+	return record, n, err
+}
+
+// 打开包含 c.seq 的段文件并定位到对应的记录. 段文件已经被删除时跳过它.
+// Opens the segment holding c.seq and seeks to its record. Segments deleted meanwhile are skipped.
+func (c *Iterator) open() error {
+	if len(c.segments) == 0 {
+		c.seq = c.end
+		return nil
+	}
+	// 早于第一个段文件的记录已经被删除, 从第一个段文件开始, 此时可能已经越过了终点
+	// Records before the first segment are gone, so start from the first segment, which may already be past the end
+	i := sort.Search(len(c.segments), func(i int) bool { return c.segments[i] > c.seq }) - 1
+	if i < 0 {
+		i, c.seq = 0, c.segments[0]
+		if c.seq >= c.end {
+			return nil
+		}
+	}
+	first := c.segments[i]
+	c.last = c.end
+	if i+1 < len(c.segments) && c.segments[i+1] < c.end {
+		c.last = c.segments[i+1]
+	}
+
+	var entry [indexEntrySize]byte
+	index, err := os.Open(segmentPath(c.dir, first, indexExt))
+	if err == nil {
+		_, err = index.ReadAt(entry[:], int64(c.seq-first)*indexEntrySize)
+		_ = index.Close()
+	}
+	if err != nil {
+		return c.skip(err)
+	}
+	file, err := os.Open(segmentPath(c.dir, first, logExt))
+	if err != nil {
+		return c.skip(err)
+	}
+	info, err := file.Stat()
+	if err == nil {
+		offset := int64(binary.BigEndian.Uint64(entry[:]))
+		c.remaining = info.Size() - offset
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	c.file = file
+	c.reader.Reset(file)
+	return nil
+}
+
+// 段文件已经被轮转删除时跳到下一个段文件; 索引项缺失说明文件损坏, 其他错误原样返回
+// Moves on to the next segment when this one was deleted by rotation;
+// a missing index entry means corruption, and other errors are returned as is
+func (c *Iterator) skip(err error) error {
+	if err == io.EOF {
+		return ErrCorrupted
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	c.seq = c.last
+	return nil
+}
+
+func (c *Iterator) closeFile() {
+	if c.file != nil {
+		_ = c.file.Close()
+		c.file = nil
+	}
+}
+
+// Record 返回 Next 读取的记录
+// Returns the record read by Next
+func (c *Iterator) Record() *Record { return c.record }
+
+// Err 返回遍历中遇到的错误
+// Returns the error met during the iteration
+func (c *Iterator) Err() error { return c.err }
+
+// Close 释放遍历占用的文件, 返回遍历中遇到的错误
+// Releases the file held by the iteration and returns the error met during it
+func (c *Iterator) Close() error {
+	c.closeFile()
+	return c.err
+}
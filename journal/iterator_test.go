@@ -0,0 +1,67 @@
+package journal
+
+import (
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterator_Corrupted(t *testing.T) {
+	as := assert.New(t)
+	dir := t.TempDir()
+	j, err := Open(dir, &Option{Sync: SyncNever})
+	if !as.NoError(err) {
+		return
+	}
+	defer j.Close()
+	for _, s := range []string{"a", "b", "c"} {
+		_, _ = j.Append(Record{Payload: []byte(s)})
+	}
+
+	// 改写第二条记录的负载
+	// Overwrites the payload of the second record
+	path := segmentPath(dir, 1, logExt)
+	p, err := os.ReadFile(path)
+	if !as.NoError(err) {
+		return
+	}
+	p[2*headerSize+1] = 'x'
+	as.NoError(os.WriteFile(path, p, 0o644))
+
+	it := j.Replay(1, math.MaxUint64)
+	as.True(it.Next())
+	as.Equal("a", string(it.Record().Payload))
+	as.False(it.Next())
+	as.ErrorIs(it.Err(), ErrCorrupted)
+	as.ErrorIs(it.Close(), ErrCorrupted)
+
+	// 索引指向的位置不是期望的记录
+	// The index points at a record other than the expected one
+	index := segmentPath(dir, 1, indexExt)
+	as.NoError(os.WriteFile(index, make([]byte, 3*indexEntrySize), 0o644))
+	it = j.Replay(3, 3)
+	as.False(it.Next())
+	as.ErrorIs(it.Close(), ErrCorrupted)
+
+	// 索引项缺失
+	// The index entry is missing
+	as.NoError(os.WriteFile(index, nil, 0o644))
+	it = j.Replay(1, 1)
+	as.False(it.Next())
+	as.ErrorIs(it.Close(), ErrCorrupted)
+}
+
+func TestIterator_Empty(t *testing.T) {
+	as := assert.New(t)
+	j, err := Open(t.TempDir(), nil)
+	if !as.NoError(err) {
+		return
+	}
+	defer j.Close()
+	it := j.Replay(0, math.MaxUint64)
+	as.False(it.Next())
+	as.Nil(it.Record())
+	as.NoError(it.Close())
+}
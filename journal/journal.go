@@ -0,0 +1,299 @@
+package journal
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/catermujo/gbs"
+)
+
+var (
+	// ErrClosed 日志已经关闭
+	// The journal is closed
+	ErrClosed = errors.New("journal: closed")
+
+	// ErrCorrupted 记录不完整或者校验失败
+	// A record is incomplete or fails its checksum
+	ErrCorrupted = errors.New("journal: corrupted record")
+)
+
+// Record 一条日志记录
+// A journal record
+type Record struct {
+	// Sequence number, consecutive across the whole journal
+	Seq uint64
+
+	// Time the message was recorded
+	Time time.Time
+
+	// Connection ID, the sequence number of the first record of the connection
+	ConnID uint64
+
+	// Whether the message was received rather than sent
+	Inbound bool
+
+	// Opcode of the message
+	Opcode gbs.Opcode
+
+	// Payload of the message
+	Payload []byte
+}
+
+// Journal 追加写入的消息日志, 实现了 gbs.Journal, 可以被多个连接并发使用
+// Append-only message journal implementing gbs.Journal, safe for concurrent use by many connections
+type Journal struct {
+	option   *Option
+	dir      string
+	mu       sync.Mutex
+	segments []uint64 // 段文件第一条记录的序列号 / Sequence number of the first record of each segment
+	log      *os.File
+	index    *os.File
+	size     int64  // 当前段文件的长度 / Length of the active segment
+	next     uint64 // 下一条记录的序列号 / Sequence number of the next record
+	buf      []byte
+	dirty    bool
+	err      error
+	closed   bool
+	done     chan struct{}
+}
+
+// Open 打开目录中的日志, 目录不存在时创建. 最后一个段文件末尾不完整的记录会被截掉, 其索引会被重建.
+// option 可以为 nil.
+// Opens the journal in the directory, which is created when missing.
+// An incomplete record at the end of the last segment is cut off and the index of that segment is rebuilt.
+// option may be nil.
+func Open(dir string, option *Option) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &Journal{option: initOption(option), dir: dir, next: 1, done: make(chan struct{})}
+	if len(segments) == 0 {
+		err = c.create(1)
+	} else {
+		c.segments = segments[:len(segments)-1]
+		err = c.recover(segments[len(segments)-1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.option.Sync == SyncInterval {
+		go c.syncLoop()
+	}
+	return c, nil
+}
+
+// 创建新的段文件
+// Creates a new segment
+func (c *Journal) create(first uint64) error {
+	const flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+	log, err := os.OpenFile(segmentPath(c.dir, first, logExt), flag, 0o644)
+	if err != nil {
+		return err
+	}
+	index, err := os.OpenFile(segmentPath(c.dir, first, indexExt), flag, 0o644)
+	if err != nil {
+		_ = log.Close()
+		return err
+	}
+	c.segments = append(c.segments, first)
+	c.log, c.index, c.size, c.next = log, index, 0, first
+	return nil
+}
+
+// 打开最后一个段文件继续写入, 截掉不完整的记录并重建索引
+// Opens the last segment to carry on writing, cutting off an incomplete record and rebuilding the index
+func (c *Journal) recover(first uint64) error {
+	offsets, size, err := scanSegment(segmentPath(c.dir, first, logExt), first)
+	if err != nil {
+		return err
+	}
+	log, err := os.OpenFile(segmentPath(c.dir, first, logExt), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	index, err := os.OpenFile(segmentPath(c.dir, first, indexExt), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		_ = log.Close()
+		return err
+	}
+	c.segments = append(c.segments, first)
+	c.log, c.index, c.size, c.next = log, index, size, first+uint64(len(offsets))
+
+	var buf = make([]byte, 0, len(offsets)*indexEntrySize)
+	for _, offset := range offsets {
+		buf = binary.BigEndian.AppendUint64(buf, offset)
+	}
+	if err := log.Truncate(size); err != nil {
+		_ = c.closeFiles()
+		return err
+	}
+	if _, err := index.Write(buf); err != nil {
+		_ = c.closeFiles()
+		return err
+	}
+	return nil
+}
+
+// Append 追加一条记录, 忽略 record.Seq, record.Time 为零值时使用当前时间. 返回记录的序列号.
+// 一次写入失败之后, 日志不再接受新的记录.
+// Appends a record, record.Seq is ignored and a zero record.Time means now. Returns the sequence number of the record.
+// After a failed write the journal accepts no more records.
+func (c *Journal) Append(record Record) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.append(&record)
+}
+
+func (c *Journal) append(record *Record) (uint64, error) {
+	if c.closed {
+		return 0, ErrClosed
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	record.Seq = c.next
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	c.buf = appendRecord(c.buf[:0], record)
+	if c.size > 0 && c.size+int64(len(c.buf)) > c.option.SegmentSize {
+		if c.err = c.rotate(); c.err != nil {
+			return 0, c.err
+		}
+	}
+
+	var entry [indexEntrySize]byte
+	binary.BigEndian.PutUint64(entry[:], uint64(c.size))
+	if _, c.err = c.log.Write(c.buf); c.err != nil {
+		return 0, c.err
+	}
+	if _, c.err = c.index.Write(entry[:]); c.err != nil {
+		return 0, c.err
+	}
+	if c.option.Sync == SyncAlways {
+		if c.err = c.log.Sync(); c.err != nil {
+			return 0, c.err
+		}
+	}
+	c.size += int64(len(c.buf))
+	c.next++
+	c.dirty = true
+	return record.Seq, nil
+}
+
+// Record 实现 gbs.Journal. 未开启 Option.Inbound 时忽略收到的消息; 写入失败时通过 Err 查询.
+// Implements gbs.Journal. Incoming messages are ignored unless Option.Inbound is on; a failed write is reported by Err.
+func (c *Journal) Record(socket *gbs.Conn, inbound bool, opcode gbs.Opcode, payload []byte) {
+	if inbound && !c.option.Inbound {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 连接 ID 在锁内分配, 读写协程不会为同一个连接分配两个 ID
+	// Connection IDs are assigned under the lock, so the reader and the writer cannot assign two IDs to one connection
+	record := Record{Inbound: inbound, Opcode: opcode, Payload: payload}
+	v, ok := socket.Session().Load(storageKey)
+	if ok {
+		record.ConnID, _ = v.(uint64)
+	} else {
+		record.ConnID = c.next
+	}
+	if seq, err := c.append(&record); err == nil && !ok {
+		socket.Session().Store(storageKey, seq)
+	}
+}
+
+// 同步并关闭当前的段文件, 创建下一个段文件, 然后删除超出数量的旧段文件
+// Syncs and closes the active segment, creates the next one, then deletes old segments beyond the limit
+func (c *Journal) rotate() error {
+	if err := c.sync(); err != nil {
+		return err
+	}
+	if err := c.closeFiles(); err != nil {
+		return err
+	}
+	if err := c.create(c.next); err != nil {
+		return err
+	}
+	for c.option.MaxSegments > 0 && len(c.segments) > c.option.MaxSegments {
+		first := c.segments[0]
+		c.segments = c.segments[1:]
+		_ = os.Remove(segmentPath(c.dir, first, logExt))
+		_ = os.Remove(segmentPath(c.dir, first, indexExt))
+	}
+	return nil
+}
+
+func (c *Journal) sync() error {
+	c.dirty = false
+	return errors.Join(c.log.Sync(), c.index.Sync())
+}
+
+func (c *Journal) closeFiles() error {
+	return errors.Join(c.log.Close(), c.index.Close())
+}
+
+// 按 SyncInterval 策略定期同步, 同步在锁外进行, 不阻塞写入
+// Syncs periodically under the SyncInterval policy, outside the lock so that writes are not blocked
+func (c *Journal) syncLoop() {
+	ticker := time.NewTicker(c.option.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			log, dirty := c.log, c.dirty
+			c.dirty = false
+			c.mu.Unlock()
+			// 轮转期间文件可能已经被关闭, 轮转本身会同步
+			// The file may have been closed by a rotation meanwhile, which syncs by itself
+			if dirty {
+				_ = log.Sync()
+			}
+		}
+	}
+}
+
+// Sync 立即将已经追加的记录同步到磁盘
+// Syncs the records appended so far to disk right away
+func (c *Journal) Sync() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return c.sync()
+}
+
+// Err 返回导致日志停止写入的错误
+// Returns the error that stopped the journal from writing
+func (c *Journal) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close 同步并关闭日志, 之后的追加返回 ErrClosed. 进行中的 Replay 不受影响.
+// Syncs and closes the journal, later appends return ErrClosed. Replays in progress are not affected.
+func (c *Journal) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	return errors.Join(c.sync(), c.closeFiles())
+}
@@ -0,0 +1,218 @@
+package journal
+
+import (
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs"
+	"github.com/catermujo/gbs/gbstest"
+	"github.com/stretchr/testify/assert"
+)
+
+// 读取区间内全部记录的负载
+// Reads the payloads of all records in the range
+func replayPayloads(t *testing.T, j *Journal, from, to uint64) []string {
+	var payloads []string
+	it := j.Replay(from, to)
+	for it.Next() {
+		payloads = append(payloads, string(it.Record().Payload))
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return payloads
+}
+
+func TestJournal(t *testing.T) {
+	as := assert.New(t)
+	dir := t.TempDir()
+	j, err := Open(dir, &Option{Sync: SyncAlways})
+	if !as.NoError(err) {
+		return
+	}
+	now := time.Now()
+	for i, s := range []string{"a", "b", "c"} {
+		seq, err := j.Append(Record{Seq: 100, Time: now, ConnID: 1, Opcode: gbs.OpcodeText, Payload: []byte(s)})
+		as.NoError(err)
+		as.Equal(uint64(i+1), seq)
+	}
+	as.Equal([]string{"a", "b", "c"}, replayPayloads(t, j, 1, math.MaxUint64))
+	as.Equal([]string{"b"}, replayPayloads(t, j, 2, 2))
+	as.Empty(replayPayloads(t, j, 4, math.MaxUint64))
+	as.Empty(replayPayloads(t, j, 3, 2))
+
+	it := j.Replay(3, 3)
+	as.True(it.Next())
+	record := it.Record()
+	as.Equal(uint64(3), record.Seq)
+	as.Equal(uint64(1), record.ConnID)
+	as.True(now.Equal(record.Time))
+	as.Equal(gbs.OpcodeText, record.Opcode)
+	as.False(it.Next())
+	as.NoError(it.Close())
+
+	as.NoError(j.Sync())
+	as.NoError(j.Close())
+	as.NoError(j.Close())
+	_, err = j.Append(Record{})
+	as.ErrorIs(err, ErrClosed)
+	as.ErrorIs(j.Sync(), ErrClosed)
+
+	// 重新打开后接着编号
+	// Numbering carries on after reopening
+	j, err = Open(dir, nil)
+	if !as.NoError(err) {
+		return
+	}
+	defer j.Close()
+	seq, err := j.Append(Record{Payload: []byte("d")})
+	as.NoError(err)
+	as.Equal(uint64(4), seq)
+	as.Equal([]string{"a", "b", "c", "d"}, replayPayloads(t, j, 0, math.MaxUint64))
+}
+
+func TestJournal_Rotate(t *testing.T) {
+	as := assert.New(t)
+	dir := t.TempDir()
+	// 每个段文件容纳两条记录
+	// Every segment holds two records
+	j, err := Open(dir, &Option{SegmentSize: 2 * (headerSize + 1), Sync: SyncNever})
+	if !as.NoError(err) {
+		return
+	}
+	defer j.Close()
+	for _, s := range []string{"a", "b", "c", "d", "e"} {
+		_, err = j.Append(Record{Payload: []byte(s)})
+		as.NoError(err)
+	}
+	segments, err := listSegments(dir)
+	as.NoError(err)
+	as.Equal([]uint64{1, 3, 5}, segments)
+	as.Equal([]string{"b", "c", "d"}, replayPayloads(t, j, 2, 4))
+	as.Equal([]string{"e"}, replayPayloads(t, j, 5, 5))
+
+	// 超过上限的记录独占一个段文件
+	// A record above the limit takes a segment of its own
+	_, err = j.Append(Record{Payload: []byte("large")})
+	as.NoError(err)
+	_, err = j.Append(Record{Payload: []byte("f")})
+	as.NoError(err)
+	segments, _ = listSegments(dir)
+	as.Equal([]uint64{1, 3, 5, 6, 7}, segments)
+	as.Equal([]string{"e", "large", "f"}, replayPayloads(t, j, 5, math.MaxUint64))
+}
+
+func TestJournal_MaxSegments(t *testing.T) {
+	as := assert.New(t)
+	dir := t.TempDir()
+	j, err := Open(dir, &Option{SegmentSize: 1, MaxSegments: 2})
+	if !as.NoError(err) {
+		return
+	}
+	defer j.Close()
+
+	// 遍历开始之后被删除的段文件同样被跳过
+	// Segments deleted after the iteration started are skipped too
+	_, _ = j.Append(Record{Payload: []byte("a")})
+	_, _ = j.Append(Record{Payload: []byte("b")})
+	it := j.Replay(1, math.MaxUint64)
+	for _, s := range []string{"c", "d"} {
+		_, err = j.Append(Record{Payload: []byte(s)})
+		as.NoError(err)
+	}
+	segments, _ := listSegments(dir)
+	as.Equal([]uint64{3, 4}, segments)
+	as.False(it.Next())
+	as.NoError(it.Close())
+
+	it = j.Replay(1, math.MaxUint64)
+	as.True(it.Next())
+	as.Equal(uint64(3), it.Record().Seq)
+	as.True(it.Next())
+	as.Equal("d", string(it.Record().Payload))
+	as.False(it.Next())
+	as.NoError(it.Close())
+}
+
+func TestJournal_Recover(t *testing.T) {
+	as := assert.New(t)
+	dir := t.TempDir()
+	j, err := Open(dir, &Option{Sync: SyncNever})
+	if !as.NoError(err) {
+		return
+	}
+	for _, s := range []string{"a", "b"} {
+		_, _ = j.Append(Record{Payload: []byte(s)})
+	}
+	as.NoError(j.Close())
+
+	// 模拟崩溃时写了一半的记录
+	// Simulates a record half written when crashing
+	file, err := os.OpenFile(segmentPath(dir, 1, logExt), os.O_WRONLY|os.O_APPEND, 0o644)
+	if !as.NoError(err) {
+		return
+	}
+	_, _ = file.Write(appendRecord(nil, &Record{Seq: 3, Payload: []byte("torn")})[:headerSize])
+	_ = file.Close()
+
+	j, err = Open(dir, nil)
+	if !as.NoError(err) {
+		return
+	}
+	defer j.Close()
+	seq, err := j.Append(Record{Payload: []byte("c")})
+	as.NoError(err)
+	as.Equal(uint64(3), seq)
+	as.Equal([]string{"a", "b", "c"}, replayPayloads(t, j, 1, math.MaxUint64))
+}
+
+func TestJournal_Record(t *testing.T) {
+	as := assert.New(t)
+	j, err := Open(t.TempDir(), &Option{Inbound: true, SyncInterval: time.Millisecond})
+	if !as.NoError(err) {
+		return
+	}
+	defer j.Close()
+
+	serverHandler, clientHandler := new(gbstest.Recorder), new(gbstest.Recorder)
+	server, client, err := gbstest.Pipe(serverHandler, clientHandler, &gbs.ServerOption{Journal: j}, nil)
+	if !as.NoError(err) {
+		return
+	}
+	go server.ReadLoop()
+	go client.ReadLoop()
+	defer client.WriteClose(1000, nil)
+
+	as.NoError(server.WriteString("out"))
+	_, err = clientHandler.WaitMessages(1, time.Second)
+	as.NoError(err)
+	as.NoError(client.WriteMessage(gbs.OpcodeBinary, []byte("in")))
+	_, err = serverHandler.WaitMessages(1, time.Second)
+	as.NoError(err)
+
+	it := j.Replay(1, math.MaxUint64)
+	defer it.Close()
+	var records []Record
+	for it.Next() {
+		records = append(records, *it.Record())
+	}
+	if !as.Len(records, 2) {
+		return
+	}
+	as.Equal(uint64(1), records[0].ConnID)
+	as.False(records[0].Inbound)
+	as.Equal("out", string(records[0].Payload))
+	as.Equal(uint64(1), records[1].ConnID)
+	as.True(records[1].Inbound)
+	as.Equal(gbs.OpcodeBinary, records[1].Opcode)
+	as.Equal("in", string(records[1].Payload))
+	as.NoError(j.Err())
+
+	// 默认不记录收到的消息
+	// Incoming messages are not recorded by default
+	j.option.Inbound = false
+	j.Record(server, true, gbs.OpcodeText, []byte("ignored"))
+	as.Equal(uint64(3), j.next)
+}
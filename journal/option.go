@@ -0,0 +1,94 @@
+package journal
+
+import "time"
+
+const (
+	// 段文件和索引文件的扩展名, 文件名是段内第一条记录的序列号
+	// Extensions of the segment and index files, named after the sequence number of the first record of the segment
+	logExt   = ".log"
+	indexExt = ".idx"
+
+	// 记录头部: length(4) crc(4) seq(8) time(8) conn(8) flags(1) opcode(1), 随后是负载
+	// Record header: length(4) crc(4) seq(8) time(8) conn(8) flags(1) opcode(1), followed by the payload
+	headerSize = 34
+
+	// 索引项: 记录在段文件中的偏移量(8)
+	// Index entry: offset of the record within the segment file(8)
+	indexEntrySize = 8
+
+	// 标志位: 收到的消息
+	// Flag: an incoming message
+	flagInbound uint8 = 1
+
+	// 连接的 SessionStorage 中保存连接 ID 的键
+	// Key of the connection ID in the SessionStorage of the connection
+	storageKey = "gbs.journal"
+
+	// 默认的段文件大小
+	// Default segment file size
+	defaultSegmentSize = 64 * 1024 * 1024
+
+	// 默认的同步间隔
+	// Default sync interval
+	defaultSyncInterval = time.Second
+)
+
+// SyncPolicy 同步策略, 决定何时调用 fsync
+// Sync policy, deciding when fsync is called
+type SyncPolicy uint8
+
+const (
+	// SyncInterval 每隔 Option.SyncInterval 在后台同步一次, 默认策略. 崩溃时最多丢失一个间隔内的记录.
+	// Syncs in the background every Option.SyncInterval, the default policy. A crash loses at most one interval of records.
+	SyncInterval SyncPolicy = iota
+
+	// SyncAlways 每条记录写入后立即同步, 最安全也最慢
+	// Syncs right after every record, the safest and the slowest
+	SyncAlways
+
+	// SyncNever 只在轮转和关闭时同步, 其余时间交给操作系统
+	// Syncs only on rotation and close, and leaves the rest to the operating system
+	SyncNever
+)
+
+// Option 日志配置
+// Journal configurations
+type Option struct {
+	// 段文件的大小上限, 写满后轮转到新的段文件, 默认为 64 MiB. 超过上限的单条记录独占一个段文件.
+	// Size limit of a segment file, the journal rotates to a new one once it is full. Defaults to 64 MiB.
+	// A single record above the limit takes a segment of its own.
+	SegmentSize int64
+
+	// 保留的段文件数量, 超出时删除最旧的段文件, 为 0 时全部保留
+	// Number of segment files kept, the oldest ones are deleted beyond it; 0 keeps them all
+	MaxSegments int
+
+	// Sync policy, defaults to SyncInterval
+	Sync SyncPolicy
+
+	// 同步间隔, 只对 SyncInterval 生效, 默认为 1 秒
+	// Sync interval, only used by SyncInterval, defaults to 1 second
+	SyncInterval time.Duration
+
+	// 是否同时记录收到的消息, 默认只记录发出的消息
+	// Whether incoming messages are recorded too, by default only outgoing ones are
+	Inbound bool
+}
+
+// 初始化配置
+// Initialize the options
+func initOption(c *Option) *Option {
+	if c == nil {
+		c = new(Option)
+	}
+	if c.SegmentSize <= 0 {
+		c.SegmentSize = defaultSegmentSize
+	}
+	if c.MaxSegments < 0 {
+		c.MaxSegments = 0
+	}
+	if c.SyncInterval <= 0 {
+		c.SyncInterval = defaultSyncInterval
+	}
+	return c
+}
@@ -0,0 +1,24 @@
+package journal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitOption(t *testing.T) {
+	as := assert.New(t)
+	option := initOption(nil)
+	as.Equal(int64(defaultSegmentSize), option.SegmentSize)
+	as.Equal(0, option.MaxSegments)
+	as.Equal(SyncInterval, option.Sync)
+	as.Equal(defaultSyncInterval, option.SyncInterval)
+	as.False(option.Inbound)
+
+	option = initOption(&Option{SegmentSize: 1024, MaxSegments: -1, Sync: SyncAlways, SyncInterval: time.Millisecond})
+	as.Equal(int64(1024), option.SegmentSize)
+	as.Equal(0, option.MaxSegments)
+	as.Equal(SyncAlways, option.Sync)
+	as.Equal(time.Millisecond, option.SyncInterval)
+}
@@ -0,0 +1,134 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/catermujo/gbs"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// 段文件或者索引文件的路径
+// Path of a segment file or an index file
+func segmentPath(dir string, first uint64, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", first, ext))
+}
+
+// 按第一条记录的序列号升序列出目录中的段文件
+// Lists the segment files of the directory in ascending order of their first sequence number
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, item := range entries {
+		name := item.Name()
+		if item.IsDir() || !strings.HasSuffix(name, logExt) {
+			continue
+		}
+		if first, err := strconv.ParseUint(strings.TrimSuffix(name, logExt), 10, 64); err == nil {
+			segments = append(segments, first)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// 将记录编码后追加到 dst
+// Encodes the record and appends it to dst
+func appendRecord(dst []byte, record *Record) []byte {
+	n := len(dst)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(record.Payload)))
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = binary.BigEndian.AppendUint64(dst, record.Seq)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(record.Time.UnixNano()))
+	dst = binary.BigEndian.AppendUint64(dst, record.ConnID)
+	var flags uint8
+	if record.Inbound {
+		flags |= flagInbound
+	}
+	dst = append(dst, flags, uint8(record.Opcode))
+	dst = append(dst, record.Payload...)
+	binary.BigEndian.PutUint32(dst[n+4:], crc32.Checksum(dst[n+8:], crcTable))
+	return dst
+}
+
+// 读取一条记录, 返回记录和它占用的字节数. limit 是剩余的文件长度.
+// 文件结束时返回 io.EOF, 记录不完整或者校验失败时返回 ErrCorrupted.
+// Reads a record, returns it and the number of bytes it takes. limit is the remaining length of the file.
+// Returns io.EOF at the end of the file, and ErrCorrupted when the record is incomplete or fails the checksum.
+func readRecord(r io.Reader, header []byte, limit int64) (*Record, int64, error) {
+	if _, err := io.ReadFull(r, header[:headerSize]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, ErrCorrupted
+		}
+		return nil, 0, err
+	}
+	n := int64(binary.BigEndian.Uint32(header))
+	if headerSize+n > limit {
+		return nil, 0, ErrCorrupted
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, ErrCorrupted
+		}
+		return nil, 0, err
+	}
+	sum := crc32.Update(crc32.Checksum(header[8:headerSize], crcTable), crcTable, payload)
+	if sum != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, ErrCorrupted
+	}
+	return &Record{
+		Seq:     binary.BigEndian.Uint64(header[8:]),
+		Time:    time.Unix(0, int64(binary.BigEndian.Uint64(header[16:]))),
+		ConnID:  binary.BigEndian.Uint64(header[24:]),
+		Inbound: header[32]&flagInbound != 0,
+		Opcode:  gbs.Opcode(header[33]),
+		Payload: payload,
+	}, headerSize + n, nil
+}
+
+// 扫描段文件, 返回有效记录的偏移量和有效长度. 遇到不完整, 损坏或者序列号不连续的记录时停止.
+// Scans a segment file, returns the offsets of the valid records and the valid length.
+// It stops at a record that is incomplete, corrupted or out of sequence.
+func scanSegment(path string, first uint64) (offsets []uint64, size int64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var header [headerSize]byte
+	reader := bufio.NewReader(file)
+	for {
+		record, n, err := readRecord(reader, header[:], info.Size()-size)
+		if err == io.EOF || err == ErrCorrupted {
+			return offsets, size, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if record.Seq != first+uint64(len(offsets)) {
+			return offsets, size, nil
+		}
+		offsets = append(offsets, uint64(size))
+		size += n
+	}
+}
@@ -0,0 +1,84 @@
+package journal
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecord_Codec(t *testing.T) {
+	as := assert.New(t)
+	record := &Record{
+		Seq:     7,
+		Time:    time.Unix(0, 1700000000123456789),
+		ConnID:  3,
+		Inbound: true,
+		Opcode:  gbs.OpcodeBinary,
+		Payload: []byte("hello"),
+	}
+	p := appendRecord(nil, record)
+	as.Len(p, headerSize+5)
+
+	var header [headerSize]byte
+	decoded, n, err := readRecord(bytes.NewReader(p), header[:], int64(len(p)))
+	if !as.NoError(err) {
+		return
+	}
+	as.Equal(int64(len(p)), n)
+	as.True(record.Time.Equal(decoded.Time))
+	decoded.Time = record.Time
+	as.Equal(record, decoded)
+
+	_, _, err = readRecord(bytes.NewReader(nil), header[:], 0)
+	as.ErrorIs(err, io.EOF)
+	_, _, err = readRecord(bytes.NewReader(p[:10]), header[:], 10)
+	as.ErrorIs(err, ErrCorrupted)
+	_, _, err = readRecord(bytes.NewReader(p), header[:], int64(len(p)-1))
+	as.ErrorIs(err, ErrCorrupted)
+
+	p[len(p)-1] ^= 0xFF
+	_, _, err = readRecord(bytes.NewReader(p), header[:], int64(len(p)))
+	as.ErrorIs(err, ErrCorrupted)
+}
+
+func TestScanSegment(t *testing.T) {
+	as := assert.New(t)
+	dir := t.TempDir()
+	var p []byte
+	var offsets []uint64
+	for seq := uint64(10); seq < 13; seq++ {
+		offsets = append(offsets, uint64(len(p)))
+		p = appendRecord(p, &Record{Seq: seq, Time: time.Now(), Payload: []byte{byte(seq)}})
+	}
+	size := int64(len(p))
+
+	// 末尾不完整的记录被忽略
+	// The incomplete record at the end is ignored
+	p = append(p, appendRecord(nil, &Record{Seq: 13, Payload: []byte("torn")})[:20]...)
+	path := segmentPath(dir, 10, logExt)
+	as.NoError(os.WriteFile(path, p, 0o644))
+	scanned, n, err := scanSegment(path, 10)
+	as.NoError(err)
+	as.Equal(offsets, scanned)
+	as.Equal(size, n)
+
+	// 序列号不连续时停止
+	// Stops when the sequence breaks
+	scanned, n, err = scanSegment(path, 11)
+	as.NoError(err)
+	as.Empty(scanned)
+	as.Zero(n)
+
+	as.NoError(os.WriteFile(filepath.Join(dir, "x.log"), nil, 0o644))
+	as.NoError(os.WriteFile(segmentPath(dir, 2, indexExt), nil, 0o644))
+	as.NoError(os.WriteFile(segmentPath(dir, 2, logExt), nil, 0o644))
+	segments, err := listSegments(dir)
+	as.NoError(err)
+	as.Equal([]uint64{2, 10}, segments)
+}
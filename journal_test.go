@@ -0,0 +1,90 @@
+package gbs
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type journalEntry struct {
+	socket  *Conn
+	inbound bool
+	opcode  Opcode
+	payload string
+}
+
+// 把记录保存在内存中的 Journal
+// Journal keeping the records in memory
+type memoryJournal struct {
+	sync.Mutex
+	entries []journalEntry
+}
+
+func (c *memoryJournal) Record(socket *Conn, inbound bool, opcode Opcode, payload []byte) {
+	c.Lock()
+	defer c.Unlock()
+	c.entries = append(c.entries, journalEntry{socket: socket, inbound: inbound, opcode: opcode, payload: string(payload)})
+}
+
+func (c *memoryJournal) Entries() []journalEntry {
+	c.Lock()
+	defer c.Unlock()
+	return append([]journalEntry(nil), c.entries...)
+}
+
+func TestJournal(t *testing.T) {
+	as := assert.New(t)
+	journal := new(memoryJournal)
+	serverHandler := new(webSocketMocker)
+	received := make(chan string, 1)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		received <- message.Data.String()
+	}
+	clientHandler := new(webSocketMocker)
+	messages := make(chan string, 8)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		messages <- message.Data.String()
+	}
+	server, client, err := newHandshakePeer(serverHandler, &ServerOption{Journal: journal}, clientHandler, nil)
+	if !as.NoError(err) {
+		return
+	}
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	as.NoError(server.WriteString("a"))
+	as.NoError(server.WritePing(nil))
+	as.NoError(server.Writev(OpcodeBinary, []byte("b"), []byte("c")))
+	as.Error(server.WriteBatch(
+		BatchMessage{Opcode: OpcodeText, Payload: []byte("d")},
+		BatchMessage{Opcode: OpcodeCloseConnection},
+		BatchMessage{Opcode: OpcodeBinary, Payload: []byte("e")},
+	))
+	broadcaster := NewBroadcaster(OpcodeText, []byte("f"))
+	as.NoError(broadcaster.Broadcast(server))
+	for i := 0; i < 5; i++ {
+		select {
+		case <-messages:
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	_ = broadcaster.Close()
+
+	as.NoError(client.WriteString("g"))
+	as.Equal("g", <-received)
+
+	// 控制帧和未通过检查的消息不会被记录
+	// Control frames and messages failing the checks are not recorded
+	as.Equal([]journalEntry{
+		{socket: server, opcode: OpcodeText, payload: "a"},
+		{socket: server, opcode: OpcodeBinary, payload: "bc"},
+		{socket: server, opcode: OpcodeText, payload: "d"},
+		{socket: server, opcode: OpcodeBinary, payload: "e"},
+		{socket: server, opcode: OpcodeText, payload: "f"},
+		{socket: server, inbound: true, opcode: OpcodeText, payload: "g"},
+	}, journal.Entries())
+	_ = client.WriteClose(1000, nil)
+}
@@ -0,0 +1,17 @@
+// Package multicast 通过 UDP 组播分发带序列号的二进制数据包, 例如行情.
+// 订阅者根据序列号发现丢包, 通过一条普通的 gbs 连接向恢复服务请求重传缺失的区间; 恢复服务保存有限长度的历史.
+// 无法恢复的区间会通过 Handler.OnLoss 通知订阅者, 之后的数据包继续按序交付.
+// Package multicast disseminates sequenced binary packets, such as market data, over UDP multicast.
+// Subscribers detect gaps from the sequence numbers and request the missing range over a regular gbs connection
+// from a recovery service, which keeps a bounded history.
+// Ranges that cannot be recovered are reported through Handler.OnLoss, and later packets keep being delivered in order.
+//
+//	publisher, _ := multicast.NewPublisher("239.0.0.1:9000", nil)
+//	go gbs.NewServer(multicast.NewRecoveryHandler(publisher.History()), nil).Run(":9001")
+//	_, _ = publisher.Publish(payload)
+//
+//	subscriber, _ := multicast.NewSubscriber("239.0.0.1:9000", handler, &multicast.SubscriberOption{
+//		Recovery: &gbs.ClientOption{Addr: "ws://127.0.0.1:9001"},
+//	})
+//	go subscriber.Run()
+package multicast
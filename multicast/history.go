@@ -0,0 +1,118 @@
+package multicast
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/catermujo/gbs"
+)
+
+// History 最近发布的数据包, 容量有限, 旧的数据包会被覆盖
+// Recently published packets, with a bounded capacity; old packets are overwritten
+type History struct {
+	mu      sync.RWMutex
+	epoch   uint32
+	packets [][]byte
+	last    uint64
+}
+
+func newHistory(epoch uint32, size int) *History {
+	return &History{epoch: epoch, packets: make([][]byte, size)}
+}
+
+// 添加数据包, 序列号必须连续递增
+// Adds a packet, sequence numbers must be consecutive
+func (c *History) add(seq uint64, packet []byte) {
+	c.mu.Lock()
+	c.packets[seq%uint64(len(c.packets))] = packet
+	c.last = seq
+	c.mu.Unlock()
+}
+
+// 第一个仍在历史中的序列号
+// First sequence number still in the history
+func (c *History) first() uint64 {
+	if n := uint64(len(c.packets)); c.last >= n {
+		return c.last - n + 1
+	}
+	return 1
+}
+
+// 查询区间 [from, to] 的数据包, 返回仍在历史中的数据包和已经被覆盖的区间
+// Looks up the packets of [from, to], returns those still in the history and the range that was overwritten
+func (c *History) get(from, to uint64) (packets [][]byte, lostFrom, lostTo uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if to > c.last {
+		to = c.last
+	}
+	if first := c.first(); from < first {
+		lostFrom, lostTo = from, first-1
+		if lostTo > to {
+			lostTo = to
+		}
+		from = first
+	}
+	for seq := from; seq <= to; seq++ {
+		packets = append(packets, c.packets[seq%uint64(len(c.packets))])
+	}
+	return packets, lostFrom, lostTo
+}
+
+// NewRecoveryHandler 创建恢复服务的事件处理器, 根据订阅者的请求重传历史中的数据包
+// Creates the event handler of the recovery service, which retransmits packets of the history on request of subscribers
+func NewRecoveryHandler(history *History) gbs.EventHandler {
+	return &recoveryHandler{history: history}
+}
+
+type recoveryHandler struct {
+	gbs.BuiltinEventHandler
+	history *History
+}
+
+func (c *recoveryHandler) OnMessage(socket *gbs.Conn, message *gbs.Message) {
+	defer message.Close()
+
+	b := message.Bytes()
+	if message.Opcode != gbs.OpcodeBinary || len(b) != requestSize {
+		_ = socket.WriteClose(1003, []byte("invalid recovery request"))
+		return
+	}
+	epoch := binary.BigEndian.Uint32(b[0:4])
+	from, to := binary.BigEndian.Uint64(b[4:12]), binary.BigEndian.Uint64(b[12:20])
+	if from == 0 || to < from {
+		return
+	}
+	if to-from >= maxRecoveryRange {
+		to = from + maxRecoveryRange - 1
+	}
+
+	// 发布者已经重启, 旧的数据包都无法恢复
+	// The publisher has restarted, none of the old packets can be recovered
+	if epoch != c.history.epoch {
+		_ = socket.WriteMessage(gbs.OpcodeBinary, encodeUnavailable(epoch, from, to))
+		return
+	}
+
+	packets, lostFrom, lostTo := c.history.get(from, to)
+	messages := make([]gbs.BatchMessage, 0, len(packets)+1)
+	if lostFrom > 0 {
+		messages = append(messages, gbs.BatchMessage{Opcode: gbs.OpcodeBinary, Payload: encodeUnavailable(epoch, lostFrom, lostTo)})
+	}
+	for _, packet := range packets {
+		messages = append(messages, gbs.BatchMessage{Opcode: gbs.OpcodeBinary, Payload: packet})
+	}
+	if len(messages) > 0 {
+		_ = socket.WriteBatch(messages...)
+	}
+}
+
+func encodeUnavailable(epoch uint32, from, to uint64) []byte {
+	b := make([]byte, 1+requestSize)
+	b[0] = kindUnavailable
+	binary.BigEndian.PutUint32(b[1:5], epoch)
+	binary.BigEndian.PutUint64(b[5:13], from)
+	binary.BigEndian.PutUint64(b[13:21], to)
+	return b
+}
@@ -0,0 +1,53 @@
+package multicast
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+	as := assert.New(t)
+	history := newHistory(1, 4)
+
+	packets, lostFrom, _ := history.get(1, 10)
+	as.Empty(packets)
+	as.Zero(lostFrom)
+
+	for seq := uint64(1); seq <= 6; seq++ {
+		history.add(seq, binary.BigEndian.AppendUint64(nil, seq))
+	}
+	as.Equal(uint64(3), history.first())
+
+	packets, lostFrom, lostTo := history.get(1, 10)
+	as.Equal(uint64(1), lostFrom)
+	as.Equal(uint64(2), lostTo)
+	as.Equal(4, len(packets))
+	for i, packet := range packets {
+		as.Equal(uint64(i+3), binary.BigEndian.Uint64(packet))
+	}
+
+	// 整个区间都已经被覆盖时, 丢失的区间不超出请求的区间
+	// When the whole range was overwritten, the lost range stays within the requested one
+	packets, lostFrom, lostTo = history.get(1, 1)
+	as.Empty(packets)
+	as.Equal(uint64(1), lostFrom)
+	as.Equal(uint64(1), lostTo)
+
+	packets, lostFrom, _ = history.get(4, 5)
+	as.Zero(lostFrom)
+	as.Equal(2, len(packets))
+	as.Equal(uint64(4), binary.BigEndian.Uint64(packets[0]))
+}
+
+func TestInitOption(t *testing.T) {
+	as := assert.New(t)
+	as.Equal(defaultHistorySize, initPublisherOption(nil).HistorySize)
+
+	option := initSubscriberOption(nil)
+	as.Equal(defaultGapTimeout, option.GapTimeout)
+	as.Equal(defaultMaxPending, option.MaxPending)
+	as.Equal(defaultReconnectInterval, option.ReconnectInterval)
+	as.Nil(option.Recovery)
+}
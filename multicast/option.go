@@ -0,0 +1,108 @@
+package multicast
+
+import (
+	"net"
+	"time"
+
+	"github.com/catermujo/gbs"
+)
+
+const (
+	// 数据包头部: epoch(4) seq(8)
+	// Packet header: epoch(4) seq(8)
+	headerSize = 12
+
+	// 重传请求: epoch(4) from(8) to(8)
+	// Retransmission request: epoch(4) from(8) to(8)
+	requestSize = 20
+
+	// 恢复服务的响应类型: 数据包
+	// Response kind of the recovery service: a packet
+	kindPacket uint8 = 1
+
+	// 恢复服务的响应类型: 不可恢复的区间 epoch(4) from(8) to(8)
+	// Response kind of the recovery service: a range that cannot be recovered, epoch(4) from(8) to(8)
+	kindUnavailable uint8 = 2
+
+	// UDP 包的最大长度
+	// Maximum size of a UDP packet
+	maxPacketSize = 64 * 1024
+
+	// 单个重传请求的最大区间长度
+	// Maximum length of the range of a single retransmission request
+	maxRecoveryRange = 1024
+
+	// 默认的历史长度, 单位为数据包
+	// Default history size, in packets
+	defaultHistorySize = 4096
+
+	// 默认的乱序缓冲上限, 单位为数据包
+	// Default limit of the out-of-order buffer, in packets
+	defaultMaxPending = 4096
+
+	// 默认的丢包等待时间
+	// Default time to wait for a missing packet
+	defaultGapTimeout = 500 * time.Millisecond
+
+	// 默认的恢复服务重连间隔
+	// Default interval between attempts to reconnect to the recovery service
+	defaultReconnectInterval = time.Second
+)
+
+// PublisherOption 发布者配置
+// Publisher configurations
+type PublisherOption struct {
+	// Number of packets kept for retransmission
+	HistorySize int
+}
+
+// SubscriberOption 订阅者配置
+// Subscriber configurations
+type SubscriberOption struct {
+	// Interface to join the multicast group on, nil means the system default
+	Interface *net.Interface
+
+	// 恢复服务的客户端配置, 为空时不请求重传, 缺失的数据包在等待超时后直接跳过
+	// Client options of the recovery service. When nil, no retransmission is requested
+	// and missing packets are skipped once the wait expires.
+	Recovery *gbs.ClientOption
+
+	// Time to wait for a missing packet, through reordering or retransmission, before skipping it
+	GapTimeout time.Duration
+
+	// Maximum number of packets buffered out of order, the oldest gap is skipped beyond it
+	MaxPending int
+
+	// Interval between attempts to reconnect to the recovery service once its connection drops, defaults to 1 second
+	ReconnectInterval time.Duration
+}
+
+// 初始化发布者配置
+// Initialize publisher options
+func initPublisherOption(c *PublisherOption) *PublisherOption {
+	if c == nil {
+		c = new(PublisherOption)
+	}
+	if c.HistorySize <= 0 {
+		c.HistorySize = defaultHistorySize
+	}
+	return c
+}
+
+// 初始化订阅者配置
+// Initialize subscriber options
+func initSubscriberOption(c *SubscriberOption) *SubscriberOption {
+	if c == nil {
+		c = new(SubscriberOption)
+	}
+	if c.GapTimeout <= 0 {
+		c.GapTimeout = defaultGapTimeout
+	}
+	if c.MaxPending <= 0 {
+		c.MaxPending = defaultMaxPending
+	}
+	if c.ReconnectInterval <= 0 {
+		c.ReconnectInterval = defaultReconnectInterval
+	}
+	return c
+}
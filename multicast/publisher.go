@@ -0,0 +1,76 @@
+package multicast
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/catermujo/gbs"
+	"github.com/catermujo/gbs/internal"
+)
+
+// Publisher 组播发布者, 为每个数据包分配递增的序列号, 并保存在历史中供重传
+// Multicast publisher, assigns increasing sequence numbers to packets and keeps them in the history for retransmission
+type Publisher struct {
+	mu      sync.Mutex
+	conn    net.PacketConn
+	addr    net.Addr
+	seq     uint64
+	history *History
+}
+
+// NewPublisher 创建向指定组播地址发布的发布者, 例如 239.0.0.1:9000
+// Creates a publisher sending to the specified multicast address, e.g. 239.0.0.1:9000
+func NewPublisher(group string, option *PublisherOption) (*Publisher, error) {
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewPublisherFromConn(pc, addr, option), nil
+}
+
+// NewPublisherFromConn 通过 PacketConn 创建向 addr 发布的发布者
+// Creates a publisher sending to addr via a PacketConn
+func NewPublisherFromConn(pc net.PacketConn, addr net.Addr, option *PublisherOption) *Publisher {
+	option = initPublisherOption(option)
+	return &Publisher{
+		conn:    pc,
+		addr:    addr,
+		history: newHistory(internal.AlphabetNumeric.Uint32(), option.HistorySize),
+	}
+}
+
+// Publish 发布一个数据包, 返回其序列号. 即使发送失败, 数据包也会进入历史, 订阅者可以通过重传恢复.
+// Publishes a packet and returns its sequence number. Even when sending fails, the packet enters the history
+// and subscribers can recover it through retransmission.
+func (c *Publisher) Publish(payload []byte) (uint64, error) {
+	if len(payload)+headerSize > maxPacketSize {
+		return 0, gbs.ErrMessageTooLarge
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	b := make([]byte, 1+headerSize+len(payload))
+	b[0] = kindPacket
+	binary.BigEndian.PutUint32(b[1:5], c.history.epoch)
+	binary.BigEndian.PutUint64(b[5:13], c.seq)
+	copy(b[1+headerSize:], payload)
+	c.history.add(c.seq, b)
+
+	_, err := c.conn.WriteTo(b[1:], c.addr)
+	return c.seq, err
+}
+
+// History 返回发布者的历史, 用于 NewRecoveryHandler
+// Returns the history of the publisher, for NewRecoveryHandler
+func (c *Publisher) History() *History { return c.history }
+
+// Close 关闭发布者
+// Closes the publisher
+func (c *Publisher) Close() error { return c.conn.Close() }
@@ -0,0 +1,355 @@
+package multicast
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/catermujo/gbs"
+)
+
+// Handler 订阅者的事件处理器. 回调在订阅者的锁内串行执行, 不应长时间阻塞.
+// Event handler of a subscriber. Callbacks run serially under the subscriber lock and should not block for long.
+type Handler interface {
+	// OnPacket 按序列号顺序交付的数据包, payload 只在回调期间有效
+	// Packet delivered in sequence order, payload is only valid during the callback
+	OnPacket(seq uint64, payload []byte)
+
+	// OnLoss 区间 [from, to] 的数据包无法恢复, 已被跳过
+	// The packets of [from, to] could not be recovered and were skipped
+	OnLoss(from, to uint64)
+}
+
+// Subscriber 组播订阅者, 检测丢包并从恢复服务请求重传
+// Multicast subscriber, detects gaps and requests retransmission from the recovery service
+type Subscriber struct {
+	conn     net.PacketConn
+	handler  Handler
+	option   *SubscriberOption
+	recovery *gbs.Conn
+
+	mu          sync.Mutex
+	started     bool
+	epoch       uint32
+	next        uint64
+	unrequested uint64
+	pending     map[uint64][]byte
+	gapSince    time.Time
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewSubscriber 加入指定的组播地址, 例如 239.0.0.1:9000
+// Joins the specified multicast address, e.g. 239.0.0.1:9000
+func NewSubscriber(group string, handler Handler, option *SubscriberOption) (*Subscriber, error) {
+	option = initSubscriberOption(option)
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenMulticastUDP("udp", option.Interface, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSubscriberFromConn(pc, handler, option)
+}
+
+// NewSubscriberFromConn 通过 PacketConn 创建订阅者. 配置了恢复服务时会立即连接, 失败时 PacketConn 会被关闭.
+// 之后连接断开时每隔 ReconnectInterval 重连, 重连后重新请求尚未补齐的缺口.
+// Creates a subscriber via a PacketConn. When a recovery service is configured it is connected right away,
+// and the PacketConn is closed on failure. Should the connection drop later, it is dialed again every
+// ReconnectInterval, and the gaps still open are requested again once it is back.
+func NewSubscriberFromConn(pc net.PacketConn, handler Handler, option *SubscriberOption) (*Subscriber, error) {
+	c := &Subscriber{
+		conn:    pc,
+		handler: handler,
+		option:  initSubscriberOption(option),
+		pending: make(map[uint64][]byte),
+		closed:  make(chan struct{}),
+	}
+	if c.option.Recovery != nil {
+		socket, _, err := gbs.NewClient(&recoveryClient{subscriber: c}, c.option.Recovery)
+		if err != nil {
+			_ = pc.Close()
+			return nil, err
+		}
+		c.recovery = socket
+		go socket.ReadLoop()
+	}
+	return c, nil
+}
+
+// 恢复服务的连接断开后定期重连, 直到成功或者订阅者关闭
+// Dials the recovery service again periodically once its connection drops, until it succeeds or the subscriber is closed
+func (c *Subscriber) reconnect() {
+	ticker := time.NewTicker(c.option.ReconnectInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		socket, _, err := gbs.NewClient(&recoveryClient{subscriber: c}, c.option.Recovery)
+		if err != nil {
+			continue
+		}
+		c.mu.Lock()
+		select {
+		case <-c.closed:
+			c.mu.Unlock()
+			_ = socket.WriteClose(1000, nil)
+			return
+		default:
+		}
+		c.recovery = socket
+		c.rerequest()
+		c.mu.Unlock()
+		go socket.ReadLoop()
+		return
+	}
+}
+
+// 重新请求当前缺口中的所有数据包, 之前的请求可能随旧连接一起丢失
+// Requests every packet of the current gaps again, earlier requests may have been lost along with the old connection
+func (c *Subscriber) rerequest() {
+	var latest uint64
+	for seq := range c.pending {
+		if seq > latest {
+			latest = seq
+		}
+	}
+	c.unrequested = c.next
+	if latest > c.next {
+		c.request(latest - 1)
+	}
+}
+
+// Run 循环接收数据包, 直到订阅者关闭
+// Receives packets in a loop until the subscriber is closed
+func (c *Subscriber) Run() error {
+	go c.watch()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			_ = c.Close()
+			return err
+		}
+		c.input(buf[:n], false)
+	}
+}
+
+// Close 关闭订阅者和恢复服务的连接
+// Closes the subscriber and the connection to the recovery service
+func (c *Subscriber) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.mu.Lock()
+		close(c.closed)
+		recovery := c.recovery
+		c.mu.Unlock()
+		if recovery != nil {
+			_ = recovery.WriteClose(1000, nil)
+		}
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// 定期跳过等待超时的缺口
+// Periodically skips gaps whose wait has expired
+func (c *Subscriber) watch() {
+	ticker := time.NewTicker(c.option.GapTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			if !c.gapSince.IsZero() && now.Sub(c.gapSince) >= c.option.GapTimeout {
+				c.skip()
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// 处理组播或重传收到的数据包
+// Handles a packet received through multicast or retransmission
+func (c *Subscriber) input(b []byte, recovered bool) {
+	if len(b) < headerSize {
+		return
+	}
+	epoch := binary.BigEndian.Uint32(b[0:4])
+	seq := binary.BigEndian.Uint64(b[4:12])
+	payload := b[headerSize:]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.started || epoch != c.epoch {
+		// 重传的旧数据包
+		// A stale retransmitted packet
+		if recovered {
+			return
+		}
+		// 首个数据包, 或者发布者已经重启, 从当前序列号开始
+		// First packet, or the publisher has restarted; start from the current sequence number
+		c.started, c.epoch, c.next, c.unrequested = true, epoch, seq, seq
+		c.pending = make(map[uint64][]byte)
+		c.gapSince = time.Time{}
+	}
+
+	// 乱序缓冲已满, 放弃最早的缺口
+	// The out-of-order buffer is full, give up on the earliest gap
+	if seq > c.next && len(c.pending) >= c.option.MaxPending {
+		c.skip()
+	}
+
+	switch {
+	case seq < c.next:
+		return
+	case seq == c.next:
+		c.handler.OnPacket(seq, payload)
+		c.next++
+		c.drain()
+	default:
+		if _, ok := c.pending[seq]; ok {
+			return
+		}
+		c.pending[seq] = append([]byte(nil), payload...)
+		if c.gapSince.IsZero() {
+			c.gapSince = time.Now()
+		}
+		c.request(seq - 1)
+	}
+}
+
+// 交付缓冲中已经连续的数据包
+// Delivers the buffered packets that are now consecutive
+func (c *Subscriber) drain() {
+	for {
+		payload, ok := c.pending[c.next]
+		if !ok {
+			break
+		}
+		delete(c.pending, c.next)
+		c.handler.OnPacket(c.next, payload)
+		c.next++
+	}
+	if len(c.pending) == 0 {
+		c.gapSince = time.Time{}
+	} else {
+		c.gapSince = time.Now()
+	}
+}
+
+// 跳过当前缺口, 直到缓冲中最早的数据包
+// Skips the current gap, up to the earliest buffered packet
+func (c *Subscriber) skip() {
+	if len(c.pending) == 0 {
+		c.gapSince = time.Time{}
+		return
+	}
+	var earliest uint64
+	for seq := range c.pending {
+		if earliest == 0 || seq < earliest {
+			earliest = seq
+		}
+	}
+	c.handler.OnLoss(c.next, earliest-1)
+	c.next = earliest
+	if c.unrequested < c.next {
+		c.unrequested = c.next
+	}
+	c.drain()
+}
+
+// 请求重传直到 to 为止尚未请求过的数据包. 恢复服务的连接断开期间不请求, 重连之后再请求.
+// Requests retransmission of the packets up to to that were not requested yet.
+// Nothing is requested while the connection to the recovery service is down, reconnecting requests the gaps again.
+func (c *Subscriber) request(to uint64) {
+	from := c.next
+	if c.unrequested > from {
+		from = c.unrequested
+	}
+	if c.recovery == nil || c.recovery.IsClosed() || from > to {
+		return
+	}
+	c.unrequested = to + 1
+	for from <= to {
+		end := to
+		if end-from >= maxRecoveryRange {
+			end = from + maxRecoveryRange - 1
+		}
+		b := make([]byte, requestSize)
+		binary.BigEndian.PutUint32(b[0:4], c.epoch)
+		binary.BigEndian.PutUint64(b[4:12], from)
+		binary.BigEndian.PutUint64(b[12:20], end)
+		c.recovery.WriteAsync(gbs.OpcodeBinary, b, nil)
+		from = end + 1
+	}
+}
+
+// 恢复服务告知区间 [from, to] 已经无法恢复
+// The recovery service reports that [from, to] can no longer be recovered
+func (c *Subscriber) unavailable(epoch uint32, from, to uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.started || epoch != c.epoch || from > c.next {
+		return
+	}
+	for c.next <= to {
+		if payload, ok := c.pending[c.next]; ok {
+			delete(c.pending, c.next)
+			c.handler.OnPacket(c.next, payload)
+			c.next++
+			continue
+		}
+		end := c.next
+		for end < to {
+			if _, ok := c.pending[end+1]; ok {
+				break
+			}
+			end++
+		}
+		c.handler.OnLoss(c.next, end)
+		c.next = end + 1
+	}
+	c.drain()
+}
+
+// 恢复服务连接的事件处理器
+// Event handler of the connection to the recovery service
+type recoveryClient struct {
+	gbs.BuiltinEventHandler
+	subscriber *Subscriber
+}
+
+func (c *recoveryClient) OnClose(socket *gbs.Conn, err error) {
+	go c.subscriber.reconnect()
+}
+
+func (c *recoveryClient) OnMessage(socket *gbs.Conn, message *gbs.Message) {
+	defer message.Close()
+
+	b := message.Bytes()
+	if len(b) == 0 {
+		return
+	}
+	switch b[0] {
+	case kindPacket:
+		c.subscriber.input(b[1:], true)
+	case kindUnavailable:
+		if len(b) == 1+requestSize {
+			epoch := binary.BigEndian.Uint32(b[1:5])
+			c.subscriber.unavailable(epoch, binary.BigEndian.Uint64(b[5:13]), binary.BigEndian.Uint64(b[13:21]))
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package multicast
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs"
+	"github.com/stretchr/testify/assert"
+)
+
+// 丢弃指定序列号的数据包
+// Drops the packets with the given sequence numbers
+type dropPacketConn struct {
+	net.PacketConn
+	drop map[uint64]bool
+}
+
+func (c *dropPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.drop[binary.BigEndian.Uint64(p[4:12])] {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+type recorder struct {
+	mu     sync.Mutex
+	seqs   []uint64
+	losses [][2]uint64
+}
+
+func (c *recorder) OnPacket(seq uint64, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if string(payload) == fmt.Sprintf("packet-%d", seq) {
+		c.seqs = append(c.seqs, seq)
+	}
+}
+
+func (c *recorder) OnLoss(from, to uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.losses = append(c.losses, [2]uint64{from, to})
+}
+
+// 等待收到 n 个数据包
+// Waits until n packets have been received
+func (c *recorder) wait(t *testing.T, n int) ([]uint64, [][2]uint64) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		c.mu.Lock()
+		if len(c.seqs) >= n {
+			c.mu.Unlock()
+			break
+		}
+		c.mu.Unlock()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seqs, c.losses
+}
+
+func listenPacket(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+// 启动恢复服务, 返回其地址
+// Starts a recovery service and returns its address
+func newRecoveryServer(t *testing.T, history *History) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gbs.NewServer(NewRecoveryHandler(history), nil).RunListener(listener)
+	return "ws://" + listener.Addr().String()
+}
+
+func publish(t *testing.T, publisher *Publisher, n int) {
+	for i := 1; i <= n; i++ {
+		seq, err := publisher.Publish([]byte(fmt.Sprintf("packet-%d", i)))
+		if err != nil || seq != uint64(i) {
+			t.Fatalf("publish %d: %v", seq, err)
+		}
+	}
+}
+
+func sequence(from, to uint64) []uint64 {
+	var list []uint64
+	for i := from; i <= to; i++ {
+		list = append(list, i)
+	}
+	return list
+}
+
+func TestSubscriber_Recovery(t *testing.T) {
+	as := assert.New(t)
+	pc := listenPacket(t)
+	publisher := NewPublisherFromConn(&dropPacketConn{PacketConn: listenPacket(t), drop: map[uint64]bool{3: true, 4: true, 10: true, 49: true}}, pc.LocalAddr(), nil)
+	defer publisher.Close()
+
+	handler := new(recorder)
+	subscriber, err := NewSubscriberFromConn(pc, handler, &SubscriberOption{
+		Recovery: &gbs.ClientOption{Addr: newRecoveryServer(t, publisher.History())},
+	})
+	if !as.NoError(err) {
+		return
+	}
+	defer subscriber.Close()
+	go subscriber.Run()
+
+	publish(t, publisher, 50)
+	seqs, losses := handler.wait(t, 50)
+	as.Equal(sequence(1, 50), seqs)
+	as.Empty(losses)
+}
+
+func TestSubscriber_Unavailable(t *testing.T) {
+	as := assert.New(t)
+	pc := listenPacket(t)
+	publisher := NewPublisherFromConn(&dropPacketConn{PacketConn: listenPacket(t), drop: map[uint64]bool{2: true}}, pc.LocalAddr(), &PublisherOption{HistorySize: 4})
+	defer publisher.Close()
+
+	handler := new(recorder)
+	subscriber, err := NewSubscriberFromConn(pc, handler, &SubscriberOption{
+		Recovery: &gbs.ClientOption{Addr: newRecoveryServer(t, publisher.History())},
+	})
+	if !as.NoError(err) {
+		return
+	}
+	defer subscriber.Close()
+
+	// 订阅者开始接收前, 数据包 2 已经不在历史中
+	// Packet 2 has left the history before the subscriber starts receiving
+	publish(t, publisher, 10)
+	go subscriber.Run()
+
+	seqs, losses := handler.wait(t, 9)
+	as.Equal(append([]uint64{1}, sequence(3, 10)...), seqs)
+	as.Equal([][2]uint64{{2, 2}}, losses)
+}
+
+func TestSubscriber_GapTimeout(t *testing.T) {
+	as := assert.New(t)
+	pc := listenPacket(t)
+	publisher := NewPublisherFromConn(&dropPacketConn{PacketConn: listenPacket(t), drop: map[uint64]bool{5: true, 6: true}}, pc.LocalAddr(), nil)
+	defer publisher.Close()
+
+	handler := new(recorder)
+	subscriber, err := NewSubscriberFromConn(pc, handler, &SubscriberOption{GapTimeout: 100 * time.Millisecond})
+	if !as.NoError(err) {
+		return
+	}
+	defer subscriber.Close()
+	go subscriber.Run()
+
+	publish(t, publisher, 8)
+	seqs, losses := handler.wait(t, 6)
+	as.Equal([]uint64{1, 2, 3, 4, 7, 8}, seqs)
+	as.Equal([][2]uint64{{5, 6}}, losses)
+}
+
+func TestSubscriber_MaxPending(t *testing.T) {
+	as := assert.New(t)
+	pc := listenPacket(t)
+	publisher := NewPublisherFromConn(&dropPacketConn{PacketConn: listenPacket(t), drop: map[uint64]bool{2: true}}, pc.LocalAddr(), nil)
+	defer publisher.Close()
+
+	handler := new(recorder)
+	subscriber, err := NewSubscriberFromConn(pc, handler, &SubscriberOption{GapTimeout: time.Minute, MaxPending: 2})
+	if !as.NoError(err) {
+		return
+	}
+	defer subscriber.Close()
+	go subscriber.Run()
+
+	publish(t, publisher, 6)
+	seqs, losses := handler.wait(t, 5)
+	as.Equal([]uint64{1, 3, 4, 5, 6}, seqs)
+	as.Equal([][2]uint64{{2, 2}}, losses)
+}
+
+func TestSubscriber_Restart(t *testing.T) {
+	as := assert.New(t)
+	pc := listenPacket(t)
+	handler := new(recorder)
+	subscriber, err := NewSubscriberFromConn(pc, handler, nil)
+	if !as.NoError(err) {
+		return
+	}
+	defer subscriber.Close()
+	go subscriber.Run()
+
+	publisher := NewPublisherFromConn(listenPacket(t), pc.LocalAddr(), nil)
+	publish(t, publisher, 3)
+	handler.wait(t, 3)
+	_ = publisher.Close()
+
+	// 发布者重启后序列号从 1 重新开始
+	// Sequence numbers start over from 1 once the publisher restarts
+	publisher = NewPublisherFromConn(listenPacket(t), pc.LocalAddr(), nil)
+	defer publisher.Close()
+	publish(t, publisher, 2)
+	seqs, losses := handler.wait(t, 5)
+	as.Equal([]uint64{1, 2, 3, 1, 2}, seqs)
+	as.Empty(losses)
+}
+
+// 记录恢复服务接受的连接
+// Records the connections accepted by the recovery service
+type recoveryTracker struct {
+	gbs.EventHandler
+	sockets chan *gbs.Conn
+}
+
+func (c *recoveryTracker) OnOpen(socket *gbs.Conn) {
+	c.sockets <- socket
+	c.EventHandler.OnOpen(socket)
+}
+
+func TestSubscriber_Reconnect(t *testing.T) {
+	as := assert.New(t)
+	pc := listenPacket(t)
+	publisher := NewPublisherFromConn(&dropPacketConn{PacketConn: listenPacket(t), drop: map[uint64]bool{5: true}}, pc.LocalAddr(), nil)
+	defer publisher.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !as.NoError(err) {
+		return
+	}
+	tracker := &recoveryTracker{EventHandler: NewRecoveryHandler(publisher.History()), sockets: make(chan *gbs.Conn, 2)}
+	go gbs.NewServer(tracker, nil).RunListener(listener)
+
+	handler := new(recorder)
+	subscriber, err := NewSubscriberFromConn(pc, handler, &SubscriberOption{
+		Recovery:          &gbs.ClientOption{Addr: "ws://" + listener.Addr().String()},
+		GapTimeout:        time.Minute,
+		ReconnectInterval: 20 * time.Millisecond,
+	})
+	if !as.NoError(err) {
+		return
+	}
+	defer subscriber.Close()
+	go subscriber.Run()
+
+	// 恢复服务断开连接之后, 订阅者重连并继续请求重传
+	// Once the recovery service drops the connection, the subscriber reconnects and keeps requesting retransmission
+	_ = (<-tracker.sockets).WriteClose(1000, nil)
+	select {
+	case <-tracker.sockets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	publish(t, publisher, 8)
+	seqs, losses := handler.wait(t, 8)
+	as.Equal(sequence(1, 8), seqs)
+	as.Empty(losses)
+}
+
+func TestSubscriber_ZeroSequence(t *testing.T) {
+	as := assert.New(t)
+	history := newHistory(7, 16)
+	packet := func(seq uint64) []byte {
+		b := make([]byte, 1+headerSize)
+		b[0] = kindPacket
+		binary.BigEndian.PutUint32(b[1:5], history.epoch)
+		binary.BigEndian.PutUint64(b[5:13], seq)
+		return append(b, fmt.Sprintf("packet-%d", seq)...)
+	}
+	history.add(1, packet(1))
+	history.add(2, packet(2))
+
+	handler := new(recorder)
+	subscriber, err := NewSubscriberFromConn(listenPacket(t), handler, &SubscriberOption{
+		Recovery:   &gbs.ClientOption{Addr: newRecoveryServer(t, history)},
+		GapTimeout: time.Minute,
+	})
+	if !as.NoError(err) {
+		return
+	}
+	defer subscriber.Close()
+
+	// 从序列号 0 开始时, 请求的区间从 1 开始, 不会回绕
+	// Starting from sequence number 0, the requested range starts at 1 without wrapping around
+	subscriber.input(packet(0)[1:], false)
+	subscriber.input(packet(3)[1:], false)
+	subscriber.mu.Lock()
+	as.Equal(uint64(3), subscriber.unrequested)
+	subscriber.mu.Unlock()
+
+	seqs, losses := handler.wait(t, 4)
+	as.Equal(sequence(0, 3), seqs)
+	as.Empty(losses)
+}
+
+func TestSubscriber_Close(t *testing.T) {
+	as := assert.New(t)
+	subscriber, err := NewSubscriberFromConn(listenPacket(t), new(recorder), nil)
+	if !as.NoError(err) {
+		return
+	}
+	ch := make(chan error)
+	go func() { ch <- subscriber.Run() }()
+	as.NoError(subscriber.Close())
+	as.ErrorIs(<-ch, net.ErrClosed)
+
+	_, err = NewSubscriberFromConn(listenPacket(t), new(recorder), &SubscriberOption{
+		Recovery: &gbs.ClientOption{Addr: "ws://127.0.0.1:1"},
+	})
+	as.Error(err)
+}
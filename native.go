@@ -0,0 +1,351 @@
+package gbs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/catermujo/gbs/internal"
+)
+
+// 原生模式省去了 HTTP 升级和掩码: 一次二进制握手协商版本, 压缩特性和子协议,
+// 之后每个帧头由 WebSocket 帧头的首字节和 uvarint 编码的负载长度组成.
+// Native mode skips the HTTP upgrade and masking: a single binary handshake negotiates the version,
+// the compression features and the subprotocol, after which every frame header consists of the first byte
+// of a WebSocket frame header and the uvarint encoded payload length.
+const (
+	// 原生协议版本
+	// Version of the native protocol
+	nativeVersion uint8 = 1
+
+	// 握手请求: magic(4) version(1) features(2) pathLen(2) protocolsLen(2) path protocols
+	// Handshake request: magic(4) version(1) features(2) pathLen(2) protocolsLen(2) path protocols
+	nativeHelloSize = 11
+
+	// 握手响应: magic(4) version(1) status(1) features(2) protocolLen(2) protocol
+	// Handshake response: magic(4) version(1) status(1) features(2) protocolLen(2) protocol
+	nativeWelcomeSize = 10
+
+	// 握手的魔数, 以 0 开头, 不会与 HTTP 请求混淆
+	// Magic number of the handshake, starts with 0 so it cannot be mistaken for an HTTP request
+	nativeMagic = "\x00GBS"
+)
+
+// 握手响应的状态码
+// Status codes of the handshake response
+const (
+	nativeStatusOK                 uint8 = 0
+	nativeStatusUnsupportedVersion uint8 = 1
+	nativeStatusUnauthorized       uint8 = 2
+	nativeStatusBadRequest         uint8 = 3
+)
+
+// 特性位, 协商结果为双方特性的交集
+// Feature bits, the negotiated features are the intersection of both sides
+const (
+	nativeFeatureDeflate               uint16 = 1 << 0
+	nativeFeatureServerContextTakeover uint16 = 1 << 1
+	nativeFeatureClientContextTakeover uint16 = 1 << 2
+)
+
+type (
+	// 原生模式的握手请求
+	// Handshake request of native mode
+	nativeHello struct {
+		version   uint8
+		features  uint16
+		path      string
+		protocols string
+	}
+
+	// 原生模式的握手响应
+	// Handshake response of native mode
+	nativeWelcome struct {
+		version  uint8
+		status   uint8
+		features uint16
+		protocol string
+	}
+)
+
+func (c *nativeHello) encode() []byte {
+	b := make([]byte, nativeHelloSize, nativeHelloSize+len(c.path)+len(c.protocols))
+	copy(b[0:4], nativeMagic)
+	b[4] = c.version
+	binary.BigEndian.PutUint16(b[5:7], c.features)
+	binary.BigEndian.PutUint16(b[7:9], uint16(len(c.path)))
+	binary.BigEndian.PutUint16(b[9:11], uint16(len(c.protocols)))
+	b = append(b, c.path...)
+	return append(b, c.protocols...)
+}
+
+func (c *nativeWelcome) encode() []byte {
+	b := make([]byte, nativeWelcomeSize, nativeWelcomeSize+len(c.protocol))
+	copy(b[0:4], nativeMagic)
+	b[4] = c.version
+	b[5] = c.status
+	binary.BigEndian.PutUint16(b[6:8], c.features)
+	binary.BigEndian.PutUint16(b[8:10], uint16(len(c.protocol)))
+	return append(b, c.protocol...)
+}
+
+// 读取握手请求
+// Reads the handshake request
+func readNativeHello(br *bufio.Reader) (*nativeHello, error) {
+	var b [nativeHelloSize]byte
+	if err := internal.ReadN(br, b[:]); err != nil {
+		return nil, err
+	}
+	if string(b[0:4]) != nativeMagic {
+		return nil, ErrHandshake
+	}
+	pathLen, protocolsLen := int(binary.BigEndian.Uint16(b[7:9])), int(binary.BigEndian.Uint16(b[9:11]))
+	rest := make([]byte, pathLen+protocolsLen)
+	if err := internal.ReadN(br, rest); err != nil {
+		return nil, err
+	}
+	return &nativeHello{
+		version:   b[4],
+		features:  binary.BigEndian.Uint16(b[5:7]),
+		path:      string(rest[:pathLen]),
+		protocols: string(rest[pathLen:]),
+	}, nil
+}
+
+// 读取握手响应
+// Reads the handshake response
+func readNativeWelcome(br *bufio.Reader) (*nativeWelcome, error) {
+	var b [nativeWelcomeSize]byte
+	if err := internal.ReadN(br, b[:]); err != nil {
+		return nil, err
+	}
+	if string(b[0:4]) != nativeMagic {
+		return nil, ErrHandshake
+	}
+	protocol := make([]byte, binary.BigEndian.Uint16(b[8:10]))
+	if err := internal.ReadN(br, protocol); err != nil {
+		return nil, err
+	}
+	return &nativeWelcome{
+		version:  b[4],
+		status:   b[5],
+		features: binary.BigEndian.Uint16(b[6:8]),
+		protocol: string(protocol),
+	}, nil
+}
+
+// 检查缓冲的数据是否以原生模式的握手开头
+// Checks whether the buffered data starts with a native mode handshake
+func isNativeHello(br *bufio.Reader) bool {
+	b, err := br.Peek(len(nativeMagic))
+	return err == nil && string(b) == nativeMagic
+}
+
+// 压缩配置对应的特性位
+// Feature bits of the compression options
+func (c *PermessageDeflate) nativeFeatures() uint16 {
+	if !c.Enabled {
+		return 0
+	}
+	features := nativeFeatureDeflate
+	if c.ServerContextTakeover {
+		features |= nativeFeatureServerContextTakeover
+	}
+	if c.ClientContextTakeover {
+		features |= nativeFeatureClientContextTakeover
+	}
+	return features
+}
+
+// 根据协商的特性位生成压缩参数, 原生模式总是使用 32KB 的滑动窗口
+// Builds the compression parameters from the negotiated feature bits, native mode always uses a 32KB window
+func newNativePermessageDeflate(options PermessageDeflate, features uint16) PermessageDeflate {
+	if !options.Enabled || features&nativeFeatureDeflate == 0 {
+		return PermessageDeflate{}
+	}
+	return PermessageDeflate{
+		Enabled:               true,
+		Level:                 options.Level,
+		Threshold:             options.Threshold,
+		PoolSize:              options.PoolSize,
+		ServerContextTakeover: features&nativeFeatureServerContextTakeover != 0,
+		ClientContextTakeover: features&nativeFeatureClientContextTakeover != 0,
+		ServerMaxWindowBits:   15,
+		ClientMaxWindowBits:   15,
+	}
+}
+
+// 用握手请求构造 HTTP 请求, 供 Authorize 使用
+// Builds an HTTP request from the handshake request, for Authorize
+func (c *nativeHello) request(conn net.Conn) (*http.Request, error) {
+	r, err := http.NewRequest(http.MethodGet, c.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.RequestURI = c.path
+	r.RemoteAddr = conn.RemoteAddr().String()
+	if c.protocols != "" {
+		r.Header.Set(internal.SecWebSocketProtocol.Key, c.protocols)
+	}
+	return r, nil
+}
+
+// UpgradeNative 使用原生模式的握手建立连接, br 中应当缓冲着握手请求.
+// 失败时会向客户端发送错误状态并关闭连接.
+// Establishes a connection with the native mode handshake, br is expected to hold the handshake request.
+// On failure the error status is sent to the client and the connection is closed.
+func (c *Upgrader) UpgradeNative(conn net.Conn, br *bufio.Reader) (*Conn, error) {
+	err := conn.SetDeadline(time.Now().Add(c.option.HandshakeTimeout))
+	var socket *Conn
+	if err == nil {
+		socket, err = c.doUpgradeNative(conn, br)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return socket, nil
+}
+
+// 拒绝握手请求
+// Rejects the handshake request
+func (c *Upgrader) rejectNative(conn net.Conn, status uint8, err error) error {
+	welcome := &nativeWelcome{version: nativeVersion, status: status}
+	_ = internal.WriteN(conn, welcome.encode())
+	return err
+}
+
+func (c *Upgrader) doUpgradeNative(conn net.Conn, br *bufio.Reader) (*Conn, error) {
+	hello, err := readNativeHello(br)
+	if err != nil {
+		return nil, err
+	}
+	if hello.version != nativeVersion {
+		return nil, c.rejectNative(conn, nativeStatusUnsupportedVersion, ErrUnsupportedVersion)
+	}
+
+	// 授权请求，如果授权失败，返回未授权错误
+	// Authorize the request, if authorization fails, return an unauthorized error
+	r, err := hello.request(conn)
+	if err != nil {
+		return nil, c.rejectNative(conn, nativeStatusBadRequest, ErrHandshake)
+	}
+	session := c.option.NewSession()
+	if !c.option.Authorize(r, session) {
+		return nil, c.rejectNative(conn, nativeStatusUnauthorized, ErrUnauthorized)
+	}
+
+	var subprotocol string
+	if len(c.option.SubProtocols) > 0 {
+		subprotocol = internal.GetIntersectionElem(c.option.SubProtocols, internal.Split(hello.protocols, ","))
+		if subprotocol == "" {
+			return nil, c.rejectNative(conn, nativeStatusBadRequest, ErrSubprotocolNegotiation)
+		}
+	}
+
+	pd := newNativePermessageDeflate(c.option.PermessageDeflate, hello.features&c.option.PermessageDeflate.nativeFeatures())
+	welcome := &nativeWelcome{version: nativeVersion, status: nativeStatusOK, features: pd.nativeFeatures(), protocol: subprotocol}
+	if err := internal.WriteN(conn, welcome.encode()); err != nil {
+		return nil, err
+	}
+
+	config := c.option.getConfig()
+	socket := &Conn{
+		ss:                session,
+		isServer:          true,
+		native:            true,
+		subprotocol:       subprotocol,
+		conn:              conn,
+		config:            config,
+		br:                br,
+		continuationFrame: continuationFrame{},
+		fh:                frameHeader{},
+		handler:           c.eventHandler,
+		closed:            0,
+		writeQueue:        workerQueue{maxConcurrency: 1},
+		readQueue:         make(channel, c.option.ParallelGolimit),
+	}
+	if pd.Enabled {
+		socket.initPermessageDeflate(pd, config.deflaterPool.Select())
+	}
+	return socket, nil
+}
+
+// 执行原生模式的握手
+// Performs the native mode handshake
+func (c *connector) nativeHandshake() (*Conn, error) {
+	URL, err := url.Parse(c.addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.conn.SetDeadline(time.Now().Add(c.option.HandshakeTimeout)); err != nil {
+		return nil, err
+	}
+
+	offer := c.option.PermessageDeflate.nativeFeatures()
+	hello := &nativeHello{
+		version:   nativeVersion,
+		features:  offer,
+		path:      URL.RequestURI(),
+		protocols: c.option.RequestHeader.Get(internal.SecWebSocketProtocol.Key),
+	}
+	if len(hello.path) > 0xFFFF || len(hello.protocols) > 0xFFFF {
+		return nil, ErrHandshake
+	}
+	if err := internal.WriteN(c.conn, hello.encode()); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(c.conn, c.option.ReadBufferSize)
+	welcome, err := readNativeWelcome(br)
+	if err != nil {
+		return nil, err
+	}
+	switch welcome.status {
+	case nativeStatusOK:
+	case nativeStatusUnsupportedVersion:
+		return nil, ErrUnsupportedVersion
+	case nativeStatusUnauthorized:
+		return nil, ErrUnauthorized
+	default:
+		return nil, ErrHandshake
+	}
+
+	// 服务端不能接受客户端没有提议的特性
+	// The server must not accept a feature the client did not offer
+	if welcome.features&^offer != 0 {
+		return nil, ErrHandshake
+	}
+	a := internal.Split(hello.protocols, ",")
+	subprotocol := internal.GetIntersectionElem(a, internal.Split(welcome.protocol, ","))
+	if len(a) > 0 && subprotocol == "" {
+		return nil, ErrSubprotocolNegotiation
+	}
+
+	pd := newNativePermessageDeflate(c.option.PermessageDeflate, welcome.features)
+	socket := &Conn{
+		ss:                c.option.NewSession(),
+		isServer:          false,
+		native:            true,
+		subprotocol:       subprotocol,
+		conn:              c.conn,
+		config:            c.option.getConfig(),
+		br:                br,
+		continuationFrame: continuationFrame{},
+		fh:                frameHeader{},
+		handler:           c.eventHandler,
+		closed:            0,
+		writeQueue:        workerQueue{maxConcurrency: 1},
+		readQueue:         make(channel, c.option.ParallelGolimit),
+	}
+	if pd.Enabled {
+		socket.initPermessageDeflate(pd, new(deflater).initialize(pd, c.option.ReadMaxPayloadSize))
+	}
+	return socket, c.conn.SetDeadline(time.Time{})
+}
@@ -0,0 +1,201 @@
+package gbs
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+// 启动同时接受原生模式和 HTTP 升级的服务器, 返回其地址
+// Starts a server accepting both native mode and HTTP upgrades, returns its address
+func newNativeServer(t *testing.T, handler EventHandler, option *ServerOption) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	option.NativeEnabled = true
+	go NewServer(handler, option).RunListener(listener)
+	return listener.Addr().String()
+}
+
+func TestNative(t *testing.T) {
+	as := assert.New(t)
+	var path string
+	serverHandler := new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+		_ = message.Close()
+	}
+	addr := newNativeServer(t, serverHandler, &ServerOption{
+		SubProtocols:      []string{"chat"},
+		PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1},
+		Authorize: func(r *http.Request, session SessionStorage) bool {
+			path = r.URL.RequestURI()
+			return true
+		},
+	})
+
+	var messages = make(chan string, 8)
+	clientHandler := new(webSocketMocker)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		messages <- message.Data.String()
+	}
+	client, resp, err := NewClient(clientHandler, &ClientOption{
+		Addr:              "ws://" + addr + "/connect?id=1",
+		RequestHeader:     http.Header{"Sec-Websocket-Protocol": {"chat"}},
+		PermessageDeflate: PermessageDeflate{Enabled: true, Threshold: 1},
+		NativeEnabled:     true,
+	})
+	if !as.NoError(err) {
+		return
+	}
+	as.Nil(resp)
+	as.True(client.native)
+	as.True(client.pd.Enabled)
+	as.Equal("chat", client.SubProtocol())
+	as.Equal("/connect?id=1", path)
+	go client.ReadLoop()
+
+	for _, n := range []int{0, 125, 126, 65536, 1024 * 1024} {
+		payload := string(internal.AlphabetNumeric.Generate(n))
+		as.NoError(client.WriteString(payload))
+		select {
+		case s := <-messages:
+			as.Equal(payload, s)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout waiting for %d bytes", n)
+		}
+	}
+
+	writer := client.NextWriter(OpcodeText)
+	_, _ = writer.Write([]byte("hello, "))
+	_, _ = writer.Write([]byte("world"))
+	as.NoError(writer.Close())
+	as.Equal("hello, world", <-messages)
+	_ = client.WriteClose(1000, nil)
+}
+
+func TestNative_Broadcast(t *testing.T) {
+	as := assert.New(t)
+	var sockets = make(chan *Conn, 2)
+	serverHandler := new(webSocketMocker)
+	serverHandler.onOpen = func(socket *Conn) { sockets <- socket }
+	addr := newNativeServer(t, serverHandler, &ServerOption{})
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	clientHandler := new(webSocketMocker)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal("broadcast", message.Data.String())
+		wg.Done()
+	}
+
+	// 原生模式和 HTTP 升级共用一个端口
+	// Native mode and HTTP upgrades share the port
+	for _, native := range []bool{true, false} {
+		client, _, err := NewClient(clientHandler, &ClientOption{Addr: "ws://" + addr, NativeEnabled: native})
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(native, client.native)
+		go client.ReadLoop()
+	}
+
+	broadcaster := NewBroadcaster(OpcodeText, []byte("broadcast"))
+	for i := 0; i < 2; i++ {
+		as.NoError(broadcaster.Broadcast(<-sockets))
+	}
+	wg.Wait()
+	_ = broadcaster.Close()
+}
+
+func TestNative_Handshake(t *testing.T) {
+	as := assert.New(t)
+	addr := newNativeServer(t, new(BuiltinEventHandler), &ServerOption{
+		SubProtocols: []string{"chat"},
+		Authorize: func(r *http.Request, session SessionStorage) bool {
+			return r.URL.Path != "/forbidden"
+		},
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		_, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+			Addr:          "ws://" + addr + "/forbidden",
+			RequestHeader: http.Header{"Sec-Websocket-Protocol": {"chat"}},
+			NativeEnabled: true,
+		})
+		as.ErrorIs(err, ErrUnauthorized)
+	})
+
+	t.Run("subprotocol", func(t *testing.T) {
+		_, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+			Addr:          "ws://" + addr,
+			RequestHeader: http.Header{"Sec-Websocket-Protocol": {"json"}},
+			NativeEnabled: true,
+		})
+		as.ErrorIs(err, ErrHandshake)
+	})
+
+	t.Run("version", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if !as.NoError(err) {
+			return
+		}
+		defer conn.Close()
+		hello := &nativeHello{version: nativeVersion + 1, path: "/"}
+		as.NoError(internal.WriteN(conn, hello.encode()))
+		welcome, err := readNativeWelcome(bufio.NewReader(conn))
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(nativeStatusUnsupportedVersion, welcome.status)
+		as.Equal(nativeVersion, welcome.version)
+	})
+
+	t.Run("features", func(t *testing.T) {
+		srv, cli := net.Pipe()
+		go func() {
+			br := bufio.NewReader(srv)
+			_, _ = readNativeHello(br)
+			welcome := &nativeWelcome{version: nativeVersion, features: nativeFeatureDeflate}
+			_ = internal.WriteN(srv, welcome.encode())
+		}()
+		_, _, err := NewClientFromConn(new(BuiltinEventHandler), &ClientOption{NativeEnabled: true}, cli)
+		as.ErrorIs(err, ErrHandshake)
+	})
+}
+
+func TestFrameHeader_Native(t *testing.T) {
+	as := assert.New(t)
+	for _, n := range []int{0, 125, 126, 65535, 65536, 1 << 30} {
+		var header frameHeader
+		headerLength := header.GenerateNativeHeader(true, true, OpcodeBinary, n)
+		as.LessOrEqual(headerLength, 11)
+
+		var parsed frameHeader
+		length, err := parsed.ParseNative(bytes.NewReader(header[:headerLength]))
+		as.NoError(err)
+		as.Equal(n, length)
+		as.True(parsed.GetFIN())
+		as.Equal(RSV1, parsed.GetRSV())
+		as.Equal(OpcodeBinary, parsed.GetOpcode())
+		as.False(parsed.GetMask())
+	}
+
+	var header frameHeader
+	_, err := header.ParseNative(bytes.NewReader([]byte{0x81, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}))
+	as.Error(err)
+
+	// 原生模式不接受掩码
+	// Native mode rejects masked frames
+	socket := &Conn{isServer: true, native: true}
+	as.Error(socket.checkMask(true))
+	as.NoError(socket.checkMask(false))
+}
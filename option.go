@@ -2,9 +2,12 @@ package gbs
 
 import (
 	"bufio"
+	"compress/flate"
 	"crypto/tls"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"time"
 
 	"github.com/catermujo/gbs/internal"
@@ -38,6 +41,38 @@ const (
 	// 默认的拨号超时时间
 	// Default dial timeout
 	defaultDialTimeout = 5 * time.Second
+
+	// 默认的数据报最大长度, 低于常见路径 MTU, 避免 IP 分片
+	// Default maximum datagram size, below common path MTUs to avoid IP fragmentation
+	defaultDatagramMTU = 1200
+
+	// 默认的数据报对端数量上限
+	// Default maximum number of datagram peers
+	defaultDatagramMaxPeers = 4096
+
+	// 默认的数据报空闲超时
+	// Default idle timeout of datagram peers
+	defaultDatagramIdleTimeout = time.Minute
+
+	// 默认的压缩级别
+	// Default compression level
+	defaultCompressLevel = flate.BestSpeed
+
+	// 默认的压缩阈值
+	// Default compression threshold
+	defaultCompressThreshold = 512
+
+	// 默认的压缩器池大小
+	// Default compressor pool size
+	defaultCompressorPoolSize = 32
+
+	// TCP 连接上跳过拷贝直接写入负载的阈值
+	// Payload size from which TCP connections skip the copy and write the payload directly
+	vectoredThreshold = 4 * 1024
+
+	// TLS 连接上跳过拷贝直接写入负载的阈值, 即 TLS 记录的最大长度
+	// Payload size from which TLS connections skip the copy, i.e. the maximum TLS record size
+	vectoredTLSThreshold = 16 * 1024
 )
 
 type (
@@ -48,6 +83,9 @@ type (
 		// Memory pool for bufio.Reader
 		brPool *internal.Pool[*bufio.Reader]
 
+		// Compressor pool, shared between connections when permessage-deflate is enabled
+		deflaterPool *deflaterPool
+
 		// Message callback (OnMessage) recovery program
 		Recovery func(logger Logger)
 
@@ -57,6 +95,12 @@ type (
 		// Size of the read buffer
 		ReadBufferSize int
 
+		// Size of the write buffer used by streaming writers
+		WriteBufferSize int
+
+		// Timeout of the closing handshake started by WriteClose, zero closes immediately
+		CloseTimeout time.Duration
+
 		// Maximum length of written message content
 		WriteMaxPayloadSize int
 
@@ -68,6 +112,74 @@ type (
 
 		// Whether to enable parallel message processing
 		ParallelEnabled bool
+
+		// Whether the zero-copy read mode is enabled
+		ZeroCopyEnabled bool
+
+		// Records the data messages sent and received, nil records nothing
+		Journal Journal
+
+		// Outgoing throttling of every connection
+		Throttle Throttle
+	}
+
+	// PermessageDeflate 压缩拓展配置
+	// 对于 gbs 客户端, 建议开启上下文接管, 不修改滑动窗口指数, 提供最好的压缩率和性能.
+	// For gbs clients, it is recommended to enable context takeover and not modify the sliding window index
+	// to get the best compression ratio and performance.
+	// https://www.rfc-editor.org/rfc/rfc7692.html
+	PermessageDeflate struct {
+		// Whether to enable compression
+		Enabled bool
+
+		// Compression level, see compress/flate. Defaults to flate.BestSpeed.
+		Level int
+
+		// Messages shorter than the threshold are sent uncompressed
+		Threshold int
+
+		// Size of the compressor pool shared between connections (server side only).
+		// A larger pool lowers contention at the cost of memory.
+		PoolSize int
+
+		// Whether the server compressor may reference previous messages.
+		// Each connection then owns a compressor, which costs about 1 MiB of memory.
+		ServerContextTakeover bool
+
+		// Whether the client compressor may reference previous messages.
+		ClientContextTakeover bool
+
+		// Server-side sliding window exponent, 8<=n<=15, meaning pow(2,n) bytes.
+		// With a window smaller than 15, messages larger than the window are sent uncompressed.
+		ServerMaxWindowBits int
+
+		// Client-side sliding window exponent, 8<=n<=15, meaning pow(2,n) bytes.
+		ClientMaxWindowBits int
+	}
+
+	// Throttle 发送限流配置, 以令牌桶限制每秒发出的消息数和字节数, 两个速率都为 0 时不限流.
+	// 只作用于数据消息: WriteMessage, WriteAsync, Writev, WriteBatch 和 Broadcaster; 流式写入器和控制帧不受限制.
+	// Outgoing throttling configuration, capping the messages and bytes sent per second with token buckets;
+	// no throttling when both rates are 0.
+	// Only data messages are throttled: WriteMessage, WriteAsync, Writev, WriteBatch and Broadcaster;
+	// streaming writers and control frames are not.
+	Throttle struct {
+		// Maximum number of messages per second, 0 means unlimited
+		MessagesPerSecond int
+
+		// Maximum number of payload bytes per second, 0 means unlimited
+		BytesPerSecond int
+
+		// Number of messages that may be sent at once, defaults to MessagesPerSecond
+		MessageBurst int
+
+		// 可以一次发出的字节数, 默认为 BytesPerSecond. ThrottleReject 和 ThrottleClose 策略下, 更大的消息总是被拒绝.
+		// Number of bytes that may be sent at once, defaults to BytesPerSecond.
+		// Under ThrottleReject and ThrottleClose, larger messages are always refused.
+		ByteBurst int
+
+		// Policy for messages over the limit, defaults to ThrottleDelay
+		Policy ThrottlePolicy
 	}
 
 	// ServerOption 服务端配置
@@ -98,15 +210,31 @@ type (
 		// WebSocket sub-protocol, handshake failure disconnects the connection
 		SubProtocols []string
 
+		// Compression extension configuration
+		PermessageDeflate PermessageDeflate
+
+		// Custom extensions, accepted in the order offered by the client
+		Extensions []Extension
+
 		// Handshake timeout duration
 		HandshakeTimeout time.Duration
 
+		// 关闭握手的超时时间. 大于 0 时, WriteClose 发送关闭帧后不会立即断开连接,
+		// 而是继续读取直到收到对端的关闭帧, 或者超时. 默认为 0, 即立即断开.
+		// Timeout of the closing handshake. When positive, WriteClose does not drop the connection right after
+		// sending the close frame, but keeps reading until the peer's close frame arrives or the timeout expires.
+		// Defaults to 0, i.e. close immediately.
+		CloseTimeout time.Duration
+
 		// Maximum payload size for writing
 		WriteMaxPayloadSize int
 
 		// Read buffer size
 		ReadBufferSize int
 
+		// Write buffer size, i.e. the frame size of streaming writers
+		WriteBufferSize int
+
 		// Maximum payload size for reading
 		ReadMaxPayloadSize int
 
@@ -118,6 +246,54 @@ type (
 
 		// Whether parallel processing is enabled
 		ParallelEnabled bool
+
+		// 数据报模式下单个 UDP 包的最大长度, 更长的帧会被分片. 默认为 1200.
+		// 超过本端 MTU 的分片会被丢弃, 所以对端的 MTU 不能更大.
+		// Maximum size of a single UDP packet in datagram mode, longer frames are fragmented. Defaults to 1200.
+		// Fragments longer than the local MTU are dropped, so the peer must not use a larger one.
+		DatagramMTU int
+
+		// 数据报服务器同时保持的对端数量上限, 达到上限后新的握手请求被忽略. 默认为 4096.
+		// Maximum number of peers kept by the datagram server at once; new handshake requests are ignored beyond it.
+		// Defaults to 4096.
+		DatagramMaxPeers int
+
+		// 数据报服务器在这段时间内没有收到对端的任何数据报时断开连接, 默认为 1 分钟.
+		// 空闲的客户端需要在此期间发送 Ping 保持连接.
+		// The datagram server drops a peer that sent no datagram for this long, defaults to 1 minute.
+		// Idle clients need to send pings within it to stay connected.
+		DatagramIdleTimeout time.Duration
+
+		// 是否接受原生模式的连接. 开启后 RunListener 根据握手的首个字节区分原生模式和 HTTP 升级, 两者可以共用端口.
+		// 原生模式没有 HTTP 握手和掩码, 帧头只有 2 到 11 字节, 适用于双方都使用 gbs 的内部服务;
+		// 自定义拓展, ResponseHeader 和 RequestHeader 中子协议以外的字段不会生效.
+		// Whether to accept native mode connections. When enabled, RunListener tells native handshakes apart from
+		// HTTP upgrades by their first bytes, so both can share a port.
+		// Native mode has neither the HTTP handshake nor masking and its frame headers take 2 to 11 bytes,
+		// meant for internal services that both run gbs;
+		// custom extensions, ResponseHeader, and RequestHeader fields other than the subprotocol do not apply.
+		NativeEnabled bool
+
+		// RunUnix 创建的套接字文件的权限, 为 0 时保持系统默认
+		// Permissions of the socket file created by RunUnix, the system default is kept when 0
+		UnixSocketMode os.FileMode
+
+		// 是否开启零拷贝读模式
+		// 开启后 OnMessage 收到的消息及其负载只在回调期间有效, 回调返回后会被回收复用; ParallelEnabled 不再生效.
+		// 完整缓冲在读缓冲区中的单帧消息, 负载直接引用读缓冲区, 不再拷贝.
+		// Whether to enable the zero-copy read mode.
+		// The message passed to OnMessage, and its payload, are only valid during the callback and are recycled afterwards;
+		// ParallelEnabled no longer applies.
+		// Single-frame messages that are fully buffered borrow their payload straight from the read buffer, without a copy.
+		ZeroCopyEnabled bool
+
+		// 记录连接收发的数据消息, 例如 journal 包, 为 nil 时不记录
+		// Records the data messages of the connections, e.g. the journal package; nil records nothing
+		Journal Journal
+
+		// 每个连接的发送限流, 可以通过 Conn.SetThrottle 单独调整
+		// Outgoing throttling of every connection, adjustable per connection through Conn.SetThrottle
+		Throttle Throttle
 	}
 )
 
@@ -146,9 +322,21 @@ func initServerOption(c *ServerOption) *ServerOption {
 	if c.ReadBufferSize <= 0 {
 		c.ReadBufferSize = defaultReadBufferSize
 	}
+	if c.WriteBufferSize <= 0 {
+		c.WriteBufferSize = defaultWriteBufferSize
+	}
 	if c.WriteMaxPayloadSize <= 0 {
 		c.WriteMaxPayloadSize = defaultWriteMaxPayloadSize
 	}
+	if c.DatagramMTU <= 0 {
+		c.DatagramMTU = defaultDatagramMTU
+	}
+	if c.DatagramMaxPeers <= 0 {
+		c.DatagramMaxPeers = defaultDatagramMaxPeers
+	}
+	if c.DatagramIdleTimeout <= 0 {
+		c.DatagramIdleTimeout = defaultDatagramIdleTimeout
+	}
 	if c.Authorize == nil {
 		c.Authorize = func(r *http.Request, session SessionStorage) bool { return true }
 	}
@@ -169,24 +357,71 @@ func initServerOption(c *ServerOption) *ServerOption {
 	}
 
 	c.deleteProtectedHeaders()
+	c.PermessageDeflate.initialize()
+	c.Throttle.initialize()
 
 	c.config = &Config{
 		ParallelEnabled:     c.ParallelEnabled,
+		ZeroCopyEnabled:     c.ZeroCopyEnabled,
 		ParallelGolimit:     c.ParallelGolimit,
 		ReadMaxPayloadSize:  c.ReadMaxPayloadSize,
 		ReadBufferSize:      c.ReadBufferSize,
+		WriteBufferSize:     c.WriteBufferSize,
+		CloseTimeout:        c.CloseTimeout,
 		WriteMaxPayloadSize: c.WriteMaxPayloadSize,
 		CheckUtf8Enabled:    c.CheckUtf8Enabled,
 		Recovery:            c.Recovery,
 		Logger:              c.Logger,
+		Journal:             c.Journal,
+		Throttle:            c.Throttle,
 		brPool: internal.NewPool(func() *bufio.Reader {
 			return bufio.NewReaderSize(nil, c.ReadBufferSize)
 		}),
 	}
+	if c.PermessageDeflate.Enabled {
+		c.config.deflaterPool = new(deflaterPool).initialize(c.PermessageDeflate, c.ReadMaxPayloadSize)
+	}
 
 	return c
 }
 
+// 初始化压缩拓展配置
+// Initialize the compression extension options
+func (c *PermessageDeflate) initialize() {
+	if !c.Enabled {
+		return
+	}
+	if c.ServerMaxWindowBits < 8 || c.ServerMaxWindowBits > 15 {
+		c.ServerMaxWindowBits = 15
+	}
+	if c.ClientMaxWindowBits < 8 || c.ClientMaxWindowBits > 15 {
+		c.ClientMaxWindowBits = 15
+	}
+	if c.Threshold <= 0 {
+		c.Threshold = defaultCompressThreshold
+	}
+	if c.Level == 0 || c.Level < flate.HuffmanOnly || c.Level > flate.BestCompression {
+		c.Level = defaultCompressLevel
+	}
+	if c.PoolSize <= 0 {
+		c.PoolSize = defaultCompressorPoolSize
+	}
+	c.PoolSize = internal.ToBinaryNumber(c.PoolSize)
+}
+
+func (c *Throttle) initialize() {
+	if c.MessageBurst <= 0 {
+		c.MessageBurst = c.MessagesPerSecond
+	}
+	if c.ByteBurst <= 0 {
+		c.ByteBurst = c.BytesPerSecond
+	}
+}
+
+func (c *Throttle) enabled() bool {
+	return c.MessagesPerSecond > 0 || c.BytesPerSecond > 0
+}
+
 // 获取服务器配置
 // Get server configuration
 func (c *ServerOption) getConfig() *Config { return c.config }
@@ -204,8 +439,18 @@ type ClientOption struct {
 	// NewDialer: func() (proxy.Dialer, error) {
 	//     return proxy.SOCKS5("tcp", "127.0.0.1:1080", nil, nil)
 	// },
+	// HTTP proxies are supported by Proxy.
+	// Dialers also implementing ContextDialer abort a dial in progress when the context of NewClientContext is canceled.
 	NewDialer func() (Dialer, error)
 
+	// 返回连接使用的代理, 返回 nil 时直接连接, 例如 http.ProxyURL, 或者按 HTTP_PROXY, HTTPS_PROXY 和 NO_PROXY 选择代理的 http.ProxyFromEnvironment.
+	// 支持 http 和 https 代理, 通过 CONNECT 建立隧道, 代理地址中的用户名和密码用于 Basic 认证; 到代理的连接同样由 NewDialer 建立.
+	// Returns the proxy for the connection, or nil to connect directly, e.g. http.ProxyURL,
+	// or http.ProxyFromEnvironment which picks the proxy by HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+	// http and https proxies are supported through CONNECT tunnels, and the user name and password of the proxy URL
+	// are used for Basic authentication; the connection to the proxy is also made by NewDialer.
+	Proxy func(*http.Request) (*url.URL, error)
+
 	// TLS configuration
 	TlsConfig *tls.Config
 
@@ -215,9 +460,19 @@ type ClientOption struct {
 	// Recovery function
 	Recovery func(logger Logger)
 
-	// Server address, e.g., wss://example.com/connect
+	// 服务器地址, 例如 wss://example.com/connect.
+	// Unix 域套接字使用 ws+unix://<socket>:<path>, 例如 ws+unix:///run/app.sock:/connect, 抽象命名空间以 @ 开头.
+	// Server address, e.g., wss://example.com/connect.
+	// Unix domain sockets use ws+unix://<socket>:<path>, e.g. ws+unix:///run/app.sock:/connect;
+	// abstract namespace sockets start with @.
 	Addr string
 
+	// Compression extension configuration
+	PermessageDeflate PermessageDeflate
+
+	// Custom extensions, offered in order after permessage-deflate
+	Extensions []Extension
+
 	// Maximum payload size for reading
 	ReadMaxPayloadSize int
 
@@ -227,9 +482,16 @@ type ClientOption struct {
 	// Read buffer size
 	ReadBufferSize int
 
+	// Write buffer size, i.e. the frame size of streaming writers
+	WriteBufferSize int
+
 	// Handshake timeout duration
 	HandshakeTimeout time.Duration
 
+	// 关闭握手的超时时间, 参见 ServerOption.CloseTimeout
+	// Timeout of the closing handshake, see ServerOption.CloseTimeout
+	CloseTimeout time.Duration
+
 	// Parallel goroutine limit
 	ParallelGolimit int
 
@@ -238,6 +500,34 @@ type ClientOption struct {
 
 	// Whether parallel processing is enabled
 	ParallelEnabled bool
+
+	// 是否开启零拷贝读模式, 参见 ServerOption.ZeroCopyEnabled
+	// Whether to enable the zero-copy read mode, see ServerOption.ZeroCopyEnabled
+	ZeroCopyEnabled bool
+
+	// 数据报模式下单个 UDP 包的最大长度, 参见 ServerOption.DatagramMTU
+	// Maximum size of a single UDP packet in datagram mode, see ServerOption.DatagramMTU
+	DatagramMTU int
+
+	// 是否使用原生模式连接, 参见 ServerOption.NativeEnabled. 此时 NewClient 返回的 *http.Response 为 nil.
+	// Whether to connect in native mode, see ServerOption.NativeEnabled. NewClient then returns a nil *http.Response.
+	NativeEnabled bool
+
+	// 记录连接收发的数据消息, 参见 ServerOption.Journal
+	// Records the data messages of the connection, see ServerOption.Journal
+	Journal Journal
+
+	// 连接的发送限流, 参见 ServerOption.Throttle
+	// Outgoing throttling of the connection, see ServerOption.Throttle
+	Throttle Throttle
+
+	// 非空时 NewClient 通过 HTTP/2 的扩展 CONNECT (RFC 8441) 建立连接, WebSocket 运行在一个 HTTP/2 流上.
+	// 传输层必须支持扩展 CONNECT, 例如 golang.org/x/net/http2 的 Transport, 标准库的 *http.Transport 会拒绝 :protocol 伪头部;
+	// 此时 NewDialer, Proxy 和 TlsConfig 不会生效.
+	// When set, NewClient connects through HTTP/2 extended CONNECT (RFC 8441) and the WebSocket runs over an HTTP/2 stream.
+	// The transport must support extended CONNECT, e.g. the Transport of golang.org/x/net/http2,
+	// since the standard *http.Transport rejects the :protocol pseudo header; NewDialer, Proxy and TlsConfig do not apply.
+	HTTP2Transport http.RoundTripper
 }
 
 // 初始化客户端配置
@@ -255,9 +545,15 @@ func initClientOption(c *ClientOption) *ClientOption {
 	if c.ReadBufferSize <= 0 {
 		c.ReadBufferSize = defaultReadBufferSize
 	}
+	if c.WriteBufferSize <= 0 {
+		c.WriteBufferSize = defaultWriteBufferSize
+	}
 	if c.WriteMaxPayloadSize <= 0 {
 		c.WriteMaxPayloadSize = defaultWriteMaxPayloadSize
 	}
+	if c.DatagramMTU <= 0 {
+		c.DatagramMTU = defaultDatagramMTU
+	}
 	if c.HandshakeTimeout <= 0 {
 		c.HandshakeTimeout = defaultHandshakeTimeout
 	}
@@ -276,6 +572,8 @@ func initClientOption(c *ClientOption) *ClientOption {
 	if c.Recovery == nil {
 		c.Recovery = func(logger Logger) {}
 	}
+	c.PermessageDeflate.initialize()
+	c.Throttle.initialize()
 	return c
 }
 
@@ -284,13 +582,18 @@ func initClientOption(c *ClientOption) *ClientOption {
 func (c *ClientOption) getConfig() *Config {
 	config := &Config{
 		ParallelEnabled:     c.ParallelEnabled,
+		ZeroCopyEnabled:     c.ZeroCopyEnabled,
 		ParallelGolimit:     c.ParallelGolimit,
 		ReadMaxPayloadSize:  c.ReadMaxPayloadSize,
 		ReadBufferSize:      c.ReadBufferSize,
+		WriteBufferSize:     c.WriteBufferSize,
+		CloseTimeout:        c.CloseTimeout,
 		WriteMaxPayloadSize: c.WriteMaxPayloadSize,
 		CheckUtf8Enabled:    c.CheckUtf8Enabled,
 		Recovery:            c.Recovery,
 		Logger:              c.Logger,
+		Journal:             c.Journal,
+		Throttle:            c.Throttle,
 	}
 	return config
 }
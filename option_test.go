@@ -17,6 +17,13 @@ func validateServerOption(as *assert.Assertions, u *Upgrader) {
 	as.Equal(config.WriteMaxPayloadSize, option.WriteMaxPayloadSize)
 	as.Equal(config.CheckUtf8Enabled, option.CheckUtf8Enabled)
 	as.Equal(config.ReadBufferSize, option.ReadBufferSize)
+	as.Equal(config.WriteBufferSize, option.WriteBufferSize)
+	as.Equal(config.CloseTimeout, option.CloseTimeout)
+	as.Equal(defaultDatagramMTU, option.DatagramMTU)
+	as.Equal(defaultDatagramMaxPeers, option.DatagramMaxPeers)
+	as.Equal(defaultDatagramIdleTimeout, option.DatagramIdleTimeout)
+	as.False(option.NativeEnabled)
+	as.Zero(option.UnixSocketMode)
 	as.NotNil(config.brPool)
 	as.NotNil(config.Recovery)
 	as.Equal(config.Logger, defaultLogger)
@@ -33,6 +40,10 @@ func validateClientOption(as *assert.Assertions, option *ClientOption) {
 	as.Equal(config.WriteMaxPayloadSize, option.WriteMaxPayloadSize)
 	as.Equal(config.CheckUtf8Enabled, option.CheckUtf8Enabled)
 	as.Equal(config.ReadBufferSize, option.ReadBufferSize)
+	as.Equal(config.WriteBufferSize, option.WriteBufferSize)
+	as.Equal(config.CloseTimeout, option.CloseTimeout)
+	as.Equal(defaultDatagramMTU, option.DatagramMTU)
+	as.False(option.NativeEnabled)
 	as.Nil(config.brPool)
 	as.NotNil(config.Recovery)
 	as.Equal(config.Logger, defaultLogger)
@@ -122,3 +133,17 @@ func TestNewSession(t *testing.T) {
 		assert.True(t, ok)
 	}
 }
+
+func TestThrottleOption(t *testing.T) {
+	as := assert.New(t)
+	option := initServerOption(&ServerOption{Throttle: Throttle{MessagesPerSecond: 10, BytesPerSecond: 1024, ByteBurst: 4096}})
+	as.Equal(10, option.Throttle.MessageBurst)
+	as.Equal(4096, option.Throttle.ByteBurst)
+	as.Equal(ThrottleDelay, option.Throttle.Policy)
+	as.Equal(option.Throttle, option.getConfig().Throttle)
+
+	client := initClientOption(&ClientOption{Throttle: Throttle{BytesPerSecond: 1024}})
+	as.Equal(1024, client.Throttle.ByteBurst)
+	as.Equal(client.Throttle, client.getConfig().Throttle)
+	as.False(initClientOption(nil).Throttle.enabled())
+}
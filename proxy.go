@@ -0,0 +1,100 @@
+package gbs
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/catermujo/gbs/internal"
+)
+
+// 查询连接 URL 使用的代理, 返回 nil 表示直接连接.
+// 代理函数收到的请求使用 http 或 https 协议名, 这样 http.ProxyFromEnvironment 会按 HTTP_PROXY 和 HTTPS_PROXY 选择代理.
+// Looks up the proxy used to connect to URL, nil means a direct connection.
+// The request passed to the proxy function uses the http or https scheme,
+// so that http.ProxyFromEnvironment picks HTTP_PROXY or HTTPS_PROXY accordingly.
+func (c *connector) getProxy(URL *url.URL) (*url.URL, error) {
+	if c.option.Proxy == nil {
+		return nil, nil
+	}
+	target := *URL
+	target.Scheme = internal.SelectValue(URL.Scheme == "wss", "https", "http")
+	return c.option.Proxy(&http.Request{Method: http.MethodGet, URL: &target, Header: http.Header{}, Host: URL.Host})
+}
+
+// 连接代理并通过 CONNECT 建立到 addr 的隧道. 代理拒绝时返回它的响应.
+// Connects to the proxy and opens a tunnel to addr with CONNECT. Returns the response of the proxy when it refuses.
+func (c *connector) dialProxy(proxyURL *url.URL, addr string) (net.Conn, *http.Response, error) {
+	tlsEnabled := proxyURL.Scheme == "https"
+	if !tlsEnabled && proxyURL.Scheme != "http" {
+		return nil, nil, ErrUnsupportedProtocol
+	}
+	conn, err := c.dialContext("tcp", internal.GetAddrFromURL(proxyURL, tlsEnabled))
+	if err != nil {
+		return nil, nil, err
+	}
+	if tlsEnabled {
+		// 和标准库一样, 代理和服务器共用 TLS 配置
+		// Like the standard library, the proxy shares the TLS configuration with the server
+		config := &tls.Config{}
+		if c.option.TlsConfig != nil {
+			config = c.option.TlsConfig.Clone()
+		}
+		config.ServerName = proxyURL.Hostname()
+		conn = tls.Client(conn, config)
+	}
+
+	stop := internal.AfterFunc(c.getContext(), func() { _ = conn.SetDeadline(aLongTimeAgo) })
+	resp, err := c.connect(conn, proxyURL, addr)
+	if !stop() {
+		err = c.getContext().Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, resp, err
+	}
+	return conn, nil, nil
+}
+
+// 完成到 https 代理的 TLS 握手, 然后发送 CONNECT 请求; 代理地址中的用户名和密码用于 Basic 认证
+// Completes the TLS handshake with an https proxy, then sends the CONNECT request;
+// the user name and password of the proxy URL are used for Basic authentication
+func (c *connector) connect(conn net.Conn, proxyURL *url.URL, addr string) (*http.Response, error) {
+	if err := c.handshakeTLS(conn); err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(c.option.HandshakeTimeout))
+	r := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		r.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := r.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp, ErrProxyConnect
+	}
+	// 隧道建立后代理不应该先于服务器发送数据, 否则这些数据会留在缓冲区中丢失
+	// The proxy must not send data ahead of the server once the tunnel is open, or it would be lost in the buffer
+	if br.Buffered() > 0 {
+		return resp, ErrProxyConnect
+	}
+	return nil, conn.SetDeadline(time.Time{})
+}
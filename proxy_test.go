@@ -0,0 +1,175 @@
+package gbs
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 在监听器上运行 HTTP CONNECT 代理, credentials 非空时要求 Basic 认证. 返回收到的 CONNECT 请求.
+// Runs an HTTP CONNECT proxy on the listener, requiring Basic authentication when credentials is not empty.
+// Returns the CONNECT requests received.
+func newConnectProxy(listener net.Listener, credentials string) chan *http.Request {
+	requests := make(chan *http.Request, 8)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				r, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				requests <- r
+				if credentials != "" && r.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+					_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\nContent-Length: 0\r\n\r\n"))
+					return
+				}
+				target, err := net.Dial("tcp", r.Host)
+				if err != nil {
+					_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+					return
+				}
+				defer target.Close()
+				_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go func() { _, _ = io.Copy(target, br) }()
+				_, _ = io.Copy(conn, target)
+			}(conn)
+		}
+	}()
+	return requests
+}
+
+// 启动回显服务器, 返回其地址
+// Starts an echo server and returns its address
+func newEchoServer(t *testing.T, config *tls.Config) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
+	serverHandler := new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+		_ = message.Close()
+	}
+	go NewServer(serverHandler, nil).RunListener(listener)
+	return listener.Addr().String()
+}
+
+// 通过客户端发送一条消息并等待回显
+// Sends a message through the client and waits for the echo
+func echoThrough(as *assert.Assertions, option *ClientOption) {
+	var messages = make(chan string, 1)
+	clientHandler := new(webSocketMocker)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		messages <- message.Data.String()
+	}
+	client, _, err := NewClient(clientHandler, option)
+	if !as.NoError(err) {
+		return
+	}
+	go client.ReadLoop()
+	as.NoError(client.WriteString("hello"))
+	select {
+	case s := <-messages:
+		as.Equal("hello", s)
+	case <-time.After(3 * time.Second):
+		as.Fail("timeout")
+	}
+	_ = client.WriteClose(1000, nil)
+}
+
+func TestNewClient_Proxy(t *testing.T) {
+	as := assert.New(t)
+	certs, _ := tls.X509KeyPair(rsaCertPEM, rsaKeyPEM)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{certs}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := newConnectProxy(listener, "dXNlcjpwYXNz")
+	proxyAddr := listener.Addr().String()
+
+	t.Run("http", func(t *testing.T) {
+		addr := newEchoServer(t, nil)
+		echoThrough(as, &ClientOption{
+			Addr:  "ws://" + addr + "/connect",
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", User: url.UserPassword("user", "pass"), Host: proxyAddr}),
+		})
+		r := <-requests
+		as.Equal(http.MethodConnect, r.Method)
+		as.Equal(addr, r.Host)
+	})
+
+	t.Run("https", func(t *testing.T) {
+		tlsListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsRequests := newConnectProxy(tls.NewListener(tlsListener, tlsConfig), "")
+		addr := newEchoServer(t, tlsConfig)
+
+		// 代理函数收到 https 协议名的请求
+		// The proxy function receives a request with the https scheme
+		var scheme string
+		echoThrough(as, &ClientOption{
+			Addr:      "wss://" + addr,
+			TlsConfig: &tls.Config{InsecureSkipVerify: true},
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				scheme = r.URL.Scheme
+				return &url.URL{Scheme: "https", Host: tlsListener.Addr().String()}, nil
+			},
+		})
+		as.Equal("https", scheme)
+		as.Equal(addr, (<-tlsRequests).Host)
+	})
+
+	t.Run("direct", func(t *testing.T) {
+		addr := newEchoServer(t, nil)
+		echoThrough(as, &ClientOption{
+			Addr:  "ws://" + addr,
+			Proxy: func(r *http.Request) (*url.URL, error) { return nil, nil },
+		})
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		_, resp, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+			Addr:  "ws://127.0.0.1:1/connect",
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", User: url.UserPassword("user", "secret"), Host: proxyAddr}),
+		})
+		as.ErrorIs(err, ErrProxyConnect)
+		as.Equal(http.StatusProxyAuthRequired, resp.StatusCode)
+		<-requests
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+			Addr:  "ws://127.0.0.1:1/connect",
+			Proxy: http.ProxyURL(&url.URL{Scheme: "socks5", Host: proxyAddr}),
+		})
+		as.ErrorIs(err, ErrUnsupportedProtocol)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		_, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+			Addr:  "ws://127.0.0.1:1/connect",
+			Proxy: func(r *http.Request) (*url.URL, error) { return nil, io.EOF },
+		})
+		as.ErrorIs(err, io.EOF)
+	})
+}
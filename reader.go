@@ -3,6 +3,7 @@ package gbs
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"unsafe"
 
 	"github.com/catermujo/gbs/internal"
@@ -11,6 +12,14 @@ import (
 // 检查掩码设置是否符合 RFC6455 协议。
 // Checks if the mask setting complies with the RFC6455 protocol.
 func (c *Conn) checkMask(enabled bool) error {
+	// 原生模式两个方向都不使用掩码
+	// Native mode masks neither direction
+	if c.native {
+		if enabled {
+			return internal.CloseProtocolError
+		}
+		return nil
+	}
 	// RFC6455: 所有从客户端发送到服务器的帧都必须设置掩码位为 1。
 	// RFC6455: All frames sent from client to server must have the mask bit set to 1.
 	if (c.isServer && !enabled) || (!c.isServer && enabled) {
@@ -64,17 +73,26 @@ func (c *Conn) readControl() error {
 	}
 }
 
-// 读取消息
-// Reads a message
-func (c *Conn) readFrame() (*Message, error) {
+// 按照连接的帧格式解析帧头
+// Parses the frame header in the framing of the connection
+func (c *Conn) parseHeader() (int, error) {
+	if c.native {
+		return c.fh.ParseNative(c.br)
+	}
+	return c.fh.Parse(c.br)
+}
+
+// 读取并校验帧头, 返回负载长度
+// Reads and validates the frame header, returns the payload length
+func (c *Conn) readHeader() (int, error) {
 	// 解析帧头并获取内容长度
 	// Parse the frame header and get the content length
-	contentLength, err := c.fh.Parse(c.br)
+	contentLength, err := c.parseHeader()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	if contentLength > c.config.ReadMaxPayloadSize {
-		return nil, internal.CloseMessageTooLarge
+		return 0, internal.CloseMessageTooLarge
 	}
 
 	// RSV1, RSV2, RSV3: 每个占 1 位
@@ -84,21 +102,64 @@ func (c *Conn) readFrame() (*Message, error) {
 	// MUST be 0 unless an extension is negotiated that defines meanings for non-zero values.
 	// If a nonzero value is received and none of the negotiated extensions defines the meaning of such a nonzero value,
 	// the receiving endpoint MUST _Fail the WebSocket Connection_.
-	if c.fh.GetRSV1() || c.fh.GetRSV2() || c.fh.GetRSV3() {
-		return nil, internal.CloseProtocolError
+	// 拓展定义的保留位只能出现在数据消息的第一帧.
+	// Reserved bits defined by extensions may only be set on the first frame of a data message.
+	rsv := c.fh.GetRSV()
+	if rsv&^c.rsv != 0 {
+		return 0, internal.CloseProtocolError
 	}
 
-	maskEnabled := c.fh.GetMask()
-	if err := c.checkMask(maskEnabled); err != nil {
-		return nil, err
+	if err := c.checkMask(c.fh.GetMask()); err != nil {
+		return 0, err
 	}
 
 	opcode := c.fh.GetOpcode()
-	if !opcode.isDataFrame() {
+	if rsv != 0 && (opcode == OpcodeContinuation || !opcode.isDataFrame()) {
+		return 0, internal.CloseProtocolError
+	}
+	return contentLength, nil
+}
+
+// 读取消息
+// Reads a message
+func (c *Conn) readFrame() (*Message, error) {
+	contentLength, err := c.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	if !c.fh.GetOpcode().isDataFrame() {
 		return nil, c.readControl()
 	}
+	return c.readPayload(contentLength)
+}
 
+// 读取数据帧的负载, 消息不完整时返回 nil
+// Reads the payload of a data frame, returns nil while the message is incomplete
+func (c *Conn) readPayload(contentLength int) (*Message, error) {
+	opcode := c.fh.GetOpcode()
+	rsv := c.fh.GetRSV()
+	maskEnabled := c.fh.GetMask()
 	fin := c.fh.GetFIN()
+
+	// 零拷贝模式下, 已经完整缓冲的单帧消息直接引用读缓冲区. 丢弃之后, 这段内存在下一次读取之前保持不变.
+	// 引用的切片容量等于长度, 解压等追加写入会拷贝, 不会覆盖缓冲区中的下一帧.
+	// In zero-copy mode, a single-frame message that is fully buffered borrows the read buffer.
+	// The memory stays untouched after Discard until the next read.
+	// The borrowed slice is capped at its length, so appends such as the one of decompression copy it
+	// instead of overwriting the next frame in the buffer.
+	if c.config.ZeroCopyEnabled && fin && opcode != OpcodeContinuation && !c.continuationFrame.initialized &&
+		contentLength <= c.br.Buffered() {
+		p, _ := c.br.Peek(contentLength)
+		_, _ = c.br.Discard(contentLength)
+		if maskEnabled {
+			internal.MaskXOR(p, c.fh.GetMaskKey())
+		}
+		msg := messagePool.Get()
+		msg.Opcode = opcode
+		msg.borrow(p[:contentLength:contentLength])
+		return c.decodeMessage(msg, rsv)
+	}
+
 	buf := binaryPool.Get(contentLength)
 	p := buf.Bytes()[:contentLength]
 	closer := Message{Data: buf}
@@ -118,13 +179,14 @@ func (c *Conn) readFrame() (*Message, error) {
 	if fin && opcode != OpcodeContinuation {
 		*(*[]byte)(unsafe.Pointer(buf)) = p
 		closer.Data = nil
-		return &Message{Opcode: opcode, Data: buf}, nil
+		return c.decodeMessage(c.newMessage(opcode, buf), rsv)
 	}
 
 	// 处理分片消息
 	// processing segmented messages
 	if !fin && opcode != OpcodeContinuation {
 		c.continuationFrame.initialized = true
+		c.continuationFrame.rsv = rsv
 		c.continuationFrame.opcode = opcode
 		c.continuationFrame.buffer = bytes.NewBuffer(make([]byte, 0, contentLength))
 	}
@@ -140,11 +202,45 @@ func (c *Conn) readFrame() (*Message, error) {
 		return nil, nil
 	}
 
-	msg := &Message{Opcode: c.continuationFrame.opcode, Data: c.continuationFrame.buffer}
+	msg := c.newMessage(c.continuationFrame.opcode, c.continuationFrame.buffer)
+	rsv = c.continuationFrame.rsv
 	c.continuationFrame.reset()
+	return c.decodeMessage(msg, rsv)
+}
+
+// 根据第一帧的保留位解压消息并执行拓展的解码
+// Decompresses the message and runs the extension decoders according to the reserved bits of the first frame
+func (c *Conn) decodeMessage(msg *Message, rsv RSV) (*Message, error) {
+	if c.pd.Enabled && rsv&RSV1 != 0 {
+		var err error
+		if msg, err = c.decompress(msg); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.extensions) > 0 {
+		var err error
+		if msg, err = c.decodeExtensions(msg, rsv); err != nil || msg == nil {
+			return msg, err
+		}
+	}
+	c.record(true, msg.Opcode, internal.Bytes(msg.Bytes()))
 	return msg, nil
 }
 
+// 创建消息, 零拷贝模式下从池中获取
+// Creates a message, taken from the pool in zero-copy mode
+func (c *Conn) newMessage(opcode Opcode, data *bytes.Buffer) *Message {
+	if !c.config.ZeroCopyEnabled {
+		return &Message{Opcode: opcode, Data: data}
+	}
+	msg := messagePool.Get()
+	msg.Opcode = opcode
+	msg.Data = data
+	return msg
+}
+
+// ReadMessage 读取一条完整的消息. 零拷贝模式下, 消息只在下一次读取之前有效.
+// Reads a complete message. In zero-copy mode, the message is only valid until the next read.
 func (c *Conn) ReadMessage() (*Message, error) {
 	for {
 		msg, err := c.readFrame()
@@ -158,14 +254,28 @@ func (c *Conn) ReadMessage() (*Message, error) {
 }
 
 func (c *Conn) readMessage() error {
+	if handler, ok := c.handler.(StreamEventHandler); ok {
+		return c.readStream(handler)
+	}
 	msg, err := c.readFrame()
 	if err != nil {
 		return err
 	}
-	if msg != nil {
-		return c.emitMessage(msg)
+	if msg == nil {
+		return nil
 	}
-	return nil
+	// 关闭握手期间收到的数据消息直接丢弃
+	// Data messages received during the closing handshake are discarded
+	if c.IsClosed() {
+		_ = msg.Close()
+		return nil
+	}
+	if c.config.ZeroCopyEnabled {
+		err = c.emitMessage(msg)
+		msg.recycle()
+		return err
+	}
+	return c.emitMessage(msg)
 }
 
 // 分发消息和异常恢复
@@ -182,8 +292,188 @@ func (c *Conn) emitMessage(msg *Message) (err error) {
 	if !internal.CheckEncoding(c.config.CheckUtf8Enabled, uint8(msg.Opcode), msg.Bytes()) {
 		return internal.NewError(internal.CloseUnsupportedData, ErrTextEncoding)
 	}
-	if c.config.ParallelEnabled {
+	if c.config.ParallelEnabled && !c.config.ZeroCopyEnabled {
 		return c.readQueue.Go(msg, c.dispatch)
 	}
 	return c.dispatch(msg)
 }
+
+// NextReader 返回下一条数据消息的类型和流式读取器, 期间收到的控制帧会照常处理.
+// 帧负载在到达时即被读取, 因此消息总长度不受 ReadMaxPayloadSize 限制, 只限制单帧长度.
+// 压缩或者经过拓展编码的消息需要完整解码, 会先缓冲整条消息.
+// 再次调用 NextReader 时, 上一个读取器中剩余的数据会被丢弃. 不要与 ReadLoop 或者 ReadMessage 混用.
+// Returns the type and a streaming reader of the next data message; control frames received meanwhile are handled as usual.
+// Frame payloads are read as they arrive, so ReadMaxPayloadSize only limits single frames, not the whole message.
+// Compressed messages, or messages encoded by extensions, need a complete decode and are buffered first.
+// The next call to NextReader discards whatever is left in the previous reader. Do not mix with ReadLoop or ReadMessage.
+func (c *Conn) NextReader() (Opcode, io.Reader, error) {
+	if err := c.discardReader(); err != nil {
+		return 0, nil, err
+	}
+
+	for {
+		contentLength, err := c.readHeader()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		opcode := c.fh.GetOpcode()
+		if !opcode.isDataFrame() {
+			if err := c.readControl(); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		if opcode == OpcodeContinuation || c.continuationFrame.initialized {
+			return 0, nil, internal.CloseProtocolError
+		}
+
+		if c.fh.GetRSV() != 0 {
+			msg, err := c.readPayload(contentLength)
+			for err == nil && msg == nil {
+				msg, err = c.readFrame()
+			}
+			if err != nil {
+				return 0, nil, err
+			}
+			if !internal.CheckEncoding(c.config.CheckUtf8Enabled, uint8(msg.Opcode), msg.Bytes()) {
+				_ = msg.Close()
+				return 0, nil, internal.NewError(internal.CloseUnsupportedData, ErrTextEncoding)
+			}
+			c.reader = msg
+			return msg.Opcode, msg, nil
+		}
+
+		reader := &messageReader{conn: c, text: opcode == OpcodeText && c.config.CheckUtf8Enabled}
+		reader.reset(contentLength)
+		c.reader = reader
+		return opcode, reader, nil
+	}
+}
+
+// 丢弃上一个读取器中剩余的数据
+// Discards whatever is left in the previous reader
+func (c *Conn) discardReader() error {
+	if c.reader == nil {
+		return nil
+	}
+	_, err := io.Copy(io.Discard, c.reader)
+	if msg, ok := c.reader.(*Message); ok {
+		_ = msg.Close()
+	}
+	c.reader = nil
+	return err
+}
+
+// 以流的形式读取一条消息并分发
+// Reads a message as a stream and dispatches it
+func (c *Conn) readStream(handler StreamEventHandler) error {
+	opcode, reader, err := c.NextReader()
+	if err != nil {
+		return err
+	}
+	c.dispatchStream(handler, opcode, reader)
+	return c.discardReader()
+}
+
+// 分发流式消息和异常恢复
+// Dispatch streaming message & Recovery
+func (c *Conn) dispatchStream(handler StreamEventHandler, opcode Opcode, reader io.Reader) {
+	defer c.config.Recovery(c.config.Logger)
+	handler.OnStream(c, opcode, reader)
+}
+
+// 流式读取器
+// Streaming reader
+type messageReader struct {
+	conn    *Conn
+	err     error
+	checker internal.UTF8Checker
+	// remaining Unread bytes of the current frame
+	remaining int
+	// offset Bytes of the current frame already unmasked
+	offset  int
+	maskKey [4]byte
+	masked  bool
+	fin     bool
+	text    bool
+}
+
+// 开始读取当前帧
+// Starts reading the current frame
+func (c *messageReader) reset(contentLength int) {
+	c.remaining = contentLength
+	c.offset = 0
+	c.fin = c.conn.fh.GetFIN()
+	if c.masked = c.conn.fh.GetMask(); c.masked {
+		copy(c.maskKey[:], c.conn.fh.GetMaskKey())
+	}
+}
+
+// Read 读取消息的负载, 读完返回 io.EOF
+// Reads the payload of the message, returns io.EOF at the end
+func (c *messageReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	for c.remaining == 0 {
+		if c.fin {
+			if c.text && !c.checker.Done() {
+				c.err = internal.NewError(internal.CloseUnsupportedData, ErrTextEncoding)
+			} else {
+				c.err = io.EOF
+			}
+			return 0, c.err
+		}
+		if c.err = c.nextFrame(); c.err != nil {
+			return 0, c.err
+		}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	n, err := c.conn.br.Read(p[:internal.Min(len(p), c.remaining)])
+	if n > 0 {
+		if c.masked {
+			i := c.offset
+			key := [4]byte{c.maskKey[i&3], c.maskKey[(i+1)&3], c.maskKey[(i+2)&3], c.maskKey[(i+3)&3]}
+			internal.MaskXOR(p[:n], key[:])
+		}
+		c.remaining -= n
+		c.offset += n
+		if c.text && !c.checker.Write(p[:n]) {
+			c.err = internal.NewError(internal.CloseUnsupportedData, ErrTextEncoding)
+			return n, c.err
+		}
+	}
+	if err != nil {
+		c.err = internal.SelectValue(err == io.EOF, io.ErrUnexpectedEOF, err)
+		return n, c.err
+	}
+	return n, nil
+}
+
+// 读取下一个后续帧, 期间处理控制帧
+// Reads the next continuation frame, handling control frames meanwhile
+func (c *messageReader) nextFrame() error {
+	conn := c.conn
+	for {
+		contentLength, err := conn.readHeader()
+		if err != nil {
+			return err
+		}
+		opcode := conn.fh.GetOpcode()
+		if !opcode.isDataFrame() {
+			if err := conn.readControl(); err != nil {
+				return err
+			}
+			continue
+		}
+		if opcode != OpcodeContinuation {
+			return internal.CloseProtocolError
+		}
+		c.reset(contentLength)
+		return nil
+	}
+}
@@ -5,6 +5,7 @@ import (
 	_ "embed"
 	"encoding/hex"
 	"encoding/json"
+	"io"
 	"net"
 	"sync"
 	"testing"
@@ -254,7 +255,7 @@ func TestFrameHeader_Parse(t *testing.T) {
 		s, c := net.Pipe()
 		go func() {
 			h := frameHeader{}
-			h.GenerateHeader(false, true, OpcodeText, 500)
+			h.GenerateHeader(false, true, false, OpcodeText, 500)
 			c.Write(h[:2])
 			c.Close()
 		}()
@@ -269,7 +270,7 @@ func TestFrameHeader_Parse(t *testing.T) {
 		s, c := net.Pipe()
 		go func() {
 			h := frameHeader{}
-			h.GenerateHeader(false, true, OpcodeText, 1024*1024)
+			h.GenerateHeader(false, true, false, OpcodeText, 1024*1024)
 			c.Write(h[:2])
 			c.Close()
 		}()
@@ -284,7 +285,7 @@ func TestFrameHeader_Parse(t *testing.T) {
 		s, c := net.Pipe()
 		go func() {
 			h := frameHeader{}
-			h.GenerateHeader(false, true, OpcodeText, 1024*1024)
+			h.GenerateHeader(false, true, false, OpcodeText, 1024*1024)
 			c.Write(h[:10])
 			c.Close()
 		}()
@@ -345,3 +346,234 @@ func TestConn_ReadMessage(t *testing.T) {
 		client.ReadLoop()
 	})
 }
+
+type streamHandler struct {
+	BuiltinEventHandler
+	onStream func(socket *Conn, opcode Opcode, reader io.Reader)
+}
+
+func (c *streamHandler) OnStream(socket *Conn, opcode Opcode, reader io.Reader) {
+	c.onStream(socket, opcode, reader)
+}
+
+func TestConn_NextReader(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("fragmented", func(t *testing.T) {
+		var pings []string
+		serverHandler := new(webSocketMocker)
+		serverHandler.onPing = func(socket *Conn, payload []byte) { pings = append(pings, string(payload)) }
+		server, client := newPeer(serverHandler, &ServerOption{ReadMaxPayloadSize: 16}, new(BuiltinEventHandler), &ClientOption{})
+
+		var payload = internal.AlphabetNumeric.Generate(100)
+		go func() {
+			for i := 0; i < len(payload); i += 10 {
+				_ = testWrite(client, i+10 >= len(payload), internal.SelectValue(i == 0, OpcodeBinary, OpcodeContinuation), testCloneBytes(payload[i:i+10]))
+				if i == 50 {
+					_ = testWrite(client, true, OpcodePing, []byte("ping"))
+					_ = testWrite(client, false, OpcodeContinuation, nil)
+				}
+			}
+			_ = client.WriteString("next")
+		}()
+
+		opcode, reader, err := server.NextReader()
+		as.NoError(err)
+		as.Equal(OpcodeBinary, opcode)
+		var p = make([]byte, 3)
+		var buf = bytes.NewBuffer(nil)
+		for {
+			n, err := reader.Read(p)
+			buf.Write(p[:n])
+			if err == io.EOF {
+				break
+			}
+			as.NoError(err)
+		}
+		as.Equal(string(payload), buf.String())
+		as.Equal([]string{"ping"}, pings)
+
+		opcode, reader, err = server.NextReader()
+		as.NoError(err)
+		as.Equal(OpcodeText, opcode)
+		p, _ = io.ReadAll(reader)
+		as.Equal("next", string(p))
+	})
+
+	t.Run("discard", func(t *testing.T) {
+		server, client := newPeer(new(BuiltinEventHandler), &ServerOption{}, new(BuiltinEventHandler), &ClientOption{})
+		go func() {
+			_ = testWrite(client, false, OpcodeText, []byte("hello"))
+			_ = testWrite(client, true, OpcodeContinuation, []byte(", world"))
+			_ = client.WriteString("next")
+		}()
+
+		_, reader, err := server.NextReader()
+		as.NoError(err)
+		p := make([]byte, 2)
+		_, _ = reader.Read(p)
+		as.Equal("he", string(p))
+
+		_, reader, err = server.NextReader()
+		as.NoError(err)
+		p, _ = io.ReadAll(reader)
+		as.Equal("next", string(p))
+	})
+
+	t.Run("utf8", func(t *testing.T) {
+		server, client := newPeer(new(BuiltinEventHandler), &ServerOption{CheckUtf8Enabled: true}, new(BuiltinEventHandler), &ClientOption{})
+		text := []byte("你好, 世界")
+		go func() {
+			_ = testWrite(client, false, OpcodeText, testCloneBytes(text[:4]))
+			_ = testWrite(client, true, OpcodeContinuation, testCloneBytes(text[4:]))
+			_ = testWrite(client, false, OpcodeText, testCloneBytes(text[:4]))
+			_ = testWrite(client, true, OpcodeContinuation, testCloneBytes(text[5:]))
+		}()
+
+		_, reader, err := server.NextReader()
+		as.NoError(err)
+		p, err := io.ReadAll(reader)
+		as.NoError(err)
+		as.Equal(string(text), string(p))
+
+		_, reader, err = server.NextReader()
+		as.NoError(err)
+		_, err = io.ReadAll(reader)
+		var e *internal.Error
+		as.ErrorAs(err, &e)
+		as.Equal(internal.CloseUnsupportedData, e.Code)
+	})
+
+	t.Run("protocol error", func(t *testing.T) {
+		server, client := newPeer(new(BuiltinEventHandler), &ServerOption{}, new(BuiltinEventHandler), &ClientOption{})
+		go func() {
+			_ = testWrite(client, false, OpcodeText, []byte("hello"))
+			_ = testWrite(client, true, OpcodeText, []byte("world"))
+			_ = testWrite(client, true, OpcodeContinuation, []byte("hello"))
+		}()
+
+		_, reader, err := server.NextReader()
+		as.NoError(err)
+		_, err = io.ReadAll(reader)
+		as.Equal(internal.CloseProtocolError, err)
+
+		_, _, err = server.NextReader()
+		as.Equal(internal.CloseProtocolError, err)
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		pd := PermessageDeflate{Enabled: true, Threshold: 1}
+		server, client, err := newHandshakePeer(
+			new(BuiltinEventHandler), &ServerOption{PermessageDeflate: pd},
+			new(BuiltinEventHandler), &ClientOption{PermessageDeflate: pd},
+		)
+		if !as.NoError(err) {
+			return
+		}
+		payload := internal.AlphabetNumeric.Generate(4096)
+		go func() { _ = client.WriteMessage(OpcodeBinary, payload) }()
+
+		opcode, reader, err := server.NextReader()
+		as.NoError(err)
+		as.Equal(OpcodeBinary, opcode)
+		p, err := io.ReadAll(reader)
+		as.NoError(err)
+		as.Equal(string(payload), string(p))
+	})
+}
+
+func TestConn_OnStream(t *testing.T) {
+	as := assert.New(t)
+	var list []string
+	var wg = &sync.WaitGroup{}
+	wg.Add(3)
+	serverHandler := &streamHandler{onStream: func(socket *Conn, opcode Opcode, reader io.Reader) {
+		// 只读取前 5 个字节, 剩余部分被丢弃
+		p := make([]byte, 5)
+		n, _ := io.ReadFull(reader, p)
+		list = append(list, string(p[:n]))
+		wg.Done()
+	}}
+	server, client := newPeer(serverHandler, &ServerOption{ParallelEnabled: true}, new(BuiltinEventHandler), &ClientOption{WriteBufferSize: 4})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	as.NoError(client.WriteString("hello, world"))
+	w := client.NextWriter(OpcodeBinary)
+	_, _ = w.Write([]byte("streaming message"))
+	as.NoError(w.Close())
+	as.NoError(client.WriteString("bye"))
+	wg.Wait()
+	as.Equal([]string{"hello", "strea", "bye"}, list)
+}
+
+func TestConn_ZeroCopy(t *testing.T) {
+	as := assert.New(t)
+	var payloads = [][]byte{
+		[]byte("hello"),
+		internal.AlphabetNumeric.Generate(8 * 1024),
+		[]byte("world"),
+		internal.AlphabetNumeric.Generate(300),
+	}
+	var borrowed []bool
+	var wg = &sync.WaitGroup{}
+	wg.Add(len(payloads))
+	serverHandler := new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		i := len(borrowed)
+		borrowed = append(borrowed, message.borrowed)
+		as.Equal(string(payloads[i]), message.Data.String())
+		_ = message.Close()
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, &ServerOption{ZeroCopyEnabled: true, ParallelEnabled: true}, new(BuiltinEventHandler), &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	for i, item := range payloads {
+		if i == 3 {
+			as.NoError(testWrite(client, false, OpcodeBinary, testCloneBytes(item[:100])))
+			as.NoError(testWrite(client, true, OpcodeContinuation, testCloneBytes(item[100:])))
+			continue
+		}
+		as.NoError(client.WriteMessage(OpcodeBinary, item))
+	}
+	wg.Wait()
+	as.Equal([]bool{true, false, true, false}, borrowed)
+}
+
+// 零拷贝模式下, 同时缓冲的多个压缩帧互不影响
+// In zero-copy mode, compressed frames buffered together do not affect one another
+func TestConn_ZeroCopyCompressed(t *testing.T) {
+	as := assert.New(t)
+	messages := make(chan string, 3)
+	serverHandler := new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		messages <- message.Data.String()
+		_ = message.Close()
+	}
+	pd := PermessageDeflate{Enabled: true, Threshold: 1}
+	server, client, err := newHandshakePeer(serverHandler, &ServerOption{PermessageDeflate: pd, ZeroCopyEnabled: true}, new(BuiltinEventHandler), &ClientOption{PermessageDeflate: pd})
+	if !as.NoError(err) {
+		return
+	}
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	// 一次写入, 三帧同时进入读缓冲区
+	// A single write puts all three frames into the read buffer at once
+	as.NoError(client.WriteBatch(
+		BatchMessage{Opcode: OpcodeText, Payload: []byte("hello")},
+		BatchMessage{Opcode: OpcodeText, Payload: []byte("gbs")},
+		BatchMessage{Opcode: OpcodeText, Payload: []byte("world")},
+	))
+	for _, expected := range []string{"hello", "gbs", "world"} {
+		select {
+		case message := <-messages:
+			as.Equal(expected, message)
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	as.False(server.IsClosed())
+}
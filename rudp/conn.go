@@ -0,0 +1,691 @@
+package rudp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// 分段头部: conv(4) cmd(1) wnd(2) sn(4) una(4) len(2)
+	// Segment header: conv(4) cmd(1) wnd(2) sn(4) una(4) len(2)
+	headerSize = 17
+
+	// 握手, 客户端发起, 服务端原样应答
+	// Handshake, sent by the client and echoed by the server
+	cmdSyn uint8 = 1
+
+	// 数据
+	// Data
+	cmdPush uint8 = 2
+
+	// 确认, 负载为若干个乱序收到的区间 [start, end)
+	// Acknowledgement, the payload lists the ranges [start, end) received out of order
+	cmdAck uint8 = 3
+
+	// 关闭, 与数据一样按序可靠传输
+	// Close, delivered reliably and in order like data
+	cmdFin uint8 = 4
+
+	// 重置, 对端不认识该连接
+	// Reset, the peer does not know the connection
+	cmdRst uint8 = 5
+
+	// UDP 包的最大长度
+	// Maximum size of a UDP packet
+	maxPacketSize = 64 * 1024
+)
+
+var (
+	// ErrDeadLink 分段重传次数超过上限, 对端无响应
+	// A segment was retransmitted too many times, the peer is not responding
+	ErrDeadLink = errors.New("rudp: peer is not responding")
+
+	// ErrConnReset 连接被对端重置
+	// The connection was reset by the peer
+	ErrConnReset = errors.New("rudp: connection reset by peer")
+
+	// ErrHandshake 握手超时
+	// The handshake timed out
+	ErrHandshake = errors.New("rudp: handshake timeout")
+)
+
+// 序列号比较, 允许回绕
+// Sequence number comparison, wrap-around safe
+func before(a, b uint32) bool { return int32(a-b) < 0 }
+
+type segment struct {
+	cmd      uint8
+	sn       uint32
+	data     []byte
+	sentAt   time.Time
+	resendAt time.Time
+	rto      time.Duration
+	xmit     int
+	fastack  int
+}
+
+// Conn 可靠 UDP 连接
+// Reliable UDP connection
+type Conn struct {
+	pc     net.PacketConn
+	addr   net.Addr
+	conv   uint32
+	config *Config
+	mss    int
+
+	// onClose 连接销毁时的回调
+	// onClose Callback invoked when the connection is torn down
+	onClose func()
+
+	mu sync.Mutex
+
+	// 发送状态
+	// Send state
+	sndNxt   uint32
+	sndQueue []*segment
+	inflight []*segment
+	cwnd     int
+	incr     int
+	ssthresh int
+	rmtWnd   int
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+
+	// 接收状态
+	// Receive state
+	rcvNxt     uint32
+	rcvBuf     map[uint32]*segment
+	rcv        bytes.Buffer
+	ackPending bool
+	finRecv    bool
+
+	err      error
+	closed   bool
+	closedAt time.Time
+
+	established   chan struct{}
+	establishOnce sync.Once
+	readable      chan struct{}
+	writable      chan struct{}
+	flushCh       chan struct{}
+	done          chan struct{}
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newConn(pc net.PacketConn, addr net.Addr, conv uint32, config *Config) *Conn {
+	return &Conn{
+		pc:            pc,
+		addr:          addr,
+		conv:          conv,
+		config:        config,
+		mss:           config.MTU - headerSize,
+		onClose:       func() {},
+		cwnd:          initialCwnd,
+		ssthresh:      config.Window,
+		rmtWnd:        config.Window,
+		rto:           initialRTO,
+		rcvBuf:        make(map[uint32]*segment),
+		established:   make(chan struct{}),
+		readable:      make(chan struct{}, 1),
+		writable:      make(chan struct{}, 1),
+		flushCh:       make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+}
+
+// Read 按序读取对端写入的数据, 对端关闭后返回 io.EOF
+// Reads the data written by the peer in order, returns io.EOF once the peer has closed
+func (c *Conn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.rcv.Len() > 0 {
+			full := c.window() == 0
+			n, _ := c.rcv.Read(p)
+			// 窗口重新打开, 立即告知对端, 不必等待对端的探测
+			// The window opened again, tell the peer right away rather than waiting for its probe
+			reopened := full && c.window() > 0
+			if reopened {
+				c.ackPending = true
+			}
+			c.mu.Unlock()
+			if reopened {
+				c.nudge()
+			}
+			return n, nil
+		}
+		eof, err, closed := c.finRecv, c.err, c.closed
+		c.mu.Unlock()
+
+		switch {
+		case closed:
+			return 0, net.ErrClosed
+		case eof:
+			return 0, io.EOF
+		case err != nil:
+			return 0, err
+		}
+
+		select {
+		case <-c.readable:
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.done:
+		}
+	}
+}
+
+// Write 将数据切分为分段放入发送队列, 队列已满时阻塞
+// Splits the data into segments on the send queue, blocks while the queue is full
+func (c *Conn) Write(p []byte) (int, error) {
+	n := 0
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return n, net.ErrClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return n, err
+		}
+		for len(p) > 0 && len(c.sndQueue) < c.config.Window {
+			// 合并到尚未发送的最后一个分段
+			// Coalesce into the last segment that has not been sent yet
+			var seg *segment
+			if k := len(c.sndQueue); k > 0 && c.sndQueue[k-1].cmd == cmdPush && len(c.sndQueue[k-1].data) < c.mss {
+				seg = c.sndQueue[k-1]
+			} else {
+				seg = &segment{cmd: cmdPush, sn: c.sndNxt, data: make([]byte, 0, c.mss)}
+				c.sndNxt++
+				c.sndQueue = append(c.sndQueue, seg)
+			}
+			m := copy(seg.data[len(seg.data):c.mss], p)
+			seg.data = seg.data[:len(seg.data)+m]
+			p = p[m:]
+			n += m
+		}
+		c.mu.Unlock()
+		c.nudge()
+
+		if len(p) == 0 {
+			return n, nil
+		}
+		select {
+		case <-c.writable:
+		case <-c.writeDeadline.wait():
+			return n, os.ErrDeadlineExceeded
+		case <-c.done:
+		}
+	}
+}
+
+// Close 关闭连接. 已写入的数据和关闭分段会在后台继续发送, 直到对端确认或者链路断开.
+// Closes the connection. Written data and the close segment keep being sent in the background,
+// until the peer acknowledges them or the link fails.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.closedAt = time.Now()
+	if c.err == nil {
+		c.sndQueue = append(c.sndQueue, &segment{cmd: cmdFin, sn: c.sndNxt})
+		c.sndNxt++
+	}
+	c.mu.Unlock()
+
+	c.nudge()
+	notify(c.readable)
+	notify(c.writable)
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr { return c.pc.LocalAddr() }
+
+func (c *Conn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// 唤醒刷新协程
+// Wakes up the flush goroutine
+func (c *Conn) nudge() { notify(c.flushCh) }
+
+// 编码分段
+// Encodes a segment
+func (c *Conn) encode(cmd uint8, sn uint32, data []byte) []byte {
+	return encodeSegment(c.conv, cmd, c.window(), sn, c.rcvNxt, data)
+}
+
+func encodeSegment(conv uint32, cmd uint8, wnd int, sn, una uint32, data []byte) []byte {
+	b := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(b[0:4], conv)
+	b[4] = cmd
+	binary.BigEndian.PutUint16(b[5:7], uint16(wnd))
+	binary.BigEndian.PutUint32(b[7:11], sn)
+	binary.BigEndian.PutUint32(b[11:15], una)
+	binary.BigEndian.PutUint16(b[15:17], uint16(len(data)))
+	copy(b[headerSize:], data)
+	return b
+}
+
+// 可用的接收窗口, 已缓冲未读的数据也会占用窗口
+// Available receive window, data buffered but not yet read also takes up the window
+func (c *Conn) window() int {
+	n := c.config.Window - len(c.rcvBuf) - c.unread()
+	if n < 0 {
+		return 0
+	}
+	if n > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return n
+}
+
+// 已缓冲未读的数据占用的分段数
+// Number of segments taken up by the data buffered but not yet read
+func (c *Conn) unread() int {
+	return (c.rcv.Len() + c.mss - 1) / c.mss
+}
+
+// 编码确认分段, 附带乱序收到的区间
+// Encodes an acknowledgement with the ranges received out of order
+func (c *Conn) encodeAck() []byte {
+	keys := make([]uint32, 0, len(c.rcvBuf))
+	for sn := range c.rcvBuf {
+		keys = append(keys, sn)
+	}
+	sort.Slice(keys, func(i, j int) bool { return before(keys[i], keys[j]) })
+
+	limit := c.mss / 8
+	blocks := make([]byte, 0, 8*limit)
+	for i := 0; i < len(keys) && len(blocks) < cap(blocks); {
+		j := i + 1
+		for j < len(keys) && keys[j] == keys[j-1]+1 {
+			j++
+		}
+		blocks = binary.BigEndian.AppendUint32(blocks, keys[i])
+		blocks = binary.BigEndian.AppendUint32(blocks, keys[j-1]+1)
+		i = j
+	}
+	return c.encode(cmdAck, 0, blocks)
+}
+
+// 处理收到的分段
+// Handles an incoming segment
+func (c *Conn) input(b []byte) {
+	if len(b) < headerSize {
+		return
+	}
+	cmd := b[4]
+	wnd := int(binary.BigEndian.Uint16(b[5:7]))
+	sn := binary.BigEndian.Uint32(b[7:11])
+	una := binary.BigEndian.Uint32(b[11:15])
+	length := int(binary.BigEndian.Uint16(b[15:17]))
+	if len(b) < headerSize+length {
+		return
+	}
+	data := b[headerSize : headerSize+length]
+
+	switch cmd {
+	case cmdSyn:
+		c.establishOnce.Do(func() { close(c.established) })
+		return
+	case cmdRst:
+		c.fail(ErrConnReset)
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	c.rmtWnd = wnd
+	c.acknowledge(now, una, data, cmd == cmdAck)
+	if wnd == 0 {
+		// 对端仍在响应, 只是窗口已满, 探测的重传不计入 DeadLink
+		// The peer still responds and its window is just full, retransmitted probes do not count towards DeadLink
+		for _, seg := range c.inflight {
+			seg.xmit = 1
+		}
+	}
+
+	if cmd == cmdPush || cmd == cmdFin {
+		c.ackPending = true
+		// 未读的数据占用窗口, 超出窗口的分段直接丢弃且不确认, 由对端稍后重传
+		// Unread data takes up the window; segments beyond it are dropped unacknowledged and retransmitted later by the peer
+		limit := uint32(maxInt(c.config.Window-c.unread(), 0))
+		if !before(sn, c.rcvNxt) && before(sn, c.rcvNxt+limit) && c.rcvBuf[sn] == nil {
+			c.rcvBuf[sn] = &segment{cmd: cmd, sn: sn, data: append([]byte(nil), data...)}
+		}
+		for {
+			seg := c.rcvBuf[c.rcvNxt]
+			if seg == nil {
+				break
+			}
+			delete(c.rcvBuf, c.rcvNxt)
+			c.rcvNxt++
+			if seg.cmd == cmdFin {
+				c.finRecv = true
+			} else {
+				c.rcv.Write(seg.data)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	notify(c.readable)
+	c.nudge()
+}
+
+// 处理累计确认和选择确认
+// Handles cumulative and selective acknowledgements
+func (c *Conn) acknowledge(now time.Time, una uint32, data []byte, selective bool) {
+	var blocks [][2]uint32
+	if selective {
+		for i := 0; i+8 <= len(data); i += 8 {
+			blocks = append(blocks, [2]uint32{binary.BigEndian.Uint32(data[i:]), binary.BigEndian.Uint32(data[i+4:])})
+		}
+	}
+
+	acked := false
+	var maxAcked uint32
+	var latest time.Time
+	list := c.inflight[:0]
+	for _, seg := range c.inflight {
+		ok := before(seg.sn, una)
+		for _, block := range blocks {
+			if !before(seg.sn, block[0]) && before(seg.sn, block[1]) {
+				ok = true
+				if !acked || before(maxAcked, seg.sn) {
+					maxAcked = seg.sn
+				}
+				if seg.sentAt.After(latest) {
+					latest = seg.sentAt
+				}
+				acked = true
+			}
+		}
+		if !ok {
+			list = append(list, seg)
+			continue
+		}
+		if seg.xmit == 1 {
+			c.updateRTT(now.Sub(seg.sentAt))
+		}
+		if c.cwnd < c.ssthresh {
+			c.cwnd++
+		} else if c.incr++; c.incr >= c.cwnd {
+			c.cwnd++
+			c.incr = 0
+		}
+	}
+	for i := len(list); i < len(c.inflight); i++ {
+		c.inflight[i] = nil
+	}
+	if len(list) < len(c.inflight) {
+		notify(c.writable)
+	}
+	c.inflight = list
+	if c.cwnd > c.config.Window {
+		c.cwnd = c.config.Window
+	}
+
+	// 在之后发送的分段先被确认, 被跳过的分段可能已经丢失
+	// Segments sent later were acknowledged first, the skipped ones may have been lost
+	if acked {
+		for _, seg := range c.inflight {
+			if before(seg.sn, maxAcked) && seg.sentAt.Before(latest) {
+				seg.fastack++
+			}
+		}
+	}
+}
+
+// 根据 RFC 6298 更新重传超时
+// Updates the retransmission timeout as per RFC 6298
+func (c *Conn) updateRTT(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt, c.rttvar = rtt, rtt/2
+	} else {
+		delta := c.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = c.srtt + 4*c.rttvar
+	if c.rto < c.config.MinRTO {
+		c.rto = c.config.MinRTO
+	}
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+// 连接出错, 停止收发
+// The connection failed, stop sending and receiving
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.nudge()
+	notify(c.readable)
+	notify(c.writable)
+}
+
+// 刷新协程: 发送新的分段, 重传超时和被跳过的分段, 发送确认
+// Flush goroutine: sends new segments, retransmits timed out and skipped segments, sends acknowledgements
+func (c *Conn) run() {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	defer func() {
+		close(c.done)
+		c.onClose()
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.flushCh:
+		}
+		if !c.flush(time.Now()) {
+			return
+		}
+	}
+}
+
+// 刷新一次, 返回连接是否仍然存活
+// Flushes once, returns whether the connection is still alive
+func (c *Conn) flush(now time.Time) bool {
+	c.mu.Lock()
+	var packets [][]byte
+	if c.ackPending {
+		c.ackPending = false
+		packets = append(packets, c.encodeAck())
+	}
+
+	limit := c.cwnd
+	if c.rmtWnd < limit {
+		limit = c.rmtWnd
+	}
+	if limit < 1 && len(c.inflight) == 0 {
+		// 对端窗口为零时, 每次只发送一个分段用于探测
+		// Probe with a single segment while the peer window is zero
+		limit = 1
+	}
+	for len(c.sndQueue) > 0 && len(c.inflight) < limit {
+		seg := c.sndQueue[0]
+		c.sndQueue[0] = nil
+		c.sndQueue = c.sndQueue[1:]
+		seg.xmit, seg.rto, seg.sentAt, seg.resendAt = 1, c.rto, now, now.Add(c.rto)
+		c.inflight = append(c.inflight, seg)
+		packets = append(packets, c.encode(seg.cmd, seg.sn, seg.data))
+		notify(c.writable)
+	}
+
+	lost, fast := false, false
+	for _, seg := range c.inflight {
+		switch {
+		case seg.fastack >= fastResend:
+			fast = true
+		case !now.Before(seg.resendAt):
+			// 退避系数为 1.5 而不是 2, 以降低连续丢包时的延迟
+			// Back off by 1.5 rather than 2, to keep the latency low on consecutive losses
+			lost = true
+			seg.rto += seg.rto / 2
+			if seg.rto > maxRTO {
+				seg.rto = maxRTO
+			}
+		default:
+			continue
+		}
+		seg.xmit++
+		seg.fastack = 0
+		seg.sentAt, seg.resendAt = now, now.Add(seg.rto)
+		packets = append(packets, c.encode(seg.cmd, seg.sn, seg.data))
+		if seg.xmit > c.config.DeadLink && c.err == nil {
+			c.err = ErrDeadLink
+		}
+	}
+	if lost || fast {
+		// 丢包时窗口减半, 不像 TCP 超时那样退回慢启动
+		// Halve the window on loss, rather than falling back to slow start like a TCP timeout
+		c.ssthresh = maxInt(c.cwnd/2, 2)
+		c.cwnd, c.incr = c.ssthresh, 0
+	}
+
+	alive := c.err == nil
+	if c.closed && alive {
+		// 关闭分段已被确认, 且对端也已关闭, 或者等待超时
+		// The close segment was acknowledged, and the peer has closed too or the wait expired
+		finished := len(c.sndQueue) == 0 && len(c.inflight) == 0
+		alive = !(finished && c.finRecv) && now.Sub(c.closedAt) < lingerTimeout
+	}
+	err := c.err
+	c.mu.Unlock()
+
+	if err != nil {
+		notify(c.readable)
+		notify(c.writable)
+		return false
+	}
+	for _, packet := range packets {
+		if _, err := c.pc.WriteTo(packet, c.addr); err != nil {
+			c.fail(err)
+			return false
+		}
+	}
+	return alive
+}
+
+// 启动刷新协程
+// Starts the flush goroutine
+func (c *Conn) start() { go c.run() }
+
+// 发送握手分段
+// Sends a handshake segment
+func (c *Conn) sendSyn() error {
+	c.mu.Lock()
+	packet := c.encode(cmdSyn, 0, nil)
+	c.mu.Unlock()
+	_, err := c.pc.WriteTo(packet, c.addr)
+	return err
+}
+
+// deadline 读写超时, 参见 net.Pipe 的实现
+// deadline Read and write deadlines, see the implementation of net.Pipe
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline { return deadline{cancel: make(chan struct{})} }
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
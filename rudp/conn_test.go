@@ -0,0 +1,201 @@
+package rudp
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 随机丢弃发出的数据报
+// Randomly drops outgoing datagrams
+type lossyPacketConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	rand *rand.Rand
+	loss float64
+}
+
+func newLossyPacketConn(t *testing.T, loss float64) *lossyPacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &lossyPacketConn{PacketConn: pc, rand: rand.New(rand.NewSource(1)), loss: loss}
+}
+
+func (c *lossyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.rand.Float64() < c.loss
+	c.mu.Unlock()
+	if drop {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// 建立一对连接, 两个方向都按 loss 丢包
+// Establishes a pair of connections, dropping datagrams with the given probability in both directions
+func newPair(t *testing.T, loss float64, config *Config) (*Listener, *Conn, *Conn) {
+	listener := NewListener(newLossyPacketConn(t, loss), config)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	pc := newLossyPacketConn(t, loss)
+	client, err := DialPacketConn(pc, listener.Addr(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener, conn.(*Conn), client
+}
+
+func TestBefore(t *testing.T) {
+	as := assert.New(t)
+	as.True(before(1, 2))
+	as.False(before(2, 2))
+	as.False(before(3, 2))
+	as.True(before(0xFFFFFFFF, 0))
+	as.False(before(0, 0xFFFFFFFF))
+}
+
+func TestConn_Transfer(t *testing.T) {
+	for _, loss := range []float64{0, 0.1, 0.3} {
+		as := assert.New(t)
+		_, server, client := newPair(t, loss, &Config{Interval: 5 * time.Millisecond})
+
+		payload := make([]byte, 256*1024)
+		rand.New(rand.NewSource(2)).Read(payload)
+		go func() {
+			for p := payload; len(p) > 0; {
+				n := len(p) % 1000
+				if n == 0 {
+					n = 1000
+				}
+				_, _ = client.Write(p[:n])
+				p = p[n:]
+			}
+			_ = client.Close()
+		}()
+
+		_ = server.SetReadDeadline(time.Now().Add(20 * time.Second))
+		received, err := io.ReadAll(server)
+		as.NoError(err)
+		as.True(bytes.Equal(payload, received), "loss %v", loss)
+		as.NoError(server.Close())
+
+		select {
+		case <-server.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("loss %v: server connection was not torn down", loss)
+		}
+	}
+}
+
+func TestConn_Window(t *testing.T) {
+	as := assert.New(t)
+	_, server, client := newPair(t, 0, &Config{Window: 4, DeadLink: 3, Interval: 5 * time.Millisecond})
+
+	payload := make([]byte, 64*server.mss)
+	rand.New(rand.NewSource(3)).Read(payload)
+	go func() {
+		_, _ = client.Write(payload)
+		_ = client.Close()
+	}()
+
+	// 接收方不读取时, 缓冲的数据不超过窗口, 发送方也不会因为探测被丢弃而判定链路断开
+	// While the receiver does not read, buffered data stays within the window,
+	// and the sender does not declare the link dead because its probes are dropped
+	time.Sleep(500 * time.Millisecond)
+	server.mu.Lock()
+	as.Equal(4*server.mss, server.rcv.Len())
+	as.Empty(server.rcvBuf)
+	server.mu.Unlock()
+
+	_ = server.SetReadDeadline(time.Now().Add(10 * time.Second))
+	received, err := io.ReadAll(server)
+	as.NoError(err)
+	as.True(bytes.Equal(payload, received))
+}
+
+func TestConn_Deadline(t *testing.T) {
+	as := assert.New(t)
+	_, server, client := newPair(t, 0, nil)
+
+	_ = server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := server.Read(make([]byte, 16))
+	as.ErrorIs(err, os.ErrDeadlineExceeded)
+
+	_ = server.SetReadDeadline(time.Time{})
+	_, _ = client.Write([]byte("hello"))
+	buf := make([]byte, 16)
+	n, err := server.Read(buf)
+	as.NoError(err)
+	as.Equal("hello", string(buf[:n]))
+
+	// 对端不再确认, 发送队列很快就会填满
+	// The peer no longer acknowledges, so the send queue fills up quickly
+	_, server, client = newPair(t, 0, &Config{Window: 1})
+	_ = server.pc.Close()
+	_ = client.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err = client.Write(make([]byte, 4*defaultMTU))
+	as.ErrorIs(err, os.ErrDeadlineExceeded)
+	as.Less(n, 4*defaultMTU)
+}
+
+func TestConn_Reset(t *testing.T) {
+	as := assert.New(t)
+	listener, _, client := newPair(t, 0, nil)
+
+	// 模拟服务端重启后丢失了连接状态
+	// Simulate a server that lost the connection state after a restart
+	listener.mu.Lock()
+	listener.conns = make(map[connKey]*Conn)
+	listener.mu.Unlock()
+
+	_, _ = client.Write([]byte("hello"))
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := client.Read(make([]byte, 16))
+	as.ErrorIs(err, ErrConnReset)
+}
+
+func TestConn_DeadLink(t *testing.T) {
+	as := assert.New(t)
+	_, server, client := newPair(t, 0, &Config{DeadLink: 2})
+	_ = server.pc.Close()
+
+	_, _ = client.Write([]byte("hello"))
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := client.Read(make([]byte, 16))
+	as.ErrorIs(err, ErrDeadLink)
+	_, err = client.Write([]byte("hello"))
+	as.ErrorIs(err, ErrDeadLink)
+}
+
+func TestDial(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("timeout", func(t *testing.T) {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		_, err = Dial("udp", pc.LocalAddr().String(), &Config{HandshakeTimeout: 300 * time.Millisecond})
+		as.ErrorIs(err, ErrHandshake)
+	})
+
+	t.Run("lossy handshake", func(t *testing.T) {
+		_, server, client := newPair(t, 0.5, nil)
+		as.Equal(client.conv, server.conv)
+		as.Equal(client.LocalAddr().String(), server.RemoteAddr().String())
+	})
+}
@@ -0,0 +1,14 @@
+// Package rudp 在 UDP 之上实现可靠有序的字节流 (ARQ), 提供 net.Listener 和 net.Conn,
+// 可以直接用于 gbs.Server.RunListener 和 gbs.NewClientFromConn.
+// 与 TCP 相比, 它使用选择确认 (SACK) 和快速重传尽早修复丢包, 重传超时的下限更低, 在有损链路上尾延迟更小.
+// Package rudp implements a reliable, ordered byte stream (ARQ) on top of UDP, exposing a net.Listener and a net.Conn
+// that plug straight into gbs.Server.RunListener and gbs.NewClientFromConn.
+// Compared to TCP it repairs losses early with selective acknowledgements (SACK) and fast retransmission,
+// and uses a lower retransmission timeout floor, which lowers the tail latency on lossy links.
+//
+//	listener, _ := rudp.Listen("udp", ":8000", nil)
+//	go gbs.NewServer(handler, nil).RunListener(listener)
+//
+//	conn, _ := rudp.Dial("udp", "127.0.0.1:8000", nil)
+//	socket, _, _ := gbs.NewClientFromConn(handler, &gbs.ClientOption{Addr: "ws://127.0.0.1:8000"}, conn)
+package rudp
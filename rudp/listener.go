@@ -0,0 +1,212 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/catermujo/gbs/internal"
+)
+
+type connKey struct {
+	addr string
+	conv uint32
+}
+
+// Listener 可靠 UDP 监听器, 在一个 PacketConn 上按对端地址和会话号分发连接
+// Reliable UDP listener, dispatches the connections of a PacketConn by peer address and conversation id
+type Listener struct {
+	pc     net.PacketConn
+	config *Config
+
+	mu     sync.Mutex
+	conns  map[connKey]*Conn
+	accept chan *Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Listen 监听指定的 UDP 地址
+// Listens on the specified UDP address
+func Listen(network, addr string, config *Config) (*Listener, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(pc, config), nil
+}
+
+// NewListener 在指定的 PacketConn 上创建监听器, 监听器关闭时 PacketConn 也会被关闭
+// Creates a listener on the specified PacketConn, which is closed together with the listener
+func NewListener(pc net.PacketConn, config *Config) *Listener {
+	l := &Listener{
+		pc:     pc,
+		config: initConfig(config),
+		conns:  make(map[connKey]*Conn),
+		accept: make(chan *Conn, acceptBacklog),
+		closed: make(chan struct{}),
+	}
+	go l.receive()
+	return l
+}
+
+// Accept 等待并返回下一个连接
+// Waits for and returns the next connection
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close 关闭监听器和所有连接
+// Closes the listener and every connection
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		err = l.pc.Close()
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr { return l.pc.LocalAddr() }
+
+// 接收循环, 将分段分发给对应的连接
+// Receive loop, dispatches segments to their connections
+func (l *Listener) receive() {
+	defer func() {
+		_ = l.Close()
+		l.mu.Lock()
+		conns := make([]*Conn, 0, len(l.conns))
+		for _, c := range l.conns {
+			conns = append(conns, c)
+		}
+		l.mu.Unlock()
+		for _, c := range conns {
+			c.fail(net.ErrClosed)
+		}
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < headerSize {
+			continue
+		}
+		key := connKey{addr: addr.String(), conv: binary.BigEndian.Uint32(buf[0:4])}
+		cmd := buf[4]
+
+		l.mu.Lock()
+		c := l.conns[key]
+		l.mu.Unlock()
+
+		switch {
+		case c != nil && cmd == cmdSyn:
+			// 握手应答丢失, 重新应答
+			// The handshake response was lost, answer again
+			_ = c.sendSyn()
+		case c != nil:
+			c.input(buf[:n])
+		case cmd == cmdSyn:
+			l.open(key, addr)
+		case cmd != cmdRst:
+			// 连接已不存在, 通知对端
+			// The connection no longer exists, tell the peer
+			_, _ = l.pc.WriteTo(encodeSegment(key.conv, cmdRst, 0, 0, 0, nil), addr)
+		}
+	}
+}
+
+// 建立新连接
+// Opens a new connection
+func (l *Listener) open(key connKey, addr net.Addr) {
+	c := newConn(l.pc, addr, key.conv, l.config)
+	c.onClose = func() {
+		l.mu.Lock()
+		if l.conns[key] == c {
+			delete(l.conns, key)
+		}
+		l.mu.Unlock()
+	}
+
+	select {
+	case l.accept <- c:
+	default:
+		// 等待 Accept 的连接过多, 丢弃握手, 客户端会重试
+		// Too many connections waiting for Accept, drop the handshake and let the client retry
+		return
+	}
+	l.mu.Lock()
+	l.conns[key] = c
+	l.mu.Unlock()
+	_ = c.sendSyn()
+	c.start()
+}
+
+// Dial 连接到指定的 UDP 地址
+// Connects to the specified UDP address
+func Dial(network, addr string, config *Config) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	return DialPacketConn(pc, raddr, config)
+}
+
+// DialPacketConn 通过 PacketConn 连接到指定地址, 连接销毁时 PacketConn 也会被关闭
+// Connects to the specified address via a PacketConn, which is closed once the connection is torn down
+func DialPacketConn(pc net.PacketConn, addr net.Addr, config *Config) (*Conn, error) {
+	config = initConfig(config)
+	c := newConn(pc, addr, internal.AlphabetNumeric.Uint32(), config)
+	c.onClose = func() { _ = pc.Close() }
+	go c.receive()
+
+	ticker := time.NewTicker(handshakeInterval)
+	defer ticker.Stop()
+	timer := time.NewTimer(config.HandshakeTimeout)
+	defer timer.Stop()
+
+	for {
+		if err := c.sendSyn(); err != nil {
+			_ = pc.Close()
+			return nil, err
+		}
+		select {
+		case <-c.established:
+			c.start()
+			return c, nil
+		case <-ticker.C:
+		case <-timer.C:
+			_ = pc.Close()
+			return nil, ErrHandshake
+		}
+	}
+}
+
+// 客户端接收循环, 只处理来自服务端地址和本连接的分段
+// Receive loop of the client, only handles segments of this connection from the server address
+func (c *Conn) receive() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if n < headerSize || addr.String() != c.addr.String() || binary.BigEndian.Uint32(buf[0:4]) != c.conv {
+			continue
+		}
+		c.input(buf[:n])
+	}
+}
@@ -0,0 +1,86 @@
+package rudp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs"
+	"github.com/stretchr/testify/assert"
+)
+
+type echoHandler struct {
+	gbs.BuiltinEventHandler
+}
+
+func (c echoHandler) OnMessage(socket *gbs.Conn, message *gbs.Message) {
+	_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	_ = message.Close()
+}
+
+type chanHandler struct {
+	gbs.BuiltinEventHandler
+	messages chan string
+}
+
+func (c chanHandler) OnMessage(socket *gbs.Conn, message *gbs.Message) {
+	c.messages <- message.Data.String()
+	_ = message.Close()
+}
+
+func TestListener_WebSocket(t *testing.T) {
+	as := assert.New(t)
+
+	// RunListener 不会关闭监听器, 测试结束时随进程一起释放
+	// RunListener never closes the listener, it goes away with the test process
+	listener := NewListener(newLossyPacketConn(t, 0.1), nil)
+	go gbs.NewServer(echoHandler{}, nil).RunListener(listener)
+
+	conn, err := DialPacketConn(newLossyPacketConn(t, 0.1), listener.Addr(), nil)
+	if !as.NoError(err) {
+		return
+	}
+	handler := chanHandler{messages: make(chan string, 1)}
+	client, _, err := gbs.NewClientFromConn(handler, &gbs.ClientOption{Addr: "ws://" + listener.Addr().String()}, conn)
+	if !as.NoError(err) {
+		return
+	}
+	go client.ReadLoop()
+
+	for i := 0; i < 32; i++ {
+		payload := fmt.Sprintf("%d:%0*d", i, i*512, i)
+		as.NoError(client.WriteString(payload))
+		select {
+		case s := <-handler.messages:
+			as.Equal(payload, s)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for message %d", i)
+		}
+	}
+	client.WriteClose(1000, nil)
+}
+
+func TestListener_Close(t *testing.T) {
+	as := assert.New(t)
+	listener, err := Listen("udp", "127.0.0.1:0", nil)
+	if !as.NoError(err) {
+		return
+	}
+	client, err := Dial("udp", listener.Addr().String(), nil)
+	if !as.NoError(err) {
+		return
+	}
+	server, err := listener.Accept()
+	if !as.NoError(err) {
+		return
+	}
+
+	as.NoError(listener.Close())
+	_, err = listener.Accept()
+	as.ErrorIs(err, net.ErrClosed)
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = server.Read(make([]byte, 16))
+	as.ErrorIs(err, net.ErrClosed)
+	_ = client.Close()
+}
@@ -0,0 +1,106 @@
+package rudp
+
+import "time"
+
+const (
+	// 默认的数据报最大长度, 低于常见路径 MTU, 避免 IP 分片
+	// Default maximum datagram size, below common path MTUs to avoid IP fragmentation
+	defaultMTU = 1200
+
+	// 默认的发送和接收窗口, 单位为分段
+	// Default send and receive window, in segments
+	defaultWindow = 256
+
+	// 默认的刷新间隔
+	// Default flush interval
+	defaultInterval = 10 * time.Millisecond
+
+	// 默认的最小重传超时
+	// Default minimum retransmission timeout
+	defaultMinRTO = 30 * time.Millisecond
+
+	// 默认的最大重传次数, 超过后认为链路断开
+	// Default maximum number of retransmissions, after which the link is considered dead
+	defaultDeadLink = 20
+
+	// 默认的握手超时时间
+	// Default handshake timeout
+	defaultHandshakeTimeout = 5 * time.Second
+
+	// 初始重传超时
+	// Initial retransmission timeout
+	initialRTO = 200 * time.Millisecond
+
+	// 最大重传超时
+	// Maximum retransmission timeout
+	maxRTO = 10 * time.Second
+
+	// 初始拥塞窗口
+	// Initial congestion window
+	initialCwnd = 4
+
+	// 触发快速重传的跳过次数
+	// Number of times a segment is skipped by selective acknowledgements before it is retransmitted
+	fastResend = 2
+
+	// 关闭后等待对端关闭的时间
+	// Time to wait for the peer to close after closing
+	lingerTimeout = 3 * time.Second
+
+	// 握手请求的重传间隔
+	// Retransmission interval of the handshake request
+	handshakeInterval = 200 * time.Millisecond
+
+	// 等待 Accept 的连接数量上限
+	// Maximum number of connections waiting for Accept
+	acceptBacklog = 128
+)
+
+// Config 可靠 UDP 配置
+// Reliable UDP configurations
+type Config struct {
+	// Maximum size of a datagram, including the segment header
+	MTU int
+
+	// Send and receive window, in segments. Data received but not yet read takes up the receive window
+	Window int
+
+	// Flush interval, i.e. the delay of acknowledgements and the resolution of retransmission timers
+	Interval time.Duration
+
+	// Minimum retransmission timeout
+	MinRTO time.Duration
+
+	// Maximum number of retransmissions of a segment, after which the connection fails with ErrDeadLink
+	DeadLink int
+
+	// Handshake timeout duration
+	HandshakeTimeout time.Duration
+}
+
+// 初始化配置
+// Initialize configurations
+func initConfig(c *Config) *Config {
+	if c == nil {
+		c = new(Config)
+	}
+	if c.MTU <= headerSize {
+		c.MTU = defaultMTU
+	}
+	if c.Window <= 0 {
+		c.Window = defaultWindow
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultInterval
+	}
+	if c.MinRTO <= 0 {
+		c.MinRTO = defaultMinRTO
+	}
+	if c.DeadLink <= 0 {
+		c.DeadLink = defaultDeadLink
+	}
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = defaultHandshakeTimeout
+	}
+	return c
+}
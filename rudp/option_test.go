@@ -0,0 +1,25 @@
+package rudp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitConfig(t *testing.T) {
+	as := assert.New(t)
+
+	config := initConfig(nil)
+	as.Equal(defaultMTU, config.MTU)
+	as.Equal(defaultWindow, config.Window)
+	as.Equal(defaultInterval, config.Interval)
+	as.Equal(defaultMinRTO, config.MinRTO)
+	as.Equal(defaultDeadLink, config.DeadLink)
+	as.Equal(defaultHandshakeTimeout, config.HandshakeTimeout)
+
+	config = initConfig(&Config{MTU: headerSize, Window: 16, Interval: time.Millisecond})
+	as.Equal(defaultMTU, config.MTU)
+	as.Equal(16, config.Window)
+	as.Equal(time.Millisecond, config.Interval)
+}
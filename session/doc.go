@@ -0,0 +1,38 @@
+// Package session 通过一个 WebSocket 拓展为连接上的每条数据消息编号, 适用于订单流等要求严格顺序的场景.
+// 两端在 Sec-WebSocket-Extensions 中交换各自的起始序列号; WriteMessage, WriteAsync 等发出的消息在写入时依次编号,
+// 收到的消息在 OnMessage 之前校验: 序列号跳跃时触发 Handler.OnGap, 消息照常交付; 重复的消息触发 Handler.OnDuplicate 并被丢弃.
+// 流式写入器 (NextWriter) 发出的消息不经过拓展, 没有编号.
+// Package session numbers every data message of a connection through a WebSocket extension,
+// for scenarios such as order flow that require strict ordering.
+// Both ends exchange their starting sequence numbers in Sec-WebSocket-Extensions;
+// messages sent with WriteMessage, WriteAsync and the like are numbered as they are written,
+// and incoming messages are validated before OnMessage: a jump in the sequence raises Handler.OnGap
+// and the message is still delivered, while a duplicate raises Handler.OnDuplicate and is discarded.
+// Messages from streaming writers (NextWriter) bypass extensions and carry no number.
+//
+//	extension := session.NewExtension(handler, nil)
+//	upgrader := gbs.NewUpgrader(handler, &gbs.ServerOption{Extensions: []gbs.Extension{extension}})
+//
+//	socket, _, err := gbs.NewClient(handler, &gbs.ClientOption{
+//		Addr:       "ws://127.0.0.1:8000/connect",
+//		Extensions: []gbs.Extension{session.NewExtension(handler, &session.Option{Start: 100})},
+//	})
+//
+// 服务端设置 Option.Store 后开启会话恢复: 升级响应的拓展参数中带有恢复令牌, 断线的会话在 Store 中保留一段时间,
+// 并保留最近发出的消息. 客户端用 Session.ResumeOption 重连, 服务端在交出新连接之前按原来的序列号重放客户端错过的消息,
+// 新连接沿用原来的 SessionStorage.
+// Setting Option.Store on the server enables session resumption: the extension parameters of the upgrade response
+// carry a resume token, and a disconnected session is kept in the Store for a while along with its recent outgoing messages.
+// The client reconnects with Session.ResumeOption; before handing over the new connection the server replays the
+// messages the client missed under their original numbers, and the new connection keeps the former SessionStorage.
+//
+//	store := session.NewStore(&session.StoreOption{BufferSize: 1024, TTL: time.Minute})
+//	defer store.Close()
+//	extension := session.NewExtension(handler, &session.Option{Store: store})
+//
+//	option := session.Get(socket).ResumeOption()
+//	socket, _, err = gbs.NewClient(handler, &gbs.ClientOption{
+//		Addr:       "ws://127.0.0.1:8000/connect",
+//		Extensions: []gbs.Extension{session.NewExtension(handler, option)},
+//	})
+package session
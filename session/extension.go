@@ -0,0 +1,122 @@
+package session
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/catermujo/gbs"
+)
+
+// ErrInvalidParams 拓展参数缺失或者无法解析
+// The extension parameters are missing or malformed
+var ErrInvalidParams = errors.New("session: invalid extension parameters")
+
+// Handler 序列号异常的回调, 在读协程中 OnMessage 之前调用
+// Callbacks for sequence anomalies, called from the reading goroutine before OnMessage
+type Handler interface {
+	// OnGap 收到的序列号大于期望值, [expected, received) 区间的消息缺失. 这条消息随后照常交付.
+	// The received sequence number is ahead of the expected one and the messages of [expected, received) are missing.
+	// The message is delivered afterwards as usual.
+	OnGap(socket *gbs.Conn, expected, received uint64)
+
+	// OnDuplicate 收到的序列号小于期望值, 这条消息会被丢弃
+	// The received sequence number is behind the expected one, the message is discarded
+	OnDuplicate(socket *gbs.Conn, seq uint64)
+}
+
+// Extension 为消息编号的拓展, 可以同时用于服务端和客户端
+// The extension numbering messages, usable on both the server and the client side
+type Extension struct {
+	handler Handler
+	option  *Option
+}
+
+// NewExtension 创建拓展, handler 可以为 nil
+// Creates the extension, handler may be nil
+func NewExtension(handler Handler, option *Option) *Extension {
+	return &Extension{handler: handler, option: initOption(option)}
+}
+
+func (c *Extension) Name() string { return extensionName }
+
+func (c *Extension) RSV() gbs.RSV { return c.option.RSV }
+
+// Offer 客户端提议自己的起始序列号, 重连时还会出示恢复令牌和收到的最后一个序列号
+// The client offers its own starting sequence number, and when reconnecting also presents the resume token
+// and the last sequence number it received
+func (c *Extension) Offer() string {
+	params := formatStart(c.option.Start)
+	if c.option.Token != "" {
+		params += "; token=" + c.option.Token + "; ack=" + strconv.FormatUint(c.option.Ack, 10)
+	}
+	return params
+}
+
+// Accept 服务端记录客户端的起始序列号, 并在响应中给出自己的起始序列号.
+// 开启了会话恢复时, 响应中还会带上恢复令牌; 客户端出示的令牌有效时恢复原来的会话, 从它确认的下一条消息开始编号.
+// The server records the starting sequence number of the client and responds with its own.
+// With session resumption enabled the response also carries the resume token; when the client presents a valid token
+// the former session is resumed, numbered from the message after the one the client acknowledged.
+func (c *Extension) Accept(params string) (gbs.ExtensionCodec, string, error) {
+	m := parseParams(params)
+	start, err := parseStart(m)
+	if err != nil {
+		return nil, "", err
+	}
+	store := c.option.Store
+	if store == nil {
+		return newSession(c.handler, c.option.Start, start), formatStart(c.option.Start), nil
+	}
+	if token := m["token"]; token != "" {
+		if ack, err := strconv.ParseUint(m["ack"], 10, 64); err == nil {
+			if session := store.lookup(token, ack); session != nil {
+				return &binding{Session: session, store: store, resume: true, ack: ack}, formatStart(ack+1) + "; token=" + token, nil
+			}
+		}
+	}
+	session, err := store.create(c.handler, c.option.Start, start)
+	if err != nil {
+		return nil, "", err
+	}
+	return &binding{Session: session, store: store}, formatStart(c.option.Start) + "; token=" + session.token, nil
+}
+
+// Confirm 客户端记录服务端的起始序列号和恢复令牌
+// The client records the starting sequence number and the resume token of the server
+func (c *Extension) Confirm(params string) (gbs.ExtensionCodec, error) {
+	m := parseParams(params)
+	start, err := parseStart(m)
+	if err != nil {
+		return nil, err
+	}
+	session := newSession(c.handler, c.option.Start, start)
+	session.token = m["token"]
+	session.resumed = c.option.Token != "" && session.token == c.option.Token
+	return session, nil
+}
+
+// 解析形如 k1=v1; k2=v2 的拓展参数
+// Parses extension parameters of the form k1=v1; k2=v2
+func parseParams(params string) map[string]string {
+	var m = make(map[string]string)
+	for _, item := range strings.Split(params, ";") {
+		k, v, _ := strings.Cut(item, "=")
+		if k = strings.TrimSpace(k); k != "" {
+			m[k] = strings.Trim(strings.TrimSpace(v), `"`)
+		}
+	}
+	return m
+}
+
+// 解析对端的起始序列号
+// Parses the starting sequence number of the peer
+func parseStart(params map[string]string) (uint64, error) {
+	start, err := strconv.ParseUint(params["start"], 10, 64)
+	if err != nil || start == 0 {
+		return 0, ErrInvalidParams
+	}
+	return start, nil
+}
+
+func formatStart(start uint64) string { return "start=" + strconv.FormatUint(start, 10) }
@@ -0,0 +1,86 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtension(t *testing.T) {
+	as := assert.New(t)
+	extension := NewExtension(nil, &Option{Start: 7})
+	as.Equal("x-sequence", extension.Name())
+	as.Equal("start=7", extension.Offer())
+
+	codec, response, err := extension.Accept("start=100")
+	if !as.NoError(err) {
+		return
+	}
+	as.Equal("start=7", response)
+	as.Equal(uint64(7), codec.(*Session).NextSend())
+	as.Equal(uint64(100), codec.(*Session).NextReceive())
+
+	for _, params := range []string{"", "start=0", "start=x", "begin=1"} {
+		_, _, err = extension.Accept(params)
+		as.ErrorIs(err, ErrInvalidParams)
+		_, err = extension.Confirm(params)
+		as.ErrorIs(err, ErrInvalidParams)
+	}
+
+	as.Equal(map[string]string{"start": "1", "token": "abc"}, parseParams(` start=1 ; token="abc"; ;`))
+}
+
+func TestExtension_Resume(t *testing.T) {
+	as := assert.New(t)
+	extension := NewExtension(nil, &Option{Start: 5, Token: "abc", Ack: 9})
+	as.Equal("start=5; token=abc; ack=9", extension.Offer())
+
+	codec, err := extension.Confirm("start=10; token=abc")
+	if !as.NoError(err) {
+		return
+	}
+	as.True(codec.(*Session).Resumed())
+	as.Equal(uint64(10), codec.(*Session).NextReceive())
+
+	codec, err = extension.Confirm("start=1; token=xyz")
+	if !as.NoError(err) {
+		return
+	}
+	as.False(codec.(*Session).Resumed())
+	as.Equal("xyz", codec.(*Session).Token())
+
+	// 服务端开启会话恢复后签发令牌, 无效的令牌得到新的会话
+	// With resumption enabled the server issues tokens, an invalid token gets a new session
+	store := NewStore(nil)
+	defer store.Close()
+	server := NewExtension(nil, &Option{Start: 100, Store: store})
+	codec, response, err := server.Accept("start=1; token=abc; ack=9")
+	if !as.NoError(err) {
+		return
+	}
+	session := codec.(*binding).Session
+	token := session.Token()
+	as.Equal("start=100; token="+token, response)
+	as.False(codec.(*binding).resume)
+	as.Nil(codec.(*binding).RestoreSession())
+
+	// 握手期间只做检查, 接管发生在 Bind 中
+	// Only checks happen during the handshake, the takeover is left to Bind
+	codec, response, err = server.Accept("start=3; token=" + token + "; ack=99")
+	if !as.NoError(err) {
+		return
+	}
+	as.Same(session, codec.(*binding).Session)
+	as.True(codec.(*binding).resume)
+	as.False(session.Resumed())
+	as.Equal("start=100; token="+token, response)
+
+	// 客户端确认了尚未发出的消息
+	// The client acknowledges a message that was never sent
+	codec, _, err = server.Accept("start=3; token=" + token + "; ack=100")
+	if !as.NoError(err) {
+		return
+	}
+	as.NotEqual(token, codec.(*binding).Token())
+	as.Equal(2, store.Len())
+}
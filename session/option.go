@@ -0,0 +1,108 @@
+package session
+
+import (
+	"time"
+
+	"github.com/catermujo/gbs"
+)
+
+const (
+	// 拓展名称
+	// Extension token
+	extensionName = "x-sequence"
+
+	// 序列号的长度, 以大端序追加在负载末尾
+	// Length of the sequence number, appended big-endian to the end of the payload
+	seqSize = 8
+
+	// 连接的 SessionStorage 中保存 *Session 的键
+	// Key of the *Session in the SessionStorage of the connection
+	storageKey = "gbs.session"
+
+	// 默认的起始序列号
+	// Default starting sequence number
+	defaultStart = 1
+
+	// 默认占用的保留位
+	// Reserved bit claimed by default
+	defaultRSV = gbs.RSV2
+
+	// 默认每个会话保留的消息条数
+	// Default number of messages kept per session
+	defaultBufferSize = 1024
+
+	// 默认的断线会话保留时长
+	// Default time a disconnected session is kept
+	defaultTTL = time.Minute
+
+	// 恢复令牌的随机字节数
+	// Number of random bytes of a resume token
+	tokenSize = 16
+)
+
+// Option 拓展配置
+// Extension configurations
+type Option struct {
+	// Sequence number of the first message sent by this end, defaults to 1
+	Start uint64
+
+	// Reserved bit marking numbered messages, defaults to RSV2
+	RSV gbs.RSV
+
+	// 服务端: 非 nil 时开启会话恢复, 为每个会话签发恢复令牌并保留发出的消息
+	// Server side: enables session resumption when set, a resume token is issued for every session
+	// and the outgoing messages are kept
+	Store *Store
+
+	// 客户端: 重连时出示的恢复令牌, 参见 Session.ResumeOption
+	// Client side: resume token presented when reconnecting, see Session.ResumeOption
+	Token string
+
+	// 客户端: 重连前收到的最后一条消息的序列号, 服务端从下一条开始重放
+	// Client side: sequence number of the last message received before reconnecting,
+	// the server replays from the one after it
+	Ack uint64
+}
+
+// StoreOption 会话仓库配置
+// Session store configurations
+type StoreOption struct {
+	// 每个会话保留的最近发出的消息条数, 断线期间更早的消息无法重放, 默认为 1024
+	// Number of recent outgoing messages kept per session; older ones cannot be replayed after a disconnect.
+	// Defaults to 1024.
+	BufferSize int
+
+	// 断线的会话保留多久, 超时后令牌失效, 默认为 1 分钟
+	// How long a disconnected session is kept before its token expires, defaults to 1 minute
+	TTL time.Duration
+}
+
+// 初始化配置
+// Initialize the options
+func initOption(c *Option) *Option {
+	if c == nil {
+		c = new(Option)
+	}
+	if c.Start == 0 {
+		c.Start = defaultStart
+	}
+	if c.RSV == 0 {
+		c.RSV = defaultRSV
+	}
+	return c
+}
+
+// 初始化会话仓库配置
+// Initialize the session store options
+func initStoreOption(c *StoreOption) *StoreOption {
+	if c == nil {
+		c = new(StoreOption)
+	}
+	if c.BufferSize <= 0 {
+		c.BufferSize = defaultBufferSize
+	}
+	if c.TTL <= 0 {
+		c.TTL = defaultTTL
+	}
+	return c
+}
@@ -0,0 +1,31 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitOption(t *testing.T) {
+	as := assert.New(t)
+	option := initOption(nil)
+	as.Equal(uint64(defaultStart), option.Start)
+	as.Equal(gbs.RSV2, option.RSV)
+
+	option = initOption(&Option{Start: 100, RSV: gbs.RSV3})
+	as.Equal(uint64(100), option.Start)
+	as.Equal(gbs.RSV3, option.RSV)
+}
+
+func TestInitStoreOption(t *testing.T) {
+	as := assert.New(t)
+	option := initStoreOption(nil)
+	as.Equal(defaultBufferSize, option.BufferSize)
+	as.Equal(defaultTTL, option.TTL)
+
+	option = initStoreOption(&StoreOption{BufferSize: 8, TTL: time.Second})
+	as.Equal(8, option.BufferSize)
+	as.Equal(time.Second, option.TTL)
+}
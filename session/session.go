@@ -0,0 +1,265 @@
+package session
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/catermujo/gbs"
+)
+
+var (
+	// ErrMissingSequence 编号的消息短于序列号的长度
+	// A numbered message is shorter than the sequence number
+	ErrMissingSequence = errors.New("session: message too short for a sequence number")
+
+	// ErrTakenOver 会话已经被新的连接恢复, 旧连接不能再收发编号的消息
+	// The session was resumed by a new connection, and the old one can no longer send or receive numbered messages
+	ErrTakenOver = errors.New("session: taken over by another connection")
+
+	// ErrReplayUnavailable 恢复会话时, 客户端错过的消息已经不在保留范围之内
+	// The messages the client missed are no longer kept when the session is resumed
+	ErrReplayUnavailable = errors.New("session: missed messages are no longer kept")
+)
+
+// Session 连接独享的编号状态, 同时是拓展的编解码器.
+// 开启了会话恢复时, 它在断线后仍然保留在 Store 中, 重连的客户端恢复会话后由新的连接继续使用.
+// Per-connection numbering state, which is also the codec of the extension.
+// With session resumption enabled it stays in the Store after a disconnect,
+// and a new connection carries it on once the reconnecting client resumes it.
+type Session struct {
+	socket      atomic.Pointer[gbs.Conn]
+	handler     Handler
+	nextSend    uint64
+	nextReceive uint64
+	token       string
+	resumed     bool
+
+	// 以下字段只在服务端开启会话恢复时使用
+	// The fields below are only used on the server side with session resumption enabled
+	mu         sync.Mutex
+	owner      atomic.Uint64      // 当前持有会话的绑定的编号 / Number of the binding currently holding the session
+	history    []entry            // 最近发出的消息, 按序列号取模存放 / Recent outgoing messages, stored by sequence number modulo
+	start      uint64             // 会话发出的第一条消息的序列号 / Sequence number of the first message of the session
+	storage    gbs.SessionStorage // 上一个连接的 SessionStorage / SessionStorage of the previous connection
+	replay     []entry            // 等待重放的消息 / Messages waiting to be replayed
+	replaying  bool
+	replaySeq  uint64
+	detachedAt time.Time // 由 Store.mu 保护 / Guarded by Store.mu
+}
+
+// 发出的消息, 负载末尾带有序列号
+// An outgoing message, with the sequence number at the end of the payload
+type entry struct {
+	opcode  gbs.Opcode
+	payload []byte
+}
+
+func newSession(handler Handler, send, receive uint64) *Session {
+	return &Session{handler: handler, nextSend: send, nextReceive: receive}
+}
+
+// Get 返回连接的编号状态, 没有协商该拓展时返回 nil
+// Returns the numbering state of the connection, nil when the extension was not negotiated
+func Get(socket *gbs.Conn) *Session {
+	if v, ok := socket.Session().Load(storageKey); ok {
+		session, _ := v.(*Session)
+		return session
+	}
+	return nil
+}
+
+// NextSend 下一条发出的消息的序列号
+// Sequence number of the next outgoing message
+func (c *Session) NextSend() uint64 { return atomic.LoadUint64(&c.nextSend) }
+
+// NextReceive 期望收到的下一条消息的序列号. 在 OnMessage 中减一即为当前消息的序列号 (未开启 ParallelEnabled 时).
+// Sequence number expected for the next incoming message.
+// Within OnMessage, minus one it is the number of the current message (unless ParallelEnabled is on).
+func (c *Session) NextReceive() uint64 { return atomic.LoadUint64(&c.nextReceive) }
+
+// Token 服务端签发的恢复令牌, 服务端没有开启会话恢复时为空
+// Resume token issued by the server, empty when the server has not enabled session resumption
+func (c *Session) Token() string { return c.token }
+
+// Resumed 是否恢复了断线之前的会话
+// Reports whether the session from before a disconnect was resumed
+func (c *Session) Resumed() bool { return c.resumed }
+
+// ResumeOption 返回客户端重连时使用的配置: 出示令牌, 确认已经收到的消息, 并接着当前的序列号继续编号.
+// 保留位等其他配置需要自行补充.
+// Returns the options for the client to reconnect with: presents the token, acknowledges the messages received so far,
+// and carries on numbering from the current sequence number. Other options such as the reserved bit are up to the caller.
+func (c *Session) ResumeOption() *Option {
+	return &Option{Start: c.NextSend(), Token: c.token, Ack: c.NextReceive() - 1}
+}
+
+// Bind 在连接的 SessionStorage 中登记自己, 供 Get 查询
+// Registers itself in the SessionStorage of the connection for Get
+func (c *Session) Bind(socket *gbs.Conn) error {
+	c.socket.Store(socket)
+	socket.Session().Store(storageKey, c)
+	return nil
+}
+
+// Encode 在负载末尾追加序列号, 在写锁内调用, 所以编号顺序就是写入顺序.
+// Appends the sequence number to the payload. It runs under the write lock, so numbers follow the order on the wire.
+func (c *Session) Encode(opcode gbs.Opcode, payload []byte) ([]byte, bool, error) {
+	p := make([]byte, len(payload), len(payload)+seqSize)
+	copy(p, payload)
+	seq := atomic.AddUint64(&c.nextSend, 1) - 1
+	return binary.BigEndian.AppendUint64(p, seq), true, nil
+}
+
+// Decode 校验并去掉序列号. 没有设置保留位的消息来自流式写入器, 原样交付.
+// Validates and strips the sequence number. Messages without the reserved bit come from streaming writers and pass as is.
+func (c *Session) Decode(opcode gbs.Opcode, rsv bool, payload []byte) ([]byte, error) {
+	if !rsv {
+		return payload, nil
+	}
+	n := len(payload) - seqSize
+	if n < 0 {
+		return nil, ErrMissingSequence
+	}
+	seq := binary.BigEndian.Uint64(payload[n:])
+	expected := atomic.LoadUint64(&c.nextReceive)
+	switch {
+	case seq < expected:
+		if c.handler != nil {
+			c.handler.OnDuplicate(c.socket.Load(), seq)
+		}
+		return nil, gbs.ErrDiscardMessage
+	case seq > expected && c.handler != nil:
+		c.handler.OnGap(c.socket.Load(), expected, seq)
+	}
+	atomic.StoreUint64(&c.nextReceive, seq+1)
+	return payload[:n], nil
+}
+
+// 保留的消息能否补齐 ack 之后的消息, 调用时持有 c.mu
+// Reports whether the kept messages can fill the gap after ack, called with c.mu held
+func (c *Session) canReplay(ack uint64) bool {
+	next := atomic.LoadUint64(&c.nextSend)
+	first := c.start
+	if size := uint64(len(c.history)); next-c.start > size {
+		first = next - size
+	}
+	return ack+1 >= first && ack+1 <= next
+}
+
+// 准备重放 ack 之后的消息, 保留的消息不足以补齐时返回 false. 调用时持有 c.mu.
+// Prepares the replay of the messages after ack, returns false when the kept messages cannot fill the gap.
+// Called with c.mu held.
+func (c *Session) prepareReplay(ack uint64) bool {
+	if !c.canReplay(ack) {
+		return false
+	}
+	next := atomic.LoadUint64(&c.nextSend)
+	size := uint64(len(c.history))
+	c.replay = c.replay[:0]
+	for seq := ack + 1; seq < next; seq++ {
+		c.replay = append(c.replay, c.history[seq%size])
+	}
+	c.resumed = true
+	return true
+}
+
+// binding 开启会话恢复时连接的编解码器, 把会话绑定到一条连接上.
+// 会话被新的连接接管之后, 旧连接的编解码器拒绝继续收发, 所以旧连接编号的每一条消息都在接管时的重放范围之内.
+// binding is the codec of a connection with session resumption enabled, binding the session to that connection.
+// Once a new connection takes the session over, the codec of the old one refuses to send or receive,
+// so every message the old connection numbered falls within the replay taken at the takeover.
+type binding struct {
+	*Session
+	store  *Store
+	resume bool
+	ack    uint64
+	number uint64
+}
+
+// RestoreSession 恢复会话时返回上一个连接的 SessionStorage
+// Returns the SessionStorage of the previous connection when the session is resumed
+func (c *binding) RestoreSession() gbs.SessionStorage {
+	if !c.resume {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.storage
+}
+
+// Bind 在握手响应发出之后接管会话: 先让旧连接停止编号, 再按 ack 准备重放, 然后关闭旧连接.
+// 客户端错过的消息在这里重放, 所以它们先于连接交给应用之后的任何消息.
+// 接管期间旧连接发出了太多消息, 保留的消息不足以补齐时, 丢弃会话并返回 ErrReplayUnavailable:
+// 新连接随之以 1001 关闭, 服务端的 OnClose 收到这个错误, 客户端重连时得到新的会话.
+// Takes the session over once the handshake response is out: the old connection stops numbering first,
+// then the replay is prepared from ack, and then the old connection is closed.
+// The messages the client missed are replayed here, ahead of anything sent once the connection is handed to the application.
+// When the old connection sent so much meanwhile that the kept messages cannot fill the gap, the session is dropped
+// and ErrReplayUnavailable returned: the new connection is then closed with 1001 and the server's OnClose receives
+// that error, while the client gets a new session when it reconnects.
+func (c *binding) Bind(socket *gbs.Conn) error {
+	c.mu.Lock()
+	if c.resume && !c.prepareReplay(c.ack) {
+		c.mu.Unlock()
+		c.store.remove(c.Session)
+		return ErrReplayUnavailable
+	}
+	c.number = c.owner.Add(1)
+	old := c.socket.Swap(socket)
+	c.storage = socket.Session()
+	replay := c.replay
+	c.replay = nil
+	c.mu.Unlock()
+
+	socket.Session().Store(storageKey, c.Session)
+	c.store.attach(c.Session)
+	if old != nil && old != socket {
+		_ = old.NetConn().Close()
+	}
+
+	for _, item := range replay {
+		n := len(item.payload) - seqSize
+		c.mu.Lock()
+		c.replaying, c.replaySeq = true, binary.BigEndian.Uint64(item.payload[n:])
+		c.mu.Unlock()
+		if err := socket.WriteMessage(item.opcode, item.payload[:n]); err != nil {
+			break
+		}
+	}
+	c.mu.Lock()
+	c.replaying = false
+	c.mu.Unlock()
+	return nil
+}
+
+// Encode 编号并记录发出的消息, 重放的消息沿用原来的序列号
+// Numbers and keeps the outgoing message; replayed messages keep their original numbers
+func (c *binding) Encode(opcode gbs.Opcode, payload []byte) ([]byte, bool, error) {
+	p := make([]byte, len(payload), len(payload)+seqSize)
+	copy(p, payload)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.owner.Load() != c.number {
+		return nil, false, ErrTakenOver
+	}
+	if c.replaying {
+		return binary.BigEndian.AppendUint64(p, c.replaySeq), true, nil
+	}
+	seq := atomic.AddUint64(&c.nextSend, 1) - 1
+	p = binary.BigEndian.AppendUint64(p, seq)
+	c.history[seq%uint64(len(c.history))] = entry{opcode: opcode, payload: p}
+	return p, true, nil
+}
+
+// Decode 会话被接管之后, 旧连接收到的消息不再计入
+// Once the session is taken over, messages received by the old connection no longer count
+func (c *binding) Decode(opcode gbs.Opcode, rsv bool, payload []byte) ([]byte, error) {
+	if c.owner.Load() != c.number {
+		return nil, ErrTakenOver
+	}
+	return c.Session.Decode(opcode, rsv, payload)
+}
@@ -0,0 +1,397 @@
+package session
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs"
+	"github.com/catermujo/gbs/gbstest"
+	"github.com/stretchr/testify/assert"
+)
+
+// 记录序列号异常的处理器
+// Handler recording sequence anomalies
+type sequenceHandler struct {
+	*gbstest.Recorder
+	gaps       chan [2]uint64
+	duplicates chan uint64
+}
+
+func newSequenceHandler() *sequenceHandler {
+	return &sequenceHandler{
+		Recorder:   new(gbstest.Recorder),
+		gaps:       make(chan [2]uint64, 8),
+		duplicates: make(chan uint64, 8),
+	}
+}
+
+func (c *sequenceHandler) OnGap(socket *gbs.Conn, expected, received uint64) {
+	c.gaps <- [2]uint64{expected, received}
+}
+
+func (c *sequenceHandler) OnDuplicate(socket *gbs.Conn, seq uint64) {
+	c.duplicates <- seq
+}
+
+// 建立协商了编号拓展的连接对
+// Builds a connection pair that negotiated the numbering extension
+func newSessionPair(t *testing.T, serverHandler, clientHandler *sequenceHandler) (*gbs.Conn, *gbs.Conn) {
+	server, client, err := gbstest.Pipe(serverHandler, clientHandler,
+		&gbs.ServerOption{Extensions: []gbs.Extension{NewExtension(serverHandler, &Option{Start: 100})}},
+		&gbs.ClientOption{Extensions: []gbs.Extension{NewExtension(clientHandler, nil)}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ReadLoop()
+	go client.ReadLoop()
+	t.Cleanup(func() { _ = client.WriteClose(1000, nil) })
+	return server, client
+}
+
+func TestSession(t *testing.T) {
+	as := assert.New(t)
+	serverHandler, clientHandler := newSequenceHandler(), newSequenceHandler()
+	server, client := newSessionPair(t, serverHandler, clientHandler)
+	as.Equal([]string{extensionName}, server.Extensions())
+	as.Equal(uint64(100), Get(server).NextSend())
+	as.Equal(uint64(1), Get(server).NextReceive())
+	as.Equal(uint64(1), Get(client).NextSend())
+	as.Equal(uint64(100), Get(client).NextReceive())
+
+	as.NoError(client.WriteString("a"))
+	done := make(chan error, 1)
+	client.WriteAsync(gbs.OpcodeText, []byte("b"), func(err error) { done <- err })
+	as.NoError(<-done)
+	as.NoError(client.WriteMessage(gbs.OpcodeBinary, nil))
+	as.NoError(server.WriteString("c"))
+
+	messages, err := serverHandler.WaitMessages(3, time.Second)
+	if !as.NoError(err) {
+		return
+	}
+	as.Equal("a", string(messages[0].Payload))
+	as.Equal("b", string(messages[1].Payload))
+	as.Empty(messages[2].Payload)
+	as.Equal(uint64(4), Get(client).NextSend())
+	as.Equal(uint64(4), Get(server).NextReceive())
+
+	messages, err = clientHandler.WaitMessages(1, time.Second)
+	if !as.NoError(err) {
+		return
+	}
+	as.Equal("c", string(messages[0].Payload))
+	as.Equal(uint64(101), Get(client).NextReceive())
+}
+
+func TestSession_Gap(t *testing.T) {
+	as := assert.New(t)
+	serverHandler, clientHandler := newSequenceHandler(), newSequenceHandler()
+	server, client := newSessionPair(t, serverHandler, clientHandler)
+
+	// 跳过 3 个序列号, 消息照常交付
+	// Skip 3 sequence numbers, the message is still delivered
+	atomic.AddUint64(&Get(client).nextSend, 3)
+	as.NoError(client.WriteString("gap"))
+	as.Equal([2]uint64{1, 4}, <-serverHandler.gaps)
+	messages, err := serverHandler.WaitMessages(1, time.Second)
+	if !as.NoError(err) {
+		return
+	}
+	as.Equal("gap", string(messages[0].Payload))
+	as.Equal(uint64(5), Get(server).NextReceive())
+
+	// 回退序列号, 重复的消息被丢弃
+	// Go back in sequence, the duplicate is discarded
+	atomic.StoreUint64(&Get(client).nextSend, 4)
+	as.NoError(client.WriteString("duplicate"))
+	as.Equal(uint64(4), <-serverHandler.duplicates)
+	as.NoError(client.WriteString("next"))
+	messages, err = serverHandler.WaitMessages(2, time.Second)
+	if !as.NoError(err) {
+		return
+	}
+	as.Equal("next", string(messages[1].Payload))
+	as.Len(serverHandler.Messages(), 2)
+	as.Empty(serverHandler.gaps)
+}
+
+func TestSession_Stream(t *testing.T) {
+	as := assert.New(t)
+	serverHandler, clientHandler := newSequenceHandler(), newSequenceHandler()
+	server, client := newSessionPair(t, serverHandler, clientHandler)
+
+	// 流式写入的消息没有编号
+	// Streamed messages are not numbered
+	writer := client.NextWriter(gbs.OpcodeText)
+	_, _ = writer.Write([]byte("stream"))
+	as.NoError(writer.Close())
+	as.NoError(client.WriteString("numbered"))
+	messages, err := serverHandler.WaitMessages(2, time.Second)
+	if !as.NoError(err) {
+		return
+	}
+	as.Equal("stream", string(messages[0].Payload))
+	as.Equal("numbered", string(messages[1].Payload))
+	as.Equal(uint64(2), Get(server).NextReceive())
+}
+
+func TestSession_Unnegotiated(t *testing.T) {
+	as := assert.New(t)
+	server, client, err := gbstest.Pipe(new(gbstest.Recorder), new(gbstest.Recorder),
+		&gbs.ServerOption{Extensions: []gbs.Extension{NewExtension(nil, nil)}},
+		nil,
+	)
+	if !as.NoError(err) {
+		return
+	}
+	as.Nil(Get(server))
+	as.Nil(Get(client))
+	as.Empty(server.Extensions())
+}
+
+// 在 OnOpen 时交出服务端连接的处理器
+// Handler handing over the server connections on OnOpen
+type resumeHandler struct {
+	*sequenceHandler
+	sockets chan *gbs.Conn
+}
+
+func (c *resumeHandler) OnOpen(socket *gbs.Conn) {
+	c.sequenceHandler.OnOpen(socket)
+	c.sockets <- socket
+}
+
+// 启动开启了会话恢复的服务器. 恢复时重放发生在握手期间, net.Pipe 没有缓冲会阻塞, 所以使用 TCP.
+// Starts a server with session resumption enabled. The replay happens during the handshake
+// and would block on the unbuffered net.Pipe, hence TCP.
+func newResumeServer(t *testing.T, option *StoreOption) (string, *Store, *resumeHandler) {
+	store := NewStore(option)
+	t.Cleanup(func() { _ = store.Close() })
+	handler := &resumeHandler{sequenceHandler: newSequenceHandler(), sockets: make(chan *gbs.Conn, 8)}
+	server := gbs.NewServer(handler, &gbs.ServerOption{
+		Extensions: []gbs.Extension{NewExtension(handler, &Option{Store: store})},
+		Authorize: func(r *http.Request, session gbs.SessionStorage) bool {
+			session.Store("path", r.URL.Path)
+			return true
+		},
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.RunListener(listener)
+	return "ws://" + listener.Addr().String(), store, handler
+}
+
+func dialSession(t *testing.T, addr string, handler *sequenceHandler, option *Option) *gbs.Conn {
+	client, _, err := gbs.NewClient(handler, &gbs.ClientOption{
+		Addr:       addr,
+		Extensions: []gbs.Extension{NewExtension(handler, option)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.ReadLoop()
+	t.Cleanup(func() { _ = client.WriteClose(1000, nil) })
+	return client
+}
+
+func TestSession_Resume(t *testing.T) {
+	as := assert.New(t)
+	addr, store, serverHandler := newResumeServer(t, nil)
+
+	clientHandler := newSequenceHandler()
+	client := dialSession(t, addr+"/first", clientHandler, nil)
+	server := <-serverHandler.sockets
+	as.NotEmpty(Get(client).Token())
+	as.Equal(Get(server).Token(), Get(client).Token())
+	as.False(Get(client).Resumed())
+	server.Session().Store("user", "alice")
+
+	for _, s := range []string{"1", "2", "3"} {
+		as.NoError(server.WriteString(s))
+	}
+	_, err := clientHandler.WaitMessages(3, time.Second)
+	if !as.NoError(err) {
+		return
+	}
+	as.NoError(client.WriteString("a"))
+	_, err = serverHandler.WaitMessages(1, time.Second)
+	if !as.NoError(err) {
+		return
+	}
+
+	// 假装 2 和 3 在断线时丢失了
+	// Pretend 2 and 3 were lost in the disconnect
+	option := Get(client).ResumeOption()
+	as.Equal(&Option{Start: 2, Token: Get(client).Token(), Ack: 3}, option)
+	option.Ack = 1
+
+	resumedHandler := newSequenceHandler()
+	resumed := dialSession(t, addr+"/second", resumedHandler, option)
+	as.True(Get(resumed).Resumed())
+	as.Equal(option.Token, Get(resumed).Token())
+
+	// 新连接接管会话, 旧连接被关闭
+	// The new connection takes the session over and the old one is closed
+	next := <-serverHandler.sockets
+	as.Same(Get(server), Get(next))
+	_, err = serverHandler.WaitEvents(gbstest.EventClose, 1, time.Second)
+	as.NoError(err)
+	as.True(server.IsClosed())
+
+	// 会话存储被恢复, 并合并了这次握手写入的键值
+	// The session storage is restored, with the entries of this handshake merged in
+	user, _ := next.Session().Load("user")
+	path, _ := next.Session().Load("path")
+	as.Equal("alice", user)
+	as.Equal("/second", path)
+
+	// 错过的消息沿用原来的序列号先于新消息重放
+	// The missed messages are replayed with their original numbers ahead of new ones
+	as.NoError(next.WriteString("4"))
+	messages, err := resumedHandler.WaitMessages(3, time.Second)
+	if !as.NoError(err) {
+		return
+	}
+	as.Equal("2", string(messages[0].Payload))
+	as.Equal("3", string(messages[1].Payload))
+	as.Equal("4", string(messages[2].Payload))
+	as.Equal(uint64(5), Get(resumed).NextReceive())
+	as.Empty(resumedHandler.gaps)
+
+	as.NoError(resumed.WriteString("b"))
+	messages, err = serverHandler.WaitMessages(2, time.Second)
+	if !as.NoError(err) {
+		return
+	}
+	as.Equal("b", string(messages[1].Payload))
+	as.Empty(serverHandler.gaps)
+	as.Equal(1, store.Len())
+}
+
+func TestSession_ResumeRejected(t *testing.T) {
+	as := assert.New(t)
+	addr, store, serverHandler := newResumeServer(t, &StoreOption{BufferSize: 2})
+
+	clientHandler := newSequenceHandler()
+	client := dialSession(t, addr, clientHandler, nil)
+	server := <-serverHandler.sockets
+	for _, s := range []string{"1", "2", "3", "4", "5"} {
+		as.NoError(server.WriteString(s))
+	}
+	_, err := clientHandler.WaitMessages(5, time.Second)
+	if !as.NoError(err) {
+		return
+	}
+	token := Get(client).Token()
+
+	// 未知的令牌得到新的会话
+	// An unknown token gets a new session
+	unknown := dialSession(t, addr, newSequenceHandler(), &Option{Token: "unknown"})
+	<-serverHandler.sockets
+	as.False(Get(unknown).Resumed())
+	as.NotEqual("unknown", Get(unknown).Token())
+
+	// 只保留了 4 和 5, 无法从 2 开始重放
+	// Only 4 and 5 are kept, the replay cannot start from 2
+	behind := dialSession(t, addr, newSequenceHandler(), &Option{Token: token, Ack: 1})
+	<-serverHandler.sockets
+	as.False(Get(behind).Resumed())
+	as.False(server.IsClosed())
+
+	resumedHandler := newSequenceHandler()
+	resumed := dialSession(t, addr, resumedHandler, &Option{Token: token, Ack: 3})
+	<-serverHandler.sockets
+	as.True(Get(resumed).Resumed())
+	messages, err := resumedHandler.WaitMessages(2, time.Second)
+	if !as.NoError(err) {
+		return
+	}
+	as.Equal("4", string(messages[0].Payload))
+	as.Equal("5", string(messages[1].Payload))
+	as.Equal(3, store.Len())
+}
+
+func TestBinding_BindUnavailable(t *testing.T) {
+	as := assert.New(t)
+	store := NewStore(&StoreOption{BufferSize: 2})
+	defer store.Close()
+	session, err := store.create(nil, 1, 1)
+	if !as.NoError(err) {
+		return
+	}
+	owner := &binding{Session: session, store: store}
+	for _, s := range []string{"1", "2", "3", "4"} {
+		_, _, err = owner.Encode(gbs.OpcodeText, []byte(s))
+		as.NoError(err)
+	}
+
+	// 握手之后旧连接又发出了消息, 保留的消息不足以从 1 之后补齐; 会话被丢弃, 错误交给连接关闭
+	// The old connection sent more after the handshake and the kept messages cannot fill the gap after 1;
+	// the session is dropped and the error handed over to close the connection
+	resumed := &binding{Session: session, store: store, resume: true, ack: 1}
+	as.ErrorIs(resumed.Bind(nil), ErrReplayUnavailable)
+	as.Equal(0, store.Len())
+}
+
+func TestSession_ResumeConcurrentWrites(t *testing.T) {
+	as := assert.New(t)
+	addr, _, serverHandler := newResumeServer(t, &StoreOption{BufferSize: 1 << 16})
+
+	clientHandler := newSequenceHandler()
+	client := dialSession(t, addr, clientHandler, nil)
+	server := <-serverHandler.sockets
+
+	// 旧连接一直写到被接管为止
+	// The old connection keeps writing until it is taken over
+	stopped := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			if err := server.WriteString(strconv.Itoa(i)); err != nil {
+				stopped <- err
+				return
+			}
+		}
+	}()
+	if _, err := clientHandler.WaitMessages(100, time.Second); !as.NoError(err) {
+		return
+	}
+
+	option := Get(client).ResumeOption()
+	resumedHandler := newSequenceHandler()
+	resumed := dialSession(t, addr, resumedHandler, option)
+	next := <-serverHandler.sockets
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	as.True(Get(resumed).Resumed())
+	as.NoError(next.WriteString("end"))
+
+	var messages []gbstest.Event
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		messages = resumedHandler.Messages()
+		if n := len(messages); n > 0 && string(messages[n-1].Payload) == "end" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+	}
+
+	// 旧连接编号的每一条消息都被重放, 没有缺口
+	// Every message numbered by the old connection is replayed, without gaps
+	as.Empty(resumedHandler.gaps)
+	as.Equal(Get(next).NextSend(), Get(resumed).NextReceive())
+	first := option.Ack + 1 - Get(next).start
+	for i, message := range messages[:len(messages)-1] {
+		as.Equal(strconv.FormatUint(first+uint64(i), 10), string(message.Payload))
+	}
+}
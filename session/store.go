@@ -0,0 +1,149 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// Store 服务端的会话仓库, 按恢复令牌保存会话, 断线的会话在 TTL 内可以被重连的客户端恢复.
+// 过期的会话由后台协程每 TTL/4 清理一次, 创建或者恢复会话时也会顺带清理. 不再使用时调用 Close 停止后台协程.
+// Server-side session store keeping sessions by resume token;
+// a disconnected session can be resumed by a reconnecting client within the TTL.
+// Expired sessions are swept by a background goroutine every TTL/4, and along the way when sessions are created
+// or resumed. Call Close to stop the background goroutine once the store is no longer used.
+type Store struct {
+	option   *StoreOption
+	mu       sync.Mutex
+	sessions map[string]*Session
+	swept    time.Time
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewStore 创建会话仓库, option 可以为 nil
+// Creates the session store, option may be nil
+func NewStore(option *StoreOption) *Store {
+	c := &Store{option: initStoreOption(option), sessions: make(map[string]*Session), done: make(chan struct{})}
+	go c.sweepLoop()
+	return c
+}
+
+// Close 停止后台清理, 保存的会话不受影响
+// Stops the background sweeping, the sessions kept are not affected
+func (c *Store) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+// 定时清理过期的会话, 断线之后没有新的连接也能释放内存
+// Sweeps expired sessions periodically, so memory is released even when no connection comes after a disconnect
+func (c *Store) sweepLoop() {
+	ticker := time.NewTicker(c.option.TTL / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			c.sweep(now)
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Len 保存的会话数量, 包括尚未清理的过期会话
+// Number of sessions kept, including expired ones not swept yet
+func (c *Store) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sessions)
+}
+
+// 创建一个签发了新令牌的会话
+// Creates a session with a newly issued token
+func (c *Store) create(handler Handler, send, receive uint64) (*Session, error) {
+	var b = make([]byte, tokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	session := newSession(handler, send, receive)
+	session.token = base64.RawURLEncoding.EncodeToString(b)
+	session.history = make([]entry, c.option.BufferSize)
+	session.start = send
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(time.Now())
+	c.sessions[session.token] = session
+	return session, nil
+}
+
+// 查找令牌对应的会话, ack 是客户端收到的最后一条消息的序列号. 令牌无效, 过期或者保留的消息不足以补齐时返回 nil.
+// 这里只做检查, 接管在握手成功之后由 Bind 完成, 失败的握手不会影响旧连接.
+// Looks up the session of the token, ack is the sequence number of the last message the client received.
+// Returns nil when the token is unknown or expired, or the kept messages cannot fill the gap.
+// This only checks; the takeover is done by Bind once the handshake succeeds, so a failed handshake leaves the old
+// connection alone.
+func (c *Store) lookup(token string, ack uint64) *Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.sweep(now)
+	session := c.sessions[token]
+	if session == nil {
+		return nil
+	}
+	if !session.detachedAt.IsZero() && now.Sub(session.detachedAt) >= c.option.TTL {
+		delete(c.sessions, token)
+		return nil
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if !session.canReplay(ack) {
+		return nil
+	}
+	return session
+}
+
+// 会话绑定了新的连接, 停止计时
+// The session is bound to a new connection, so it is no longer timed
+func (c *Store) attach(session *Session) {
+	c.mu.Lock()
+	session.detachedAt = time.Time{}
+	c.mu.Unlock()
+}
+
+// 移除会话
+// Removes the session
+func (c *Store) remove(session *Session) {
+	c.mu.Lock()
+	if c.sessions[session.token] == session {
+		delete(c.sessions, session.token)
+	}
+	c.mu.Unlock()
+}
+
+// 清理过期的会话, 至多每 TTL/4 执行一次. 从未绑定连接或者连接已经关闭的会话从发现时开始计时.
+// Sweeps expired sessions, at most once every TTL/4.
+// Sessions never bound to a connection, or whose connection is closed, are timed from when that is noticed.
+func (c *Store) sweep(now time.Time) {
+	if now.Sub(c.swept) < c.option.TTL/4 {
+		return
+	}
+	c.swept = now
+	for token, session := range c.sessions {
+		socket := session.socket.Load()
+		switch {
+		case socket != nil && !socket.IsClosed():
+			session.detachedAt = time.Time{}
+		case session.detachedAt.IsZero():
+			session.detachedAt = now
+		case now.Sub(session.detachedAt) >= c.option.TTL:
+			delete(c.sessions, token)
+		}
+	}
+}
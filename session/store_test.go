@@ -0,0 +1,59 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	as := assert.New(t)
+	store := NewStore(&StoreOption{TTL: time.Minute})
+	defer store.Close()
+	session, err := store.create(nil, 1, 1)
+	if !as.NoError(err) {
+		return
+	}
+	as.Len(session.Token(), 22)
+	as.Len(session.history, defaultBufferSize)
+	as.Equal(1, store.Len())
+	as.Same(session, store.lookup(session.Token(), 0))
+	as.Nil(store.lookup("unknown", 0))
+
+	// 从未绑定连接的会话从被发现时开始计时
+	// A session never bound to a connection is timed from when that is noticed
+	now := time.Now()
+	store.swept = time.Time{}
+	store.sweep(now)
+	as.Equal(now, session.detachedAt)
+	store.sweep(now.Add(time.Minute / 2))
+	as.Equal(1, store.Len())
+	store.sweep(now.Add(time.Minute))
+	as.Equal(0, store.Len())
+	as.Nil(store.lookup(session.Token(), 0))
+
+	// 过期的会话无法恢复
+	// Expired sessions cannot be resumed
+	session, _ = store.create(nil, 1, 1)
+	session.detachedAt = time.Now().Add(-time.Minute)
+	as.Nil(store.lookup(session.Token(), 0))
+	as.Equal(0, store.Len())
+}
+
+func TestStore_Sweep(t *testing.T) {
+	as := assert.New(t)
+	store := NewStore(&StoreOption{TTL: 40 * time.Millisecond})
+	defer store.Close()
+	_, err := store.create(nil, 1, 1)
+	if !as.NoError(err) {
+		return
+	}
+
+	// 没有任何后续调用, 断线的会话也会被清理
+	// The detached session is swept without any further call on the store
+	as.Eventually(func() bool { return store.Len() == 0 }, time.Second, 10*time.Millisecond)
+
+	as.NoError(store.Close())
+	as.NoError(store.Close())
+}
@@ -0,0 +1,307 @@
+//go:build unix
+
+package shm
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// 文件格式的版本
+	// Version of the file format
+	version = 1
+
+	// 文件头: magic(8) version(4) attached(4) size(8) closed(4*2), 之后是两个控制块和两段数据
+	// File header: magic(8) version(4) attached(4) size(8) closed(4*2), followed by two control blocks and two data areas
+	fileHeaderSize = 256
+
+	// 数据区在文件中的起始位置
+	// Offset of the data areas in the file
+	dataOffset = fileHeaderSize + 2*ringHeaderSize
+)
+
+var magic = [8]byte{'G', 'B', 'S', 'R', 'I', 'N', 'G', 0}
+
+var (
+	// ErrAttached 另一个进程已经打开了这个文件
+	// Another process has already opened the file
+	ErrAttached = errors.New("shm: ring buffer is already attached")
+
+	// ErrInvalidFile 文件不是环形缓冲区文件, 或者尚未初始化完成
+	// The file is not a ring buffer file, or it is not initialized yet
+	ErrInvalidFile = errors.New("shm: invalid ring buffer file")
+)
+
+type fileHeader struct {
+	magic    [8]byte
+	version  uint32
+	attached uint32
+	size     uint64
+	closed   [2]uint32
+}
+
+// Addr 共享内存连接的地址, 即文件路径
+// Address of a shared memory connection, i.e. the file path
+type Addr string
+
+func (c Addr) Network() string { return "shm" }
+
+func (c Addr) String() string { return string(c) }
+
+// Conn 共享内存连接. 创建者写入第一个环形队列, 打开者写入第二个.
+// Shared memory connection. The creator writes to the first ring and the opener to the second.
+type Conn struct {
+	mem    []byte
+	path   string
+	side   int
+	option *Option
+	header *fileHeader
+	rx     *ring
+	tx     *ring
+
+	rmu           sync.Mutex
+	wmu           sync.Mutex
+	mu            sync.Mutex
+	readDeadline  int64
+	writeDeadline int64
+	closed        uint32
+	once          sync.Once
+}
+
+// Create 创建环形缓冲区文件并作为服务端连接, 文件不能已经存在. 连接关闭时文件会被删除.
+// Creates the ring buffer file and connects as the server side; the file must not exist yet.
+// The file is removed when the connection closes.
+func Create(path string, option *Option) (*Conn, error) {
+	option = initOption(option)
+	size := dataOffset + 2*option.Size
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, option.Mode)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := file.Truncate(int64(size)); err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	mem, err := syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+
+	// 版本号最后写入, 打开者据此判断文件已经初始化完成
+	// The version is written last, the opener relies on it to tell that the file is initialized
+	header := (*fileHeader)(unsafe.Pointer(&mem[0]))
+	header.size = uint64(option.Size)
+	header.magic = magic
+	atomic.StoreUint32(&header.version, version)
+	return newConn(mem, path, 0, option), nil
+}
+
+// Open 打开其它进程创建的环形缓冲区文件, 作为客户端连接. 一个文件只能被打开一次.
+// 只有 Option.SpinCount 会生效, 容量由创建者决定.
+// Opens a ring buffer file created by another process and connects as the client side. A file can only be opened once.
+// Only Option.SpinCount applies, the capacity is decided by the creator.
+func Open(path string, option *Option) (*Conn, error) {
+	option = initOption(option)
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < dataOffset {
+		return nil, ErrInvalidFile
+	}
+	mem, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	header := (*fileHeader)(unsafe.Pointer(&mem[0]))
+	size := header.size
+	if atomic.LoadUint32(&header.version) != version || header.magic != magic ||
+		size == 0 || size&(size-1) != 0 || uint64(len(mem)) < dataOffset+2*size {
+		_ = syscall.Munmap(mem)
+		return nil, ErrInvalidFile
+	}
+	if !atomic.CompareAndSwapUint32(&header.attached, 0, 1) {
+		_ = syscall.Munmap(mem)
+		return nil, ErrAttached
+	}
+	option.Size = int(size)
+	return newConn(mem, path, 1, option), nil
+}
+
+func newConn(mem []byte, path string, side int, option *Option) *Conn {
+	size := option.Size
+	rings := [2]*ring{
+		newRing(mem[fileHeaderSize:], mem[dataOffset:dataOffset+size]),
+		newRing(mem[fileHeaderSize+ringHeaderSize:], mem[dataOffset+size:dataOffset+2*size]),
+	}
+	return &Conn{
+		mem:    mem,
+		path:   path,
+		side:   side,
+		option: option,
+		header: (*fileHeader)(unsafe.Pointer(&mem[0])),
+		rx:     rings[1-side],
+		tx:     rings[side],
+	}
+}
+
+func (c *Conn) isClosed() bool { return atomic.LoadUint32(&c.closed) == 1 }
+
+func (c *Conn) peerClosed() bool { return atomic.LoadUint32(&c.header.closed[1-c.side]) == 1 }
+
+// 返回本次休眠的时长, 超时已经到期时返回错误
+// Returns how long to sleep this time, or an error once the deadline has passed
+func (c *Conn) timeout(deadline *int64) (time.Duration, error) {
+	d := atomic.LoadInt64(deadline)
+	if d == 0 {
+		return maxSleep, nil
+	}
+	remain := time.Until(time.Unix(0, d))
+	if remain <= 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if remain > maxSleep {
+		remain = maxSleep
+	}
+	return remain, nil
+}
+
+// Read 读取对端写入的数据. 对端关闭后, 剩余的数据读完时返回 io.EOF.
+// Reads the data written by the peer. Once the peer has closed, io.EOF is returned after the remaining data is read.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	header := c.rx.header
+	err := c.rx.await(&header.dataSeq, &header.dataWaiters, c.option.SpinCount, c.rx.readable, func() (time.Duration, error) {
+		if c.isClosed() {
+			return 0, net.ErrClosed
+		}
+		if c.peerClosed() {
+			return 0, io.EOF
+		}
+		return c.timeout(&c.readDeadline)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return c.rx.read(p), nil
+}
+
+// Write 写入全部数据, 缓冲区满时等待对端读取
+// Writes all the data, waiting for the peer to read whenever the buffer is full
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	header := c.tx.header
+	total := 0
+	for total < len(p) {
+		if c.peerClosed() {
+			return total, io.ErrClosedPipe
+		}
+		err := c.tx.await(&header.spaceSeq, &header.spaceWaiters, c.option.SpinCount, c.tx.writable, func() (time.Duration, error) {
+			if c.isClosed() {
+				return 0, net.ErrClosed
+			}
+			if c.peerClosed() {
+				return 0, io.ErrClosedPipe
+			}
+			return c.timeout(&c.writeDeadline)
+		})
+		if err != nil {
+			return total, err
+		}
+		total += c.tx.write(p[total:])
+	}
+	return total, nil
+}
+
+// Close 通知对端并解除映射, 创建者同时删除文件
+// Notifies the peer and unmaps the file, the creator also removes the file
+func (c *Conn) Close() error {
+	var err error
+	c.once.Do(func() {
+		atomic.StoreUint32(&c.closed, 1)
+		atomic.StoreUint32(&c.header.closed[c.side], 1)
+		c.rx.notify()
+		c.tx.notify()
+
+		// 等待进行中的读写退出, 之后才能解除映射
+		// Wait for the reads and writes in progress to leave before unmapping
+		c.rmu.Lock()
+		c.wmu.Lock()
+		c.mu.Lock()
+		err = syscall.Munmap(c.mem)
+		c.mu.Unlock()
+		c.wmu.Unlock()
+		c.rmu.Unlock()
+		if c.side == 0 {
+			_ = os.Remove(c.path)
+		}
+	})
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr { return Addr(c.path) }
+
+func (c *Conn) RemoteAddr() net.Addr { return Addr(c.path) }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(&c.readDeadline, t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(&c.writeDeadline, t)
+	return nil
+}
+
+// 修改超时并唤醒正在等待的读写
+// Updates the deadline and wakes up the reads and writes waiting
+func (c *Conn) setDeadline(deadline *int64, t time.Time) {
+	var d int64
+	if !t.IsZero() {
+		d = t.UnixNano()
+	}
+	atomic.StoreInt64(deadline, d)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.isClosed() {
+		c.rx.notify()
+		c.tx.notify()
+	}
+}
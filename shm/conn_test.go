@@ -0,0 +1,184 @@
+//go:build unix
+
+package shm
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs"
+	"github.com/catermujo/gbs/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func newPair(t *testing.T, option *Option) (*Conn, *Conn) {
+	path := filepath.Join(t.TempDir(), "ring")
+	server, err := Create(path, option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Open(path, option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return server, client
+}
+
+func TestConn(t *testing.T) {
+	as := assert.New(t)
+	server, client := newPair(t, &Option{Size: 4096})
+
+	// 负载远大于缓冲区, 双向同时传输
+	// Payloads far larger than the buffer, sent both ways at once
+	for _, pair := range [][2]*Conn{{client, server}, {server, client}} {
+		writer, reader := pair[0], pair[1]
+		payload := internal.AlphabetNumeric.Generate(1024 * 1024)
+		go func() {
+			n, err := writer.Write(payload)
+			as.NoError(err)
+			as.Equal(len(payload), n)
+		}()
+		received := make([]byte, len(payload))
+		_, err := io.ReadFull(reader, received)
+		as.NoError(err)
+		as.True(bytes.Equal(payload, received))
+	}
+	as.Equal("shm", server.LocalAddr().Network())
+	as.Equal(server.LocalAddr().String(), client.RemoteAddr().String())
+}
+
+func TestConn_Close(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("peer", func(t *testing.T) {
+		server, client := newPair(t, nil)
+		_, err := client.Write([]byte("bye"))
+		as.NoError(err)
+		as.NoError(client.Close())
+
+		// 对端关闭前写入的数据仍然可读
+		// Data written before the peer closed is still readable
+		b, err := io.ReadAll(server)
+		as.NoError(err)
+		as.Equal("bye", string(b))
+		_, err = server.Write([]byte("hello"))
+		as.ErrorIs(err, io.ErrClosedPipe)
+	})
+
+	t.Run("local", func(t *testing.T) {
+		server, client := newPair(t, nil)
+		ch := make(chan error)
+		go func() {
+			_, err := server.Read(make([]byte, 8))
+			ch <- err
+		}()
+		time.Sleep(20 * time.Millisecond)
+		as.NoError(server.Close())
+		as.ErrorIs(<-ch, net.ErrClosed)
+		_, err := server.Write([]byte("hello"))
+		as.ErrorIs(err, net.ErrClosed)
+
+		// 创建者关闭后文件被删除
+		// The file is removed once the creator closes
+		_, err = os.Stat(server.path)
+		as.True(os.IsNotExist(err))
+		_, err = client.Read(make([]byte, 8))
+		as.ErrorIs(err, io.EOF)
+	})
+}
+
+func TestConn_Deadline(t *testing.T) {
+	as := assert.New(t)
+	server, client := newPair(t, &Option{Size: 4096})
+
+	as.NoError(server.SetReadDeadline(time.Now().Add(50 * time.Millisecond)))
+	_, err := server.Read(make([]byte, 8))
+	as.ErrorIs(err, os.ErrDeadlineExceeded)
+
+	as.NoError(client.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)))
+	n, err := client.Write(make([]byte, 8192))
+	as.ErrorIs(err, os.ErrDeadlineExceeded)
+	as.Equal(4096, n)
+
+	as.NoError(server.SetReadDeadline(time.Time{}))
+	n, err = server.Read(make([]byte, 8192))
+	as.NoError(err)
+	as.Equal(4096, n)
+}
+
+func TestOpen(t *testing.T) {
+	as := assert.New(t)
+	path := filepath.Join(t.TempDir(), "ring")
+	server, err := Create(path, nil)
+	if !as.NoError(err) {
+		return
+	}
+	defer server.Close()
+
+	_, err = Create(path, nil)
+	as.Error(err)
+
+	client, err := Open(path, nil)
+	if !as.NoError(err) {
+		return
+	}
+	defer client.Close()
+	_, err = Open(path, nil)
+	as.ErrorIs(err, ErrAttached)
+
+	invalid := filepath.Join(t.TempDir(), "invalid")
+	as.NoError(os.WriteFile(invalid, make([]byte, 4096), 0600))
+	_, err = Open(invalid, nil)
+	as.ErrorIs(err, ErrInvalidFile)
+}
+
+func TestConn_Native(t *testing.T) {
+	as := assert.New(t)
+	server, client := newPair(t, nil)
+
+	serverHandler := &echoHandler{}
+	upgrader := gbs.NewUpgrader(serverHandler, &gbs.ServerOption{NativeEnabled: true})
+	go func() {
+		socket, err := upgrader.UpgradeNative(server, bufio.NewReader(server))
+		if err == nil {
+			socket.ReadLoop()
+		}
+	}()
+
+	clientHandler := &echoHandler{messages: make(chan string, 1)}
+	socket, _, err := gbs.NewClientFromConn(clientHandler, &gbs.ClientOption{NativeEnabled: true}, client)
+	if !as.NoError(err) {
+		return
+	}
+	go socket.ReadLoop()
+	for _, n := range []int{0, 125, 65536, 1024 * 1024} {
+		payload := string(internal.AlphabetNumeric.Generate(n))
+		as.NoError(socket.WriteString(payload))
+		as.Equal(payload, <-clientHandler.messages)
+	}
+	_ = socket.WriteClose(1000, nil)
+}
+
+type echoHandler struct {
+	gbs.BuiltinEventHandler
+	messages chan string
+}
+
+func (c *echoHandler) OnMessage(socket *gbs.Conn, message *gbs.Message) {
+	defer message.Close()
+	if c.messages != nil {
+		c.messages <- message.Data.String()
+		return
+	}
+	_ = socket.WriteMessage(message.Opcode, message.Bytes())
+}
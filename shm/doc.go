@@ -0,0 +1,16 @@
+// Package shm 在同一台机器的进程之间, 通过内存映射的环形缓冲区文件 (通常位于 /dev/shm) 传输字节流.
+// 文件中每个方向各有一个单生产者单消费者的环形队列, 读写双方先自旋等待, 再通过 futex (Linux) 休眠和唤醒,
+// 不经过网络协议栈. Conn 实现了 net.Conn, gbs 的连接可以直接运行在上面, 推荐使用原生模式.
+// Package shm carries a byte stream between processes on the same host through a memory-mapped ring buffer file,
+// usually under /dev/shm. The file holds a single-producer/single-consumer ring for each direction;
+// readers and writers spin first, then sleep and wake up through futexes (on Linux), bypassing the network stack.
+// Conn implements net.Conn, so a gbs connection runs on top of it unchanged, preferably in native mode.
+//
+//	conn, _ := shm.Create("/dev/shm/engine", nil)
+//	socket, _ := gbs.NewUpgrader(handler, &gbs.ServerOption{NativeEnabled: true}).UpgradeNative(conn, bufio.NewReader(conn))
+//	go socket.ReadLoop()
+//
+//	conn, _ := shm.Open("/dev/shm/engine", nil)
+//	socket, _, _ := gbs.NewClientFromConn(handler, &gbs.ClientOption{NativeEnabled: true}, conn)
+//	go socket.ReadLoop()
+package shm
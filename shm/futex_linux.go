@@ -0,0 +1,25 @@
+package shm
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	futexWait = 0
+	futexWake = 1
+)
+
+// 在 addr 的值仍为 val 时休眠, 最长 timeout. 共享映射上不能使用 FUTEX_PRIVATE_FLAG.
+// Sleeps while the value at addr is still val, for at most timeout. FUTEX_PRIVATE_FLAG must not be used on shared mappings.
+func sleep(addr *uint32, val uint32, timeout time.Duration) {
+	ts := syscall.NsecToTimespec(int64(timeout))
+	_, _, _ = syscall.Syscall6(syscall.SYS_FUTEX, uintptr(unsafe.Pointer(addr)), futexWait, uintptr(val), uintptr(unsafe.Pointer(&ts)), 0, 0)
+}
+
+// 唤醒所有在 addr 上休眠的线程
+// Wakes up every thread sleeping on addr
+func wake(addr *uint32) {
+	_, _, _ = syscall.Syscall6(syscall.SYS_FUTEX, uintptr(unsafe.Pointer(addr)), futexWake, uintptr(^uint32(0)>>1), 0, 0, 0)
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package shm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// 没有 futex 的平台上退化为短暂的轮询休眠
+// Falls back to short polling sleeps on platforms without futexes
+const pollInterval = 50 * time.Microsecond
+
+func sleep(addr *uint32, val uint32, timeout time.Duration) {
+	for deadline := time.Now().Add(timeout); atomic.LoadUint32(addr) == val && time.Now().Before(deadline); {
+		time.Sleep(pollInterval)
+	}
+}
+
+func wake(addr *uint32) {}
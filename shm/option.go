@@ -0,0 +1,62 @@
+package shm
+
+import (
+	"os"
+	"time"
+
+	"github.com/catermujo/gbs/internal"
+)
+
+const (
+	// 默认的单个方向的环形缓冲区容量
+	// Default capacity of the ring buffer of each direction
+	defaultSize = 1024 * 1024
+
+	// 默认的自旋次数
+	// Default number of spins
+	defaultSpinCount = 1000
+
+	// 默认的文件权限
+	// Default file permissions
+	defaultMode os.FileMode = 0600
+
+	// 单次休眠的最长时间, 保证关闭和超时的变化最终会被注意到
+	// Longest single sleep, making sure changes of the closed state and deadlines are eventually noticed
+	maxSleep = 100 * time.Millisecond
+)
+
+// Option 共享内存传输配置
+// Shared memory transport configurations
+type Option struct {
+	// 单个方向的环形缓冲区容量, 向上取整为 2 的幂. 默认为 1MB.
+	// Capacity of the ring buffer of each direction, rounded up to a power of two. Defaults to 1MB.
+	Size int
+
+	// 休眠之前检查环形缓冲区的次数. 越大延迟越低, 但空闲时占用的 CPU 越多. 默认为 1000.
+	// Number of times the ring is checked before going to sleep.
+	// Larger values lower the latency but burn more CPU while idle. Defaults to 1000.
+	SpinCount int
+
+	// Create 创建的文件的权限, 默认为 0600
+	// Permissions of the file created by Create, defaults to 0600
+	Mode os.FileMode
+}
+
+// 初始化配置
+// Initialize configurations
+func initOption(c *Option) *Option {
+	if c == nil {
+		c = new(Option)
+	}
+	if c.Size <= 0 {
+		c.Size = defaultSize
+	}
+	c.Size = internal.ToBinaryNumber(c.Size)
+	if c.SpinCount <= 0 {
+		c.SpinCount = defaultSpinCount
+	}
+	if c.Mode == 0 {
+		c.Mode = defaultMode
+	}
+	return c
+}
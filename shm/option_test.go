@@ -0,0 +1,18 @@
+package shm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitOption(t *testing.T) {
+	as := assert.New(t)
+	option := initOption(nil)
+	as.Equal(defaultSize, option.Size)
+	as.Equal(defaultSpinCount, option.SpinCount)
+	as.Equal(defaultMode, option.Mode)
+
+	option = initOption(&Option{Size: 5000})
+	as.Equal(8192, option.Size)
+}
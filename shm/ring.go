@@ -0,0 +1,143 @@
+package shm
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// 环形队列的控制块, 生产者和消费者修改的字段各自独占缓存行
+// Control block of a ring. The fields written by the producer and by the consumer sit on separate cache lines.
+type ringHeader struct {
+	// 消费者的读位置
+	// Read position of the consumer
+	head uint64
+	_    [56]byte
+
+	// 生产者的写位置
+	// Write position of the producer
+	tail uint64
+	_    [56]byte
+
+	// 每次写入后递增, 消费者在上面休眠
+	// Incremented after every write, the consumer sleeps on it
+	dataSeq     uint32
+	dataWaiters uint32
+	_           [56]byte
+
+	// 每次读取后递增, 生产者在上面休眠
+	// Incremented after every read, the producer sleeps on it
+	spaceSeq     uint32
+	spaceWaiters uint32
+	_            [56]byte
+}
+
+// 控制块在文件中占用的长度
+// Length taken by a control block in the file
+const ringHeaderSize = 256
+
+// 单生产者单消费者的字节环形队列, 控制块和数据都位于共享内存中
+// Single-producer/single-consumer byte ring, whose control block and data both live in shared memory
+type ring struct {
+	header *ringHeader
+	data   []byte
+	mask   uint64
+}
+
+func newRing(header []byte, data []byte) *ring {
+	return &ring{
+		header: (*ringHeader)(unsafe.Pointer(&header[0])),
+		data:   data,
+		mask:   uint64(len(data) - 1),
+	}
+}
+
+// 写入尽可能多的字节, 返回写入的长度
+// Writes as many bytes as fit, returns the number written
+func (c *ring) write(p []byte) int {
+	head := atomic.LoadUint64(&c.header.head)
+	tail := atomic.LoadUint64(&c.header.tail)
+	n := uint64(len(c.data)) - (tail - head)
+	if n == 0 {
+		return 0
+	}
+	if n > uint64(len(p)) {
+		n = uint64(len(p))
+	}
+	offset := tail & c.mask
+	m := copy(c.data[offset:], p[:n])
+	copy(c.data, p[m:n])
+	atomic.StoreUint64(&c.header.tail, tail+n)
+
+	atomic.AddUint32(&c.header.dataSeq, 1)
+	if atomic.LoadUint32(&c.header.dataWaiters) > 0 {
+		wake(&c.header.dataSeq)
+	}
+	return int(n)
+}
+
+// 读取尽可能多的字节, 返回读取的长度
+// Reads as many bytes as available, returns the number read
+func (c *ring) read(p []byte) int {
+	head := atomic.LoadUint64(&c.header.head)
+	tail := atomic.LoadUint64(&c.header.tail)
+	n := tail - head
+	if n == 0 {
+		return 0
+	}
+	if n > uint64(len(p)) {
+		n = uint64(len(p))
+	}
+	offset := head & c.mask
+	m := copy(p[:n], c.data[offset:])
+	copy(p[m:n], c.data)
+	atomic.StoreUint64(&c.header.head, head+n)
+
+	atomic.AddUint32(&c.header.spaceSeq, 1)
+	if atomic.LoadUint32(&c.header.spaceWaiters) > 0 {
+		wake(&c.header.spaceSeq)
+	}
+	return int(n)
+}
+
+func (c *ring) readable() bool {
+	return atomic.LoadUint64(&c.header.tail) != atomic.LoadUint64(&c.header.head)
+}
+
+func (c *ring) writable() bool {
+	return atomic.LoadUint64(&c.header.tail)-atomic.LoadUint64(&c.header.head) < uint64(len(c.data))
+}
+
+// 唤醒在 seq 上休眠的一方, 用于关闭和修改超时
+// Wakes up whoever sleeps on seq, used on close and when deadlines change
+func (c *ring) notify() {
+	atomic.AddUint32(&c.header.dataSeq, 1)
+	wake(&c.header.dataSeq)
+	atomic.AddUint32(&c.header.spaceSeq, 1)
+	wake(&c.header.spaceSeq)
+}
+
+// 等待 ready 成立: 先自旋, 然后在 seq 上休眠, 直到 ready 成立, stop 返回错误或者超过 timeout
+// Waits until ready holds: spins first, then sleeps on seq until ready holds, stop returns an error or timeout passes
+func (c *ring) await(seq, waiters *uint32, spinCount int, ready func() bool, stop func() (time.Duration, error)) error {
+	for i := 0; i < spinCount; i++ {
+		if ready() {
+			return nil
+		}
+	}
+	for {
+		val := atomic.LoadUint32(seq)
+		if ready() {
+			return nil
+		}
+		timeout, err := stop()
+		if err != nil {
+			return err
+		}
+		atomic.AddUint32(waiters, 1)
+		if !ready() {
+			sleep(seq, val, timeout)
+		}
+		atomic.AddUint32(waiters, ^uint32(0))
+	}
+}
@@ -148,7 +148,7 @@ func TestConn_WriteAsync(t *testing.T) {
 
 		{
 			fh := frameHeader{}
-			n, _ := fh.GenerateHeader(true, true, OpcodeText, 0)
+			n, _ := fh.GenerateHeader(true, true, false, OpcodeText, 0)
 			go func() { client.conn.Write(fh[:n]) }()
 		}
 
@@ -0,0 +1,207 @@
+package gbs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/catermujo/gbs/internal"
+)
+
+// ThrottlePolicy 超出发送限流时的处理策略
+// Policy for messages over the outgoing rate limit
+type ThrottlePolicy uint8
+
+const (
+	// ThrottleDelay 等待令牌足够之后再写入, 调用方因此被阻塞. WriteAsync 和广播在发送队列中等待,
+	// 排在后面的任务 (包括 Async 提交的任务) 也随之停顿.
+	// Waits until enough tokens are available before writing, which blocks the caller.
+	// WriteAsync and broadcasts wait inside the send queue, stalling every job queued behind them, Async jobs included.
+	ThrottleDelay ThrottlePolicy = iota
+
+	// ThrottleReject 丢弃消息并返回 ErrThrottled, 连接保持打开
+	// Drops the message and returns ErrThrottled, the connection stays open
+	ThrottleReject
+
+	// ThrottleClose 丢弃消息, 以 1008 (ClosePolicyViolation) 关闭连接并返回 ErrThrottled
+	// Drops the message, closes the connection with 1008 (ClosePolicyViolation) and returns ErrThrottled
+	ThrottleClose
+)
+
+// ThrottleStats 连接的限流计数
+// Throttling counts of a connection
+type ThrottleStats struct {
+	// Number of messages written after a delay
+	Delayed uint64
+
+	// Number of messages dropped under ThrottleReject or ThrottleClose
+	Rejected uint64
+}
+
+// 令牌桶, 以 rate 每秒的速度补充令牌, 最多存放 burst 个
+// Token bucket refilled at rate tokens per second, holding at most burst tokens
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// 速率为 0 时不限制, 返回 nil
+// Returns nil for a zero rate, meaning unlimited
+func newTokenBucket(rate, burst int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (c *tokenBucket) refill(now time.Time) {
+	if c == nil {
+		return
+	}
+	if elapsed := now.Sub(c.last); elapsed > 0 {
+		c.tokens += elapsed.Seconds() * c.rate
+		if c.tokens > c.burst {
+			c.tokens = c.burst
+		}
+		c.last = now
+	}
+}
+
+// 取得 n 个令牌需要等待的时间
+// Time to wait until n tokens are available
+func (c *tokenBucket) wait(n float64) time.Duration {
+	if c == nil || c.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - c.tokens) / c.rate * float64(time.Second))
+}
+
+// 取走 n 个令牌, 可以透支, 透支的部分由之后的调用等待补齐
+// Takes n tokens, possibly going into debt, which later calls wait to pay off
+func (c *tokenBucket) take(n float64) {
+	if c != nil {
+		c.tokens -= n
+	}
+}
+
+// 连接的限流器
+// Rate limiter of a connection
+type throttler struct {
+	option   Throttle
+	mu       sync.Mutex
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func newThrottler(option Throttle, now time.Time) *throttler {
+	option.initialize()
+	return &throttler{
+		option:   option,
+		messages: newTokenBucket(option.MessagesPerSecond, option.MessageBurst, now),
+		bytes:    newTokenBucket(option.BytesPerSecond, option.ByteBurst, now),
+	}
+}
+
+// 为 n 条共 size 字节的消息预留令牌, 返回需要等待的时间. 需要等待且策略不是 ThrottleDelay 时不预留, 返回 false.
+// Reserves tokens for n messages of size bytes in total and returns the time to wait.
+// When a wait is needed and the policy is not ThrottleDelay, nothing is reserved and false is returned.
+func (c *throttler) reserve(n, size int, now time.Time) (time.Duration, bool) {
+	if c.messages == nil && c.bytes == nil {
+		return 0, true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages.refill(now)
+	c.bytes.refill(now)
+	d := c.messages.wait(float64(n))
+	if w := c.bytes.wait(float64(size)); w > d {
+		d = w
+	}
+	if d > 0 && c.option.Policy != ThrottleDelay {
+		return d, false
+	}
+	c.messages.take(float64(n))
+	c.bytes.take(float64(size))
+	return d, true
+}
+
+// SetThrottle 调整连接的发送限流, 替换 ServerOption.Throttle 或 ClientOption.Throttle 的设置, 两个速率都为 0 时取消限流.
+// 令牌桶从满额开始, 计数不受影响.
+// Adjusts the outgoing throttling of the connection, replacing the setting of ServerOption.Throttle or
+// ClientOption.Throttle; zero for both rates turns throttling off. The token buckets start full, and the counts are kept.
+func (c *Conn) SetThrottle(t Throttle) {
+	c.throttler.Store(newThrottler(t, time.Now()))
+}
+
+// ThrottleStats 返回连接的限流计数
+// Returns the throttling counts of the connection
+func (c *Conn) ThrottleStats() ThrottleStats {
+	return ThrottleStats{Delayed: c.throttleStats.delayed.Load(), Rejected: c.throttleStats.rejected.Load()}
+}
+
+// 限流 n 条共 size 字节的数据消息. ThrottleDelay 策略下等待, 其他策略下超出限流时返回 ErrThrottled.
+// 在获取写锁之前调用, 等待不会阻塞控制帧.
+// Throttles n data messages of size bytes in total. Waits under ThrottleDelay;
+// the other policies return ErrThrottled when over the limit.
+// Called before the write locks are taken, so waiting does not hold up control frames.
+// Closed connections are not throttled, the write itself reports the error.
+func (c *Conn) throttle(n, size int) error {
+	if n == 0 || c.IsClosed() {
+		return nil
+	}
+	t := c.loadThrottler()
+	if t == nil {
+		return nil
+	}
+
+	d, ok := t.reserve(n, size, time.Now())
+	if ok {
+		if d > 0 {
+			c.throttleStats.delayed.Add(uint64(n))
+			time.Sleep(d)
+		}
+		return nil
+	}
+
+	c.throttleStats.rejected.Add(uint64(n))
+	if t.option.Policy == ThrottleClose {
+		_ = c.WriteClose(uint16(internal.ClosePolicyViolation), []byte(ErrThrottled.Error()))
+	}
+	return ErrThrottled
+}
+
+// 广播的限流检查. ThrottleDelay 之外的策略在加入发送队列之前预留令牌, 超出限流时返回 ErrThrottled;
+// ThrottleDelay 策略返回 true, 由发送任务调用 throttle 等待.
+// Throttle check of a broadcast. Policies other than ThrottleDelay reserve tokens before the job is queued and
+// return ErrThrottled when over the limit; ThrottleDelay returns true, leaving the wait to the job through throttle.
+func (c *Conn) throttleBroadcast(size int) (bool, error) {
+	if c.IsClosed() {
+		return false, nil
+	}
+	if t := c.loadThrottler(); t == nil || t.option.Policy == ThrottleDelay {
+		return t != nil, nil
+	}
+	return false, c.throttle(1, size)
+}
+
+// 取得连接的限流器, 首次使用时按配置创建; 没有限流时返回 nil
+// Gets the rate limiter of the connection, created from the config on first use; nil when not throttled
+func (c *Conn) loadThrottler() *throttler {
+	if t := c.throttler.Load(); t != nil {
+		return t
+	}
+	if !c.config.Throttle.enabled() {
+		return nil
+	}
+	c.throttler.CompareAndSwap(nil, newThrottler(c.config.Throttle, time.Now()))
+	return c.throttler.Load()
+}
+
+// 连接的限流计数
+// Throttling counts of a connection
+type throttleCounter struct {
+	delayed  atomic.Uint64
+	rejected atomic.Uint64
+}
@@ -0,0 +1,184 @@
+package gbs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	as := assert.New(t)
+	now := time.Now()
+	as.Nil(newTokenBucket(0, 10, now))
+
+	bucket := newTokenBucket(10, 5, now)
+	as.Equal(time.Duration(0), bucket.wait(5))
+	bucket.take(5)
+	as.Equal(100*time.Millisecond, bucket.wait(1))
+
+	bucket.refill(now.Add(200 * time.Millisecond))
+	as.Equal(time.Duration(0), bucket.wait(2))
+	as.Equal(100*time.Millisecond, bucket.wait(3))
+
+	// 令牌不超过 burst
+	// Tokens never exceed burst
+	bucket.refill(now.Add(time.Hour))
+	as.Equal(5.0, bucket.tokens)
+
+	// 透支之后需要等待补齐
+	// A debt has to be paid off before the next take
+	bucket.take(7)
+	as.Equal(300*time.Millisecond, bucket.wait(1))
+}
+
+func TestThrottler_Reserve(t *testing.T) {
+	as := assert.New(t)
+	now := time.Now()
+
+	t.Run("unlimited", func(t *testing.T) {
+		c := newThrottler(Throttle{}, now)
+		d, ok := c.reserve(100, 1<<20, now)
+		as.True(ok)
+		as.Equal(time.Duration(0), d)
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		c := newThrottler(Throttle{MessagesPerSecond: 10, BytesPerSecond: 100}, now)
+		as.Equal(10, c.option.MessageBurst)
+		as.Equal(100, c.option.ByteBurst)
+
+		d, ok := c.reserve(1, 100, now)
+		as.True(ok)
+		as.Equal(time.Duration(0), d)
+
+		// 字节数是更紧的限制
+		// Bytes are the tighter limit
+		d, ok = c.reserve(1, 50, now)
+		as.True(ok)
+		as.Equal(500*time.Millisecond, d)
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		c := newThrottler(Throttle{MessagesPerSecond: 2, Policy: ThrottleReject}, now)
+		_, ok := c.reserve(2, 0, now)
+		as.True(ok)
+		_, ok = c.reserve(1, 0, now)
+		as.False(ok)
+
+		// 被拒绝的消息不消耗令牌
+		// Refused messages consume no tokens
+		_, ok = c.reserve(1, 0, now.Add(500*time.Millisecond))
+		as.True(ok)
+	})
+}
+
+func TestConn_Throttle(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("delay", func(t *testing.T) {
+		clientHandler := new(webSocketMocker)
+		messages := make(chan string, 8)
+		clientHandler.onMessage = func(socket *Conn, message *Message) { messages <- message.Data.String() }
+		server, client, err := newHandshakePeer(new(webSocketMocker), &ServerOption{
+			Throttle: Throttle{MessagesPerSecond: 20, MessageBurst: 1},
+		}, clientHandler, nil)
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		start := time.Now()
+		as.NoError(server.WriteString("a"))
+		as.NoError(server.WriteString("b"))
+		as.NoError(server.WriteString("c"))
+		as.GreaterOrEqual(time.Since(start), 90*time.Millisecond)
+		for _, expected := range []string{"a", "b", "c"} {
+			as.Equal(expected, <-messages)
+		}
+
+		// 广播在发送队列中等待
+		// Broadcasts wait inside the send queue
+		broadcaster := NewBroadcaster(OpcodeText, []byte("d"))
+		as.NoError(broadcaster.Broadcast(server))
+		_ = broadcaster.Close()
+		as.Equal("d", <-messages)
+
+		// 控制帧不受限制
+		// Control frames are not throttled
+		as.NoError(server.WritePing(nil))
+		as.Equal(ThrottleStats{Delayed: 3}, server.ThrottleStats())
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		clientHandler := new(webSocketMocker)
+		messages := make(chan string, 8)
+		clientHandler.onMessage = func(socket *Conn, message *Message) { messages <- message.Data.String() }
+		server, client, err := newHandshakePeer(new(webSocketMocker), &ServerOption{
+			Throttle: Throttle{BytesPerSecond: 4, Policy: ThrottleReject},
+		}, clientHandler, nil)
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(server.WriteString("abc"))
+		as.ErrorIs(server.WriteString("de"), ErrThrottled)
+		as.ErrorIs(server.WriteBatch(
+			BatchMessage{Opcode: OpcodeText, Payload: []byte("f")},
+			BatchMessage{Opcode: OpcodeText, Payload: []byte("g")},
+		), ErrThrottled)
+		as.NoError(server.WriteString("h"))
+
+		var callback = make(chan error, 1)
+		server.WriteAsync(OpcodeText, []byte("i"), func(err error) { callback <- err })
+		as.ErrorIs(<-callback, ErrThrottled)
+
+		broadcaster := NewBroadcaster(OpcodeText, []byte("j"))
+		as.ErrorIs(broadcaster.Broadcast(server), ErrThrottled)
+		_ = broadcaster.Close()
+
+		as.False(server.IsClosed())
+		as.Equal("abc", <-messages)
+		as.Equal("h", <-messages)
+		as.Equal(ThrottleStats{Rejected: 5}, server.ThrottleStats())
+
+		// 单独调整连接的限流
+		// Throttling adjusted per connection
+		server.SetThrottle(Throttle{})
+		as.NoError(server.WriteString("k"))
+		as.Equal("k", <-messages)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		clientHandler := new(webSocketMocker)
+		closed := make(chan error, 1)
+		clientHandler.onClose = func(socket *Conn, err error) { closed <- err }
+		server, client, err := newHandshakePeer(new(webSocketMocker), nil, clientHandler, nil)
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		server.SetThrottle(Throttle{MessagesPerSecond: 1, Policy: ThrottleClose})
+		as.NoError(server.WriteString("a"))
+		as.ErrorIs(server.WriteString("b"), ErrThrottled)
+		as.True(server.IsClosed())
+		as.Equal(ThrottleStats{Rejected: 1}, server.ThrottleStats())
+
+		select {
+		case err := <-closed:
+			var closeErr *CloseError
+			if as.True(errors.As(err, &closeErr)) {
+				as.Equal(uint16(internal.ClosePolicyViolation), closeErr.Code)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	})
+}
@@ -0,0 +1,27 @@
+// Package topic 基于 Broadcaster 实现快照加增量的主题, 例如订单簿: 订阅者先收到一份一致的快照, 然后只收到比快照更新的增量.
+// 快照由用户的回调提供, 并给出它包含的最后一个增量的序列号; 获取快照期间到达的增量在订阅者的队列中排队,
+// 快照发出之后再补发其中比快照更新的部分, 所以中间既不会丢失也不会重复.
+// 负载由用户编码, 主题不会在其中加入序列号.
+// Package topic implements snapshot-plus-delta topics on top of Broadcaster, e.g. for an order book:
+// subscribers first get a consistent snapshot, then only the deltas newer than it.
+// The snapshot comes from a user callback along with the sequence number of the last delta it includes;
+// deltas arriving while the snapshot is taken queue up per subscriber, and those newer than the snapshot
+// follow it once it is sent, so nothing is lost or duplicated in between.
+// Payloads are encoded by the user, the topic adds no sequence number to them.
+//
+//	book := topic.NewTopic(func() (uint64, []byte, error) {
+//		return orderBook.Snapshot()
+//	}, nil)
+//
+//	func (c *Handler) OnOpen(socket *gbs.Conn) {
+//		if err := book.Subscribe(socket); err != nil {
+//			_ = socket.WriteClose(1011, nil)
+//		}
+//	}
+//
+//	func (c *Handler) OnClose(socket *gbs.Conn, err error) {
+//		book.Unsubscribe(socket)
+//	}
+//
+//	_ = book.Publish(seq, delta)
+package topic
@@ -0,0 +1,34 @@
+package topic
+
+import "github.com/catermujo/gbs"
+
+// 默认的订阅者队列长度, 单位为增量
+// Default subscriber queue size, in deltas
+const defaultQueueSize = 4096
+
+// Option 主题配置
+// Topic configurations
+type Option struct {
+	// Opcode of the snapshot and the deltas, defaults to OpcodeBinary
+	Opcode gbs.Opcode
+
+	// 获取快照期间每个订阅者最多排队的增量数, 超出时订阅失败, 默认为 4096
+	// Maximum number of deltas queued per subscriber while its snapshot is taken;
+	// the subscription fails beyond it. Defaults to 4096.
+	QueueSize int
+}
+
+// 初始化配置
+// Initialize the options
+func initOption(c *Option) *Option {
+	if c == nil {
+		c = new(Option)
+	}
+	if c.Opcode == 0 {
+		c.Opcode = gbs.OpcodeBinary
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaultQueueSize
+	}
+	return c
+}
@@ -0,0 +1,19 @@
+package topic
+
+import (
+	"testing"
+
+	"github.com/catermujo/gbs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitOption(t *testing.T) {
+	as := assert.New(t)
+	option := initOption(nil)
+	as.Equal(gbs.OpcodeBinary, option.Opcode)
+	as.Equal(defaultQueueSize, option.QueueSize)
+
+	option = initOption(&Option{Opcode: gbs.OpcodeText, QueueSize: 8})
+	as.Equal(gbs.OpcodeText, option.Opcode)
+	as.Equal(8, option.QueueSize)
+}
@@ -0,0 +1,167 @@
+package topic
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/catermujo/gbs"
+)
+
+var (
+	// ErrSubscribed 连接已经订阅了该主题
+	// The connection already subscribes to the topic
+	ErrSubscribed = errors.New("topic: already subscribed")
+
+	// ErrQueueOverflow 获取快照期间排队的增量超过了 Option.QueueSize
+	// More deltas than Option.QueueSize were queued while the snapshot was taken
+	ErrQueueOverflow = errors.New("topic: subscriber queue overflow")
+
+	// ErrOutOfOrder 增量的序列号没有大于上一个增量
+	// The sequence number of the delta is not greater than that of the previous one
+	ErrOutOfOrder = errors.New("topic: delta out of order")
+)
+
+// Snapshot 返回当前的快照及其包含的最后一个增量的序列号
+// Returns the current snapshot and the sequence number of the last delta it includes
+type Snapshot func() (seq uint64, payload []byte, err error)
+
+// Topic 快照加增量的主题. 订阅者先收到一份完整的快照, 然后只收到比快照更新的增量, 中间不会丢失或者重复.
+// 增量通过 Broadcaster 发送, 每个增量只编码和压缩一次.
+// A snapshot-plus-delta topic. Subscribers first get a complete snapshot and then only the deltas newer than it,
+// with nothing lost or duplicated in between.
+// Deltas are sent through a Broadcaster, so each of them is encoded and compressed once.
+type Topic struct {
+	option      *Option
+	snapshot    Snapshot
+	mu          sync.Mutex
+	seq         uint64
+	subscribers map[*gbs.Conn]*subscriber
+}
+
+// 订阅者. 获取快照期间 pending 为 true, 期间的增量进入队列.
+// A subscriber. pending is true while its snapshot is taken, and the deltas of that time go to the queue.
+type subscriber struct {
+	pending  bool
+	overflow bool
+	queue    []delta
+}
+
+type delta struct {
+	seq     uint64
+	payload []byte
+}
+
+// NewTopic 创建主题, option 可以为 nil
+// Creates a topic, option may be nil
+func NewTopic(snapshot Snapshot, option *Option) *Topic {
+	return &Topic{
+		option:      initOption(option),
+		snapshot:    snapshot,
+		subscribers: make(map[*gbs.Conn]*subscriber),
+	}
+}
+
+// Subscribe 订阅主题: 取得快照后发送快照, 然后发送获取快照期间到达的, 比快照更新的增量.
+// 快照在调用的协程中获取, 消息通过连接的发送队列异步写入, 与之后广播的增量保持顺序.
+// Subscribes to the topic: takes the snapshot and sends it,
+// then the deltas that arrived meanwhile and are newer than the snapshot.
+// The snapshot is taken on the calling goroutine, and messages are written asynchronously through the send queue
+// of the connection, in order with the deltas broadcast later.
+func (c *Topic) Subscribe(socket *gbs.Conn) error {
+	c.mu.Lock()
+	if _, ok := c.subscribers[socket]; ok {
+		c.mu.Unlock()
+		return ErrSubscribed
+	}
+	sub := &subscriber{pending: true}
+	c.subscribers[socket] = sub
+	c.mu.Unlock()
+
+	// 先登记再获取快照, 快照之后的增量一定会进入队列
+	// Registered before the snapshot is taken, so every delta after the snapshot is sure to be queued
+	seq, payload, err := c.snapshot()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil && sub.overflow {
+		err = ErrQueueOverflow
+	}
+	if err != nil {
+		if c.subscribers[socket] == sub {
+			delete(c.subscribers, socket)
+		}
+		return err
+	}
+	if c.subscribers[socket] != sub {
+		return nil
+	}
+
+	socket.WriteAsync(c.option.Opcode, payload, nil)
+	for _, item := range sub.queue {
+		if item.seq > seq {
+			socket.WriteAsync(c.option.Opcode, item.payload, nil)
+		}
+	}
+	sub.pending, sub.queue = false, nil
+	return nil
+}
+
+// Unsubscribe 取消订阅
+// Unsubscribes
+func (c *Topic) Unsubscribe(socket *gbs.Conn) {
+	c.mu.Lock()
+	delete(c.subscribers, socket)
+	c.mu.Unlock()
+}
+
+// Publish 发布增量, 序列号必须大于上一个增量 (初始为 0). payload 会被复制, 返回后即可修改.
+// 已经关闭的连接会被移出订阅者.
+// Publishes a delta whose sequence number must be greater than the previous one (initially 0).
+// The payload is copied, so it may be modified once Publish returns.
+// Closed connections are dropped from the subscribers.
+func (c *Topic) Publish(seq uint64, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq <= c.seq {
+		return ErrOutOfOrder
+	}
+	c.seq = seq
+
+	// 广播和排队的增量都可能在 Publish 返回后才写入, 共用一份副本
+	// Both the broadcast and the queued deltas may be written after Publish returns, so they share a copy
+	if len(c.subscribers) > 0 {
+		payload = append([]byte{}, payload...)
+	}
+	var broadcaster = gbs.NewBroadcaster(c.option.Opcode, payload)
+	defer broadcaster.Close()
+	for socket, sub := range c.subscribers {
+		switch {
+		case socket.IsClosed():
+			delete(c.subscribers, socket)
+		case !sub.pending:
+			_ = broadcaster.Broadcast(socket)
+		case sub.overflow:
+		case len(sub.queue) < c.option.QueueSize:
+			sub.queue = append(sub.queue, delta{seq: seq, payload: payload})
+		default:
+			sub.overflow, sub.queue = true, nil
+		}
+	}
+	return nil
+}
+
+// Seq 最后发布的增量的序列号
+// Sequence number of the last published delta
+func (c *Topic) Seq() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seq
+}
+
+// Len 订阅者数量, 包括正在获取快照的订阅者
+// Number of subscribers, including those whose snapshot is being taken
+func (c *Topic) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.subscribers)
+}
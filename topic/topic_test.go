@@ -0,0 +1,181 @@
+package topic
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/catermujo/gbs"
+	"github.com/catermujo/gbs/gbstest"
+	"github.com/stretchr/testify/assert"
+)
+
+// 建立一对连接, 返回服务端连接和客户端的记录器
+// Builds a connection pair, returns the server connection and the recorder of the client
+func newPair(t *testing.T) (*gbs.Conn, *gbstest.Recorder) {
+	recorder := new(gbstest.Recorder)
+	server, client, err := gbstest.Pipe(new(gbstest.Recorder), recorder, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ReadLoop()
+	go client.ReadLoop()
+	t.Cleanup(func() { _ = client.WriteClose(1000, nil) })
+	return server, recorder
+}
+
+func payloads(messages []gbstest.Event) []string {
+	var list []string
+	for _, item := range messages {
+		list = append(list, string(item.Payload))
+	}
+	return list
+}
+
+func TestTopic(t *testing.T) {
+	as := assert.New(t)
+
+	// 获取快照期间发布 2 和 3, 快照只包含 2
+	// 2 and 3 are published while the snapshot is taken, and the snapshot only includes 2
+	var topic *Topic
+	started, release := make(chan struct{}), make(chan struct{})
+	topic = NewTopic(func() (uint64, []byte, error) {
+		close(started)
+		<-release
+		return 2, []byte("snapshot@2"), nil
+	}, &Option{Opcode: gbs.OpcodeText})
+	as.NoError(topic.Publish(1, []byte("delta1")))
+
+	server, recorder := newPair(t)
+	done := make(chan error, 1)
+	go func() { done <- topic.Subscribe(server) }()
+	<-started
+	as.NoError(topic.Publish(2, []byte("delta2")))
+	as.NoError(topic.Publish(3, []byte("delta3")))
+	close(release)
+	as.NoError(<-done)
+	as.NoError(topic.Publish(4, []byte("delta4")))
+
+	messages, err := recorder.WaitMessages(3, time.Second)
+	if !as.NoError(err) {
+		return
+	}
+	as.Equal([]string{"snapshot@2", "delta3", "delta4"}, payloads(messages))
+	as.Equal(gbs.OpcodeText, messages[0].Opcode)
+	as.Equal(uint64(4), topic.Seq())
+	as.Equal(1, topic.Len())
+
+	as.ErrorIs(topic.Subscribe(server), ErrSubscribed)
+	as.ErrorIs(topic.Publish(4, nil), ErrOutOfOrder)
+
+	topic.Unsubscribe(server)
+	as.Zero(topic.Len())
+	as.NoError(topic.Publish(5, []byte("delta5")))
+	time.Sleep(50 * time.Millisecond)
+	as.Len(recorder.Messages(), 3)
+}
+
+func TestTopic_Reuse(t *testing.T) {
+	as := assert.New(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	topic := NewTopic(func() (uint64, []byte, error) {
+		close(started)
+		<-release
+		return 0, []byte("snapshot"), nil
+	}, nil)
+
+	// 发布之后立即复用缓冲区, 排队的增量不受影响
+	// The buffer is reused right after publishing, which leaves the queued deltas intact
+	server, recorder := newPair(t)
+	done := make(chan error, 1)
+	go func() { done <- topic.Subscribe(server) }()
+	<-started
+	buf := []byte("delta1")
+	as.NoError(topic.Publish(1, buf))
+	copy(buf, "delta2")
+	as.NoError(topic.Publish(2, buf))
+	copy(buf, "------")
+	close(release)
+	as.NoError(<-done)
+
+	messages, err := recorder.WaitMessages(3, time.Second)
+	if as.NoError(err) {
+		as.Equal([]string{"snapshot", "delta1", "delta2"}, payloads(messages))
+	}
+}
+
+func TestTopic_Broadcast(t *testing.T) {
+	as := assert.New(t)
+	var seq uint64
+	topic := NewTopic(func() (uint64, []byte, error) {
+		return seq, []byte("snapshot"), nil
+	}, nil)
+
+	var recorders []*gbstest.Recorder
+	for i := 0; i < 3; i++ {
+		server, recorder := newPair(t)
+		as.NoError(topic.Subscribe(server))
+		recorders = append(recorders, recorder)
+	}
+	var expected = []string{"snapshot"}
+	for seq = 1; seq <= 10; seq++ {
+		payload := strconv.Itoa(int(seq))
+		as.NoError(topic.Publish(seq, []byte(payload)))
+		expected = append(expected, payload)
+	}
+	for _, recorder := range recorders {
+		messages, err := recorder.WaitMessages(len(expected), time.Second)
+		if as.NoError(err) {
+			as.Equal(expected, payloads(messages))
+		}
+	}
+}
+
+func TestTopic_Errors(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("snapshot", func(t *testing.T) {
+		failure := errors.New("not ready")
+		topic := NewTopic(func() (uint64, []byte, error) { return 0, nil, failure }, nil)
+		server, _ := newPair(t)
+		as.ErrorIs(topic.Subscribe(server), failure)
+		as.Zero(topic.Len())
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		var topic *Topic
+		topic = NewTopic(func() (uint64, []byte, error) {
+			for seq := uint64(1); seq <= 3; seq++ {
+				_ = topic.Publish(seq, nil)
+			}
+			return 0, nil, nil
+		}, &Option{QueueSize: 2})
+		server, _ := newPair(t)
+		as.ErrorIs(topic.Subscribe(server), ErrQueueOverflow)
+		as.Zero(topic.Len())
+	})
+
+	t.Run("unsubscribed", func(t *testing.T) {
+		var topic *Topic
+		server, recorder := newPair(t)
+		topic = NewTopic(func() (uint64, []byte, error) {
+			topic.Unsubscribe(server)
+			return 0, []byte("snapshot"), nil
+		}, nil)
+		as.NoError(topic.Subscribe(server))
+		as.Zero(topic.Len())
+		time.Sleep(50 * time.Millisecond)
+		as.Empty(recorder.Messages())
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		topic := NewTopic(func() (uint64, []byte, error) { return 0, nil, nil }, nil)
+		server, _ := newPair(t)
+		as.NoError(topic.Subscribe(server))
+		_ = server.NetConn().Close()
+		as.Eventually(func() bool { return server.IsClosed() }, time.Second, 10*time.Millisecond)
+		as.NoError(topic.Publish(1, nil))
+		as.Zero(topic.Len())
+	})
+}
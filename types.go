@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"runtime"
 	"unsafe"
@@ -48,6 +49,52 @@ func (c *CloseError) Error() string {
 	return fmt.Sprintf("gbs: connection closed, code=%d, reason=%s", c.Code, string(c.Reason))
 }
 
+// BatchMessage 批量写入的一条消息
+// A message of a batch write
+type BatchMessage struct {
+	// Payload of the message
+	Payload []byte
+
+	// Opcode of the message
+	Opcode Opcode
+}
+
+// BatchError 批量写入中部分消息未能编码, 其余消息已经写入
+// Some messages of a batch write could not be encoded, the others have been written
+type BatchError struct {
+	// Errors 与消息一一对应, 写入成功的消息对应 nil
+	// One entry per message, nil for the messages that were written
+	Errors []error
+}
+
+// Error 批量写入错误的描述
+// Returns a description of the batch error
+func (c *BatchError) Error() string {
+	var n int
+	var first error
+	for _, err := range c.Errors {
+		if err != nil {
+			if n == 0 {
+				first = err
+			}
+			n++
+		}
+	}
+	return fmt.Sprintf("gbs: %d of %d messages failed, first error: %v", n, len(c.Errors), first)
+}
+
+// Unwrap 返回所有失败消息的错误, 以便使用 errors.Is 判断
+// Returns the errors of the failed messages, for use with errors.Is
+func (c *BatchError) Unwrap() []error {
+	var errs []error
+	for _, err := range c.Errors {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
 var (
 	errEmpty = errors.New("")
 
@@ -78,6 +125,26 @@ var (
 	// ErrUnsupportedProtocol 不支持的网络协议
 	// Unsupported network protocols
 	ErrUnsupportedProtocol = errors.New("unsupported protocol")
+
+	// ErrWriterClosed 流式写入器已关闭
+	// Streaming writer closed
+	ErrWriterClosed = errors.New("writer closed")
+
+	// ErrUnsupportedVersion 对端不支持原生模式的协议版本
+	// The peer does not support the protocol version of native mode
+	ErrUnsupportedVersion = errors.New("unsupported version")
+
+	// ErrProxyConnect 代理拒绝建立隧道
+	// The proxy refused to open the tunnel
+	ErrProxyConnect = errors.New("proxy connect failed")
+
+	// ErrThrottled 消息超出了连接的发送限流, 参见 Throttle
+	// The message exceeds the outgoing rate limit of the connection, see Throttle
+	ErrThrottled = errors.New("message throttled")
+
+	// ErrFragmented 数据报模式不支持分片的消息
+	// Fragmented messages are not supported in datagram mode
+	ErrFragmented = errors.New("fragmented messages are not supported in datagram mode")
 )
 
 type EventHandler interface {
@@ -106,6 +173,21 @@ type EventHandler interface {
 	OnMessage(socket *Conn, message *Message)
 }
 
+// StreamEventHandler 可选的流式事件接口
+// 如果 EventHandler 同时实现了该接口, ReadLoop 通过 OnStream 以流的形式分发数据消息, 不再调用 OnMessage.
+// reader 只在回调期间有效, 未读完的数据会被丢弃; OnStream 总是在读协程中串行调用, 不受 ParallelEnabled 影响.
+// Optional streaming event.
+// If the EventHandler implements it too, ReadLoop dispatches data messages as streams through OnStream instead of OnMessage.
+// reader is only valid during the callback, unread data is discarded; OnStream is always called serially
+// from the reading goroutine, regardless of ParallelEnabled.
+type StreamEventHandler interface {
+	EventHandler
+
+	// OnStream 流式消息事件
+	// Streaming message event
+	OnStream(socket *Conn, opcode Opcode, reader io.Reader)
+}
+
 type BuiltinEventHandler struct{}
 
 func (b BuiltinEventHandler) OnOpen(socket *Conn) {}
@@ -144,6 +226,18 @@ func (c *frameHeader) GetRSV3() bool {
 	return ((*c)[0] << 3 >> 7) == 1
 }
 
+// GetRSV 返回所有保留位
+// Returns all the reserved bits
+func (c *frameHeader) GetRSV() RSV {
+	return RSV((*c)[0]) & rsvMask
+}
+
+// SetRSV 设置保留位
+// Sets the reserved bits
+func (c *frameHeader) SetRSV(rsv RSV) {
+	(*c)[0] |= uint8(rsv & rsvMask)
+}
+
 // GetOpcode 返回操作码
 // Returns the opcode
 func (c *frameHeader) GetOpcode() Opcode {
@@ -195,12 +289,15 @@ func (c *frameHeader) SetMaskKey(offset int, key [4]byte) {
 // Generates a frame header
 // 可以考虑每个客户端连接带一个随机数发生器
 // Consider having a random number generator for each client connection
-func (c *frameHeader) GenerateHeader(isServer bool, fin bool, opcode Opcode, length int) (headerLength int, maskBytes []byte) {
+func (c *frameHeader) GenerateHeader(isServer bool, fin bool, compress bool, opcode Opcode, length int) (headerLength int, maskBytes []byte) {
 	headerLength = 2
 	b0 := uint8(opcode)
 	if fin {
 		b0 += 128
 	}
+	if compress {
+		b0 += 64
+	}
 	(*c)[0] = b0
 	headerLength += c.SetLength(uint64(length))
 
@@ -255,12 +352,55 @@ func (c *frameHeader) GetMaskKey() []byte {
 	return (*c)[10:14]
 }
 
+// GenerateNativeHeader 生成原生模式的帧头: 首字节与 WebSocket 相同, 随后是 uvarint 编码的负载长度, 没有掩码
+// Generates a native mode frame header: the first byte matches WebSocket, followed by the uvarint encoded
+// payload length, without a mask
+func (c *frameHeader) GenerateNativeHeader(fin bool, compress bool, opcode Opcode, length int) int {
+	b0 := uint8(opcode)
+	if fin {
+		b0 += 128
+	}
+	if compress {
+		b0 += 64
+	}
+	(*c)[0] = b0
+	return 1 + binary.PutUvarint((*c)[1:], uint64(length))
+}
+
+// ParseNative 解析原生模式的帧头, 最多11字节, 返回payload长度
+// 长度同时按照 WebSocket 的格式写入帧头, 使控制帧的长度校验保持一致
+// Parses a native mode frame header, up to 11 bytes, and returns the payload length.
+// The length is also stored in the WebSocket layout, so that control frames are validated the same way
+func (c *frameHeader) ParseNative(reader io.ByteReader) (int, error) {
+	b0, err := reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt {
+		return 0, internal.CloseMessageTooLarge
+	}
+	*c = frameHeader{}
+	(*c)[0] = b0
+	c.SetLength(n)
+	return int(n), nil
+}
+
 type Message struct {
 	// content of the message
 	Data *bytes.Buffer
 
+	// buffer that borrows the payload from the read buffer in zero-copy mode
+	buf bytes.Buffer
+
 	// opcode of the message
 	Opcode Opcode
+
+	// whether Data borrows memory from the read buffer
+	borrowed bool
 }
 
 // Read 从消息中读取数据到给定的字节切片 p 中
@@ -278,11 +418,31 @@ func (c *Message) Bytes() []byte {
 // Close 关闭消息, 回收资源
 // Close message, recycling resources
 func (c *Message) Close() error {
-	binaryPool.Put(c.Data)
+	if !c.borrowed {
+		binaryPool.Put(c.Data)
+	}
 	c.Data = nil
+	c.borrowed = false
 	return nil
 }
 
+// 引用 p 作为消息的负载, 不拷贝
+// Borrows p as the payload of the message, without a copy
+func (c *Message) borrow(p []byte) {
+	c.buf = *bytes.NewBuffer(p)
+	c.Data = &c.buf
+	c.borrowed = true
+}
+
+// 回收消息, 以便复用
+// Recycles the message for reuse
+func (c *Message) recycle() {
+	_ = c.Close()
+	c.buf = bytes.Buffer{}
+	c.Opcode = 0
+	messagePool.Put(c)
+}
+
 type continuationFrame struct {
 	// The buffer for the frame data
 	buffer *bytes.Buffer
@@ -292,12 +452,16 @@ type continuationFrame struct {
 
 	// Indicates if the frame is initialized
 	initialized bool
+
+	// Reserved bits of the first frame
+	rsv RSV
 }
 
 // 重置延续帧的状态
 // Resets the state of the continuation frame
 func (c *continuationFrame) reset() {
 	c.initialized = false
+	c.rsv = 0
 	c.opcode = 0
 	c.buffer = nil
 }
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -75,6 +76,24 @@ func (c *responseWriter) WithSubProtocol(requestHeader http.Header, expectedSubP
 	}
 }
 
+// WithExtensions 写入协商成功的拓展
+// Writes the negotiated extensions
+func (c *responseWriter) WithExtensions(pd PermessageDeflate, list *extensionList) {
+	if extensions := extensionResponse(pd, list); extensions != "" {
+		c.WithHeader(internal.SecWebSocketExtensions.Key, extensions)
+	}
+}
+
+// 生成 Sec-WebSocket-Extensions 响应头, 压缩拓展排在最前
+// Generates the Sec-WebSocket-Extensions response header, with the compression extension first
+func extensionResponse(pd PermessageDeflate, list *extensionList) string {
+	extensions := list.response
+	if pd.Enabled {
+		extensions = append([]string{pd.genResponseHeader()}, extensions...)
+	}
+	return strings.Join(extensions, ", ")
+}
+
 // Write 将缓冲区内容写入连接，并设置超时
 // Writes the buffer content to the connection and sets the timeout
 func (c *responseWriter) Write(conn net.Conn, timeout time.Duration) error {
@@ -122,9 +141,17 @@ func (c *Upgrader) hijack(w http.ResponseWriter) (net.Conn, *bufio.Reader, error
 	return netConn, br, nil
 }
 
-// Upgrade 升级 HTTP 连接到 WebSocket 连接
-// Upgrades the HTTP connection to a WebSocket connection
+// Upgrade 升级 HTTP 连接到 WebSocket 连接.
+// HTTP/2 的扩展 CONNECT 请求 (RFC 8441) 不需要劫持连接, WebSocket 运行在请求所在的流上,
+// 此时处理函数返回就会结束流, 必须在处理函数中调用 ReadLoop. 标准库的 HTTP/2 服务器需要 GODEBUG=http2xconnect=1 才接受扩展 CONNECT.
+// Upgrades the HTTP connection to a WebSocket connection.
+// HTTP/2 extended CONNECT requests (RFC 8441) need no hijacking and the WebSocket runs over the stream of the request;
+// the stream ends as soon as the handler returns, so ReadLoop must be called within the handler.
+// The HTTP/2 server of the standard library only accepts extended CONNECT with GODEBUG=http2xconnect=1.
 func (c *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if isExtendedConnect(r) {
+		return c.upgradeHTTP2(w, r)
+	}
 	netConn, br, err := c.hijack(w)
 	if err != nil {
 		return nil, err
@@ -193,6 +220,10 @@ func (c *Upgrader) doUpgradeFromConn(netConn net.Conn, br *bufio.Reader, r *http
 	}
 	rw.WithHeader(internal.SecWebSocketAccept.Key, internal.ComputeAcceptKey(websocketKey))
 	rw.WithSubProtocol(r.Header, c.option.SubProtocols)
+	extensions := r.Header.Get(internal.SecWebSocketExtensions.Key)
+	pd := c.getPermessageDeflate(extensions)
+	list := acceptExtensions(c.option.Extensions, extensions, internal.SelectValue(pd.Enabled, RSV1, 0))
+	rw.WithExtensions(pd, list)
 	rw.WithExtraHeader(c.option.ResponseHeader)
 	if err := rw.Write(netConn, c.option.HandshakeTimeout); err != nil {
 		return nil, err
@@ -213,10 +244,42 @@ func (c *Upgrader) doUpgradeFromConn(netConn net.Conn, br *bufio.Reader, r *http
 		writeQueue:        workerQueue{maxConcurrency: 1},
 		readQueue:         make(channel, c.option.ParallelGolimit),
 	}
+	if pd.Enabled {
+		socket.initPermessageDeflate(pd, config.deflaterPool.Select())
+	}
+	socket.initExtensions(list)
 
 	return socket, nil
 }
 
+// 根据客户端的提议协商压缩参数
+// Negotiates the compression parameters from the client's offer
+func (c *Upgrader) getPermessageDeflate(extensions string) PermessageDeflate {
+	serverPD := c.option.PermessageDeflate
+	offer, ok := permessageOffer(extensions)
+	if !serverPD.Enabled || !ok {
+		return PermessageDeflate{}
+	}
+
+	// 客户端没有提议 client_max_window_bits 时, 服务端不能限制客户端的滑动窗口
+	// The server must not limit the client's window unless the client offered client_max_window_bits
+	clientPD := permessageNegotiation(offer)
+	clientMaxWindowBits := 15
+	if strings.Contains(offer, internal.ClientMaxWindowBits) {
+		clientMaxWindowBits = internal.Min(clientPD.ClientMaxWindowBits, serverPD.ClientMaxWindowBits)
+	}
+	return PermessageDeflate{
+		Enabled:               true,
+		Level:                 serverPD.Level,
+		Threshold:             serverPD.Threshold,
+		PoolSize:              serverPD.PoolSize,
+		ServerContextTakeover: clientPD.ServerContextTakeover && serverPD.ServerContextTakeover,
+		ClientContextTakeover: clientPD.ClientContextTakeover && serverPD.ClientContextTakeover,
+		ServerMaxWindowBits:   internal.Min(clientPD.ServerMaxWindowBits, serverPD.ServerMaxWindowBits),
+		ClientMaxWindowBits:   clientMaxWindowBits,
+	}
+}
+
 // Server WebSocket服务器
 // Websocket server
 type Server struct {
@@ -270,8 +333,11 @@ func (c *Server) Run(addr string) error {
 	return c.RunListener(listener)
 }
 
-// RunTLS 启动支持 TLS 的 WebSocket 服务器，监听指定地址
-// Starts the WebSocket server with TLS support and listens on the specified address
+// RunTLS 启动支持 TLS 的 WebSocket 服务器，监听指定地址.
+// RunListener 自己解析 HTTP/1.1 的升级请求, 所以这里只通过 ALPN 协商 http/1.1; 需要 HTTP/2 扩展 CONNECT 时使用 RunHTTP2.
+// Starts the WebSocket server with TLS support and listens on the specified address.
+// RunListener parses HTTP/1.1 upgrade requests by itself, so only http/1.1 is negotiated through ALPN;
+// use RunHTTP2 for HTTP/2 extended CONNECT.
 func (c *Server) RunTLS(addr string, certFile, keyFile string) error {
 	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
@@ -292,6 +358,88 @@ func (c *Server) RunTLS(addr string, certFile, keyFile string) error {
 	return c.RunListener(tls.NewListener(listener, config))
 }
 
+// RunHTTP2 通过标准库的 net/http 启动支持 TLS 的 WebSocket 服务器, 通过 ALPN 同时提供 h2 和 http/1.1:
+// HTTP/2 客户端使用扩展 CONNECT (RFC 8441), HTTP/1.1 客户端照常升级. 原生模式和 OnRequest 不会生效.
+// 标准库的 HTTP/2 服务器需要 GODEBUG=http2xconnect=1 才会在 SETTINGS 中开启 SETTINGS_ENABLE_CONNECT_PROTOCOL.
+// Starts the WebSocket server with TLS support through net/http of the standard library, offering both h2 and
+// http/1.1 through ALPN: HTTP/2 clients use extended CONNECT (RFC 8441) and HTTP/1.1 clients upgrade as usual.
+// Native mode and OnRequest do not apply.
+// The HTTP/2 server of the standard library only enables SETTINGS_ENABLE_CONNECT_PROTOCOL with GODEBUG=http2xconnect=1.
+func (c *Server) RunHTTP2(addr string, certFile, keyFile string) error {
+	return c.newHTTPServer(addr).ListenAndServeTLS(certFile, keyFile)
+}
+
+// 创建以 Server 为处理函数, 通过 ALPN 提供 h2 和 http/1.1 的 HTTP 服务器
+// Creates an HTTP server handled by the Server, offering h2 and http/1.1 through ALPN
+func (c *Server) newHTTPServer(addr string) *http.Server {
+	var config = &tls.Config{}
+	if c.option.TlsConfig != nil {
+		config = c.option.TlsConfig.Clone()
+	}
+	config.NextProtos = []string{"h2", "http/1.1"}
+	return &http.Server{Addr: addr, Handler: c, TLSConfig: config}
+}
+
+// ServeHTTP 实现 http.Handler, 升级请求并在处理函数中运行 ReadLoop. 同时支持 HTTP/1.1 升级和 HTTP/2 扩展 CONNECT.
+// 升级失败时以 nil 连接调用 OnError.
+// Implements http.Handler, upgrading the request and running ReadLoop within the handler.
+// Both HTTP/1.1 upgrades and HTTP/2 extended CONNECT are supported. OnError gets a nil conn when the upgrade fails.
+func (c *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	socket, err := c.GetUpgrader().Upgrade(w, r)
+	if err != nil {
+		c.OnError(nil, err)
+		return
+	}
+	socket.ReadLoop()
+}
+
+// RunUnix 启动 WebSocket 服务器, 监听指定的 Unix 域套接字. 以 @ 开头的路径属于抽象命名空间, 不会创建文件.
+// 已有的套接字文件如果无人监听, 会被当作残留删除; 监听器关闭时套接字文件随之删除.
+// Starts the WebSocket server and listens on the specified Unix domain socket.
+// Paths starting with @ belong to the abstract namespace and create no file.
+// An existing socket file that nobody listens on is removed as stale; the socket file is removed when the listener closes.
+func (c *Server) RunUnix(path string) error {
+	abstract := strings.HasPrefix(path, "@")
+	if !abstract {
+		removeStaleSocket(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if !abstract && c.option.UnixSocketMode != 0 {
+		if err := os.Chmod(path, c.option.UnixSocketMode); err != nil {
+			_ = listener.Close()
+			return err
+		}
+	}
+	return c.RunListener(listener)
+}
+
+// 删除无人监听的套接字文件, 其它类型的文件保持不变
+// Removes a socket file nobody listens on, leaving files of other types untouched
+func removeStaleSocket(path string) {
+	if info, err := os.Lstat(path); err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return
+	}
+	_ = os.Remove(path)
+}
+
+// 处理原生模式的连接
+// Serves a native mode connection
+func (c *Server) serveNative(conn net.Conn, br *bufio.Reader) {
+	socket, err := c.GetUpgrader().UpgradeNative(conn, br)
+	if err != nil {
+		c.OnError(conn, err)
+	} else {
+		socket.ReadLoop()
+	}
+}
+
 // RunListener 使用指定的监听器运行 WebSocket 服务器
 // Runs the WebSocket server using the specified listener
 func (c *Server) RunListener(listener net.Listener) error {
@@ -307,6 +455,10 @@ func (c *Server) RunListener(listener net.Listener) error {
 		go func(conn net.Conn) {
 			br := c.option.config.brPool.Get()
 			br.Reset(conn)
+			if c.option.NativeEnabled && isNativeHello(br) {
+				c.serveNative(conn, br)
+				return
+			}
 			if r, err := http.ReadRequest(br); err != nil {
 				c.OnError(conn, err)
 			} else {
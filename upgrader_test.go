@@ -11,6 +11,8 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -270,7 +272,8 @@ func TestNewServer(t *testing.T) {
 		server := NewServer(new(BuiltinEventHandler), &ServerOption{})
 		dir := os.Getenv("PWD")
 		go server.RunTLS(addr, dir+"/examples/wss/cert/server.crt", dir+"/examples/wss/cert/server.pem")
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 		<-ctx.Done()
 	})
 
@@ -417,3 +420,86 @@ func TestServer_RunListener(t *testing.T) {
 	}()
 	time.Sleep(time.Microsecond)
 }
+
+func TestServer_RunUnix(t *testing.T) {
+	as := assert.New(t)
+	var paths = make(chan string, 1)
+	newUnixServer := func() *Server {
+		return NewServer(new(BuiltinEventHandler), &ServerOption{
+			UnixSocketMode: 0600,
+			Authorize: func(r *http.Request, session SessionStorage) bool {
+				paths <- r.URL.RequestURI()
+				return true
+			},
+		})
+	}
+	waitUnix := func(path string) {
+		for i := 0; i < 100; i++ {
+			if conn, err := net.Dial("unix", path); err == nil {
+				_ = conn.Close()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "gbs.sock")
+		go newUnixServer().RunUnix(path)
+		waitUnix(path)
+
+		info, err := os.Stat(path)
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(os.FileMode(0600), info.Mode().Perm())
+
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws+unix://" + path + ":/connect?id=1"})
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal("/connect?id=1", <-paths)
+		as.NoError(client.WriteString("hello"))
+		_ = client.WriteClose(1000, nil)
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "gbs.sock")
+		listener, err := net.Listen("unix", path)
+		if !as.NoError(err) {
+			return
+		}
+		listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		_ = listener.Close()
+
+		go newUnixServer().RunUnix(path)
+		waitUnix(path)
+		_, _, err = NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws+unix://" + path})
+		as.NoError(err)
+		as.Equal("/", <-paths)
+
+		// 正在使用的套接字不会被删除
+		// A socket in use is not removed
+		as.Error(newUnixServer().RunUnix(path))
+	})
+
+	t.Run("not socket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "gbs.sock")
+		as.NoError(os.WriteFile(path, nil, 0600))
+		as.Error(newUnixServer().RunUnix(path))
+		_, err := os.Stat(path)
+		as.NoError(err)
+	})
+
+	t.Run("abstract", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("abstract namespace sockets are linux only")
+		}
+		path := "@gbs-" + nextPort()
+		go newUnixServer().RunUnix(path)
+		waitUnix(path)
+		_, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws+unix://" + path + ":/abstract"})
+		as.NoError(err)
+		as.Equal("/abstract", <-paths)
+	})
+}
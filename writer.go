@@ -2,19 +2,32 @@ package gbs
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"math"
+	"net"
 	"sync"
 	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/catermujo/gbs/internal"
 )
 
 // WriteClose 发送关闭帧并断开连接
 // 没有特殊需求的话, 推荐code=1000, reason=nil
+// 如果设置了 CloseTimeout, 会在后台等待对端的关闭帧, 收到或者超时后再断开连接.
 // Send shutdown frame, active disconnection
 // If you don't have any special needs, we recommend code=1000, reason=nil
+// If CloseTimeout is set, the connection is dropped in the background once the peer's close frame arrives or the timeout expires.
 // https://developer.mozilla.org/zh-CN/docs/Web/API/CloseEvent#status_codes
 func (c *Conn) WriteClose(code uint16, reason []byte) error {
+	if c.config.CloseTimeout > 0 {
+		return c.startClose(code, reason, c.config.CloseTimeout)
+	}
 	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
 		buf := binaryPool.Get(128)
 		code = internal.SelectValue(code < 1000, 1000, code)
@@ -27,16 +40,84 @@ func (c *Conn) WriteClose(code uint16, reason []byte) error {
 	return ErrConnClosed
 }
 
+// CloseContext 执行关闭握手: 发送关闭帧, 等待对端的关闭帧之后断开连接.
+// 对端的关闭帧由读协程(例如 ReadLoop)处理, 所以不要在读协程的回调中调用, 否则只能等到 ctx 结束.
+// ctx 结束时直接断开连接并返回 ctx.Err().
+// Performs the closing handshake: sends a close frame and drops the connection once the peer's close frame arrives.
+// The peer's close frame is handled by the reading goroutine (e.g. ReadLoop), so do not call it from callbacks
+// running on that goroutine, or it can only wait for ctx to end.
+// When ctx ends, the connection is dropped and ctx.Err() is returned.
+func (c *Conn) CloseContext(ctx context.Context, code uint16, reason []byte) error {
+	if err := c.startClose(code, reason, 0); err != nil {
+		return err
+	}
+	select {
+	case <-c.closing.Load().done:
+		return nil
+	case <-ctx.Done():
+		c.finishClose()
+		return ctx.Err()
+	}
+}
+
+// 关闭握手
+// Closing handshake
+type closeHandshake struct {
+	done chan struct{}
+	once sync.Once
+}
+
+// 发起关闭握手, timeout 大于 0 时超时后自动断开连接
+// Starts the closing handshake, the connection is dropped after timeout if it is positive
+func (c *Conn) startClose(code uint16, reason []byte, timeout time.Duration) error {
+	if !atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		return ErrConnClosed
+	}
+	c.closing.Store(&closeHandshake{done: make(chan struct{})})
+
+	buf := binaryPool.Get(128)
+	code = internal.SelectValue(code < 1000, 1000, code)
+	buf.Write(internal.StatusCode(code).Bytes())
+	buf.Write(reason)
+	err := c.sendClose(internal.StatusCode(code), buf.Bytes())
+	binaryPool.Put(buf)
+	if err != nil {
+		c.finishClose()
+		return err
+	}
+	if timeout > 0 {
+		time.AfterFunc(timeout, c.finishClose)
+	}
+	return nil
+}
+
+// 结束关闭握手, 断开连接
+// Finishes the closing handshake and drops the connection
+func (c *Conn) finishClose() {
+	if h := c.closing.Load(); h != nil {
+		h.once.Do(func() {
+			_ = c.conn.Close()
+			close(h.done)
+		})
+	}
+}
+
 // 关闭连接并存储错误信息
 // Closes the connection and stores the error information
 func (c *Conn) writeClose(ev error, reason []byte) error {
+	err := c.sendClose(ev, reason)
+	_ = c.conn.Close()
+	return err
+}
+
+// 发送关闭帧并存储错误信息
+// Sends the close frame and stores the error information
+func (c *Conn) sendClose(ev error, reason []byte) error {
 	if len(reason) > internal.ThresholdV1 {
 		reason = reason[:internal.ThresholdV1]
 	}
 	c.ev.Store(ev)
-	err := c.doWrite(OpcodeCloseConnection, internal.Bytes(reason))
-	_ = c.conn.Close()
-	return err
+	return c.doWrite(OpcodeCloseConnection, internal.Bytes(reason))
 }
 
 // WritePing
@@ -64,11 +145,112 @@ func (c *Conn) WriteString(s string) error {
 // 写入文本/二进制消息, 文本消息应该使用UTF8编码
 // Writes text/binary messages, text messages should be encoded in UTF8.
 func (c *Conn) WriteMessage(opcode Opcode, payload []byte) error {
+	if opcode.isDataFrame() {
+		if err := c.throttle(1, len(payload)); err != nil {
+			return err
+		}
+	}
 	err := c.doWrite(opcode, internal.Bytes(payload))
 	c.emitError(false, err)
 	return err
 }
 
+// WriteBatch 批量写入
+// 将多条消息编码到同一个缓冲区, 只用一次系统调用写入. 每条消息单独检查 WriteMaxPayloadSize 和文本编码,
+// 未通过检查的消息会被跳过, 并通过 *BatchError 报告; 网络错误等整体性的错误直接返回.
+// Encodes several messages into one buffer and writes them with a single syscall.
+// Every message is checked against WriteMaxPayloadSize and the text encoding on its own;
+// the messages that fail are skipped and reported through *BatchError, while errors that affect
+// the whole batch, such as network errors, are returned as is.
+// 压缩或者拓展编码失败时, 连接的压缩上下文和拓展的状态已经改变, 之后的帧对端无法解码,
+// 因此整批放弃, 连接随之关闭, 与 WriteMessage 的处理一致.
+// A failure to compress or to encode through an extension has already moved the compression context and
+// the extension state on, so the frames after it could not be decoded by the peer;
+// the batch is then given up as a whole and the connection closed, the same as WriteMessage does.
+// 发送限流以整批计算, 超出限流时整批被拒绝.
+// Throttling counts the batch as a whole, which is refused as a whole when over the limit.
+func (c *Conn) WriteBatch(messages ...BatchMessage) error {
+	var n, size = 0, 0
+	for _, item := range messages {
+		if item.Opcode.isDataFrame() {
+			n, size = n+1, size+len(item.Payload)
+		}
+	}
+	if err := c.throttle(n, size); err != nil {
+		return err
+	}
+	errs, err := c.doWriteBatch(messages)
+	c.emitError(false, err)
+	if err != nil {
+		return err
+	}
+	if errs != nil {
+		return &BatchError{Errors: errs}
+	}
+	return nil
+}
+
+// 执行批量写入, 返回每条消息的错误和整体的错误
+// Executes the batch write, returns the error of every message and the error of the whole batch
+func (c *Conn) doWriteBatch(messages []BatchMessage) ([]error, error) {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.IsClosed() {
+		return nil, ErrConnClosed
+	}
+
+	var errs []error
+	var size = 0
+	for i := range messages {
+		size += len(messages[i].Payload) + frameHeaderSize
+	}
+	buf := binaryPool.Get(size)
+	defer binaryPool.Put(buf)
+
+	for i, item := range messages {
+		if item.Opcode == OpcodeCloseConnection {
+			errs = c.batchError(errs, len(messages), i, fmt.Errorf("gbs: unexpected opcode %d", item.Opcode))
+			continue
+		}
+		err := c.encodeFrame(buf, item.Opcode, internal.Bytes(item.Payload), frameConfig{
+			fin:           true,
+			compress:      c.pd.Enabled,
+			broadcast:     false,
+			checkEncoding: c.config.CheckUtf8Enabled,
+		})
+		if errors.Is(err, ErrTextEncoding) || errors.Is(err, ErrMessageTooLarge) {
+			errs = c.batchError(errs, len(messages), i, err)
+		} else if err != nil {
+			return errs, err
+		}
+	}
+	if buf.Len() == 0 {
+		return errs, nil
+	}
+	if err := internal.WriteN(c.conn, buf.Bytes()); err != nil {
+		return errs, err
+	}
+	for i, item := range messages {
+		if item.Opcode.isDataFrame() && (errs == nil || errs[i] == nil) {
+			c.record(false, item.Opcode, internal.Bytes(item.Payload))
+		}
+	}
+	return errs, nil
+}
+
+// 记录批量写入中第 i 条消息的错误
+// Records the error of the i-th message of a batch write
+func (c *Conn) batchError(errs []error, n, i int, err error) []error {
+	if errs == nil {
+		errs = make([]error, n)
+	}
+	errs[i] = err
+	return errs
+}
+
 // WriteAsync 异步写
 // Writes messages asynchronously
 // 异步非阻塞地将消息写入到任务队列, 收到回调后才允许回收payload内存
@@ -86,6 +268,11 @@ func (c *Conn) WriteAsync(opcode Opcode, payload []byte, callback func(error)) {
 // 类似 WriteMessage, 区别是可以一次写入多个切片
 // Writev is similar to WriteMessage, except that you can write multiple slices at once.
 func (c *Conn) Writev(opcode Opcode, payloads ...[]byte) error {
+	if opcode.isDataFrame() {
+		if err := c.throttle(1, internal.Buffers(payloads).Len()); err != nil {
+			return err
+		}
+	}
 	err := c.doWrite(opcode, internal.Buffers(payloads))
 	c.emitError(false, err)
 	return err
@@ -113,6 +300,12 @@ func (c *Conn) Async(f func()) {
 // 执行写入逻辑, 注意妥善维护压缩字典
 // Executes the write logic, ensuring proper maintenance of the compression dictionary
 func (c *Conn) doWrite(opcode Opcode, payload internal.Payload) error {
+	// 控制帧可以插入到分片消息的帧之间, 数据帧必须等待流式写入结束
+	// Control frames may be injected between the fragments of a message, data frames must wait for the streaming writer to finish
+	if opcode.isDataFrame() {
+		c.dmu.Lock()
+		defer c.dmu.Unlock()
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -124,8 +317,22 @@ func (c *Conn) doWrite(opcode Opcode, payload internal.Payload) error {
 	// 为了使上下文接管模式正常工作, 压缩, 写入和更新字典三个操作的上下文必须保持同步
 	// Generate frames, write to the connection, and update the compression dictionary
 	// For context_takeover mode to work correctly, the contexts of compression, writing, and dictionary updating must be synchronized.
+	if c.vectored(opcode, payload.Len()) {
+		header, err := c.genHeader(opcode, payload, c.config.CheckUtf8Enabled)
+		if err != nil {
+			return err
+		}
+		err = c.writev(header.Bytes(), payload)
+		binaryPool.Put(header)
+		if err == nil && opcode.isDataFrame() {
+			c.record(false, opcode, payload)
+		}
+		return err
+	}
+
 	frame, err := c.genFrame(opcode, payload, frameConfig{
 		fin:           true,
+		compress:      c.pd.Enabled,
 		broadcast:     false,
 		checkEncoding: c.config.CheckUtf8Enabled,
 	})
@@ -134,6 +341,9 @@ func (c *Conn) doWrite(opcode Opcode, payload internal.Payload) error {
 	}
 	err = internal.WriteN(c.conn, frame.Bytes())
 	binaryPool.Put(frame)
+	if err == nil && opcode.isDataFrame() {
+		c.record(false, opcode, payload)
+	}
 	return err
 }
 
@@ -144,6 +354,10 @@ type frameConfig struct {
 	// Finish flag
 	fin bool
 
+	// 是否压缩
+	// Whether to compress
+	compress bool
+
 	// 帧生成动作是否由广播发起
 	// Whether the frame generation action is initiated by a broadcast
 	broadcast bool
@@ -153,37 +367,328 @@ type frameConfig struct {
 	checkEncoding bool
 }
 
+// 检查负载的编码和长度
+// Checks the encoding and the length of the payload
+func (c *Conn) checkPayload(opcode Opcode, payload internal.Payload, checkEncoding bool) error {
+	if opcode == OpcodeText && !payload.CheckEncoding(checkEncoding, uint8(opcode)) {
+		return ErrTextEncoding
+	}
+	if payload.Len() > c.config.WriteMaxPayloadSize {
+		return ErrMessageTooLarge
+	}
+	return nil
+}
+
+// 是否跳过拷贝, 将帧头和负载通过 writev 直接写入连接.
+// 只有服务端和原生模式不需要掩码, 压缩和拓展都会改写负载. TLS 连接不支持 writev, 每次写入都会产生一个记录,
+// 所以只有负载超过记录的最大长度时才值得分开写.
+// Whether to skip the copy and write the header and the payload straight to the connection with writev.
+// Only the server side and native mode go without masking, while compression and extensions rewrite the payload.
+// TLS connections cannot writev and each write produces a record,
+// so writing separately only pays off when the payload exceeds the maximum record size anyway.
+func (c *Conn) vectored(opcode Opcode, n int) bool {
+	if (!c.isServer && !c.native) || (len(c.extensions) > 0 && opcode.isDataFrame()) || c.shouldCompress(opcode, n) {
+		return false
+	}
+	switch c.conn.(type) {
+	case *net.TCPConn:
+		return n >= vectoredThreshold
+	case *tls.Conn:
+		return n >= vectoredTLSThreshold
+	default:
+		return false
+	}
+}
+
+// 按照连接的帧格式生成帧头, 需要掩码时返回掩码
+// Generates a frame header in the framing of the connection, returns the mask when one is required
+func (c *Conn) generateHeader(header *frameHeader, fin bool, compress bool, opcode Opcode, length int) (int, []byte) {
+	if c.native {
+		return header.GenerateNativeHeader(fin, compress, opcode, length), nil
+	}
+	return header.GenerateHeader(c.isServer, fin, compress, opcode, length)
+}
+
+// 生成帧头, 负载由调用者直接写入连接
+// Generates the frame header only, the caller writes the payload straight to the connection
+func (c *Conn) genHeader(opcode Opcode, payload internal.Payload, checkEncoding bool) (*bytes.Buffer, error) {
+	if err := c.checkPayload(opcode, payload, checkEncoding); err != nil {
+		return nil, err
+	}
+	header := frameHeader{}
+	headerLength, _ := c.generateHeader(&header, true, false, opcode, payload.Len())
+	buf := binaryPool.Get(frameHeaderSize)
+	buf.Write(header[:headerLength])
+	return buf, nil
+}
+
+// 通过 writev 写入帧头和负载
+// Writes the header and the payload with writev
+func (c *Conn) writev(header []byte, payload internal.Payload) error {
+	buffers := make(net.Buffers, 1, 4)
+	buffers[0] = header
+	buffers = payload.AppendTo(buffers)
+	_, err := buffers.WriteTo(c.conn)
+	return err
+}
+
 // 生成帧数据
 // Generates the frame data
 func (c *Conn) genFrame(opcode Opcode, payload internal.Payload, cfg frameConfig) (*bytes.Buffer, error) {
+	buf := binaryPool.Get(payload.Len() + frameHeaderSize)
+	if err := c.encodeFrame(buf, opcode, payload, cfg); err != nil {
+		binaryPool.Put(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// 将一帧编码到 buf 的末尾. 未压缩的帧先写帧头再写负载;
+// 压缩后的长度事先未知, 负载写在预留的帧头空间之后, buf 为空时跳过多余的空间, 否则将负载前移补上.
+// 出错时 buf 保持原样.
+// Encodes a frame at the end of buf. Uncompressed frames get the header first, then the payload.
+// The compressed length is not known in advance, so the payload goes after room reserved for the header;
+// the unused room is skipped when buf was empty, otherwise the payload is moved down over it.
+// buf is left as it was on error.
+func (c *Conn) encodeFrame(buf *bytes.Buffer, opcode Opcode, payload internal.Payload, cfg frameConfig) error {
+	if err := c.checkPayload(opcode, payload, cfg.checkEncoding); err != nil {
+		return err
+	}
 	n := payload.Len()
-	if opcode == OpcodeText && !payload.CheckEncoding(cfg.checkEncoding, uint8(opcode)) {
-		return nil, ErrTextEncoding
+
+	var rsv RSV
+	if len(c.extensions) > 0 && cfg.fin && opcode.isDataFrame() {
+		var err error
+		if payload, rsv, err = c.encodeExtensions(opcode, payload); err != nil {
+			return err
+		}
+		n = payload.Len()
 	}
-	if n > c.config.WriteMaxPayloadSize {
-		return nil, ErrMessageTooLarge
+
+	start := buf.Len()
+	header := frameHeader{}
+	if compress := cfg.compress && cfg.fin && c.shouldCompress(opcode, n); !compress {
+		headerLength, maskBytes := c.generateHeader(&header, cfg.fin, false, opcode, n)
+		header.SetRSV(rsv)
+		buf.Write(header[:headerLength])
+		_, _ = payload.WriteTo(buf)
+		if maskBytes != nil {
+			internal.MaskXOR(buf.Bytes()[start+headerLength:], maskBytes)
+		}
+		return nil
 	}
 
-	buf := binaryPool.Get(n + frameHeaderSize)
 	buf.Write(framePadding[0:])
+	if err := c.compressData(buf, payload, cfg.broadcast); err != nil {
+		buf.Truncate(start)
+		return err
+	}
+	headerLength, maskBytes := c.generateHeader(&header, cfg.fin, true, opcode, buf.Len()-start-frameHeaderSize)
+	header.SetRSV(rsv)
+	contents := buf.Bytes()[start:]
+	if maskBytes != nil {
+		internal.MaskXOR(contents[frameHeaderSize:], maskBytes)
+	}
+	m := frameHeaderSize - headerLength
+	copy(contents[m:], header[:headerLength])
+	if start == 0 {
+		buf.Next(m)
+		return nil
+	}
+	copy(contents, contents[m:])
+	buf.Truncate(buf.Len() - m)
+	return nil
+}
+
+// 压缩数据
+// 广播的帧会被多个连接共享, 因此不能引用任何连接的压缩上下文
+// Compresses the data
+// Broadcast frames are shared by many connections, so they must not reference any connection's compression context
+func (c *Conn) compressData(buf *bytes.Buffer, payload internal.Payload, broadcast bool) error {
+	if c.cps != nil && !broadcast {
+		return c.cps.Compress(payload, buf)
+	}
+	return c.deflater.Compress(payload, buf)
+}
+
+// NextWriter 返回一个流式写入器, 用于发送分片的文本/二进制消息
+// 缓冲区写满后发送 FIN=0 的帧, Close 时发送最后一帧. 第一帧发出之后, 其它数据消息会一直等待到 Close, 控制帧不受影响.
+// 流式消息不会被压缩, 也不经过拓展的编码. 用完必须调用 Close.
+// 文本编码错误或者超过 WriteMaxPayloadSize 时以 1007 或 1009 关闭连接, 出错的消息不会被结束, 对端收不到残缺的消息.
+// Returns a streaming writer for a fragmented text/binary message.
+// A frame with FIN=0 is sent whenever the buffer (WriteBufferSize) fills up, and the final frame is sent on Close.
+// Once the first frame is out, other data messages wait until Close; control frames are not affected.
+// Streamed messages are neither compressed nor passed through extensions. Close must always be called.
+// Invalid text or going over WriteMaxPayloadSize closes the connection with 1007 or 1009;
+// the failed message is never finished, so the peer never takes a truncated message for a complete one.
+// 数据报模式不支持分片的消息, 写入时返回 ErrFragmented.
+// Datagram mode does not support fragmented messages, writes fail with ErrFragmented.
+func (c *Conn) NextWriter(opcode Opcode) io.WriteCloser {
+	w := &messageWriter{conn: c, opcode: opcode, text: opcode == OpcodeText}
+	if opcode != OpcodeText && opcode != OpcodeBinary {
+		w.err = fmt.Errorf("gbs: unexpected opcode %d", opcode)
+	}
+	if _, ok := c.conn.(*datagramConn); ok {
+		w.err = ErrFragmented
+	}
+	return w
+}
+
+// 流式写入器
+// Streaming writer
+type messageWriter struct {
+	conn   *Conn
+	buf    *bytes.Buffer
+	err    error
+	size   int
+	opcode Opcode
+	text   bool
+	locked bool
+	closed bool
+}
+
+// Write 将数据写入缓冲区, 缓冲区写满时发送一帧
+// Writes data into the buffer, sending a frame whenever the buffer is full
+func (c *messageWriter) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, ErrWriterClosed
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.size+len(p) > c.conn.config.WriteMaxPayloadSize {
+		return 0, c.fail(internal.CloseMessageTooLarge, ErrMessageTooLarge)
+	}
+	c.size += len(p)
+
+	// 缓冲区至少要能容纳一个完整的字符, 否则无法分片校验文本
+	// The buffer must hold at least one whole character, or fragmented text cannot be validated
+	size := internal.Max(c.conn.config.WriteBufferSize, utf8.UTFMax)
+	if c.buf == nil {
+		c.buf = binaryPool.Get(size + frameHeaderSize)
+		c.buf.Write(framePadding[0:])
+	}
+
+	var total = len(p)
+	for len(p) > 0 {
+		if c.buf.Len()-frameHeaderSize >= size {
+			if err := c.flush(false); err != nil {
+				return total - len(p), err
+			}
+		}
+		n := internal.Min(len(p), size+frameHeaderSize-c.buf.Len())
+		c.buf.Write(p[:n])
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// Close 发送最后一帧并释放写锁
+// Sends the final frame and releases the write lock
+func (c *messageWriter) Close() error {
+	if c.closed {
+		return ErrWriterClosed
+	}
+	c.closed = true
+
+	if c.err == nil {
+		if c.buf == nil {
+			c.buf = binaryPool.Get(frameHeaderSize)
+			c.buf.Write(framePadding[0:])
+		}
+		c.err = c.flush(true)
+	}
+
+	// 出错时不发送最后一帧, 连接已经关闭
+	// No final frame on error, the connection is closed already
+	if c.locked {
+		c.conn.dmu.Unlock()
+		c.locked = false
+	}
+	if c.buf != nil {
+		binaryPool.Put(c.buf)
+		c.buf = nil
+	}
+	return c.err
+}
+
+// 发送缓冲区中的数据. 文本消息末尾不完整的字符会留在缓冲区中.
+// Sends the buffered data. An incomplete character at the end of a text message stays in the buffer.
+func (c *messageWriter) flush(fin bool) error {
+	payload := c.buf.Bytes()[frameHeaderSize:]
+	n := len(payload)
+	if c.text && c.conn.config.CheckUtf8Enabled {
+		var ok bool
+		if fin {
+			ok = utf8.Valid(payload)
+		} else {
+			n, ok = internal.SplitUTF8(payload)
+		}
+		if !ok {
+			return c.fail(internal.CloseUnsupportedData, ErrTextEncoding)
+		}
+	}
+
+	if !c.locked {
+		c.conn.dmu.Lock()
+		c.locked = true
+	}
+	if err := c.writeFrame(fin, n); err != nil {
+		c.err = err
+		c.conn.emitError(false, err)
+		return err
+	}
 
+	tail := payload[n:]
+	c.buf.Truncate(frameHeaderSize)
+	c.buf.Write(tail)
+	return nil
+}
+
+// 消息校验失败, 以对应的状态码关闭连接. 已经发出的帧不会被结束.
+// The message failed validation: closes the connection with the matching status code.
+// The frames already sent are never finished.
+func (c *messageWriter) fail(code internal.StatusCode, err error) error {
+	c.err = err
+	conn := c.conn
+	if atomic.CompareAndSwapUint32(&conn.closed, 0, 1) {
+		reason := append(code.Bytes(), err.Error()...)
+		_ = conn.writeClose(err, reason)
+	}
+	return err
+}
+
+// 将缓冲区中前 n 个字节作为一帧写入, 第一帧之后操作码变为 OpcodeContinuation
+// Writes the first n buffered bytes as a frame, the opcode turns into OpcodeContinuation after the first frame
+func (c *messageWriter) writeFrame(fin bool, n int) error {
+	conn := c.conn
+	contents := c.buf.Bytes()[:frameHeaderSize+n]
 	header := frameHeader{}
-	headerLength, maskBytes := header.GenerateHeader(c.isServer, cfg.fin, opcode, n)
-	_, _ = payload.WriteTo(buf)
-	contents := buf.Bytes()
-	if !c.isServer {
+	headerLength, maskBytes := conn.generateHeader(&header, fin, false, c.opcode, n)
+	if maskBytes != nil {
 		internal.MaskXOR(contents[frameHeaderSize:], maskBytes)
 	}
 	m := frameHeaderSize - headerLength
 	copy(contents[m:], header[:headerLength])
-	buf.Next(m)
-	return buf, nil
+	c.opcode = OpcodeContinuation
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.IsClosed() {
+		return ErrConnClosed
+	}
+	return internal.WriteN(conn.conn, contents[m:])
 }
 
 type (
+	// Broadcaster 广播器
+	// msgs 依次缓存未压缩的帧, 压缩的帧, 以及直接写入负载时使用的帧头; 后三个是原生模式的对应帧
+	// msgs caches the plain frame, the compressed frame, and the header used when the payload is written directly;
+	// the last three are their native mode counterparts
 	Broadcaster struct {
-		msgs    [2]*broadcastMessageWrapper
+		msgs    [6]*broadcastMessageWrapper
 		payload []byte
+		key     string
 		state   int64
 		opcode  Opcode
 	}
@@ -193,6 +698,20 @@ type (
 		frame *bytes.Buffer
 		once  sync.Once
 	}
+
+	// 连接的发送队列中等待的合并广播, 每个键至多一条
+	// Conflating broadcasts waiting in the send queue of a connection, at most one per key
+	conflation struct {
+		mu      sync.Mutex
+		pending map[string]*conflatedJob
+	}
+
+	// 等待中的合并广播, 被替换时只更新内容, 不改变在队列中的位置
+	// A waiting conflating broadcast; replacing it updates the contents but keeps its place in the queue
+	conflatedJob struct {
+		broadcaster *Broadcaster
+		write       func()
+	}
 )
 
 // NewBroadcaster 创建广播器
@@ -203,33 +722,96 @@ func NewBroadcaster(opcode Opcode, payload []byte) *Broadcaster {
 	c := &Broadcaster{
 		opcode:  opcode,
 		payload: payload,
-		msgs:    [2]*broadcastMessageWrapper{{}, {}},
+		msgs:    [6]*broadcastMessageWrapper{{}, {}, {}, {}, {}, {}},
 		state:   int64(math.MaxInt32),
 	}
 	return c
 }
 
+// NewConflatingBroadcaster 创建合并模式的广播器, key 是合并的键, 例如证券代码.
+// 连接的发送队列积压时, 每个键只保留最新的一条待发送消息, 新消息原地替换旧消息, 不改变其在队列中的位置;
+// 已经开始写入的消息不会被替换. 慢速的消费者因此总是收到最新的数据, 积压的内存也有上限.
+// Creates a broadcaster in conflating mode, key is the conflation key, e.g. an instrument ID.
+// While the send queue of a connection is backed up, only the latest pending message per key is kept:
+// a newer message replaces the older one in place, keeping its position in the queue;
+// a message already being written is not replaced. Slow consumers thus always get fresh data, with bounded memory.
+func NewConflatingBroadcaster(key string, opcode Opcode, payload []byte) *Broadcaster {
+	c := NewBroadcaster(opcode, payload)
+	c.key = key
+	return c
+}
+
 // 将帧数据写入连接
 // Writes the frame data to the connection
-func (c *Broadcaster) writeFrame(socket *Conn, frame *bytes.Buffer) error {
+// vectored 表示 frame 只有帧头, 负载直接写入连接
+// vectored means frame only holds the header, and the payload is written straight to the connection
+func (c *Broadcaster) writeFrame(socket *Conn, frame *bytes.Buffer, compressed, vectored bool) error {
 	if socket.IsClosed() {
 		return ErrConnClosed
 	}
+	socket.dmu.Lock()
+	defer socket.dmu.Unlock()
 	socket.mu.Lock()
-	err := internal.WriteN(socket.conn, frame.Bytes())
+	var err error
+	if vectored {
+		err = socket.writev(frame.Bytes(), internal.Bytes(c.payload))
+	} else {
+		err = internal.WriteN(socket.conn, frame.Bytes())
+	}
+	// 对端的解压字典中已经加入了广播的内容, 本端的压缩上下文不再与之同步, 必须丢弃
+	// The peer's decompression dictionary now holds the broadcast payload, which the local
+	// compression context knows nothing about, so the context has to be discarded
+	if compressed && socket.cps != nil {
+		socket.cps.Reset()
+	}
+	if err == nil && c.opcode.isDataFrame() {
+		socket.record(false, c.opcode, internal.Bytes(c.payload))
+	}
 	socket.mu.Unlock()
 	return err
 }
 
 // Broadcast 广播
 // 向客户端发送广播消息
+// 开启了发送限流时, ThrottleReject 和 ThrottleClose 策略在加入发送队列之前检查, 超出限流时直接返回 ErrThrottled;
+// ThrottleDelay 策略在发送队列中等待, 期间连接上排队的其它任务都会停顿.
 // Send a broadcast message to a client.
+// With outgoing throttling, ThrottleReject and ThrottleClose are checked before the job is queued and
+// ErrThrottled is returned right away when over the limit; ThrottleDelay waits inside the send queue,
+// stalling every other job queued on the connection meanwhile.
 func (c *Broadcaster) Broadcast(socket *Conn) error {
-	msg := c.msgs[0]
+	var delay bool
+	if c.opcode.isDataFrame() {
+		var err error
+		if delay, err = socket.throttleBroadcast(len(c.payload)); err != nil {
+			return err
+		}
+	}
+
+	// 拓展的编解码器是连接独享的, 帧无法在连接之间共享
+	// Extension codecs belong to a single connection, so the frame cannot be shared between connections
+	if len(socket.extensions) > 0 {
+		c.push(socket, func() {
+			if !delay || socket.throttle(1, len(c.payload)) == nil {
+				socket.emitError(false, socket.doWrite(c.opcode, internal.Bytes(c.payload)))
+			}
+		})
+		return nil
+	}
+
+	compressed := socket.shouldCompress(c.opcode, len(c.payload))
+	vectored := socket.vectored(c.opcode, len(c.payload))
+	index := internal.SelectValue(compressed, 1, internal.SelectValue(vectored, 2, 0))
+	msg := c.msgs[internal.SelectValue(socket.native, index+3, index)]
 
 	msg.once.Do(func() {
+		if vectored {
+			msg.frame, msg.err = socket.genHeader(c.opcode, internal.Bytes(c.payload), socket.config.CheckUtf8Enabled)
+			return
+		}
 		msg.frame, msg.err = socket.genFrame(c.opcode, internal.Bytes(c.payload), frameConfig{
 			fin:           true,
+			compress:      compressed,
 			broadcast:     true,
 			checkEncoding: socket.config.CheckUtf8Enabled,
 		})
@@ -238,17 +820,67 @@ func (c *Broadcaster) Broadcast(socket *Conn) error {
 		return msg.err
 	}
 
-	atomic.AddInt64(&c.state, 1)
-	socket.writeQueue.Push(func() {
-		err := c.writeFrame(socket, msg.frame)
-		socket.emitError(false, err)
-		if atomic.AddInt64(&c.state, -1) == 0 {
-			c.doClose()
+	c.push(socket, func() {
+		// 只有入队之后 SetThrottle 改变了策略时才会被拒绝
+		// Only rejected when SetThrottle changed the policy after the job was queued
+		if delay && socket.throttle(1, len(c.payload)) != nil {
+			return
 		}
+		err := c.writeFrame(socket, msg.frame, compressed, vectored)
+		socket.emitError(false, err)
 	})
 	return nil
 }
 
+// 将写入任务加入连接的发送队列, 合并模式下替换同一个键的待发送任务
+// Adds the write job to the send queue of the connection; in conflating mode it replaces the pending job of the same key
+func (c *Broadcaster) push(socket *Conn, write func()) {
+	atomic.AddInt64(&c.state, 1)
+	if c.key == "" {
+		socket.writeQueue.Push(func() {
+			write()
+			c.release()
+		})
+		return
+	}
+
+	q := &socket.conflated
+	q.mu.Lock()
+	if job, ok := q.pending[c.key]; ok {
+		replaced := job.broadcaster
+		job.broadcaster, job.write = c, write
+		q.mu.Unlock()
+		replaced.release()
+		return
+	}
+	if q.pending == nil {
+		q.pending = make(map[string]*conflatedJob)
+	}
+	job := &conflatedJob{broadcaster: c, write: write}
+	q.pending[c.key] = job
+	q.mu.Unlock()
+
+	key := c.key
+	socket.writeQueue.Push(func() {
+		// 开始写入之后, 同一个键的新消息重新排队
+		// Once writing starts, newer messages of the same key queue up again
+		q.mu.Lock()
+		delete(q.pending, key)
+		broadcaster, write := job.broadcaster, job.write
+		q.mu.Unlock()
+		write()
+		broadcaster.release()
+	})
+}
+
+// 一次写入完成或者被替换, 全部完成并且已经 Close 时释放资源
+// One write is done or replaced; resources are released once all are done and Close was called
+func (c *Broadcaster) release() {
+	if atomic.AddInt64(&c.state, -1) == 0 {
+		c.doClose()
+	}
+}
+
 // 释放资源
 // releases resources
 func (c *Broadcaster) doClose() {
@@ -3,11 +3,15 @@ package gbs
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -22,7 +26,7 @@ func testWrite(c *Conn, fin bool, opcode Opcode, payload []byte) error {
 
 	header := frameHeader{}
 	n := len(payload)
-	headerLength, maskBytes := header.GenerateHeader(c.isServer, fin, opcode, n)
+	headerLength, maskBytes := header.GenerateHeader(c.isServer, fin, false, opcode, n)
 	if !c.isServer {
 		internal.MaskXOR(payload, maskBytes)
 	}
@@ -457,3 +461,604 @@ func TestConn_Async(t *testing.T) {
 	wg.Wait()
 	assert.True(t, internal.IsSameSlice(arr1, arr2))
 }
+
+func TestConn_NextWriter(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("fragmented", func(t *testing.T) {
+		var payload = internal.AlphabetNumeric.Generate(1000)
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal(OpcodeBinary, message.Opcode)
+			as.Equal(string(payload), message.Data.String())
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, new(BuiltinEventHandler), &ClientOption{WriteBufferSize: 64})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		w := client.NextWriter(OpcodeBinary)
+		for i := 0; i < len(payload); i += 7 {
+			n, err := w.Write(payload[i:internal.Min(i+7, len(payload))])
+			as.NoError(err)
+			as.Equal(internal.Min(7, len(payload)-i), n)
+		}
+		as.NoError(w.Close())
+		wg.Wait()
+	})
+
+	t.Run("frames", func(t *testing.T) {
+		server, client := newPeer(new(BuiltinEventHandler), &ServerOption{WriteBufferSize: 4, CheckUtf8Enabled: true}, new(BuiltinEventHandler), &ClientOption{})
+		go func() {
+			w := server.NextWriter(OpcodeText)
+			_, _ = w.Write([]byte("hello, "))
+			_, _ = w.Write([]byte("你好"))
+			_ = w.Close()
+		}()
+
+		var frames []string
+		var opcodes []Opcode
+		for {
+			_, err := io.ReadFull(client.br, client.fh[:2])
+			as.NoError(err)
+			p := make([]byte, int(client.fh[1]&0x7f))
+			_, err = io.ReadFull(client.br, p)
+			as.NoError(err)
+			frames = append(frames, string(p))
+			opcodes = append(opcodes, client.fh.GetOpcode())
+			if client.fh.GetFIN() {
+				break
+			}
+		}
+		as.Equal([]string{"hell", "o, ", "你", "好"}, frames)
+		as.Equal([]Opcode{OpcodeText, OpcodeContinuation, OpcodeContinuation, OpcodeContinuation}, opcodes)
+	})
+
+	t.Run("utf8 split", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal("你好, 世界", message.Data.String())
+			wg.Done()
+		}
+		server, client := newPeer(
+			serverHandler, &ServerOption{CheckUtf8Enabled: true},
+			new(BuiltinEventHandler), &ClientOption{WriteBufferSize: 4, CheckUtf8Enabled: true},
+		)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		w := client.NextWriter(OpcodeText)
+		for _, b := range []byte("你好, 世界") {
+			_, err := w.Write([]byte{b})
+			as.NoError(err)
+		}
+		as.NoError(w.Close())
+		wg.Wait()
+	})
+
+	t.Run("invalid text", func(t *testing.T) {
+		closed := make(chan error, 1)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Fail("truncated message delivered")
+		}
+		serverHandler.onClose = func(socket *Conn, err error) { closed <- err }
+		server, client := newPeer(serverHandler, &ServerOption{}, new(BuiltinEventHandler), &ClientOption{WriteBufferSize: 4, CheckUtf8Enabled: true})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		w := client.NextWriter(OpcodeText)
+		_, err := w.Write([]byte{'a', 'b', 'c', 'd', 0xff, 'e'})
+		as.NoError(err)
+		_, err = w.Write([]byte("fghi"))
+		as.ErrorIs(err, ErrTextEncoding)
+		as.ErrorIs(w.Close(), ErrTextEncoding)
+
+		// 被中断的消息不会被结束, 连接以 1007 关闭
+		// The interrupted message is never finished, the connection is closed with 1007
+		as.True(client.IsClosed())
+		as.ErrorIs(client.WriteString("ok"), ErrConnClosed)
+		select {
+		case err := <-closed:
+			var closeErr *CloseError
+			if as.True(errors.As(err, &closeErr)) {
+				as.Equal(uint16(internal.CloseUnsupportedData), closeErr.Code)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		closed := make(chan error, 1)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Fail("truncated message delivered")
+		}
+		serverHandler.onClose = func(socket *Conn, err error) { closed <- err }
+		server, client := newPeer(serverHandler, &ServerOption{}, new(BuiltinEventHandler), &ClientOption{WriteBufferSize: 4, WriteMaxPayloadSize: 32})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		w := client.NextWriter(OpcodeBinary)
+		n, err := w.Write(make([]byte, 30))
+		as.NoError(err)
+		as.Equal(30, n)
+		n, err = w.Write(make([]byte, 3))
+		as.ErrorIs(err, ErrMessageTooLarge)
+		as.Equal(0, n)
+		as.ErrorIs(w.Close(), ErrMessageTooLarge)
+
+		as.True(client.IsClosed())
+		select {
+		case err := <-closed:
+			var closeErr *CloseError
+			if as.True(errors.As(err, &closeErr)) {
+				as.Equal(uint16(internal.CloseMessageTooLarge), closeErr.Code)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	})
+
+	t.Run("interleave", func(t *testing.T) {
+		var list []string
+		var mu = &sync.Mutex{}
+		var wg = &sync.WaitGroup{}
+		wg.Add(3)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			mu.Lock()
+			list = append(list, message.Data.String())
+			mu.Unlock()
+			wg.Done()
+		}
+		serverHandler.onPing = func(socket *Conn, payload []byte) {
+			as.Equal("ping", string(payload))
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, new(BuiltinEventHandler), &ClientOption{WriteBufferSize: 4})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		w := client.NextWriter(OpcodeText)
+		_, _ = w.Write([]byte("streamed "))
+		done := make(chan error)
+		go func() { done <- client.WriteString("message") }()
+		as.NoError(client.WritePing([]byte("ping")))
+		select {
+		case <-done:
+			as.Fail("data message interleaved with the stream")
+		case <-time.After(50 * time.Millisecond):
+		}
+		_, _ = w.Write([]byte("data"))
+		as.NoError(w.Close())
+		as.NoError(<-done)
+		wg.Wait()
+		as.Equal([]string{"streamed data", "message"}, list)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal(OpcodeBinary, message.Opcode)
+			as.Equal(0, message.Data.Len())
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, new(BuiltinEventHandler), &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		as.NoError(client.NextWriter(OpcodeBinary).Close())
+		wg.Wait()
+	})
+
+	t.Run("misuse", func(t *testing.T) {
+		server, _ := newPeer(new(BuiltinEventHandler), &ServerOption{}, new(BuiltinEventHandler), &ClientOption{})
+		_, err := server.NextWriter(OpcodePing).Write([]byte("hello"))
+		as.Error(err)
+
+		w := server.NextWriter(OpcodeText)
+		_ = server.NetConn().Close()
+		_ = server.WriteClose(1000, nil)
+		_, err = w.Write([]byte("hello"))
+		as.NoError(err)
+		as.ErrorIs(w.Close(), ErrConnClosed)
+		as.ErrorIs(w.Close(), ErrWriterClosed)
+		_, err = w.Write([]byte("hello"))
+		as.ErrorIs(err, ErrWriterClosed)
+	})
+}
+
+func newTCPPeer(serverHandler EventHandler, serverOption *ServerOption, clientHandler EventHandler, clientOption *ClientOption) (server, client *Conn, err error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer listener.Close()
+
+	serverOption = initServerOption(serverOption)
+	clientOption = initClientOption(clientOption)
+	sch := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		sch <- conn
+	}()
+	c, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	s := <-sch
+	if s == nil {
+		return nil, nil, net.ErrClosed
+	}
+	server = serveWebSocket(true, serverOption.getConfig(), newSmap(), s, bufio.NewReader(s), serverHandler, "")
+	client = serveWebSocket(false, clientOption.getConfig(), newSmap(), c, bufio.NewReader(c), clientHandler, "")
+	return server, client, nil
+}
+
+func TestConn_Vectored(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("conditions", func(t *testing.T) {
+		config := initServerOption(nil).getConfig()
+		conn := &Conn{isServer: true, conn: &net.TCPConn{}, config: config}
+		as.True(conn.vectored(OpcodeBinary, vectoredThreshold))
+		as.False(conn.vectored(OpcodeBinary, vectoredThreshold-1))
+
+		conn.conn = &tls.Conn{}
+		as.False(conn.vectored(OpcodeBinary, vectoredThreshold))
+		as.True(conn.vectored(OpcodeBinary, vectoredTLSThreshold))
+
+		conn.conn = &benchConn{}
+		as.False(conn.vectored(OpcodeBinary, vectoredTLSThreshold))
+
+		conn = &Conn{isServer: false, conn: &net.TCPConn{}, config: config}
+		as.False(conn.vectored(OpcodeBinary, vectoredTLSThreshold))
+
+		conn = &Conn{isServer: true, conn: &net.TCPConn{}, config: config, pd: PermessageDeflate{Enabled: true, ServerMaxWindowBits: 15}}
+		as.False(conn.vectored(OpcodeBinary, vectoredTLSThreshold))
+
+		_, err := conn.genHeader(OpcodeText, internal.Bytes{0xff}, true)
+		as.ErrorIs(err, ErrTextEncoding)
+		_, err = conn.genHeader(OpcodeBinary, internal.Bytes(make([]byte, config.WriteMaxPayloadSize+1)), true)
+		as.ErrorIs(err, ErrMessageTooLarge)
+	})
+
+	t.Run("write", func(t *testing.T) {
+		var payloads = [][]byte{
+			internal.AlphabetNumeric.Generate(64 * 1024),
+			internal.AlphabetNumeric.Generate(vectoredThreshold),
+			internal.AlphabetNumeric.Generate(16),
+		}
+		var list [][]byte
+		var wg = &sync.WaitGroup{}
+		wg.Add(4)
+		clientHandler := new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			list = append(list, testCloneBytes(message.Bytes()))
+			wg.Done()
+		}
+		server, client, err := newTCPPeer(new(BuiltinEventHandler), &ServerOption{CheckUtf8Enabled: true}, clientHandler, &ClientOption{})
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(server.WriteMessage(OpcodeBinary, payloads[0]))
+		as.NoError(server.Writev(OpcodeText, payloads[1][:100], nil, payloads[1][100:]))
+		as.NoError(server.WriteMessage(OpcodeText, payloads[2]))
+
+		b := NewBroadcaster(OpcodeBinary, payloads[0])
+		as.NoError(b.Broadcast(server))
+		wg.Wait()
+		_ = b.Close()
+		as.Equal([][]byte{payloads[0], payloads[1], payloads[2], payloads[0]}, list)
+	})
+}
+
+type countConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(p)
+}
+
+func TestConn_WriteBatch(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("ok", func(t *testing.T) {
+		var list []string
+		var wg = &sync.WaitGroup{}
+		wg.Add(4)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			list = append(list, message.Data.String())
+			wg.Done()
+		}
+		serverHandler.onPing = func(socket *Conn, payload []byte) {
+			list = append(list, "ping:"+string(payload))
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, new(BuiltinEventHandler), &ClientOption{})
+		conn := &countConn{Conn: client.conn}
+		client.conn = conn
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		as.NoError(client.WriteBatch(
+			BatchMessage{Opcode: OpcodeText, Payload: []byte("a")},
+			BatchMessage{Opcode: OpcodeBinary, Payload: []byte("b")},
+			BatchMessage{Opcode: OpcodePing, Payload: []byte("c")},
+			BatchMessage{Opcode: OpcodeText, Payload: nil},
+		))
+		wg.Wait()
+		as.Equal(1, conn.writes)
+		as.Equal([]string{"a", "b", "ping:c", ""}, list)
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		var list []string
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			list = append(list, message.Data.String())
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, new(BuiltinEventHandler), &ClientOption{
+			WriteMaxPayloadSize: 16,
+			CheckUtf8Enabled:    true,
+		})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		err := client.WriteBatch(
+			BatchMessage{Opcode: OpcodeText, Payload: []byte("a")},
+			BatchMessage{Opcode: OpcodeText, Payload: []byte{0xff}},
+			BatchMessage{Opcode: OpcodeBinary, Payload: make([]byte, 17)},
+			BatchMessage{Opcode: OpcodeCloseConnection},
+			BatchMessage{Opcode: OpcodeText, Payload: []byte("b")},
+		)
+		var e *BatchError
+		as.ErrorAs(err, &e)
+		as.Len(e.Errors, 5)
+		as.NoError(e.Errors[0])
+		as.ErrorIs(e.Errors[1], ErrTextEncoding)
+		as.ErrorIs(e.Errors[2], ErrMessageTooLarge)
+		as.Error(e.Errors[3])
+		as.NoError(e.Errors[4])
+		as.ErrorIs(err, ErrMessageTooLarge)
+		as.Contains(err.Error(), "3 of 5")
+		wg.Wait()
+		as.Equal([]string{"a", "b"}, list)
+		as.False(client.IsClosed())
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		var list []string
+		var wg = &sync.WaitGroup{}
+		wg.Add(8)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			list = append(list, message.Data.String())
+			wg.Done()
+		}
+		pd := PermessageDeflate{Enabled: true, Threshold: 64, ServerContextTakeover: true, ClientContextTakeover: true}
+		server, client, err := newHandshakePeer(serverHandler, &ServerOption{PermessageDeflate: pd}, new(BuiltinEventHandler), &ClientOption{PermessageDeflate: pd})
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		// 压缩和未压缩的帧交替编码到同一个缓冲区
+		// Compressed and uncompressed frames are encoded into the same buffer in turn
+		var expected []string
+		var messages []BatchMessage
+		for i := 0; i < 8; i++ {
+			s := string(internal.AlphabetNumeric.Generate(internal.SelectValue(i%3 == 0, 16, 1024)))
+			expected = append(expected, s)
+			messages = append(messages, BatchMessage{Opcode: OpcodeText, Payload: []byte(s)})
+		}
+		as.NoError(client.WriteBatch(messages...))
+		wg.Wait()
+		as.Equal(expected, list)
+	})
+
+	t.Run("compress error", func(t *testing.T) {
+		var count int64
+		serverHandler := new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) { atomic.AddInt64(&count, 1) }
+		pd := PermessageDeflate{Enabled: true, Threshold: 64, ServerContextTakeover: true, ClientContextTakeover: true}
+		server, client, err := newHandshakePeer(serverHandler, &ServerOption{PermessageDeflate: pd}, new(BuiltinEventHandler), &ClientOption{PermessageDeflate: pd})
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		// 压缩器失败之后上下文无法恢复, 整批放弃并关闭连接
+		// The context cannot be recovered once the compressor fails, so the batch is given up and the connection closed
+		client.cps.dst.w = io.Discard
+		_ = client.cps.writer.Close()
+		err = client.WriteBatch(
+			BatchMessage{Opcode: OpcodeText, Payload: []byte("a")},
+			BatchMessage{Opcode: OpcodeText, Payload: internal.AlphabetNumeric.Generate(1024)},
+			BatchMessage{Opcode: OpcodeText, Payload: internal.AlphabetNumeric.Generate(1024)},
+		)
+		as.Error(err)
+		var e *BatchError
+		as.False(errors.As(err, &e))
+		as.True(client.IsClosed())
+		as.Zero(atomic.LoadInt64(&count))
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		server, _ := newPeer(new(BuiltinEventHandler), &ServerOption{}, new(BuiltinEventHandler), &ClientOption{})
+		_ = server.NetConn().Close()
+		_ = server.WriteClose(1000, nil)
+		as.ErrorIs(server.WriteBatch(BatchMessage{Opcode: OpcodeText}), ErrConnClosed)
+	})
+}
+
+func TestConn_CloseContext(t *testing.T) {
+	as := assert.New(t)
+
+	t.Run("handshake", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			as.Equal(internal.StatusCode(1000), err)
+			wg.Done()
+		}
+		clientHandler := new(webSocketMocker)
+		clientHandler.onClose = func(socket *Conn, err error) {
+			var e *CloseError
+			as.ErrorAs(err, &e)
+			as.Equal(uint16(1000), e.Code)
+			as.Equal("bye", string(e.Reason))
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		as.NoError(server.CloseContext(ctx, 1000, []byte("bye")))
+		as.ErrorIs(server.CloseContext(ctx, 1000, nil), ErrConnClosed)
+		wg.Wait()
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) { wg.Done() }
+		server, client := newPeer(serverHandler, &ServerOption{}, new(BuiltinEventHandler), &ClientOption{})
+		go server.ReadLoop()
+		go func() { _, _ = io.Copy(io.Discard, client.conn) }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		as.ErrorIs(server.CloseContext(ctx, 1000, nil), context.DeadlineExceeded)
+		wg.Wait()
+	})
+
+	t.Run("write close", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			as.Equal(internal.StatusCode(4000), err)
+			wg.Done()
+		}
+		clientHandler := new(webSocketMocker)
+		clientHandler.onClose = func(socket *Conn, err error) {
+			var e *CloseError
+			as.ErrorAs(err, &e)
+			as.Equal(uint16(4000), e.Code)
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{CloseTimeout: 5 * time.Second}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		start := time.Now()
+		as.NoError(server.WriteClose(4000, nil))
+		wg.Wait()
+		as.Less(time.Since(start), time.Second)
+	})
+
+	t.Run("write close timeout", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		serverHandler := new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) { wg.Done() }
+		server, client := newPeer(serverHandler, &ServerOption{CloseTimeout: 50 * time.Millisecond}, new(BuiltinEventHandler), &ClientOption{})
+		go server.ReadLoop()
+		go func() { _, _ = io.Copy(io.Discard, client.conn) }()
+
+		as.NoError(server.WriteClose(1000, nil))
+		wg.Wait()
+	})
+}
+
+func TestConflatingBroadcaster(t *testing.T) {
+	as := assert.New(t)
+	clientHandler := new(webSocketMocker)
+	messages := make(chan string, 16)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		messages <- message.Data.String()
+	}
+	server, client, err := newHandshakePeer(new(BuiltinEventHandler), nil, clientHandler, nil)
+	if !as.NoError(err) {
+		return
+	}
+	go server.ReadLoop()
+	go client.ReadLoop()
+	defer client.WriteClose(1000, nil)
+
+	// 堵住发送队列, 模拟慢速的消费者
+	// Block the send queue to emulate a slow consumer
+	gate := make(chan struct{})
+	server.Async(func() { <-gate })
+
+	var broadcasters []*Broadcaster
+	broadcast := func(b *Broadcaster) {
+		as.NoError(b.Broadcast(server))
+		as.NoError(b.Close())
+		broadcasters = append(broadcasters, b)
+	}
+	broadcast(NewConflatingBroadcaster("A", OpcodeText, []byte("A1")))
+	broadcast(NewConflatingBroadcaster("B", OpcodeText, []byte("B1")))
+	broadcast(NewBroadcaster(OpcodeText, []byte("plain")))
+	for i := 2; i <= 100; i++ {
+		broadcast(NewConflatingBroadcaster("A", OpcodeText, []byte(fmt.Sprintf("A%d", i))))
+	}
+	for i := 2; i <= 10; i++ {
+		broadcast(NewConflatingBroadcaster("B", OpcodeText, []byte(fmt.Sprintf("B%d", i))))
+	}
+	server.conflated.mu.Lock()
+	as.Len(server.conflated.pending, 2)
+	server.conflated.mu.Unlock()
+	close(gate)
+
+	// 每个键只剩最新的消息, 并且保持最初的排队位置
+	// Only the latest message per key is left, in the place where the key first queued
+	for _, expected := range []string{"A100", "B10", "plain"} {
+		select {
+		case s := <-messages:
+			as.Equal(expected, s)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s", expected)
+		}
+	}
+
+	// 队列空闲时消息照常发送
+	// Messages go out as usual while the queue is idle
+	broadcast(NewConflatingBroadcaster("A", OpcodeText, []byte("A101")))
+	as.Equal("A101", <-messages)
+	as.Eventually(func() bool {
+		server.conflated.mu.Lock()
+		defer server.conflated.mu.Unlock()
+		return len(server.conflated.pending) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// 被替换的广播器同样释放了资源
+	// Replaced broadcasters have released their resources too
+	for _, b := range broadcasters {
+		as.Zero(atomic.LoadInt64(&b.state))
+	}
+}